@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// base64Transform returns a transform decoding the base64 encoded binary fields of the documents,
+// given as dotted paths into their _source. The decoded values replace the encoded ones when
+// they are text. When dir is set, the decoded values are written to files in it instead, named
+// by the _id of the document and the field, as <_id>.<field>, and the fields are set to the path
+// of the files. Values that are not base64, or decode to binary data when not writing to files,
+// are left as they are, with a warning the first time for each field
+func base64Transform(fields []string, dir string) (hitTransform, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create --decode-base64-dir %s: %w", dir, err)
+		}
+	}
+
+	var warnedLock sync.Mutex
+	warned := map[string]bool{}
+	warn := func(field string, msg string) {
+		warnedLock.Lock()
+		defer warnedLock.Unlock()
+		if !warned[field] {
+			warned[field] = true
+			slog.Warn(fmt.Sprintf("%s, leaving %s as is", msg, field), "event", "base64_not_decoded", "field", field)
+		}
+	}
+
+	// decode returns what replaces value, the suffix telling apart the files of the values of
+	// array fields
+	decode := func(id string, field string, suffix string, value any) (any, error) {
+		encoded, ok := value.(string)
+		if !ok {
+			return value, nil
+		}
+		decoded, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			if decoded, decodeErr = base64.RawStdEncoding.DecodeString(encoded); decodeErr != nil {
+				warn(field, fmt.Sprintf("Value of document %s is not base64", id))
+				return value, nil
+			}
+		}
+		if dir == "" {
+			if !utf8.Valid(decoded) {
+				warn(field, fmt.Sprintf("Value of document %s is binary, use --decode-base64-dir to write it to a file", id))
+				return value, nil
+			}
+			return string(decoded), nil
+		}
+		path := filepath.Join(dir, url.PathEscape(id)+"."+field+suffix)
+		if err := os.WriteFile(path, decoded, 0o644); err != nil {
+			return value, fmt.Errorf("failed to write decoded %s of document %s: %w", field, id, err)
+		}
+		return path, nil
+	}
+
+	return func(hit map[string]any) error {
+		source, ok := hit["_source"].(map[string]any)
+		if !ok {
+			return nil
+		}
+		id, _ := hit["_id"].(string)
+		var err error
+		for _, field := range fields {
+			updatePath(source, field, func(value any) any {
+				var decodeErr error
+				if values, ok := value.([]any); ok {
+					for i, v := range values {
+						values[i], decodeErr = decode(id, field, "."+strconv.Itoa(i), v)
+						err = errors.Join(err, decodeErr)
+					}
+					return values
+				}
+				value, decodeErr = decode(id, field, "", value)
+				err = errors.Join(err, decodeErr)
+				return value
+			})
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// runBatch runs every query file of --query-dir, --batch-parallel at a time, writing the hits of
+// each to its --batch-output file. A failed query doesn't stop the others, and its file is removed
+// so a partial export isn't mistaken for a complete one
+func runBatch(ctx context.Context, args args, traceWriter io.Writer) error {
+	switch {
+	case args.QueryString != "" || args.QueryFile != "" || args.KibanaSavedSearch != "":
+		return fmt.Errorf("--query-dir can't be used together with --query, --query-file or --kibana-saved-search")
+	case args.Output != "" || args.StateFile != "" || args.Journal != "" || args.SummaryFile != "" || args.DocErrors != "" || args.Watch > 0:
+		return fmt.Errorf("--query-dir can't be used together with --output, --state-file, --journal, --summary-file, --doc-errors or --watch")
+	case args.BatchParallel < 1:
+		return fmt.Errorf("invalid --batch-parallel %d, expected at least 1", args.BatchParallel)
+	case args.BatchParallel > 1 && args.FetchAll && args.ConfirmAbove > 0 && !args.Yes:
+		return fmt.Errorf("--batch-parallel can't ask for the confirmation of large exports, pass --yes or --confirm-above 0")
+	}
+
+	files, err := queryFiles(args.QueryDir)
+	if err != nil {
+		return err
+	}
+	var params map[string]any
+	if args.Params != "" {
+		if params, err = loadParams(args.Params); err != nil {
+			return err
+		}
+	}
+	paths := make([]string, len(files))
+	owners := map[string]string{}
+	now := time.Now()
+	for i, file := range files {
+		if paths[i], err = batchOutputPath(args.BatchOutput, file, now); err != nil {
+			return err
+		}
+		if owner, ok := owners[paths[i]]; ok {
+			return fmt.Errorf("--batch-output %s writes both %s and %s to %s, it needs a {{name}} placeholder", args.BatchOutput, owner, file, paths[i])
+		}
+		owners[paths[i]] = file
+	}
+	if traceWriter != nil && args.BatchParallel > 1 {
+		traceWriter = &syncWriter{writer: traceWriter}
+	}
+
+	start := time.Now()
+	errs := make([]error, len(files))
+	group := errgroup.Group{}
+	group.SetLimit(args.BatchParallel)
+	for i, file := range files {
+		group.Go(func() error {
+			if ctx.Err() != nil {
+				return nil
+			}
+			queryArgs := args
+			queryArgs.QueryDir = ""
+			queryArgs.QueryFile = file
+			errs[i] = exportTo(ctx, queryArgs, paths[i], traceWriter)
+			return nil
+		})
+	}
+	group.Wait()
+
+	if args.Manifest != "" {
+		if err := writeBatchManifest(args, params, files, paths, errs, start); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w before all the queries of --query-dir ran", errInterrupted)
+	}
+	var failed []string
+	var first error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, files[i])
+			first = cmp.Or(first, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d queries failed (%s), the first with: %w", len(failed), len(files), strings.Join(failed, ", "), first)
+	}
+	slog.Info(fmt.Sprintf("Ran the %d queries of %s", len(files), args.QueryDir), "event", "batch_done", "queries", len(files))
+	return nil
+}
+
+// writeBatchManifest writes the --manifest of the files written by the queries of --query-dir,
+// and of the queries that failed
+func writeBatchManifest(args args, params map[string]any, files []string, paths []string, errs []error, start time.Time) error {
+	m := manifest{
+		StartedAt:  start,
+		FinishedAt: time.Now(),
+		Cluster:    args.ESURL,
+		Index:      args.Index,
+		Format:     args.Format,
+		Params:     params,
+		Files:      []manifestFile{},
+	}
+	for i, file := range files {
+		var partial *PartialResultsError
+		if errs[i] != nil {
+			m.Failed = append(m.Failed, manifestFailed{QueryFile: file, Error: errs[i].Error()})
+			if !errors.As(errs[i], &partial) {
+				continue
+			}
+		}
+		// files older than the batch were not written by it, as when interrupted. File systems
+		// stamp files with a coarse clock, which may be behind the start by a few milliseconds
+		if info, err := os.Stat(paths[i]); err != nil || info.ModTime().Before(start.Add(-time.Second)) {
+			continue
+		}
+		entry, err := describeFile(paths[i], args.Format)
+		if err != nil {
+			return err
+		}
+		entry.QueryFile = file
+		entry.Query = manifestQuery(file, params)
+		if partial != nil {
+			entry.MissingSlices = partial.Missing
+		}
+		m.Files = append(m.Files, entry)
+	}
+	if err := writeManifest(args.Manifest, m); err != nil {
+		return err
+	}
+	slog.Info(fmt.Sprintf("Wrote the manifest of %d files to %s", len(m.Files), args.Manifest), "event", "manifest_written", "files", len(m.Files))
+	return nil
+}
+
+// exportTo runs the query of args, writing its hits to the file at path. The file is removed
+// when the export fails, unless it holds the slices that didn't fail with --keep-partial
+func exportTo(ctx context.Context, args args, path string, traceWriter io.Writer) error {
+	start := time.Now()
+	slog.Info(fmt.Sprintf("Running query %s into %s", args.QueryFile, path), "event", "batch_query_start", "query", args.QueryFile, "path", path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	var file *os.File
+	if err == nil {
+		file, err = os.Create(path)
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to create output file %s: %w", path, err)
+		slog.Error(fmt.Sprintf("Query %s failed: %v", args.QueryFile, err), "event", "batch_query_failed", "query", args.QueryFile, "error", err)
+		return err
+	}
+	args.MetricsExport = args.QueryFile
+	err = export(ctx, args, file, traceWriter)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write output file %s: %w", path, closeErr)
+	}
+	if err != nil {
+		var partial *PartialResultsError
+		if !errors.As(err, &partial) {
+			os.Remove(path)
+		}
+		slog.Error(fmt.Sprintf("Query %s failed: %v", args.QueryFile, err), "event", "batch_query_failed", "query", args.QueryFile, "error", err)
+		return err
+	}
+	slog.Info(
+		fmt.Sprintf("Query %s done in %v", args.QueryFile, time.Since(start).Round(time.Millisecond)),
+		"event", "batch_query_done", "query", args.QueryFile, "path", path, "duration", time.Since(start),
+	)
+	return nil
+}
+
+// queryFiles returns the query files of --query-dir, sorted: the .json files of a directory, or
+// the files matching a glob
+func queryFiles(dirOrGlob string) ([]string, error) {
+	pattern := dirOrGlob
+	if info, err := os.Stat(dirOrGlob); err == nil && info.IsDir() {
+		pattern = filepath.Join(dirOrGlob, "*.json")
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --query-dir %q: %w", dirOrGlob, err)
+	}
+	var files []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && !info.IsDir() {
+			files = append(files, match)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no query files found in --query-dir %s", dirOrGlob)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// batchOutputPath renders the --batch-output template for a query file: {{name}} is the name of
+// the file without its extension, and {{date}} the date of now
+func batchOutputPath(template string, file string, now time.Time) (string, error) {
+	values := map[string]string{
+		"name": strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		"date": now.Format(time.DateOnly),
+	}
+	var unknown []string
+	path := placeholderRe.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholderRe.FindStringSubmatch(placeholder)[1]
+		value, ok := values[name]
+		if !ok {
+			unknown = append(unknown, name)
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("invalid --batch-output %q, unknown placeholders %s, expected {{name}} or {{date}}", template, strings.Join(unknown, ", "))
+	}
+	return path, nil
+}
+
+// syncWriter serializes the writes of the concurrent exports of --query-dir to the shared
+// --trace-file
+type syncWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer.Write(p)
+}
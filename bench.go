@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// benchResult is how one combination of page size and slices performed in a benchmark
+type benchResult struct {
+	size      int
+	slices    int
+	docs      int64
+	bytes     int64
+	elapsed   time.Duration
+	latencies []time.Duration
+}
+
+func runBench(args args) error {
+	cmd := args.Bench
+	sizes, err := parseInts(cmd.Sizes, "--sizes")
+	if err != nil {
+		return err
+	}
+	sliceCounts, err := parseInts(cmd.SliceCounts, "--slice-counts")
+	if err != nil {
+		return err
+	}
+	if len(sliceCounts) == 0 {
+		sliceCounts = []int{max(args.Slices, 1)}
+	}
+	if cmd.Duration <= 0 && cmd.Pages <= 0 {
+		return fmt.Errorf("bench needs a --duration or a number of --pages to run every combination for")
+	}
+
+	query, err := args.Query()
+	if err != nil {
+		return err
+	}
+	if query, err = applyTimeRange(query, args.TimeField, args.Since, args.Until, args.Timezone); err != nil {
+		return err
+	}
+	if len(sizes) == 0 {
+		// the size of the query, or the default of Elasticsearch
+		sizes = []int{0}
+	}
+
+	client, err := newClient(args, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := client.detectCluster(ctx, args.Flavor); err != nil {
+		return err
+	}
+
+	fmt.Printf("%6s  %6s  %6s  %9s  %8s  %10s  %8s  %8s  %8s  %8s\n", "size", "slices", "pages", "docs", "docs/s", "bytes/s", "p50", "p90", "p99", "max")
+	for _, size := range sizes {
+		sized, err := withPageSize(query, size)
+		if err != nil {
+			return err
+		}
+		for _, slices := range sliceCounts {
+			result, err := client.bench(ctx, args.Index, sized, slices, cmd.Duration, cmd.Pages)
+			if ctx.Err() != nil {
+				return errInterrupted
+			}
+			if err != nil {
+				return fmt.Errorf("benchmark of --size %d and %d slices failed: %w", size, slices, err)
+			}
+			result.size = size
+			fmt.Println(result)
+		}
+	}
+	return nil
+}
+
+// bench fetches all the results of the query, without writing them anywhere, until duration
+// elapsed or pages were fetched, whichever happens first, measuring how long every page took
+func (c *Client) bench(ctx context.Context, index string, query string, slices int, duration time.Duration, pages int) (*benchResult, error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	result := &benchResult{slices: slices}
+	var mu sync.Mutex
+	c.onPage = func(slice int, docs int, bytes int64, latency time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		result.docs += int64(docs)
+		result.bytes += bytes
+		result.latencies = append(result.latencies, latency)
+		if pages > 0 && len(result.latencies) >= pages {
+			stop()
+		}
+	}
+	defer func() { c.onPage = nil }()
+
+	start := time.Now()
+	_, err := c.Query(ctx, index, query, true, slices, io.Discard)
+	// the export is interrupted once the time or the pages are up, which is not a failure
+	if err != nil && ctx.Err() == nil {
+		return nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	result.elapsed = time.Since(start)
+	return result, nil
+}
+
+func (r *benchResult) String() string {
+	latencies := slices.Clone(r.latencies)
+	slices.Sort(latencies)
+	percentile := func(p float64) string {
+		if len(latencies) == 0 {
+			return "-"
+		}
+		i := int(math.Ceil(p*float64(len(latencies)))) - 1
+		return latencies[max(i, 0)].Round(time.Millisecond).String()
+	}
+	size := strconv.Itoa(r.size)
+	if r.size == 0 {
+		size = "query"
+	}
+	seconds := r.elapsed.Seconds()
+	return fmt.Sprintf(
+		"%6s  %6d  %6d  %9d  %8.0f  %10s  %8s  %8s  %8s  %8s",
+		size, r.slices, len(latencies), r.docs, float64(r.docs)/seconds, formatBytes(float64(r.bytes)/seconds),
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1),
+	)
+}
+
+// withPageSize sets the size of the pages of the query, left as is when 0
+func withPageSize(query string, size int) (string, error) {
+	if size == 0 {
+		return query, nil
+	}
+	body := map[string]any{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &body); err != nil {
+			return "", &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+	body["size"] = size
+	out, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query: %w", err)
+	}
+	return string(out), nil
+}
+
+// parseInts parses the comma separated positive integers of a flag
+func parseInts(value string, flag string) ([]int, error) {
+	var ints []int
+	for _, item := range splitList(value) {
+		n, err := strconv.Atoi(item)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, expected comma separated positive numbers", flag, value)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
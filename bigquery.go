@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	bigQueryScope = "https://www.googleapis.com/auth/bigquery"
+
+	// the requests of the Storage Write API are limited to 10MB
+	bigQueryMaxRequestBytes = 9 * 1024 * 1024
+)
+
+var (
+	bigQueryAPI        = "https://bigquery.googleapis.com/bigquery/v2"
+	bigQueryStorageAPI = "https://bigquerystorage.googleapis.com"
+)
+
+// bigQueryTypes are the column types of the field types of Elasticsearch mappings. Any other
+// type is written to a JSON column
+var bigQueryTypes = map[string]string{
+	"text":               "STRING",
+	"keyword":            "STRING",
+	"constant_keyword":   "STRING",
+	"wildcard":           "STRING",
+	"match_only_text":    "STRING",
+	"search_as_you_type": "STRING",
+	"ip":                 "STRING",
+	"version":            "STRING",
+	"long":               "INTEGER",
+	"integer":            "INTEGER",
+	"short":              "INTEGER",
+	"byte":               "INTEGER",
+	"unsigned_long":      "NUMERIC",
+	"double":             "FLOAT",
+	"float":              "FLOAT",
+	"half_float":         "FLOAT",
+	"scaled_float":       "FLOAT",
+	"boolean":            "BOOLEAN",
+	"date":               "TIMESTAMP",
+	"date_nanos":         "TIMESTAMP",
+	"binary":             "BYTES",
+}
+
+// protobuf field types of descriptor.proto
+const (
+	protoTypeDouble  = 1
+	protoTypeInt64   = 3
+	protoTypeInt32   = 5
+	protoTypeBool    = 8
+	protoTypeString  = 9
+	protoTypeMessage = 11
+	protoTypeBytes   = 12
+)
+
+// bigQueryProtoTypes are the protobuf types the Storage Write API takes the values of the column
+// types in. Record columns are nested messages
+var bigQueryProtoTypes = map[string]int{
+	"STRING":     protoTypeString,
+	"JSON":       protoTypeString,
+	"NUMERIC":    protoTypeString,
+	"DECIMAL":    protoTypeString,
+	"BIGNUMERIC": protoTypeString,
+	"BIGDECIMAL": protoTypeString,
+	"GEOGRAPHY":  protoTypeString,
+	"DATETIME":   protoTypeString,
+	"TIME":       protoTypeString,
+	"INTERVAL":   protoTypeString,
+	"INTEGER":    protoTypeInt64,
+	"INT64":      protoTypeInt64,
+	"TIMESTAMP":  protoTypeInt64,
+	"FLOAT":      protoTypeDouble,
+	"FLOAT64":    protoTypeDouble,
+	"BOOLEAN":    protoTypeBool,
+	"BOOL":       protoTypeBool,
+	"DATE":       protoTypeInt32,
+	"BYTES":      protoTypeBytes,
+}
+
+// bigQueryField is a column of the schema of a BigQuery table, as the tables API has them
+type bigQueryField struct {
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Mode   string          `json:"mode,omitempty"`
+	Fields []bigQueryField `json:"fields,omitempty"`
+}
+
+func (f bigQueryField) record() bool {
+	return f.Type == "RECORD" || f.Type == "STRUCT"
+}
+
+// bigQuerySink appends the hits to a BigQuery table with the Storage Write API, through the
+// default stream of the table, where rows are committed as soon as they are appended. A page
+// that fails to be appended is retried, so rows can be written twice when an append succeeded
+// but its response was lost. The table is created when missing, with a schema derived from the
+// mapping of the index: the fields of the _source become columns, along with _index and _id.
+// Existing tables are written as they are: the fields of the _source fill the columns of the
+// same name, with the characters not allowed in column names replaced by underscores, and the
+// metadata of the hits, as _index, _id or _version, the columns named after it. Fields without
+// a column are dropped with a warning
+type bigQuerySink struct {
+	ctx        context.Context
+	client     *http.Client
+	creds      *gcpCredentials
+	maxRetries int
+	backoff    Backoff
+
+	project string
+	dataset string
+	table   string
+
+	schema     []bigQueryField
+	descriptor []byte
+
+	// the fields dropped for not having a column, warned about once
+	dropped map[string]bool
+}
+
+func (c *Client) newBigQuerySink(ctx context.Context, index string, u *url.URL) (*bigQuerySink, error) {
+	parts := strings.Split(u.Host, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid --output %q, expected bigquery://PROJECT.DATASET.TABLE", u.String())
+	}
+	creds, err := newGCPCredentials(bigQueryScope)
+	if err != nil {
+		return nil, err
+	}
+	s := &bigQuerySink{
+		ctx:        ctx,
+		client:     http.DefaultClient,
+		creds:      creds,
+		maxRetries: c.MaxRetries,
+		backoff:    c.Backoff,
+		project:    parts[0],
+		dataset:    parts[1],
+		table:      parts[2],
+		dropped:    map[string]bool{},
+	}
+
+	var table struct {
+		Schema struct {
+			Fields []bigQueryField `json:"fields"`
+		} `json:"schema"`
+	}
+	status, err := s.api("GET", s.tablePath(), nil, &table)
+	switch {
+	case status == http.StatusNotFound:
+		mappings, err := c.mappingProperties(ctx, index)
+		if err != nil {
+			return nil, err
+		}
+		s.schema = bigQuerySchema(mappings)
+		if err := s.createTable(); err != nil {
+			return nil, err
+		}
+		slog.Info(
+			fmt.Sprintf("Created BigQuery table %s with %d columns from the mapping of %s", s, len(s.schema), index),
+			"event", "bigquery_table_created", "table", s.String(), "columns", len(s.schema),
+		)
+	case err != nil:
+		return nil, fmt.Errorf("failed to get BigQuery table %s: %w", s, err)
+	default:
+		s.schema = table.Schema.Fields
+	}
+
+	var nested [][]byte
+	row, err := bigQueryDescriptor("row", s.schema, &nested)
+	if err != nil {
+		return nil, fmt.Errorf("can't write to BigQuery table %s: %w", s, err)
+	}
+	for _, message := range nested {
+		row = appendProtoDelimited(row, 3, message)
+	}
+	s.descriptor = row
+	return s, nil
+}
+
+func (s *bigQuerySink) String() string {
+	return s.project + "." + s.dataset + "." + s.table
+}
+
+func (s *bigQuerySink) tablePath() string {
+	return fmt.Sprintf("projects/%s/datasets/%s/tables/%s", s.project, s.dataset, s.table)
+}
+
+func (s *bigQuerySink) createTable() error {
+	body := map[string]any{
+		"tableReference": map[string]string{"projectId": s.project, "datasetId": s.dataset, "tableId": s.table},
+		"schema":         map[string]any{"fields": s.schema},
+	}
+	path := fmt.Sprintf("projects/%s/datasets/%s/tables", s.project, s.dataset)
+	if _, err := s.api("POST", path, body, nil); err != nil {
+		return fmt.Errorf("failed to create BigQuery table %s: %w", s, err)
+	}
+	return nil
+}
+
+// api sends a request to the BigQuery REST API, decoding the response into out. The status of
+// the response is returned along with the error of failed requests
+func (s *bigQuerySink) api(method string, path string, body any, out any) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(s.ctx, method, bigQueryAPI+"/"+path, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := s.creds.authorize(s.ctx, req); err != nil {
+		return 0, err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, err
+	}
+	if res.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+			return res.StatusCode, fmt.Errorf("%s: %s", res.Status, apiErr.Error.Message)
+		}
+		return res.StatusCode, fmt.Errorf("%s", res.Status)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return res.StatusCode, fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+	return res.StatusCode, nil
+}
+
+func (s *bigQuerySink) write(hits []json.RawMessage) error {
+	var rows [][]byte
+	size := 0
+	for _, hit := range hits {
+		row, err := s.encodeRow(hit)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 && size+len(row) > bigQueryMaxRequestBytes {
+			if err := s.appendRows(rows); err != nil {
+				return err
+			}
+			rows, size = nil, 0
+		}
+		rows = append(rows, row)
+		size += len(row)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return s.appendRows(rows)
+}
+
+func (s *bigQuerySink) Close() error {
+	// rows of the default stream are committed as they are appended
+	return nil
+}
+
+// appendRows sends an AppendRowsRequest with the rows to the default stream of the table, in a
+// call of its own, retrying it when BigQuery is unavailable
+func (s *bigQuerySink) appendRows(rows [][]byte) error {
+	stream := s.tablePath() + "/streams/_default"
+	var serialized []byte
+	for _, row := range rows {
+		serialized = appendProtoDelimited(serialized, 1, row)
+	}
+	data := appendProtoDelimited(nil, 1, appendProtoDelimited(nil, 1, s.descriptor))
+	data = appendProtoDelimited(data, 2, serialized)
+	request := appendProtoDelimited(nil, 1, []byte(stream))
+	request = appendProtoDelimited(request, 4, data)
+
+	header := http.Header{"X-Goog-Request-Params": {"write_stream=" + url.QueryEscape(stream)}}
+	for attempt := 0; ; attempt++ {
+		token, err := s.creds.accessToken(s.ctx)
+		if err != nil {
+			return err
+		}
+		header.Set("Authorization", "Bearer "+token)
+		response, err := grpcCall(s.ctx, s.client, bigQueryStorageAPI+"/google.cloud.bigquery.storage.v1.BigQueryWrite/AppendRows", header, request)
+		if err == nil {
+			err = bigQueryAppendError(response)
+		}
+		if err == nil {
+			return nil
+		}
+
+		var status *grpcError
+		var urlErr *url.Error
+		retryable := errors.As(err, &urlErr) ||
+			errors.As(err, &status) && (status.Code == grpcUnavailable || status.Code == grpcResourceExhausted)
+		if !retryable || attempt >= s.maxRetries || s.ctx.Err() != nil {
+			return fmt.Errorf("failed to append %d rows to BigQuery table %s: %w", len(rows), s, err)
+		}
+		wait := s.backoff.delay(attempt)
+		slog.Warn(
+			fmt.Sprintf("Appending %d rows to BigQuery table %s failed, retrying in %v: %v", len(rows), s, wait, err),
+			"event", "bigquery_retry", "rows", len(rows), "error", err,
+		)
+		if err := sleep(s.ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// bigQueryAppendError returns the error of an AppendRowsResponse, with the first rows rejected,
+// nil when the rows were appended
+func bigQueryAppendError(response []byte) error {
+	var status *grpcError
+	var rowErrors []string
+	rejected := 0
+	err := protoFields(response, func(field int, wireType int, value uint64, bytesValue []byte) error {
+		switch {
+		case field == 2 && wireType == 2: // error, a google.rpc.Status
+			status = &grpcError{}
+			return protoFields(bytesValue, func(field int, wireType int, value uint64, bytesValue []byte) error {
+				switch {
+				case field == 1 && wireType == 0:
+					status.Code = int(int32(value))
+				case field == 2 && wireType == 2:
+					status.Message = string(bytesValue)
+				}
+				return nil
+			})
+		case field == 4 && wireType == 2: // row_errors
+			rejected++
+			if len(rowErrors) >= 3 {
+				return nil
+			}
+			var index uint64
+			var message string
+			err := protoFields(bytesValue, func(field int, wireType int, value uint64, bytesValue []byte) error {
+				switch {
+				case field == 1 && wireType == 0:
+					index = value
+				case field == 3 && wireType == 2:
+					message = string(bytesValue)
+				}
+				return nil
+			})
+			rowErrors = append(rowErrors, fmt.Sprintf("row %d: %s", index, message))
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decode AppendRowsResponse: %w", err)
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d rows rejected: %s", rejected, strings.Join(rowErrors, "; "))
+	}
+	if status != nil && status.Code != grpcOK {
+		return status
+	}
+	return nil
+}
+
+// bigQuerySchema derives the schema of a table from the mappings of the indices: a column for
+// every field of the mappings, and the _index and _id of the documents. Objects become RECORD
+// columns, and nested fields REPEATED ones. Fields of types without a column type of their own,
+// as geo_point or flattened, are written to JSON columns
+func bigQuerySchema(mappings []map[string]any) []bigQueryField {
+	fields := []bigQueryField{{Name: "_index", Type: "STRING"}, {Name: "_id", Type: "STRING"}}
+	for _, properties := range mappings {
+		fields = mergeBigQueryFields(fields, bigQueryFields(properties))
+	}
+	return fields
+}
+
+// bigQueryFields returns the columns of the properties of a mapping, by name
+func bigQueryFields(properties map[string]any) []bigQueryField {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fields []bigQueryField
+	for _, name := range names {
+		def, ok := properties[name].(map[string]any)
+		if !ok {
+			continue
+		}
+		field := bigQueryField{Name: bigQueryColumnName(name), Type: "JSON"}
+		kind, _ := def["type"].(string)
+		children, hasChildren := def["properties"].(map[string]any)
+		switch {
+		case kind == "alias":
+			// aliases are not in the _source
+			continue
+		case kind == "nested" || hasChildren && (kind == "" || kind == "object"):
+			if subfields := bigQueryFields(children); len(subfields) > 0 {
+				field.Type, field.Fields = "RECORD", subfields
+			}
+			if kind == "nested" {
+				field.Mode = "REPEATED"
+			}
+		case bigQueryTypes[kind] != "":
+			field.Type = bigQueryTypes[kind]
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// mergeBigQueryFields adds the columns of more missing from fields, the mappings of several
+// indices having different fields
+func mergeBigQueryFields(fields []bigQueryField, more []bigQueryField) []bigQueryField {
+	for _, field := range more {
+		i := bigQueryColumn(fields, field.Name)
+		switch {
+		case i < 0:
+			fields = append(fields, field)
+		case fields[i].record() && field.record():
+			fields[i].Fields = mergeBigQueryFields(fields[i].Fields, field.Fields)
+		}
+	}
+	return fields
+}
+
+// bigQueryColumn returns the index of the column of fields with the given name, which is case
+// insensitive, -1 if none
+func bigQueryColumn(fields []bigQueryField, name string) int {
+	for i, field := range fields {
+		if strings.EqualFold(field.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// bigQueryColumnName returns the column name of a field: its name with the characters other than
+// letters, digits and underscores replaced by underscores, and not starting with a digit, so
+// @timestamp becomes _timestamp
+func bigQueryColumnName(name string) string {
+	column := []byte(name)
+	for i, c := range column {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			column[i] = '_'
+		}
+	}
+	if len(column) == 0 || column[0] >= '0' && column[0] <= '9' {
+		column = append([]byte{'_'}, column...)
+	}
+	return string(column)
+}
+
+// bigQueryDescriptor builds the DescriptorProto of the message of the columns of a table, which
+// field numbers are the positions of the columns. The messages of RECORD columns are added to
+// nested, as the Storage Write API wants them all nested in the row message
+func bigQueryDescriptor(name string, fields []bigQueryField, nested *[][]byte) ([]byte, error) {
+	message := appendProtoDelimited(nil, 1, []byte(name))
+	for i, f := range fields {
+		field := appendProtoDelimited(nil, 1, []byte(f.Name))
+		field = appendProtoVarint(field, 3, uint64(i+1))
+		switch f.Mode {
+		case "REPEATED":
+			field = appendProtoVarint(field, 4, 3)
+		case "REQUIRED":
+			field = appendProtoVarint(field, 4, 2)
+		default:
+			field = appendProtoVarint(field, 4, 1)
+		}
+
+		if f.record() {
+			typeName := name + "_" + strconv.Itoa(i+1)
+			sub, err := bigQueryDescriptor(typeName, f.Fields, nested)
+			if err != nil {
+				return nil, err
+			}
+			*nested = append(*nested, sub)
+			field = appendProtoVarint(field, 5, protoTypeMessage)
+			field = appendProtoDelimited(field, 6, []byte(typeName))
+		} else {
+			kind, ok := bigQueryProtoTypes[f.Type]
+			if !ok {
+				return nil, fmt.Errorf("column %s is of the unsupported type %s", f.Name, f.Type)
+			}
+			field = appendProtoVarint(field, 5, uint64(kind))
+		}
+		message = appendProtoDelimited(message, 2, field)
+	}
+	return message, nil
+}
+
+// encodeRow encodes a hit as a message of the columns of the table
+func (s *bigQuerySink) encodeRow(hit json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(hit))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode hit: %w", err)
+	}
+	values, _ := doc["_source"].(map[string]any)
+	if values == nil {
+		values = map[string]any{}
+	}
+	for key, value := range doc {
+		if _, ok := values[key]; !ok && key != "_source" && bigQueryColumn(s.schema, key) >= 0 {
+			values[key] = value
+		}
+	}
+	return s.encodeMessage(nil, s.schema, values, "")
+}
+
+// encodeMessage appends the values of the fields of an object to the message of its columns, in
+// the order of their names, so the same document is always encoded the same way
+func (s *bigQuerySink) encodeMessage(message []byte, fields []bigQueryField, values map[string]any, path string) ([]byte, error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := values[key]
+		i := bigQueryColumn(fields, bigQueryColumnName(key))
+		if i < 0 {
+			if !s.dropped[path+key] {
+				s.dropped[path+key] = true
+				slog.Warn(
+					fmt.Sprintf("Field %s has no column in BigQuery table %s, dropping it", path+key, s),
+					"event", "bigquery_field_dropped", "field", path+key,
+				)
+			}
+			continue
+		}
+		var err error
+		if message, err = s.appendValue(message, fields[i], i+1, value, path+key); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// appendValue appends the value of a field to the message of its column. Arrays fill REPEATED
+// columns, and others only when they hold a single value
+func (s *bigQuerySink) appendValue(message []byte, f bigQueryField, number int, value any, path string) ([]byte, error) {
+	if f.Type == "JSON" && f.Mode != "REPEATED" {
+		if value == nil {
+			return message, nil
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoDelimited(message, number, data), nil
+	}
+
+	items, isArray := value.([]any)
+	if !isArray {
+		items = []any{value}
+	}
+	var present []any
+	for _, item := range items {
+		if item != nil {
+			present = append(present, item)
+		}
+	}
+	if len(present) > 1 && f.Mode != "REPEATED" {
+		return nil, fmt.Errorf("field %s holds %d values, but column %s of BigQuery table %s is not REPEATED", path, len(present), f.Name, s)
+	}
+	for _, item := range present {
+		var err error
+		if message, err = s.appendScalar(message, f, number, item, path); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+func (s *bigQuerySink) appendScalar(message []byte, f bigQueryField, number int, value any, path string) ([]byte, error) {
+	invalid := func() error {
+		return fmt.Errorf("invalid value %v of field %s for the %s column %s of BigQuery table %s", value, path, f.Type, f.Name, s)
+	}
+	if f.record() {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, invalid()
+		}
+		sub, err := s.encodeMessage(nil, f.Fields, object, path+".")
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoDelimited(message, number, sub), nil
+	}
+
+	text, isText := value.(string)
+	switch bigQueryProtoTypes[f.Type] {
+	case protoTypeString:
+		if !isText || f.Type == "JSON" {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			text = string(data)
+		}
+		return appendProtoDelimited(message, number, []byte(text)), nil
+
+	case protoTypeInt64:
+		if f.Type == "TIMESTAMP" {
+			t, ok := parseDate(value, defaultDateFormats)
+			if !ok {
+				return nil, invalid()
+			}
+			return appendProtoVarint(message, number, uint64(t.UnixMicro())), nil
+		}
+		n, ok := value.(json.Number)
+		if isText {
+			n, ok = json.Number(text), true
+		}
+		if !ok {
+			return nil, invalid()
+		}
+		i, err := n.Int64()
+		if err != nil {
+			// integral values written with a fraction, as 3.0
+			float, err := n.Float64()
+			if err != nil || float != math.Trunc(float) || math.Abs(float) > math.MaxInt64 {
+				return nil, invalid()
+			}
+			i = int64(float)
+		}
+		return appendProtoVarint(message, number, uint64(i)), nil
+
+	case protoTypeInt32:
+		t, ok := parseDate(value, defaultDateFormats)
+		if !ok {
+			return nil, invalid()
+		}
+		// days since the epoch, rounded down for dates before it
+		days := t.Unix() / 86400
+		if t.Unix()%86400 < 0 {
+			days--
+		}
+		return appendProtoVarint(message, number, uint64(days)), nil
+
+	case protoTypeDouble:
+		n, ok := value.(json.Number)
+		if isText {
+			n, ok = json.Number(text), true
+		}
+		float, err := n.Float64()
+		if !ok || err != nil {
+			return nil, invalid()
+		}
+		return appendProtoFixed64(message, number, math.Float64bits(float)), nil
+
+	case protoTypeBool:
+		b, ok := value.(bool)
+		if isText {
+			b, ok = text == "true", text == "true" || text == "false"
+		}
+		if !ok {
+			return nil, invalid()
+		}
+		var v uint64
+		if b {
+			v = 1
+		}
+		return appendProtoVarint(message, number, v), nil
+
+	case protoTypeBytes:
+		data, err := base64.StdEncoding.DecodeString(text)
+		if !isText || err != nil {
+			return nil, invalid()
+		}
+		return appendProtoDelimited(message, number, data), nil
+	}
+	return nil, invalid()
+}
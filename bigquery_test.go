@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestBigQuerySchema(t *testing.T) {
+	mappings := []map[string]any{}
+	for _, mapping := range []string{
+		`{
+			"@timestamp": {"type": "date"},
+			"msg": {"type": "text", "fields": {"keyword": {"type": "keyword"}}},
+			"count": {"type": "long"},
+			"count_alias": {"type": "alias", "path": "count"},
+			"loc": {"type": "geo_point"},
+			"user": {"properties": {"name": {"type": "keyword"}, "age": {"type": "integer"}}},
+			"tags": {"type": "nested", "properties": {"k": {"type": "keyword"}}},
+			"events": {"type": "nested"},
+			"empty": {"type": "object"},
+			"big": {"type": "unsigned_long"}
+		}`,
+		`{
+			"count": {"type": "keyword"},
+			"user": {"properties": {"zip": {"type": "keyword"}}},
+			"extra": {"type": "boolean"}
+		}`,
+	} {
+		var properties map[string]any
+		if err := json.Unmarshal([]byte(mapping), &properties); err != nil {
+			t.Fatal(err)
+		}
+		mappings = append(mappings, properties)
+	}
+
+	got := bigQuerySchema(mappings)
+	want := []bigQueryField{
+		{Name: "_index", Type: "STRING"},
+		{Name: "_id", Type: "STRING"},
+		{Name: "_timestamp", Type: "TIMESTAMP"},
+		{Name: "big", Type: "NUMERIC"},
+		{Name: "count", Type: "INTEGER"},
+		{Name: "empty", Type: "JSON"},
+		{Name: "events", Type: "JSON", Mode: "REPEATED"},
+		{Name: "loc", Type: "JSON"},
+		{Name: "msg", Type: "STRING"},
+		{Name: "tags", Type: "RECORD", Mode: "REPEATED", Fields: []bigQueryField{{Name: "k", Type: "STRING"}}},
+		{Name: "user", Type: "RECORD", Fields: []bigQueryField{
+			{Name: "age", Type: "INTEGER"},
+			{Name: "name", Type: "STRING"},
+			{Name: "zip", Type: "STRING"},
+		}},
+		{Name: "extra", Type: "BOOLEAN"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got schema\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestBigQueryColumnName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"msg", "msg"},
+		{"ok_1", "ok_1"},
+		{"@timestamp", "_timestamp"},
+		{"a.b-c", "a_b_c"},
+		{"1st", "_1st"},
+		{"", "_"},
+	}
+	for _, tt := range tests {
+		if got := bigQueryColumnName(tt.name); got != tt.want {
+			t.Errorf("bigQueryColumnName(%q): got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBigQueryDescriptor(t *testing.T) {
+	fields := []bigQueryField{
+		{Name: "a", Type: "STRING"},
+		{Name: "r", Type: "RECORD", Mode: "REPEATED", Fields: []bigQueryField{{Name: "b", Type: "INTEGER"}}},
+	}
+	var nested [][]byte
+	got, err := bigQueryDescriptor("row", fields, &nested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// name "row", then a: number 1, optional, string, and r: number 2, repeated, message row_2
+	want := "0a03726f77" +
+		"1209" + "0a0161" + "1801" + "2001" + "2809" +
+		"1210" + "0a0172" + "1802" + "2003" + "280b" + "3205726f775f32"
+	if hex.EncodeToString(got) != want {
+		t.Errorf("got descriptor %x, want %s", got, want)
+	}
+	// row_2, with b: number 1, optional, int64
+	wantNested := "0a05726f775f32" + "1209" + "0a0162" + "1801" + "2001" + "2803"
+	if len(nested) != 1 || hex.EncodeToString(nested[0]) != wantNested {
+		t.Errorf("got nested descriptors %x, want [%s]", nested, wantNested)
+	}
+
+	if _, err := bigQueryDescriptor("row", []bigQueryField{{Name: "g", Type: "RANGE"}}, &nested); err == nil {
+		t.Errorf("got no error for a column of an unsupported type")
+	}
+}
+
+// bigQueryTestSchema has a column of every protobuf type of the Storage Write API, numbered from 1
+var bigQueryTestSchema = []bigQueryField{
+	{Name: "_index", Type: "STRING"},
+	{Name: "_id", Type: "STRING"},
+	{Name: "n", Type: "INTEGER"},
+	{Name: "f", Type: "FLOAT"},
+	{Name: "ok", Type: "BOOLEAN"},
+	{Name: "ts", Type: "TIMESTAMP"},
+	{Name: "tags", Type: "STRING", Mode: "REPEATED"},
+	{Name: "user", Type: "RECORD", Fields: []bigQueryField{{Name: "age", Type: "INTEGER"}}},
+	{Name: "day", Type: "DATE"},
+	{Name: "raw", Type: "BYTES"},
+	{Name: "extra", Type: "JSON"},
+}
+
+func TestBigQueryEncodeRow(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"integer", `{"n": 150}`, "189601"},
+		{"negative integer as text", `{"n": "-1"}`, "18ffffffffffffffffff01"},
+		{"integral float", `{"n": 3.0}`, "1803"},
+		{"column names are case insensitive", `{"N": 1}`, "1801"},
+		{"double", `{"f": 1.5}`, "21000000000000f83f"},
+		{"boolean as text", `{"ok": "false"}`, "2800"},
+		{"fields in the order of their names", `{"ok": true, "n": 1}`, "18012801"},
+		{"timestamp", `{"ts": "1970-01-01T00:00:01Z"}`, "30c0843d"},
+		{"timestamp in epoch millis", `{"ts": 1700000000000}`, "308080f9c0c1c48203"},
+		{"repeated without nulls", `{"tags": ["a", null, "b"]}`, "3a01613a0162"},
+		{"record", `{"user": {"age": 42}}`, "4202082a"},
+		{"date before the epoch", `{"day": "1969-12-31"}`, "48ffffffffffffffffff01"},
+		{"bytes", `{"raw": "aGk="}`, "52026869"},
+		{"json", `{"extra": {"a": 1}}`, "5a077b2261223a317d"},
+		{"null", `{"n": null, "extra": null}`, ""},
+		{"field without a column", `{"zzz": 1}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &bigQuerySink{project: "p", dataset: "d", table: "t", schema: bigQueryTestSchema, dropped: map[string]bool{}}
+			got, err := s.encodeRow(json.RawMessage(`{"_score": 1, "_source": ` + tt.source + `}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("got row %x, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("metadata", func(t *testing.T) {
+		s := &bigQuerySink{project: "p", dataset: "d", table: "t", schema: bigQueryTestSchema, dropped: map[string]bool{}}
+		got, err := s.encodeRow(json.RawMessage(`{"_index": "logs", "_id": "1", "_source": {}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "120131" + "0a046c6f6773"; hex.EncodeToString(got) != want {
+			t.Errorf("got row %x, want %s", got, want)
+		}
+	})
+}
+
+func TestBigQueryEncodeRowErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"integer", `{"n": "x"}`},
+		{"fractional integer", `{"n": 1.5}`},
+		{"boolean", `{"ok": "yes"}`},
+		{"timestamp", `{"ts": "yesterday"}`},
+		{"record", `{"user": "bob"}`},
+		{"bytes", `{"raw": "!!"}`},
+		{"several values in a column that is not repeated", `{"n": [1, 2]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &bigQuerySink{project: "p", dataset: "d", table: "t", schema: bigQueryTestSchema, dropped: map[string]bool{}}
+			if _, err := s.encodeRow(json.RawMessage(`{"_source": ` + tt.source + `}`)); err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestBigQueryAppendRows(t *testing.T) {
+	// the first call is refused as BigQuery is unavailable, the second one rejects a row
+	var calls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /google.cloud.bigquery.storage.v1.BigQueryWrite/AppendRows", func(w http.ResponseWriter, r *http.Request) {
+		call := calls.Add(1)
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("got Authorization %q, want %q", got, "Bearer token")
+		}
+		stream := "projects/p/datasets/d/tables/t/streams/_default"
+		if got := r.Header.Get("X-Goog-Request-Params"); got != "write_stream="+strings.ReplaceAll(stream, "/", "%2F") {
+			t.Errorf("got X-Goog-Request-Params %q", got)
+		}
+		message, _, err := readGRPCMessage(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// write_stream, then proto_rows with the descriptor and the rows
+		want := appendProtoDelimited(nil, 1, []byte(stream))
+		want = appendProtoDelimited(want, 4, append(
+			appendProtoDelimited(nil, 1, appendProtoDelimited(nil, 1, []byte("descriptor"))),
+			appendProtoDelimited(nil, 2, append(appendProtoDelimited(nil, 1, []byte("row1")), appendProtoDelimited(nil, 1, []byte("row2"))...))...,
+		))
+		if string(message) != string(want) {
+			t.Errorf("got request %x, want %x", message, want)
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+		if call == 1 {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "14")
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", "try again")
+			return
+		}
+		rowError := appendProtoVarint(nil, 1, 1)
+		rowError = appendProtoVarint(rowError, 2, 1)
+		rowError = appendProtoDelimited(rowError, 3, []byte("bad value"))
+		response := appendProtoDelimited(nil, 4, rowError)
+		frame := []byte{0, 0, 0, 0, byte(len(response))}
+		w.Write(append(frame, response...))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+	server := httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	defer server.Close()
+	defer func(api string) { bigQueryStorageAPI = api }(bigQueryStorageAPI)
+	bigQueryStorageAPI = server.URL
+
+	s := &bigQuerySink{
+		ctx:        context.Background(),
+		client:     h2cClient(),
+		creds:      &gcpCredentials{token: "token", expires: time.Now().Add(time.Hour)},
+		maxRetries: 2,
+		backoff:    Backoff{Initial: time.Millisecond, Max: time.Millisecond},
+		project:    "p",
+		dataset:    "d",
+		table:      "t",
+		descriptor: []byte("descriptor"),
+	}
+	err := s.appendRows([][]byte{[]byte("row1"), []byte("row2")})
+	if err == nil || !strings.Contains(err.Error(), "1 rows rejected: row 1: bad value") {
+		t.Errorf("got error %v, want the rejected row", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("got %d calls, want 2", got)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cachingTransport keeps the successful responses of the cluster in a directory, keyed by a hash
+// of the request, and answers the same requests from there until they are older than the ttl.
+// Meant for iterating on the output and transform options of an export without running its
+// searches again: as the cached pages hold the scroll ids of the run that fetched them, the
+// requests for the next pages are the same too, and the whole export is replayed from the cache
+type cachingTransport struct {
+	next http.RoundTripper
+	dir  string
+	ttl  time.Duration
+
+	warnOnce sync.Once
+}
+
+// cachedResponse is a response as written to the cache directory
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+func newCachingTransport(next http.RoundTripper, dir string, ttl time.Duration) (*cachingTransport, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid --cache-ttl %v, expected a positive duration", ttl)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %w", dir, err)
+	}
+	return &cachingTransport{next: next, dir: dir, ttl: ttl}, nil
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// deletes, as clearing scrolls, always go to the cluster
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return t.next.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		req.Body.Close()
+	}
+	key := cacheKey(req, body)
+	path := filepath.Join(t.dir, key+".json")
+
+	if cached, ok := t.load(path); ok {
+		slog.Debug(fmt.Sprintf("%s %s answered from the cache", req.Method, req.URL.Path), "event", "cache_hit", "key", key)
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", cached.Status, http.StatusText(cached.Status)),
+			StatusCode:    cached.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        cached.Header,
+			Body:          io.NopCloser(bytes.NewReader(cached.Body)),
+			ContentLength: int64(len(cached.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	forward := req.Clone(req.Context())
+	forward.Body = io.NopCloser(bytes.NewReader(body))
+	res, err := t.next.RoundTrip(forward)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+	data, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	res.Body = io.NopCloser(bytes.NewReader(data))
+	t.store(path, cachedResponse{Status: res.StatusCode, Header: res.Header, Body: data})
+	return res, nil
+}
+
+// cacheKey hashes what makes responses differ: the method, URL, credentials, accepted media type
+// and body of the request
+func cacheKey(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	for _, part := range []string{req.Method, req.URL.String(), req.Header.Get("Authorization"), req.Header.Get("Accept")} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// load returns the cached response of path, unless missing or expired
+func (t *cachingTransport) load(path string) (cachedResponse, bool) {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > t.ttl {
+		return cachedResponse{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cachedResponse{}, false
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return cachedResponse{}, false
+	}
+	return cached, true
+}
+
+// store writes a response to the cache, only warning once when it can't, as the export doesn't
+// need it
+func (t *cachingTransport) store(path string, cached cachedResponse) {
+	data, err := json.Marshal(cached)
+	if err == nil {
+		// written to a temporary file first, so concurrent slices never read a partial response
+		tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		t.warnOnce.Do(func() {
+			slog.Warn(fmt.Sprintf("failed to write to the cache directory %s: %v", t.dir, err), "event", "cache_write_failed", "error", err)
+		})
+	}
+}
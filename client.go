@@ -6,125 +6,350 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 type Client struct {
 	ESURL    string
 	User     string
 	Password string
+
+	// HTTP client used to talk to Elasticsearch. Defaults to http.DefaultClient
+	HTTPClient *http.Client
+
+	// Flavor of the cluster, elasticsearch or opensearch. Requests that differ between the two
+	// are built for this flavor
+	Flavor string
+
+	// Version of the cluster, zero when unknown. Requests are built for this version
+	Version clusterVersion
+
+	// When set, requests ask the cluster to behave as this major version of Elasticsearch, so
+	// they keep working against the next major version in REST compatibility mode
+	CompatVersion int
+
+	// Set for Elastic Cloud Serverless projects, which don't support scrolls. All results are
+	// fetched with point in time searches instead
+	Serverless bool
+
+	// Set for Amazon OpenSearch Serverless collections, which have neither scrolls nor points in
+	// time, nor the _cat, _tasks and cluster information APIs. All results are fetched with
+	// search_after searches on the index instead
+	AOSS bool
+
+	// Optional mapping type searches and counts are restricted to, using the typed endpoints of
+	// Elasticsearch 6.x and older
+	DocType string
+
+	// Comma separated routing values restricting searches and counts to the shards they route to
+	Routing string
+
+	// Optional point in time, opened beforehand with pit open, that all results are fetched from
+	// instead of a scroll. It is neither extended nor closed, so other exports can share it
+	PIT string
+
+	// Sent as the X-Opaque-Id header of every request, so the tasks Elasticsearch runs on our
+	// behalf can be identified
+	OpaqueID string
+
+	// Optional Host header sent instead of the host of ESURL, for clusters reached by address
+	// behind proxies routing on the host name
+	HostHeader string
+
+	// Search tuning parameters. Zero values leave the Elasticsearch defaults in place
+	MaxConcurrentShardRequests int
+	BatchedReduceSize          int
+
+	// How long scrolls and points in time are kept alive between pages, in Elasticsearch time
+	// units. Defaults to 1m
+	KeepAlive string
+
+	// Value of the ignore_throttled search parameter, left to the Elasticsearch default when empty
+	IgnoreThrottled string
+
+	// Query string parameters added to search requests as they are, overriding the ones set from
+	// the other options
+	SearchParams url.Values
+
+	// Transformations applied, in order, to every hit before it is written
+	Transforms []hitTransform
+
+	// Encodes the hits for the output. Hits are written as json lines when nil
+	Encoder hitEncoder
+
+	// Optional sink the hits are delivered to instead of the writer
+	Sink sink
+
+	// Optional WebAssembly module every hit is run through after the transforms, which can
+	// rewrite or drop it
+	Plugin *wasmPlugin
+
+	// Don't fetch the source of the documents, only their ids
+	IDsOnly bool
+
+	// How the inner hits of the hits are written: embedded in the _source of their document, or
+	// exploded into rows of their own, when "explode". As returned when empty
+	InnerHits string
+
+	// Hits larger than MaxDocBytes, as json, are skipped, truncated or fail the export, depending
+	// on OversizedDocs. No limit when 0
+	MaxDocBytes   int
+	OversizedDocs string
+	// Hits failing to be transformed or encoded are left out and recorded, instead of failing the
+	// export, when set
+	DocErrors *docErrorLog
+	// What to do with pages that timed out: retry, fail or ignore them
+	OnTimeout string
+	// A failed slice doesn't stop the others when set, the export failing with the slices it
+	// misses once they are done
+	KeepPartial bool
+	// Name of the export in the labels of the per slice metrics, when several run in the process
+	MetricsExport string
+
+	// Optional journal of the documents delivered, which are not written again
+	Journal *Journal
+
+	// Optional record of the scrolls open, for clear-scrolls to clear them if the export is killed
+	Scrolls *scrollRegistry
+
+	// Optional function called with every page fetched by Query, from the goroutines of the
+	// slices
+	onPage func(slice int, docs int, bytes int64, latency time.Duration)
+
+	// Include the _version, and the _seq_no and _primary_term, of the documents in the hits
+	DocVersion       bool
+	SeqNoPrimaryTerm bool
+
+	// Number of times a request is retried on connection errors and overloaded cluster responses,
+	// waiting Backoff between attempts
+	MaxRetries int
+	Backoff    Backoff
+
+	// Optional limit on the retries of all requests of this client together, so a cluster that
+	// keeps failing fails the export quickly
+	RetryBudget *RetryBudget
+
+	// Optional circuit breaker shared by all requests of this client. Pauses every slice when
+	// the cluster looks overloaded
+	Breaker *CircuitBreaker
+
+	// Warn about search and scroll requests taking longer than this. Disabled when zero
+	SlowRequestThreshold time.Duration
+
+	// Log DNS, connect, TLS handshake and time to first byte of every request
+	TraceConn bool
+
+	// Show a progress bar on stderr instead of periodic log lines when stderr is a terminal
+	ProgressBar bool
+
+	// Also report the progress of each slice on every periodic progress log line
+	SliceProgress bool
+
+	// Optional limit on the number of requests in flight at the same time, independently of the
+	// number of slices
+	Inflight *semaphore.Weighted
 }
 
 type ShardsMetaResult struct {
-	Total      int `json:"total"`
-	Successful int `json:"successful"`
-	Skipped    int `json:"skipped"`
-	Failed     int `json:"failed"`
-	Failures   []struct {
-		Shard  int    `json:"shard"`
-		Index  string `json:"index"`
-		Node   string `json:"node"`
-		Reason struct {
-			Type   string `json:"type"`
-			Reason string `json:"reason"`
-		} `json:"reason"`
-	} `json:"failures"`
+	Total      int            `json:"total"`
+	Successful int            `json:"successful"`
+	Skipped    int            `json:"skipped"`
+	Failed     int            `json:"failed"`
+	Failures   []ShardFailure `json:"failures"`
 }
 
 type SearchResult struct {
 	ShardsMetaResult ShardsMetaResult `json:"_shards"`
+	// Took is how long the cluster took to run the search, in milliseconds
+	Took int64 `json:"took"`
+	// TimedOut tells that some shards didn't answer before the timeout of the search, and
+	// their hits are missing
+	TimedOut bool `json:"timed_out"`
 
 	ScrollId string `json:"_scroll_id"`
+	PitId    string `json:"pit_id"`
 
 	Hits struct {
-		Total struct {
-			Value    int64  `json:"value"`
-			Relation string `json:"relation"`
-		} `json:"total"`
-		Hits []json.RawMessage `json:"hits"`
+		Total totalHits         `json:"total"`
+		Hits  []json.RawMessage `json:"hits"`
 	} `json:"hits"`
 }
 
-func (c *Client) Query(ctx context.Context, index string, query string, fetchAll bool, slices int, writer io.Writer) error {
-	var docs atomic.Int64
-	var totalDocs atomic.Int64
-	if slices <= 1 {
-		return c.querySlice(ctx, index, query, fetchAll, 0, 1, &docs, &totalDocs, nil, writer)
+// totalHits is the number of documents a search matched. Elasticsearch 7.0 and later report it
+// as an object with a value and whether it is exact or a lower bound, older versions (and newer
+// ones asked for rest_total_hits_as_int) as a plain number, which is always exact
+type totalHits struct {
+	Value    int64  `json:"value"`
+	Relation string `json:"relation"`
+}
+
+func (t *totalHits) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '{' && data[0] != 'n' {
+		t.Relation = "eq"
+		return json.Unmarshal(data, &t.Value)
 	}
+	type plain totalHits
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+// Query runs the query against the index and writes the resulting documents to the writer, one
+// json document per line. A summary of the run is returned even when the query fails
+func (c *Client) Query(ctx context.Context, index string, query string, fetchAll bool, slices int, writer io.Writer) (*Summary, error) {
+	slices = max(slices, 1)
+	p := newProgress(slices)
+	p.export = c.MetricsExport
+	p.onPage = c.onPage
+	ctx = withProgress(ctx, p)
+	ctx, span := startSpan(ctx, "esfetcher.query", spanKindInternal, map[string]any{
+		"elasticsearch.index": index, "esfetcher.slices": slices, "esfetcher.fetch_all": fetchAll,
+	})
 
 	start := time.Now()
-	group, ctx := errgroup.WithContext(ctx)
-	var writerLock sync.Mutex
+	searchAfter := fetchAll && (c.Serverless || c.AOSS || c.PIT != "")
+	if searchAfter && c.AOSS && slices > 1 {
+		err := fmt.Errorf("Amazon OpenSearch Serverless does not support sliced searches, run without --slices")
+		span.finish(err)
+		return p.summary(index, start, err), err
+	}
+	pit := c.PIT
+	if searchAfter && c.Serverless && pit == "" {
+		var err error
+		if pit, err = c.openPIT(ctx, index, ""); err != nil {
+			span.finish(err)
+			return p.summary(index, start, err), err
+		}
+		defer c.closePIT(ctx, pit)
+	}
+	group, groupCtx := errgroup.WithContext(ctx)
+	if c.KeepPartial {
+		group, groupCtx = &errgroup.Group{}, ctx
+	}
+	var writerLock *sync.Mutex
+	if slices > 1 {
+		writerLock = &sync.Mutex{}
+	}
 	for i := 0; i < slices; i++ {
 		group.Go(func() error {
-			return c.querySlice(ctx, index, query, fetchAll, i, slices, &docs, &totalDocs, &writerLock, writer)
+			ctx, span := startSpan(withSlice(groupCtx, i), "esfetcher.slice", spanKindInternal, map[string]any{"esfetcher.slice": i})
+			var err error
+			if searchAfter {
+				err = c.searchAfterSlice(ctx, index, pit, query, i, slices, p, writerLock, writer)
+			} else {
+				err = c.querySlice(ctx, index, query, fetchAll, i, slices, p, writerLock, writer)
+			}
+			p.finishSlice(i, err)
+			span.setAttribute("esfetcher.docs", p.slices[i].docs.Load())
+			span.finish(err)
+			if err != nil && c.KeepPartial && slices > 1 {
+				slog.Error(
+					fmt.Sprintf("Slice %d failed, the other slices go on: %v", i, err),
+					"event", "slice_failed", "slice", i, "error", err,
+				)
+				return nil
+			}
+			return err
 		})
 	}
 
-	// progress monitor every 10 seconds
-	go func() {
-		logEvery := 10 * time.Second
-		maxAvgPoints := 6 // moving average over 1 minute (10s * 6 = 1m)
-
-		var avgPoints int
-		var avgSpeed float64
-		var lastDocs int64
-		ticker := time.NewTicker(logEvery)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				localDocs := docs.Load()
-				localTotalDocs := totalDocs.Load()
-				remainingDocs := localTotalDocs - localDocs
-
-				// Calculate average speed. Apply moving average to smooth out speed and ETA calculations
-				docsPerS := float64(localDocs-lastDocs) / float64(logEvery/time.Second)
-				avgSpeed = (avgSpeed*float64(avgPoints) + docsPerS) / float64(avgPoints+1)
-				if avgPoints < maxAvgPoints {
-					avgPoints++
-				}
-
-				eta := time.Duration(float64(remainingDocs) / docsPerS * float64(time.Second)).Truncate(time.Second)
-				log.Printf(
-					"Fetched %d documents out of %d documents (%.1f%%). Avg Speed: %d docs/s. ETA: %v",
-					localDocs, localTotalDocs, float64(localDocs)/float64(localTotalDocs)*100, int(avgSpeed), eta,
-				)
-				lastDocs = localDocs
-			}
-		}
-	}()
+	stopDump := dumpProgressOnSignal(p, start)
+	defer stopDump()
 
-	if err := group.Wait(); err != nil {
-		return err
+	stopProgress := func() {}
+	if fetchAll {
+		stopProgress = reportProgress(ctx, p, c.ProgressBar, c.SliceProgress)
 	}
+	err := group.Wait()
+	if err == nil {
+		err = p.partialError()
+	}
+	stopProgress()
+	span.setAttribute("esfetcher.docs", p.docs.Load())
+	span.finish(err)
+	if err == nil && fetchAll && p.exactTotal.Load() && p.docs.Load() != p.totalDocs.Load() {
+		err = &CountMismatchError{Fetched: p.docs.Load(), Expected: p.totalDocs.Load()}
+	}
+	summary := p.summary(index, start, err)
+	if err != nil {
+		return summary, err
+	}
+
+	if fetchAll || slices > 1 {
+		logDone(p, start)
+	}
+	return summary, nil
+}
 
+// logDone logs how many documents were fetched and how fast
+func logDone(p *progress, start time.Time) {
 	taken := time.Since(start)
-	log.Printf(
-		"Fetched %d documents in %v. Avg Speed: %d docs/s",
-		totalDocs.Load(), taken, int(float64(totalDocs.Load())/taken.Seconds()),
+	slog.Info(
+		fmt.Sprintf(
+			"Fetched %d documents (%s) in %v. Avg Speed: %d docs/s",
+			p.docs.Load(), formatBytes(float64(p.bytes.Load())), taken, int(float64(p.docs.Load())/taken.Seconds()),
+		),
+		"event", "done", "docs", p.docs.Load(), "bytes", p.bytes.Load(), "duration", taken,
 	)
-	return nil
 }
 
-func (c *Client) querySlice(ctx context.Context, index string, query string, fetchAll bool, slice int, maxSlices int, docs *atomic.Int64, totalDocs *atomic.Int64, writerLock *sync.Mutex, writer io.Writer) error {
-	url := fmt.Sprintf("%s/_search?_source=true", index)
+// searchParams returns the query string parameters of search requests
+func (c *Client) searchParams() url.Values {
+	params := url.Values{}
+	params.Set("_source", strconv.FormatBool(!c.IDsOnly))
+	if c.MaxConcurrentShardRequests > 0 {
+		params.Set("max_concurrent_shard_requests", strconv.Itoa(c.MaxConcurrentShardRequests))
+	}
+	if c.BatchedReduceSize > 0 {
+		params.Set("batched_reduce_size", strconv.Itoa(c.BatchedReduceSize))
+	}
+	if c.IgnoreThrottled != "" {
+		params.Set("ignore_throttled", c.IgnoreThrottled)
+	}
+	if c.DocVersion {
+		params.Set("version", "true")
+	}
+	if c.SeqNoPrimaryTerm {
+		params.Set("seq_no_primary_term", "true")
+	}
+	if c.Routing != "" {
+		params.Set("routing", c.Routing)
+	}
+	for key, values := range c.SearchParams {
+		params[key] = values
+	}
+	return params
+}
+
+// keepAlive returns how long scrolls and points in time are kept alive between pages
+func (c *Client) keepAlive() string {
+	if c.KeepAlive == "" {
+		return "1m"
+	}
+	return c.KeepAlive
+}
+
+func (c *Client) querySlice(ctx context.Context, index string, query string, fetchAll bool, slice int, maxSlices int, p *progress, writerLock *sync.Mutex, writer io.Writer) error {
+	params := c.searchParams()
 	if fetchAll {
-		url += "&scroll=1m"
+		params.Set("scroll", c.keepAlive())
 	}
+	path := c.indexPath(index, "_search") + "?" + params.Encode()
 
 	if maxSlices > 1 {
+		if !c.supports(5, 0) {
+			return fmt.Errorf("sliced scrolls need Elasticsearch 5.0 or later, run without --slices")
+		}
 		var queryObj map[string]any
 		if err := json.Unmarshal([]byte(query), &queryObj); err != nil {
-			return fmt.Errorf("failed to parse query: %w", err)
+			return &QueryError{fmt.Errorf("failed to parse query: %w", err)}
 		}
 		queryObj["slice"] = map[string]int{"id": slice, "max": maxSlices}
 		queryBytes, err := json.Marshal(queryObj)
@@ -134,108 +359,345 @@ func (c *Client) querySlice(ctx context.Context, index string, query string, fet
 		query = string(queryBytes)
 	}
 
-	_, data, err := c.do(ctx, "GET", url, query)
+	sr, took, err := c.searchPage(ctx, p, slice, 1, "GET", path, query, true)
 	if err != nil {
 		return err
 	}
 
-	var sr SearchResult
-	if err := json.Unmarshal(data, &sr); err != nil {
-		return fmt.Errorf("failed to unmarshal response: %w", err)
+	if fetchAll && sr.ScrollId != "" {
+		c.Scrolls.add(sr.ScrollId)
 	}
 
-	if sr.ShardsMetaResult.Failed > 0 {
-		return fmt.Errorf("failed to query Elasticsearch: %v", sr.ShardsMetaResult.Failures)
+	if err := checkShards(sr, p); err != nil {
+		return err
 	}
 
-	totalDocs.Add(sr.Hits.Total.Value)
-	docs.Add(int64(len(sr.Hits.Hits)))
+	p.recordSliceTotal(slice, sr.Hits.Total.Value, sr.Hits.Total.Relation == "eq")
 
-	if err := writeJsons(sr.Hits.Hits, writerLock, writer); err != nil {
+	bytes, err := c.writeHits(sr.Hits.Hits, writerLock, writer)
+	if err != nil {
 		return err
 	}
+	p.recordPage(slice, len(sr.Hits.Hits), bytes, took)
 
 	if !fetchAll {
 		return nil
 	}
 
-	return c.scroll(ctx, &sr, docs, totalDocs, writerLock, writer)
+	return c.scroll(ctx, sr, slice, p, writerLock, writer)
 }
 
-func (c *Client) scroll(ctx context.Context, sr *SearchResult, docs *atomic.Int64, totalDocs *atomic.Int64, writerLock *sync.Mutex, writer io.Writer) error {
+func (c *Client) scroll(ctx context.Context, sr *SearchResult, slice int, p *progress, writerLock *sync.Mutex, writer io.Writer) error {
 	scrollId := sr.ScrollId
 	defer func() {
-		_, _, err := c.do(ctx, "DELETE", "_search/scroll", fmt.Sprintf(`{"scroll_id":"%s"}`, scrollId))
-		if err != nil {
-			log.Printf("failed to clear scroll: %v", err)
+		// clear the scroll even if the export was interrupted, so it does not hold cluster resources
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+		if _, err := c.clearScrolls(ctx, []string{scrollId}); err != nil {
+			slog.WarnContext(ctx, err.Error(), "event", "clear_scroll_failed", "error", err)
+			return
 		}
+		c.Scrolls.remove(scrollId)
 	}()
 
-	for {
-		body := fmt.Sprintf(`{"scroll":"1m","scroll_id":"%s"}`, scrollId)
-		_, data, err := c.do(ctx, "POST", "_search/scroll", body)
+	for page := 2; ; page++ {
+		body, err := json.Marshal(scrollRequest{Scroll: c.keepAlive(), ScrollID: scrollId})
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to marshal scroll request: %w", err)
 		}
-
-		var sr SearchResult
-		if err := json.Unmarshal(data, &sr); err != nil {
-			return fmt.Errorf("failed to unmarshal response: %w", err)
+		// the scroll moved on even when the page timed out or the request failed on the way back,
+		// it can't be fetched again
+		sr, took, err := c.searchPage(ctx, p, slice, page, "POST", "_search/scroll", string(body), false)
+		if err != nil {
+			return err
 		}
 
-		if sr.ShardsMetaResult.Failed > 0 {
-			return fmt.Errorf("failed to query Elasticsearch: %v", sr.ShardsMetaResult.Failures)
+		if err := checkShards(sr, p); err != nil {
+			return err
 		}
 
 		if len(sr.Hits.Hits) == 0 {
 			break
 		}
 
-		docs.Add(int64(len(sr.Hits.Hits)))
-
-		if err := writeJsons(sr.Hits.Hits, writerLock, writer); err != nil {
+		bytes, err := c.writeHits(sr.Hits.Hits, writerLock, writer)
+		if err != nil {
 			return err
 		}
+		p.recordPage(slice, len(sr.Hits.Hits), bytes, took)
 
+		c.Scrolls.replace(scrollId, sr.ScrollId)
 		scrollId = sr.ScrollId
 	}
 
 	return nil
 }
 
+// hitsQuery returns the query clause of the search body matching its hits, with the post_filter
+// folded into it, for requests that don't take a post_filter or where it would not apply to
+// what they return. It reports false when the body has neither
+func hitsQuery(queryObj map[string]json.RawMessage) (json.RawMessage, bool) {
+	clause, hasQuery := queryObj["query"]
+	if postFilter, ok := queryObj["post_filter"]; ok {
+		if !hasQuery {
+			clause = json.RawMessage(`{"match_all":{}}`)
+		}
+		return json.RawMessage(fmt.Sprintf(`{"bool":{"must":%s,"filter":%s}}`, clause, postFilter)), true
+	}
+	return clause, hasQuery
+}
+
+// count returns how many documents of the index the query matches, using the _count API. Only
+// the query clause of the search body is sent, as the count API rejects everything else, with
+// the post_filter folded into it as it also restricts the hits
+func (c *Client) count(ctx context.Context, index string, query string) (int64, error) {
+	body := ""
+	if query != "" {
+		var queryObj map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(query), &queryObj); err != nil {
+			return 0, &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+		if clause, ok := hitsQuery(queryObj); ok {
+			body = fmt.Sprintf(`{"query":%s}`, clause)
+		}
+	}
+	path := c.indexPath(index, "_count")
+	params := url.Values{}
+	if c.IgnoreThrottled != "" {
+		params.Set("ignore_throttled", c.IgnoreThrottled)
+	}
+	if c.Routing != "" {
+		params.Set("routing", c.Routing)
+	}
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	_, data, err := c.do(ctx, "GET", path, body)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal count response: %w", err)
+	}
+	return result.Count, nil
+}
+
+// indexPath returns the path of an endpoint of the index, the typed one when a mapping type is set
+func (c *Client) indexPath(index string, endpoint string) string {
+	if c.DocType != "" {
+		return index + "/" + url.PathEscape(c.DocType) + "/" + endpoint
+	}
+	return index + "/" + endpoint
+}
+
+// searchPage fetches a page of search results. Pages the cluster answers with timed_out miss
+// the hits of the shards that didn't answer in time: they are fetched again when retryable, up
+// to MaxRetries times, or fail the export, unless OnTimeout is ignore, which writes them as they
+// are with a warning. Pages that aren't retryable aren't sent again after failures either, but
+// when rejected with 429
+func (c *Client) searchPage(ctx context.Context, p *progress, slice int, page int, method string, path string, body string, retryable bool) (*SearchResult, time.Duration, error) {
+	for attempt := 0; ; attempt++ {
+		pageStart := time.Now()
+		_, data, err := c.send(ctx, method, path, body, retryable)
+		if err != nil {
+			return nil, 0, err
+		}
+		took := time.Since(pageStart)
+		c.checkSlowPage(ctx, slice, page, took)
+
+		var sr SearchResult
+		if err := json.Unmarshal(data, &sr); err != nil {
+			return nil, 0, fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		p.took.Add(sr.Took)
+		if !sr.TimedOut {
+			return &sr, took, nil
+		}
+
+		p.timedOutPages.Add(1)
+		metrics.recordError("timed_out")
+		if c.OnTimeout == "ignore" {
+			slog.WarnContext(
+				ctx, fmt.Sprintf("Page %d of slice %d timed out, writing the hits of the shards that answered in time", page, slice),
+				"event", "page_timed_out", "page", page,
+			)
+			return &sr, took, nil
+		}
+		if c.OnTimeout == "fail" || !retryable || attempt >= c.MaxRetries {
+			return nil, 0, &TimedOutError{Slice: slice, Page: page, Attempts: attempt + 1}
+		}
+		if sr.ScrollId != "" {
+			// the search is run again with a scroll of its own
+			if _, err := c.clearScrolls(ctx, []string{sr.ScrollId}); err != nil {
+				slog.WarnContext(ctx, err.Error(), "event", "clear_scroll_failed", "error", err)
+			}
+		}
+		wait := c.Backoff.delay(attempt)
+		slog.WarnContext(
+			ctx, fmt.Sprintf("Page %d of slice %d timed out, fetching it again in %v (attempt %d of %d)", page, slice, wait, attempt+1, c.MaxRetries+1),
+			"event", "page_timed_out", "page", page, "attempt", attempt+1, "wait", wait,
+		)
+		if err := sleep(ctx, wait); err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// checkSlowPage warns when fetching a page took longer than the slow request threshold
+func (c *Client) checkSlowPage(ctx context.Context, slice int, page int, took time.Duration) {
+	if c.SlowRequestThreshold <= 0 || took < c.SlowRequestThreshold {
+		return
+	}
+	slog.WarnContext(
+		ctx, fmt.Sprintf("Slice %d took %v to fetch page %d, above the %v threshold", slice, took, page, c.SlowRequestThreshold),
+		"event", "slow_request", "page", page, "duration", took,
+	)
+}
+
+func checkShards(sr *SearchResult, p *progress) error {
+	if sr.ShardsMetaResult.Failed == 0 {
+		return nil
+	}
+	p.shardFailures.Add(int64(sr.ShardsMetaResult.Failed))
+	metrics.recordError("shard_failure")
+	return &ShardFailuresError{Failed: sr.ShardsMetaResult.Failed, Failures: sr.ShardsMetaResult.Failures}
+}
+
+// do sends a request to the cluster, retrying it on failures that are worth it
 func (c *Client) do(ctx context.Context, method string, path string, body string) (*http.Response, []byte, error) {
+	return c.send(ctx, method, path, body, true)
+}
+
+// send sends a request to the cluster as do does. A request that isn't repeatable is only retried
+// when the cluster rejected it without running it, see shouldRetry
+func (c *Client) send(ctx context.Context, method string, path string, body string, repeatable bool) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.Breaker.wait(ctx); err != nil {
+			return nil, nil, err
+		}
+
+		c.RetryBudget.request()
+		res, data, err := c.doOnce(ctx, method, path, body)
+		if err == nil {
+			c.Breaker.success()
+			return res, data, nil
+		}
+
+		if !shouldRetry(ctx, res, repeatable) {
+			if !repeatable && shouldRetry(ctx, res, true) {
+				return nil, data, fmt.Errorf("%s %s can't be sent again, the cluster may have run it already: %w", method, path, err)
+			}
+			return nil, data, err
+		}
+		c.Breaker.failure(res, attempt+1)
+		if attempt >= c.MaxRetries {
+			return nil, data, fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+
+		wait := c.Backoff.delay(attempt)
+		if budgetErr := c.RetryBudget.spend(wait); budgetErr != nil {
+			return nil, data, fmt.Errorf("giving up after %d attempts, %v: %w", attempt+1, budgetErr, err)
+		}
+		progressFromContext(ctx).retries.Add(1)
+		metrics.recordRetry()
+		slog.WarnContext(
+			ctx, fmt.Sprintf("%s %s failed, retrying in %v (attempt %d of %d): %v", method, path, wait, attempt+1, c.MaxRetries+1, err),
+			"event", "retry", "method", method, "path", path, "attempt", attempt+1, "wait", wait, "error", err,
+		)
+		if err := sleep(ctx, wait); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, method string, path string, body string) (res *http.Response, data []byte, err error) {
+	ctx, span := startSpan(ctx, method+" "+operationName(method, path), spanKindClient, map[string]any{
+		"http.request.method": method, "db.system": "elasticsearch",
+	})
+	defer func() {
+		if res != nil {
+			span.setAttribute("http.response.status_code", res.StatusCode)
+		}
+		span.finish(err)
+	}()
+
+	if c.TraceConn {
+		var trace *connTrace
+		ctx, trace = withConnTrace(ctx)
+		defer trace.log(ctx, method, path)
+	}
+
 	req, err := http.NewRequestWithContext(ctx, method, c.pathURL(path), bytes.NewBufferString(body))
 	if err != nil {
 		return nil, nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if c.CompatVersion > 0 {
+		// REST compatibility mode: the cluster answers as version CompatVersion would
+		mediaType := fmt.Sprintf("application/vnd.elasticsearch+json; compatible-with=%d", c.CompatVersion)
+		req.Header.Set("Content-Type", mediaType)
+		req.Header.Set("Accept", mediaType)
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.OpaqueID != "" {
+		req.Header.Set("X-Opaque-Id", c.OpaqueID)
+	}
+	if c.HostHeader != "" {
+		req.Host = c.HostHeader
+	}
+	span.setAttribute("url.full", redactURL(req))
+	if traceparent := span.traceparent(); traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
 	if c.User != "" {
 		req.SetBasicAuth(c.User, c.Password)
 	}
 
-	// log.Printf("%s %s", req.Method, req.URL.String())
-	// for k, v := range req.Header {
-	// 	log.Printf("%s: %s", k, v)
-	// }
-	// log.Print()
-	// log.Print(body)
+	if c.Inflight != nil {
+		if err := c.Inflight.Acquire(ctx, 1); err != nil {
+			return nil, nil, err
+		}
+		defer c.Inflight.Release(1)
+	}
 
-	res, err := http.DefaultClient.Do(req)
+	start := time.Now()
+	res, err = c.httpClient().Do(req)
+	metrics.recordRequest(operationName(method, path), time.Since(start))
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to query Elasticsearch: %w", err)
+		metrics.recordError("connection")
+		slog.DebugContext(
+			ctx, fmt.Sprintf("%s %s failed after %v: %v", method, path, time.Since(start), err),
+			"event", "request", "method", method, "path", path, "duration", time.Since(start), "error", err,
+		)
+		return nil, nil, &ConnectionError{err}
 	}
 
 	defer res.Body.Close()
-	data, err := io.ReadAll(res.Body)
+	data, err = io.ReadAll(res.Body)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read response body: %w", err)
 	}
+	slog.DebugContext(
+		ctx, fmt.Sprintf("%s %s: %s, %d bytes in %v", method, path, res.Status, len(data), time.Since(start)),
+		"event", "request", "method", method, "path", path, "status", res.StatusCode, "bytes", len(data), "duration", time.Since(start),
+	)
 	if res.StatusCode != http.StatusOK {
-		return nil, data, fmt.Errorf("failed to query Elasticsearch: %s", res.Status)
+		metrics.recordError(strconv.Itoa(res.StatusCode))
+		return res, data, newElasticsearchError(res, data)
 	}
 	return res, data, nil
 }
 
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
 func (c *Client) pathURL(path string) string {
 	url := c.ESURL
 	for url[len(url)-1] == '/' {
@@ -247,7 +709,118 @@ func (c *Client) pathURL(path string) string {
 	return fmt.Sprintf("%s/%s", c.ESURL, path)
 }
 
-func writeJsons(jsons []json.RawMessage, writerLock *sync.Mutex, writer io.Writer) error {
+// writeHits applies the transforms of the client to the hits and writes them to the writer, in
+// the output format of the client
+func (c *Client) writeHits(hits []json.RawMessage, writerLock *sync.Mutex, writer io.Writer) (int64, error) {
+	// the documents already delivered are dropped before anything else, and the others recorded
+	// once written, leaving out the ones skipped on the way
+	hits, keys, err := c.Journal.filter(hits)
+	if err != nil {
+		return 0, err
+	}
+	written, delivered, err := c.encodeHits(hits, writerLock, writer)
+	if err != nil || keys == nil {
+		return written, err
+	}
+	recorded := make([]string, len(delivered))
+	for i, hit := range delivered {
+		recorded[i] = keys[hit]
+	}
+	return written, c.Journal.record(recorded)
+}
+
+// encodeHits transforms, encodes and writes the hits, returning the bytes written and the indexes
+// of the hits written whole, without the ones, or the inner hits of the ones, left out by
+// --on-doc-error or --oversized-docs
+func (c *Client) encodeHits(hits []json.RawMessage, writerLock *sync.Mutex, writer io.Writer) (int64, []int, error) {
+	// the hit each of the rows written comes from, and whether any of its rows were left out
+	origins := make([]int, len(hits))
+	for i := range origins {
+		origins[i] = i
+	}
+	dropped := make([]bool, len(hits))
+	delivered := func() []int {
+		var indexes []int
+		for i, drop := range dropped {
+			if !drop {
+				indexes = append(indexes, i)
+			}
+		}
+		return indexes
+	}
+
+	if c.InnerHits == "explode" {
+		var err error
+		if hits, origins, err = explodeInnerHits(hits); err != nil {
+			return 0, nil, err
+		}
+	}
+	// hits failing a transform are handled one by one, so a bad document can be left out
+	// instead of failing the export
+	transformed := hits[:0:0]
+	var kept []int
+	for i, hit := range hits {
+		out, err := transformHit(hit, c.Transforms)
+		if err == nil && c.Plugin != nil {
+			if out, err = c.Plugin.transform(out); err == nil && out == nil {
+				dropped[origins[i]] = true
+				continue
+			}
+		}
+		if err == nil && !utf8.Valid(out) {
+			err = fmt.Errorf("invalid UTF-8")
+		}
+		if err != nil {
+			if err := c.DocErrors.handle(hit, err); err != nil {
+				return 0, nil, err
+			}
+			dropped[origins[i]] = true
+			continue
+		}
+		if out, err = c.limitDocSize(out); err != nil {
+			return 0, nil, err
+		}
+		if out == nil {
+			dropped[origins[i]] = true
+			continue
+		}
+		transformed = append(transformed, out)
+		kept = append(kept, origins[i])
+	}
+	hits = transformed
+	if c.Sink != nil {
+		written, err := c.writeSink(hits, writerLock)
+		return written, delivered(), err
+	}
+	if c.Encoder == nil {
+		written, err := writeJsons(hits, writerLock, writer)
+		return written, delivered(), err
+	}
+
+	// the page is encoded and written under the lock, as encoders keep state, as the csv header
+	if writerLock != nil {
+		writerLock.Lock()
+		defer writerLock.Unlock()
+	}
+	var buf bytes.Buffer
+	for i, hit := range hits {
+		if err := c.Encoder.encode(&buf, hit); err != nil {
+			if err := c.DocErrors.handle(hit, err); err != nil {
+				return 0, nil, err
+			}
+			dropped[kept[i]] = true
+		}
+	}
+	written, err := writer.Write(buf.Bytes())
+	if err != nil {
+		return int64(written), nil, fmt.Errorf("failed to write entry: %w", err)
+	}
+	return int64(written), delivered(), nil
+}
+
+// writeJsons writes the json entries to the writer, one per line, returning how many bytes were
+// written
+func writeJsons(jsons []json.RawMessage, writerLock *sync.Mutex, writer io.Writer) (int64, error) {
 	writeEntry := func(entry json.RawMessage) error {
 		if writerLock != nil {
 			writerLock.Lock()
@@ -261,10 +834,12 @@ func writeJsons(jsons []json.RawMessage, writerLock *sync.Mutex, writer io.Write
 		}
 		return nil
 	}
+	var written int64
 	for _, entry := range jsons {
 		if err := writeEntry(entry); err != nil {
-			return err
+			return written, err
 		}
+		written += int64(len(entry) + 1)
 	}
-	return nil
+	return written, nil
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+const (
+	flavorElasticsearch = "elasticsearch"
+	flavorOpenSearch    = "opensearch"
+)
+
+// clusterInfo is the answer of the cluster to GET /
+type clusterInfo struct {
+	ClusterName string `json:"cluster_name"`
+	Version     struct {
+		Number       string `json:"number"`
+		Distribution string `json:"distribution"`
+		BuildFlavor  string `json:"build_flavor"`
+	} `json:"version"`
+
+	// set when the cluster answers with the X-Elastic-Product header, as Elasticsearch does
+	// since 7.14
+	elasticProduct bool
+}
+
+// clusterVersion is the major and minor version of a cluster
+type clusterVersion struct {
+	major, minor int
+}
+
+func parseClusterVersion(number string) clusterVersion {
+	parts := strings.SplitN(number, ".", 3)
+	var v clusterVersion
+	v.major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		v.minor, _ = strconv.Atoi(parts[1])
+	}
+	return v
+}
+
+func (v clusterVersion) atLeast(major, minor int) bool {
+	return v.major > major || (v.major == major && v.minor >= minor)
+}
+
+func (info *clusterInfo) flavor() string {
+	if info.Version.Distribution == flavorOpenSearch {
+		return flavorOpenSearch
+	}
+	return flavorElasticsearch
+}
+
+func (c *Client) clusterInfo(ctx context.Context) (*clusterInfo, error) {
+	res, data, err := c.do(ctx, "GET", "", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cluster information: %w", err)
+	}
+	var info clusterInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal cluster information: %w", err)
+	}
+	info.elasticProduct = res.Header.Get("X-Elastic-Product") == "Elasticsearch"
+	return &info, nil
+}
+
+// detectCluster reads the cluster information on startup and sets the flavor, Elasticsearch or
+// OpenSearch, and the version of the cluster on the client, so requests can be adapted to it.
+// When flavor is auto it is detected, and Elasticsearch is assumed when the cluster does not let
+// us read it, as Amazon OpenSearch Serverless or restricted users don't. An unknown version is
+// treated as a recent one
+func (c *Client) detectCluster(ctx context.Context, flavor string) error {
+	switch flavor {
+	case flavorElasticsearch, flavorOpenSearch:
+		c.Flavor = flavor
+	case "auto", "":
+	default:
+		return fmt.Errorf("invalid flavor %q, expected one of auto, elasticsearch or opensearch", flavor)
+	}
+
+	if c.AOSS {
+		c.Flavor = flavorOpenSearch
+		slog.Debug("Connected to an Amazon OpenSearch Serverless collection", "event", "cluster_info", "flavor", c.Flavor)
+		return nil
+	}
+
+	info, err := c.clusterInfo(ctx)
+	var connErr *ConnectionError
+	if errors.As(err, &connErr) {
+		return err
+	}
+	if err != nil {
+		if c.Flavor != "" {
+			slog.Debug(fmt.Sprintf("Could not read the cluster version: %v", err), "event", "version_detection_failed", "error", err)
+			return nil
+		}
+		c.Flavor = flavorElasticsearch
+		slog.Warn(
+			fmt.Sprintf("Could not detect the cluster flavor, assuming %s. Set --flavor to skip detection: %v", c.Flavor, err),
+			"event", "flavor_detection_failed", "error", err,
+		)
+		return nil
+	}
+	if c.Flavor == "" {
+		c.Flavor = info.flavor()
+	}
+	if info.Version.BuildFlavor == "serverless" && !c.Serverless {
+		c.Serverless = true
+		slog.Debug("Connected to an Elastic Cloud Serverless project, fetching with point in time searches", "event", "serverless_detected")
+	}
+	c.Version = parseClusterVersion(info.Version.Number)
+	if c.Flavor == flavorElasticsearch && !info.elasticProduct && c.Version.atLeast(7, 14) {
+		slog.Warn(
+			"The cluster does not identify itself as Elasticsearch, results may be unexpected",
+			"event", "unknown_product", "version", info.Version.Number,
+		)
+	}
+	slog.Debug(
+		fmt.Sprintf("Connected to %s %s cluster %s", c.Flavor, info.Version.Number, info.ClusterName),
+		"event", "cluster_info", "flavor", c.Flavor, "version", info.Version.Number, "cluster", info.ClusterName,
+	)
+	return c.adaptToVersion(info.Version.Number)
+}
+
+// supports reports whether the cluster is at least the given Elasticsearch version. OpenSearch
+// forked from Elasticsearch 7.10 and clusters of unknown version are assumed to support
+// everything
+func (c *Client) supports(major, minor int) bool {
+	return c.Flavor == flavorOpenSearch || c.Version.major == 0 || c.Version.atLeast(major, minor)
+}
+
+// adaptToVersion warns about clusters too old to be supported and drops the search tuning
+// options the cluster does not know about, which it would otherwise reject the search for. It
+// fails when a mapping type is set for a cluster that removed them
+func (c *Client) adaptToVersion(number string) error {
+	if !c.supports(5, 0) {
+		slog.Warn(
+			fmt.Sprintf("Elasticsearch %s is not supported, the oldest supported version is 5.0", number),
+			"event", "unsupported_version", "version", number,
+		)
+	}
+	if c.MaxConcurrentShardRequests > 0 && !c.supports(5, 6) {
+		slog.Warn(
+			fmt.Sprintf("Ignoring --max-concurrent-shard-requests, which Elasticsearch %s does not support", number),
+			"event", "unsupported_option", "option", "max-concurrent-shard-requests", "version", number,
+		)
+		c.MaxConcurrentShardRequests = 0
+	}
+	if c.BatchedReduceSize > 0 && !c.supports(5, 4) {
+		slog.Warn(
+			fmt.Sprintf("Ignoring --batched-reduce-size, which Elasticsearch %s does not support", number),
+			"event", "unsupported_option", "option", "batched-reduce-size", "version", number,
+		)
+		c.BatchedReduceSize = 0
+	}
+	if c.CompatVersion > 0 && c.Flavor == flavorOpenSearch {
+		slog.Warn("Ignoring --compat-version, which OpenSearch does not support", "event", "unsupported_option", "option", "compat-version")
+		c.CompatVersion = 0
+	}
+	if c.SeqNoPrimaryTerm && !c.supports(6, 7) {
+		slog.Warn(
+			fmt.Sprintf("Ignoring --seq-no-primary-term, which Elasticsearch %s does not support", number),
+			"event", "unsupported_option", "option", "seq-no-primary-term", "version", number,
+		)
+		c.SeqNoPrimaryTerm = false
+	}
+	if c.DocType != "" {
+		// OpenSearch 2.0 removed mapping types as Elasticsearch 8.0 did, and both versions before
+		// deprecated them
+		product, removed, deprecated := "Elasticsearch", c.Version.atLeast(8, 0), c.Version.atLeast(7, 0)
+		if c.Flavor == flavorOpenSearch {
+			product, removed, deprecated = "OpenSearch", c.Version.atLeast(2, 0), true
+		}
+		if removed {
+			return fmt.Errorf("--doc-type can't be used with %s %s, which removed mapping types", product, number)
+		}
+		if deprecated {
+			slog.Warn(
+				fmt.Sprintf("Mapping types are deprecated in %s %s, --doc-type may stop working", product, number),
+				"event", "deprecated_option", "option", "doc-type", "version", number,
+			)
+		}
+	}
+	return nil
+}
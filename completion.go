@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// completionShells are the shells `esfetch completion` generates scripts for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// writeCompletion writes the completion script for the given shell, completing the command
+// program, the name the binary is run with. Besides flags and subcommands, the scripts complete
+// --index with the indices of the cluster, listed by running program with the connection options
+// already typed (or the ones of the config file)
+func writeCompletion(writer io.Writer, shell string, program string) error {
+	flags, subcommands := commandLine(reflect.TypeOf(args{}))
+	var script string
+	switch shell {
+	case "bash":
+		script = bashCompletion(program, flags, subcommands)
+	case "zsh":
+		script = zshCompletion(program, flags, subcommands)
+	case "fish":
+		script = fishCompletion(program, flags, subcommands)
+	default:
+		return fmt.Errorf("unsupported shell %q, expected one of %s", shell, strings.Join(completionShells, ", "))
+	}
+	_, err := io.WriteString(writer, script)
+	return err
+}
+
+// completionFunction returns the name of the shell function completing program
+func completionFunction(program string) string {
+	return "_" + strings.Map(func(r rune) rune {
+		if r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, program)
+}
+
+func completionWords(flags []commandFlag, subcommands []string) []string {
+	words := append([]string{}, subcommands...)
+	for _, flag := range flags {
+		words = append(words, flag.names()...)
+	}
+	return words
+}
+
+func valueFlagNames(flags []commandFlag) []string {
+	var names []string
+	for _, flag := range flags {
+		if flag.takesValue && flag.long != "index" {
+			names = append(names, flag.names()...)
+		}
+	}
+	return names
+}
+
+func bashCompletion(program string, flags []commandFlag, subcommands []string) string {
+	return fmt.Sprintf(`# bash completion for %[1]s
+# Load it with: source <(%[1]s completion bash)
+%[2]s() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+    case "$prev" in
+        -i|--index)
+            COMPREPLY=($(compgen -W "$(%[1]s list-indices "${COMP_WORDS[@]:1:COMP_CWORD-2}" 2>/dev/null)" -- "$cur"))
+            return
+            ;;
+        completion)
+            COMPREPLY=($(compgen -W "%[3]s" -- "$cur"))
+            return
+            ;;
+        %[4]s)
+            return
+            ;;
+    esac
+    COMPREPLY=($(compgen -W "%[5]s" -- "$cur"))
+}
+complete -o default -F %[2]s %[1]s
+`,
+		program, completionFunction(program),
+		strings.Join(completionShells, " "),
+		strings.Join(valueFlagNames(flags), "|"),
+		strings.Join(completionWords(flags, subcommands), " "),
+	)
+}
+
+func zshCompletion(program string, flags []commandFlag, subcommands []string) string {
+	return fmt.Sprintf(`#compdef %[1]s
+# zsh completion for %[1]s
+# Load it with: source <(%[1]s completion zsh), or save it as %[2]s in your $fpath
+%[2]s() {
+    local prev="${words[CURRENT-1]}"
+    case "$prev" in
+        -i|--index)
+            local -a indices
+            indices=(${(f)"$(%[1]s list-indices ${words[2,CURRENT-2]} 2>/dev/null)"})
+            compadd -a indices
+            return
+            ;;
+        completion)
+            compadd %[3]s
+            return
+            ;;
+        %[4]s)
+            _files
+            return
+            ;;
+    esac
+    compadd -- %[5]s
+}
+if [ "$funcstack[1]" = "%[2]s" ]; then
+    %[2]s "$@"
+else
+    compdef %[2]s %[1]s
+fi
+`,
+		program, completionFunction(program),
+		strings.Join(completionShells, " "),
+		strings.Join(valueFlagNames(flags), "|"),
+		strings.Join(completionWords(flags, subcommands), " "),
+	)
+}
+
+func fishCompletion(program string, flags []commandFlag, subcommands []string) string {
+	indices := "_" + completionFunction(program) + "_indices"
+	var b strings.Builder
+	fmt.Fprintf(&b, `# fish completion for %[1]s
+# Load it with: %[1]s completion fish | source
+function %[2]s
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    set -e tokens[-1]
+    %[1]s list-indices $tokens 2>/dev/null
+end
+complete -c %[1]s -f
+`, program, indices)
+	fmt.Fprintf(&b, "complete -c %s -n __fish_use_subcommand -a '%s'\n", program, strings.Join(subcommands, " "))
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from completion' -a '%s'\n", program, strings.Join(completionShells, " "))
+	for _, flag := range flags {
+		line := "complete -c " + program + " -l " + flag.long
+		if flag.short != "" {
+			line += " -s " + flag.short
+		}
+		switch {
+		case flag.long == "index":
+			line += " -x -a '(" + indices + ")'"
+		case flag.takesValue:
+			line += " -r -F"
+		}
+		if help := firstSentence(flag.help); help != "" {
+			line += " -d " + fishQuote(help)
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+// firstSentence shortens a help message to its first sentence, to fit completion menus
+func firstSentence(help string) string {
+	if i := strings.Index(help, ". "); i >= 0 {
+		return help[:i]
+	}
+	return strings.TrimSuffix(help, ".")
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
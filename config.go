@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/alexflint/go-scalar"
+	"gopkg.in/yaml.v3"
+)
+
+// secretOptions are config file options that are never shown as defaults in the usage message.
+// They are applied after parsing the command line, and only if neither a flag nor an env var
+// provided them, as applyRest does
+var secretOptions = map[string]bool{
+	"password":  true,
+	"hec-token": true,
+}
+
+// config holds the options read from the config file, keyed by their long flag name
+type config map[string]any
+
+// configOrigin tells where the config was read from. Path is empty when there is no config file
+type configOrigin struct {
+	Path    string
+	Profile string
+}
+
+// defaultConfigPath returns where the config file is looked for when --config is not given
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "esfetcher", "config.yaml")
+}
+
+// lookupOption finds the value of a flag in the command line, falling back to an env var. It is
+// used for the options that have to be known before the command line is parsed, as they select
+// the config file that provides the defaults the parser works with
+func lookupOption(argv []string, flag string, env string) (string, bool) {
+	for i, arg := range argv {
+		if arg == "--" {
+			break
+		}
+		if arg == flag && i+1 < len(argv) {
+			return argv[i+1], true
+		}
+		if value, ok := strings.CutPrefix(arg, flag+"="); ok {
+			return value, true
+		}
+	}
+	if value := os.Getenv(env); value != "" {
+		return value, true
+	}
+	return "", false
+}
+
+// loadConfig reads the config file selected by the command line, and merges the options of the
+// selected profile over its top level options. A missing default config file is not an error and
+// yields an empty config
+func loadConfig(argv []string) (config, configOrigin, error) {
+	path, explicit := lookupOption(argv, "--config", "ESFETCHER_CONFIG")
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	profile, _ := lookupOption(argv, "--profile", "ESFETCHER_PROFILE")
+	if path == "" {
+		if profile != "" {
+			return nil, configOrigin{}, fmt.Errorf("profile %s requested but no config file was found", profile)
+		}
+		return config{}, configOrigin{}, nil
+	}
+	cfg, profile, err := readConfig(path, profile)
+	if errors.Is(err, fs.ErrNotExist) && !explicit && profile == "" {
+		return config{}, configOrigin{}, nil
+	}
+	if err != nil {
+		return nil, configOrigin{}, err
+	}
+	return cfg, configOrigin{Path: path, Profile: profile}, nil
+}
+
+// readConfig reads a config file, merging the options of the profile over the top level ones. The
+// profile defaults to the one named by the profile key of the file. The profile used is returned
+func readConfig(path string, profile string) (config, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, profile, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	// decoding into a plain map, as yaml would decode nested mappings into config values too
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, profile, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	cfg := config(raw)
+	if cfg == nil {
+		cfg = config{}
+	}
+
+	profiles, ok := cfg["profiles"].(map[string]any)
+	if _, set := cfg["profiles"]; set && !ok {
+		return nil, profile, fmt.Errorf("invalid profiles in config file %s: expected a mapping of profile names to options", path)
+	}
+	delete(cfg, "profiles")
+	if profile == "" {
+		profile, _ = cfg["profile"].(string)
+	}
+	delete(cfg, "profile")
+	if err := cfg.validate(); err != nil {
+		return nil, profile, fmt.Errorf("%w in config file %s", err, path)
+	}
+	if profile == "" {
+		return cfg, "", nil
+	}
+
+	options, ok := profiles[profile].(map[string]any)
+	if !ok {
+		return nil, profile, fmt.Errorf("profile %s not found in config file %s", profile, path)
+	}
+	if err := config(options).validate(); err != nil {
+		return nil, profile, fmt.Errorf("%w in profile %s of config file %s", err, profile, path)
+	}
+	for key, value := range options {
+		cfg[key] = value
+	}
+	return cfg, profile, nil
+}
+
+// validate checks every key of the config is the long name of an option
+func (c config) validate() error {
+	fields := optionFields(reflect.TypeOf(args{}))
+	for key := range c {
+		if _, ok := fields[key]; !ok || key == "config" || key == "profile" {
+			return fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return nil
+}
+
+// applyDefaults sets the options of the config file on dest that the parser can take as defaults.
+// It must be called before the command line is parsed: the parser takes the values already set as
+// the defaults, so flags and env vars keep precedence over the config file
+func (c config) applyDefaults(dest *args) error {
+	return c.apply(dest, func(name string, field reflect.Value) bool {
+		return !appliedAfterParsing(name, field)
+	})
+}
+
+// applyRest sets the other options of the config file on dest, the ones still unset after parsing
+// the command line
+func (c config) applyRest(dest *args) error {
+	return c.apply(dest, func(name string, field reflect.Value) bool {
+		return appliedAfterParsing(name, field) && field.IsZero()
+	})
+}
+
+// appliedAfterParsing reports whether an option of the config file is set once the command line
+// is parsed instead of being given to the parser as a default: secrets, so the usage message
+// doesn't show them, and lists, as the parser turns defaults into a string it then parses back as
+// a single value
+func appliedAfterParsing(name string, field reflect.Value) bool {
+	return secretOptions[name] || field.Kind() == reflect.Slice
+}
+
+func (c config) apply(dest *args, want func(name string, field reflect.Value) bool) error {
+	value := reflect.ValueOf(dest).Elem()
+	fields := optionFields(value.Type())
+	for name, raw := range c {
+		field := value.FieldByIndex(fields[name])
+		if !want(name, field) {
+			continue
+		}
+		if err := setOption(field, raw); err != nil {
+			return fmt.Errorf("invalid value for %s in config file: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setOption sets field from a value decoded from yaml. Scalars go through the same parsing as
+// command line values, so durations, sizes and the like are written the same way in both places
+func setOption(field reflect.Value, raw any) error {
+	if field.Kind() == reflect.Slice {
+		items, ok := raw.([]any)
+		if !ok {
+			items = []any{raw}
+		}
+		slice := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := scalar.ParseValue(slice.Index(i), fmt.Sprint(item)); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	if _, ok := raw.([]any); ok {
+		return fmt.Errorf("expected a single value, got a list")
+	}
+	if _, ok := raw.(map[string]any); ok {
+		return fmt.Errorf("expected a single value, got a mapping")
+	}
+	return scalar.ParseValue(field, fmt.Sprint(raw))
+}
+
+// optionFields maps the long flag name of every option of t to the index of its field
+func optionFields(t reflect.Type) map[string][]int {
+	flags, _ := commandLine(t)
+	fields := make(map[string][]int, len(flags))
+	for _, flag := range flags {
+		fields[flag.long] = flag.index
+	}
+	return fields
+}
+
+// commandFlag describes a command line option
+type commandFlag struct {
+	long       string
+	short      string
+	env        string
+	help       string
+	takesValue bool
+	index      []int
+}
+
+// names returns the spellings of the flag on the command line
+func (f commandFlag) names() []string {
+	names := []string{"--" + f.long}
+	if f.short != "" {
+		names = append(names, "-"+f.short)
+	}
+	return names
+}
+
+// commandLine lists the options and subcommands of t, following the same naming rules as the
+// command line parser
+func commandLine(t reflect.Type) (flags []commandFlag, subcommands []string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("arg")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		flag := commandFlag{
+			long:       strings.ToLower(field.Name),
+			help:       field.Tag.Get("help"),
+			takesValue: field.Type.Kind() != reflect.Bool,
+			index:      field.Index,
+		}
+		positional := false
+		for _, part := range strings.Split(tag, ",") {
+			switch {
+			case strings.HasPrefix(part, "subcommand:"):
+				subcommands = append(subcommands, strings.TrimPrefix(part, "subcommand:"))
+				positional = true
+			case part == "positional":
+				positional = true
+			case strings.HasPrefix(part, "--"):
+				flag.long = part[2:]
+			case strings.HasPrefix(part, "-"):
+				flag.short = part[1:]
+			case strings.HasPrefix(part, "env:"):
+				flag.env = strings.TrimPrefix(part, "env:")
+			}
+		}
+		if !positional {
+			flags = append(flags, flag)
+		}
+	}
+	return flags, subcommands
+}
+
+// showConfig writes the options resolved from flags, env vars, the config file and defaults as
+// yaml, annotated with where each value comes from. Options left unset are omitted, and secrets
+// are masked
+func showConfig(writer io.Writer, resolved args, cfg config, origin configOrigin, argv []string) error {
+	if origin.Path == "" {
+		fmt.Fprintf(writer, "# config file: none\n")
+	} else if origin.Profile == "" {
+		fmt.Fprintf(writer, "# config file: %s\n", origin.Path)
+	} else {
+		fmt.Fprintf(writer, "# config file: %s, profile %s\n", origin.Path, origin.Profile)
+	}
+
+	onCommandLine := map[string]bool{}
+	for _, arg := range argv {
+		if arg == "--" {
+			break
+		}
+		name, _, _ := strings.Cut(arg, "=")
+		onCommandLine[name] = true
+	}
+
+	flags, _ := commandLine(reflect.TypeOf(resolved))
+	value := reflect.ValueOf(resolved)
+	for _, flag := range flags {
+		if flag.long == "config" || flag.long == "profile" {
+			continue
+		}
+		field := value.FieldByIndex(flag.index)
+		var source string
+		_, fromEnv := os.LookupEnv(flag.env)
+		_, fromConfig := cfg[flag.long]
+		switch {
+		case onCommandLine["--"+flag.long] || (flag.short != "" && onCommandLine["-"+flag.short]):
+			source = "flag"
+		case flag.env != "" && fromEnv:
+			source = "env " + flag.env
+		case fromConfig:
+			source = "config file"
+		default:
+			source = "default"
+		}
+		if field.IsZero() && source == "default" {
+			continue
+		}
+
+		var shown any = field.Interface()
+		if stringer, ok := shown.(fmt.Stringer); ok {
+			shown = stringer.String()
+		}
+		if s, ok := shown.(string); ok {
+			if secretOptions[flag.long] && s != "" {
+				shown = "********"
+			} else if u, err := url.Parse(s); err == nil && u.User != nil {
+				shown = u.Redacted()
+			}
+		}
+		var node yaml.Node
+		if err := node.Encode(shown); err != nil {
+			return err
+		}
+		if node.Kind == yaml.SequenceNode || node.Kind == yaml.MappingNode {
+			node.Style = yaml.FlowStyle
+		}
+		out, err := yaml.Marshal(&node)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(writer, "%s: %s  # %s\n", flag.long, strings.TrimSpace(string(out)), source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/alexflint/go-arg"
+)
+
+// parseWithConfig parses argv the way main does, over the options of the config file it selects
+func parseWithConfig(t *testing.T, argv []string) args {
+	t.Helper()
+	var args args
+	cfg, _, err := loadConfig(argv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.applyDefaults(&args); err != nil {
+		t.Fatal(err)
+	}
+	parser, err := arg.NewParser(arg.Config{}, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parser.Parse(argv); err != nil {
+		t.Fatalf("failed to parse %v: %v", argv, err)
+	}
+	if err := cfg.applyRest(&args); err != nil {
+		t.Fatal(err)
+	}
+	return args
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := "index: config-index\npassword: config-secret\nrename:\n  - _id=doc_id\n  - _source.a=b\n"
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		argv     []string
+		env      map[string]string
+		index    string
+		rename   []string
+		password string
+	}{
+		{
+			name:     "config file",
+			index:    "config-index",
+			rename:   []string{"_id=doc_id", "_source.a=b"},
+			password: "config-secret",
+		},
+		{
+			name:     "env over config file",
+			env:      map[string]string{"ES_INDEX": "env-index", "ESFETCHER_RENAME": "_id=id", "ES_PASSWD": "env-secret"},
+			index:    "env-index",
+			rename:   []string{"_id=id"},
+			password: "env-secret",
+		},
+		{
+			// the parser adds the values of repeated flags to the ones of their env var, so the
+			// env var of the list is left unset
+			name:     "flags over env",
+			argv:     []string{"--index", "flag-index", "--rename", "_id=key", "--rename", "x=y", "--password", "flag-secret"},
+			env:      map[string]string{"ES_INDEX": "env-index", "ES_PASSWD": "env-secret"},
+			index:    "flag-index",
+			rename:   []string{"_id=key", "x=y"},
+			password: "flag-secret",
+		},
+		{
+			name:     "flag for the list only",
+			argv:     []string{"--rename=_id=key"},
+			index:    "config-index",
+			rename:   []string{"_id=key"},
+			password: "config-secret",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"ES_INDEX", "ESFETCHER_RENAME", "ES_PASSWD", "ESFETCHER_CONFIG", "ESFETCHER_PROFILE"} {
+				t.Setenv(name, test.env[name])
+				if _, ok := test.env[name]; !ok {
+					os.Unsetenv(name)
+				}
+			}
+			args := parseWithConfig(t, append([]string{"--config", path}, test.argv...))
+			if args.Index != test.index {
+				t.Errorf("got index %q, want %q", args.Index, test.index)
+			}
+			if !slices.Equal(args.Rename, test.rename) {
+				t.Errorf("got rename %q, want %q", args.Rename, test.rename)
+			}
+			if args.Password != test.password {
+				t.Errorf("got password %q, want %q", args.Password, test.password)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// csvEncoder writes hits as csv rows, one column per field, given as dotted paths into the hit
+// as _source.user.name. Objects are flattened to their fields, arrays are written as json
+type csvEncoder struct {
+	// columns of the output, in order. Taken from the fields of the first hit when empty
+	columns []string
+	// written instead of the value of missing and null fields
+	missing string
+	// fail on fields of the document that are not columns, instead of dropping them
+	strict bool
+	// columns of the mapping of the index by path, added to the columns taken from the first hit.
+	// Fields without a scalar type are written whole as json
+	types map[string]csvColumn
+	// convert the values of the columns of types to their mapped type, instead of writing them
+	// as found in the documents
+	convert bool
+
+	wroteHeader bool
+	dropped     map[string]bool
+}
+
+func newCSVEncoder(columns []string, missing string, strict bool) *csvEncoder {
+	return &csvEncoder{columns: columns, missing: missing, strict: strict, dropped: map[string]bool{}}
+}
+
+func (e *csvEncoder) encode(buf *bytes.Buffer, hit json.RawMessage) error {
+	decoder := json.NewDecoder(bytes.NewReader(hit))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("failed to decode hit: %w", err)
+	}
+	fields := map[string]string{}
+	flattenFields(fields, "", doc, e.types, e.convert)
+
+	if len(e.columns) == 0 {
+		// the fields of the mapping, as the first hit may lack some, and the metadata and fields
+		// not in the mapping of the first hit
+		for field := range e.types {
+			e.columns = append(e.columns, field)
+		}
+		for field := range fields {
+			if _, ok := e.types[field]; !ok {
+				e.columns = append(e.columns, field)
+			}
+		}
+		sort.Strings(e.columns)
+	}
+
+	// only the fields of the document are checked, the metadata of the hit, as _index or
+	// _score, is left out silently when not a column
+	for field := range fields {
+		if !strings.HasPrefix(field, "_source.") || slices.Contains(e.columns, field) {
+			continue
+		}
+		if e.strict {
+			return fmt.Errorf("unexpected field %s, not one of the --columns", field)
+		}
+		if !e.dropped[field] {
+			e.dropped[field] = true
+			slog.Warn(fmt.Sprintf("Dropping field %s from the csv output, as it is not one of the columns", field), "event", "csv_field_dropped", "field", field)
+		}
+	}
+
+	// nothing is written until the hit is known to fit, so a hit left out by --on-doc-error
+	// leaves no partial row
+	w := csv.NewWriter(buf)
+	if !e.wroteHeader {
+		if err := w.Write(e.columns); err != nil {
+			return fmt.Errorf("failed to write csv header: %w", err)
+		}
+		e.wroteHeader = true
+	}
+	row := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		value, ok := fields[column]
+		if !ok {
+			value = e.missing
+		}
+		row[i] = value
+	}
+	if err := w.Write(row); err != nil {
+		return fmt.Errorf("failed to write csv row: %w", err)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// flattenFields sets the leaf fields of value in fields, keyed by their dotted path under prefix.
+// Null fields are left out, as missing ones. The fields of types are written whole as json when
+// they have no scalar type, and converted to their type when convert is set
+func flattenFields(fields map[string]string, prefix string, value any, types map[string]csvColumn, convert bool) {
+	if column, ok := types[prefix]; ok && value != nil {
+		if convert {
+			value = column.value(value)
+		}
+		if column.kind == "json" {
+			data, _ := json.Marshal(value)
+			fields[prefix] = string(data)
+			return
+		}
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenFields(fields, key, child, types, convert)
+		}
+	case nil:
+	case string:
+		fields[prefix] = v
+	case json.Number:
+		fields[prefix] = v.String()
+	case bool:
+		fields[prefix] = fmt.Sprint(v)
+	default:
+		data, _ := json.Marshal(v)
+		fields[prefix] = string(data)
+	}
+}
+
+// splitList splits comma separated flag values, as --columns
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
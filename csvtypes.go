@@ -0,0 +1,175 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumn is how the values of a _source field of the mapping are written to the csv output:
+// as integers, floats, booleans, rfc3339 dates in UTC, text, or a single json value for fields
+// without a scalar type, as geo_point, flattened or nested
+type csvColumn struct {
+	kind    string
+	formats []string
+}
+
+// csvKinds are the csv column kinds of the field types of Elasticsearch mappings. Any other type
+// is written as json
+var csvKinds = map[string]string{
+	"text":               "string",
+	"keyword":            "string",
+	"constant_keyword":   "string",
+	"wildcard":           "string",
+	"match_only_text":    "string",
+	"search_as_you_type": "string",
+	"ip":                 "string",
+	"version":            "string",
+	"binary":             "string",
+	"long":               "integer",
+	"integer":            "integer",
+	"short":              "integer",
+	"byte":               "integer",
+	"unsigned_long":      "integer",
+	"double":             "float",
+	"float":              "float",
+	"half_float":         "float",
+	"scaled_float":       "float",
+	"boolean":            "boolean",
+	"date":               "date",
+	"date_nanos":         "date",
+}
+
+// csvColumns returns the columns of the _source fields of the mappings of the indices matching
+// index, by their dotted path into the hit. Multi-fields are not columns, as they are not in the
+// _source. A field mapped to different types in different indices is written as text, or as a
+// float when they are all numbers
+func (c *Client) csvColumns(ctx context.Context, index string) (map[string]csvColumn, error) {
+	mappings, err := c.mappingProperties(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]csvColumn{}
+	conflicts := map[string]bool{}
+	for _, properties := range mappings {
+		collectCSVColumns(columns, conflicts, "_source.", properties)
+	}
+	paths := make([]string, 0, len(conflicts))
+	for path := range conflicts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		slog.Warn(
+			fmt.Sprintf("Field %s has different types in the mappings of %s, treating it as %s", path, index, columns[path].kind),
+			"event", "csv_type_conflict", "field", path, "kind", columns[path].kind,
+		)
+	}
+	return columns, nil
+}
+
+func collectCSVColumns(columns map[string]csvColumn, conflicts map[string]bool, prefix string, properties map[string]any) {
+	for name, def := range properties {
+		def, ok := def.(map[string]any)
+		if !ok {
+			continue
+		}
+		path := prefix + name
+		kind, _ := def["type"].(string)
+		children, hasChildren := def["properties"].(map[string]any)
+		if hasChildren && (kind == "" || kind == "object") {
+			collectCSVColumns(columns, conflicts, path+".", children)
+			continue
+		}
+		if kind == "alias" {
+			// aliases are not in the _source
+			continue
+		}
+
+		column := csvColumn{kind: cmp.Or(csvKinds[kind], "json")}
+		if column.kind == "date" {
+			format, _ := def["format"].(string)
+			column.formats = strings.Split(cmp.Or(format, "strict_date_optional_time||epoch_millis"), "||")
+		}
+		existing, ok := columns[path]
+		switch {
+		case !ok:
+		case existing.kind == column.kind:
+			for _, format := range existing.formats {
+				if !slices.Contains(column.formats, format) {
+					column.formats = append(column.formats, format)
+				}
+			}
+			slices.Sort(column.formats)
+		case isNumericKind(existing.kind) && isNumericKind(column.kind):
+			column = csvColumn{kind: "float"}
+			conflicts[path] = true
+		default:
+			column = csvColumn{kind: "string"}
+			conflicts[path] = true
+		}
+		columns[path] = column
+	}
+}
+
+func isNumericKind(kind string) bool {
+	return kind == "integer" || kind == "float"
+}
+
+// value returns the value of a field of the column converted to its kind, as Elasticsearch
+// indexes it: integers written as 1.0, 1e3 or "42" become 1, 1000 and 42, fractions are
+// truncated, "true" becomes true, and dates are rewritten to rfc3339 in UTC. Values that can't be
+// converted are left as they are. Arrays have every element converted
+func (col csvColumn) value(value any) any {
+	if values, ok := value.([]any); ok {
+		converted := make([]any, len(values))
+		for i, v := range values {
+			converted[i] = col.value(v)
+		}
+		return converted
+	}
+
+	text := ""
+	switch v := value.(type) {
+	case json.Number:
+		text = v.String()
+	case string:
+		text = strings.TrimSpace(v)
+	case bool:
+		text = strconv.FormatBool(v)
+	default:
+		return value
+	}
+	switch col.kind {
+	case "integer":
+		if n, _, err := big.ParseFloat(text, 10, 256, big.ToZero); err == nil && !n.IsInf() {
+			i, _ := n.Int(nil)
+			return json.Number(i.String())
+		}
+	case "float":
+		if _, err := strconv.ParseFloat(text, 64); err == nil && json.Valid([]byte(text)) {
+			return json.Number(text)
+		}
+	case "boolean":
+		if text == "true" || text == "false" {
+			return text == "true"
+		}
+	case "date":
+		if t, ok := parseDate(value, col.formats); ok {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return text
+		}
+	}
+	return value
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dateFormats are the formats --normalize-dates rewrites dates to
+var dateFormats = []string{"rfc3339", "epoch_millis"}
+
+// dateField is a date field of the mapping of the index, with the formats it accepts
+type dateField struct {
+	path    string
+	formats []string
+}
+
+// mappingProperties returns the properties of the mappings of the indices matching index, one
+// per index
+func (c *Client) mappingProperties(ctx context.Context, index string) ([]map[string]any, error) {
+	_, data, err := c.do(ctx, "GET", index+"/_mapping", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the mapping of %s: %w", index, err)
+	}
+	var result map[string]struct {
+		Mappings map[string]any `json:"mappings"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the mapping of %s: %w", index, err)
+	}
+	all := make([]map[string]any, 0, len(result))
+	for _, mapping := range result {
+		properties, ok := mapping.Mappings["properties"].(map[string]any)
+		if !ok {
+			// indices of 6.x and older have their properties under the mapping type
+			for _, typeMapping := range mapping.Mappings {
+				if typeMapping, ok := typeMapping.(map[string]any); ok {
+					properties, _ = typeMapping["properties"].(map[string]any)
+				}
+			}
+		}
+		all = append(all, properties)
+	}
+	return all, nil
+}
+
+// dateFields returns the date and date_nanos fields of the mappings of the indices matching
+// index, by their dotted path in the documents
+func (c *Client) dateFields(ctx context.Context, index string) ([]dateField, error) {
+	mappings, err := c.mappingProperties(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	formats := map[string][]string{}
+	for _, properties := range mappings {
+		collectDateFields(formats, "", properties)
+	}
+
+	fields := make([]dateField, 0, len(formats))
+	for path, pathFormats := range formats {
+		fields = append(fields, dateField{path: path, formats: pathFormats})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].path < fields[j].path })
+	return fields, nil
+}
+
+// collectDateFields adds the formats of the date fields of properties to formats, in the order
+// of the mapping, which is the order Elasticsearch tries them in
+func collectDateFields(formats map[string][]string, prefix string, properties map[string]any) {
+	for name, def := range properties {
+		def, ok := def.(map[string]any)
+		if !ok {
+			continue
+		}
+		path := prefix + name
+		if children, ok := def["properties"].(map[string]any); ok {
+			collectDateFields(formats, path+".", children)
+			continue
+		}
+		if kind, _ := def["type"].(string); kind != "date" && kind != "date_nanos" {
+			continue
+		}
+		format, _ := def["format"].(string)
+		if format == "" {
+			format = "strict_date_optional_time||epoch_millis"
+		}
+		for _, f := range strings.Split(format, "||") {
+			if !slices.Contains(formats[path], f) {
+				formats[path] = append(formats[path], f)
+			}
+		}
+	}
+}
+
+// dateTransform returns a transform rewriting the date fields of the documents, as found in the
+// mapping of the index, to the given format. Values that can't be parsed are left as they are,
+// with a warning the first time for each field
+func (c *Client) dateTransform(ctx context.Context, index string, format string) (hitTransform, error) {
+	switch format {
+	case "rfc3339", "epoch_millis":
+	default:
+		return nil, fmt.Errorf("invalid --normalize-dates %q, expected one of %s", format, strings.Join(dateFormats, ", "))
+	}
+	fields, err := c.dateFields(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug(fmt.Sprintf("Normalizing %d date fields to %s", len(fields), format), "event", "date_fields", "fields", len(fields))
+
+	var warnedLock sync.Mutex
+	warned := map[string]bool{}
+	normalize := func(field dateField, value any) any {
+		t, ok := parseDate(value, field.formats)
+		if !ok {
+			warnedLock.Lock()
+			defer warnedLock.Unlock()
+			if !warned[field.path] {
+				warned[field.path] = true
+				slog.Warn(
+					fmt.Sprintf("Could not parse %v of date field %s, leaving it as is", value, field.path),
+					"event", "date_unparsed", "field", field.path,
+				)
+			}
+			return value
+		}
+		if format == "epoch_millis" {
+			return json.Number(strconv.FormatInt(t.UnixMilli(), 10))
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+
+	return func(hit map[string]any) error {
+		source, ok := hit["_source"].(map[string]any)
+		if !ok {
+			return nil
+		}
+		for _, field := range fields {
+			updatePath(source, field.path, func(value any) any {
+				if values, ok := value.([]any); ok {
+					for i, v := range values {
+						values[i] = normalize(field, v)
+					}
+					return values
+				}
+				return normalize(field, value)
+			})
+		}
+		return nil
+	}, nil
+}
+
+// parseDate parses a date value of a document with the formats of its mapping, tried in order.
+// Dates without a time zone are in UTC, as Elasticsearch assumes
+func parseDate(value any, formats []string) (time.Time, bool) {
+	var text string
+	switch v := value.(type) {
+	case nil:
+		return time.Time{}, false
+	case json.Number:
+		text = v.String()
+	case string:
+		text = v
+	default:
+		return time.Time{}, false
+	}
+
+	for _, format := range formats {
+		if format == "epoch_millis" || format == "epoch_second" {
+			millis, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				continue
+			}
+			if format == "epoch_second" {
+				millis *= 1000
+			}
+			return time.UnixMicro(int64(millis * 1000)), true
+		}
+		layouts := isoDateLayouts
+		if layout, ok := javaDateLayout(format); ok {
+			layouts = []string{layout}
+		}
+		for _, layout := range layouts {
+			if t, err := time.ParseInLocation(layout, text, time.UTC); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// defaultDateFormats are the formats of date fields without one in their mapping, to parse the
+// dates of documents which mapping is unknown
+var defaultDateFormats = []string{"strict_date_optional_time", "epoch_millis"}
+
+// isoDateLayouts are the layouts of the ISO 8601 based built in formats of Elasticsearch, as
+// strict_date_optional_time and date_time
+var isoDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02T15",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// javaDateLayout converts a custom Java date pattern of a mapping, as yyyy/MM/dd HH:mm:ss, to a
+// Go layout. Built in format names and patterns using unsupported letters are not converted
+func javaDateLayout(pattern string) (string, bool) {
+	replacements := []struct{ java, layout string }{
+		{"yyyy", "2006"}, {"uuuu", "2006"}, {"yy", "06"},
+		{"MMMM", "January"}, {"MMM", "Jan"}, {"MM", "01"},
+		{"dd", "02"}, {"HH", "15"}, {"hh", "03"}, {"mm", "04"}, {"ss", "05"},
+		{"SSSSSSSSS", "000000000"}, {"SSSSSS", "000000"}, {"SSS", "000"},
+		{"EEEE", "Monday"}, {"EEE", "Mon"}, {"a", "PM"},
+		{"XXX", "Z07:00"}, {"XX", "Z0700"}, {"Z", "-0700"},
+	}
+	var b strings.Builder
+	for i := 0; i < len(pattern); {
+		r := pattern[i]
+		switch {
+		case r == '\'':
+			end := strings.IndexByte(pattern[i+1:], '\'')
+			if end < 0 {
+				return "", false
+			}
+			b.WriteString(pattern[i+1 : i+1+end])
+			i += end + 2
+			continue
+		case (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			matched := false
+			for _, rep := range replacements {
+				if strings.HasPrefix(pattern[i:], rep.java) {
+					b.WriteString(rep.layout)
+					i += len(rep.java)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return "", false
+			}
+			continue
+		}
+		b.WriteByte(r)
+		i++
+	}
+	return b.String(), true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// dialFunc is the signature of the DialContext of http.Transport
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// newDialer returns a dial function connecting to the addresses given by resolve, curl style
+// HOST:PORT:ADDRESS overrides, instead of what their host resolves to, and resolving the other
+// hosts with dnsServer, when set, instead of the system resolver. TLS still verifies the
+// certificate against the host of the URL. With an ipVersion of 4 or 6 only addresses of that
+// family are connected to, so a broken IPv6 route doesn't stall every connection. TCP keep-alive
+// probes are sent every keepAlive, disabled when negative
+func newDialer(resolve []string, dnsServer string, ipVersion string, keepAlive time.Duration) (dialFunc, error) {
+	var family string
+	switch ipVersion {
+	case "auto", "":
+	case "4", "6":
+		family = ipVersion
+	default:
+		return nil, fmt.Errorf("invalid --ip-version %q, expected 4, 6 or auto", ipVersion)
+	}
+
+	overrides := map[string]string{}
+	for _, spec := range resolve {
+		hostPort, address, err := parseResolve(spec)
+		if err != nil {
+			return nil, err
+		}
+		overrides[hostPort] = address
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: keepAlive}
+	if dnsServer != "" {
+		if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+			dnsServer = net.JoinHostPort(dnsServer, "53")
+		}
+		dnsDialer := &net.Dialer{Timeout: 5 * time.Second}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dnsDialer.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if override, ok := overrides[strings.ToLower(address)]; ok {
+			slog.DebugContext(ctx, fmt.Sprintf("Connecting to %s instead of %s", override, address), "event", "resolve_override", "address", address, "override", override)
+			address = override
+		}
+		if network == "tcp" {
+			network += family
+		}
+		return dialer.DialContext(ctx, network, address)
+	}, nil
+}
+
+// parseResolve parses a --resolve HOST:PORT:ADDRESS spec, where an IPv6 ADDRESS can be written
+// in brackets, into the host and port it overrides and the address to connect to instead
+func parseResolve(spec string) (hostPort string, address string, err error) {
+	invalid := fmt.Errorf("invalid --resolve %q, expected HOST:PORT:ADDRESS, e.g. es.internal:9200:10.1.2.3", spec)
+	host, rest, ok := strings.Cut(spec, ":")
+	if !ok || host == "" {
+		return "", "", invalid
+	}
+	port, ip, ok := strings.Cut(rest, ":")
+	if !ok || port == "" {
+		return "", "", invalid
+	}
+	ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if net.ParseIP(ip) == nil {
+		return "", "", invalid
+	}
+	return strings.ToLower(net.JoinHostPort(host, port)), net.JoinHostPort(ip, port), nil
+}
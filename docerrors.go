@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// docErrorPolicies are what --on-doc-error can do with a hit that fails to be transformed or
+// encoded
+var docErrorPolicies = []string{"fail", "skip", "route"}
+
+// docError is a line of the --doc-errors file: a hit that failed, with the reason, and the hit
+// itself when routed
+type docError struct {
+	Index string          `json:"_index,omitempty"`
+	ID    string          `json:"_id"`
+	Error string          `json:"error"`
+	Hit   json.RawMessage `json:"hit,omitempty"`
+}
+
+// docErrorLog applies --on-doc-error to the hits that fail, recording them in the --doc-errors
+// file if any. A nil log fails the export on the first bad hit
+type docErrorLog struct {
+	policy string
+
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	failed atomic.Int64
+}
+
+// newDocErrorLog returns the log of the documents that fail, creating the file at path if set
+func newDocErrorLog(policy string, path string) (*docErrorLog, error) {
+	if !slices.Contains(docErrorPolicies, policy) {
+		return nil, fmt.Errorf("invalid --on-doc-error %q, expected one of %s", policy, strings.Join(docErrorPolicies, ", "))
+	}
+	switch {
+	case policy == "route" && path == "":
+		return nil, fmt.Errorf("--on-doc-error route needs --doc-errors, the file bad documents are routed to")
+	case policy == "fail" && path != "":
+		return nil, fmt.Errorf("--doc-errors needs --on-doc-error skip or route, documents failing the export are not recorded")
+	case policy == "fail":
+		return nil, nil
+	}
+	l := &docErrorLog{policy: policy, path: path}
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create doc errors file %s: %w", path, err)
+		}
+		l.file = file
+	}
+	return l, nil
+}
+
+// handle deals with a hit that failed with err: the error is returned when failing the export,
+// otherwise the hit is recorded and nil returned, for the hit to be left out of the output
+func (l *docErrorLog) handle(hit json.RawMessage, err error) error {
+	if l == nil {
+		return err
+	}
+	var meta struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	}
+	json.Unmarshal(hit, &meta)
+	metrics.recordError("doc_error")
+	if l.failed.Add(1) == 1 {
+		slog.Warn(
+			fmt.Sprintf("Leaving out document %s, which failed: %v. Further failed documents are only logged at debug level", meta.ID, err),
+			"event", "doc_error", "id", meta.ID, "error", err,
+		)
+	} else {
+		slog.Debug(fmt.Sprintf("Leaving out document %s, which failed: %v", meta.ID, err), "event", "doc_error", "id", meta.ID, "error", err)
+	}
+	if l.file == nil {
+		return nil
+	}
+
+	record := docError{Index: meta.Index, ID: meta.ID, Error: err.Error()}
+	if l.policy == "route" && json.Valid(hit) {
+		record.Hit = hit
+	}
+	line, _ := json.Marshal(record)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write doc errors file %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Close closes the --doc-errors file, logging how many documents failed
+func (l *docErrorLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	if failed := l.failed.Load(); failed > 0 {
+		where := ""
+		if l.file != nil {
+			where = ", recorded in " + l.path
+		}
+		slog.Warn(fmt.Sprintf("%d documents failed and were left out%s", failed, where), "event", "doc_errors", "docs", failed)
+	}
+	if l.file == nil {
+		return nil
+	}
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to write doc errors file %s: %w", l.path, err)
+	}
+	return nil
+}
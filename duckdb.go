@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// duckDBBatchBytes is how many bytes of rows are buffered before they are loaded, by default
+const duckDBBatchBytes = 64 * 1024 * 1024
+
+// duckDBSink appends the hits to a table of a DuckDB database file, through the duckdb command
+// line client, so esfetcher doesn't need to be built with the DuckDB library. Running the client
+// costs a process and a transaction, so the rows of the pages are buffered in a temporary json
+// lines file and loaded in batches of the batch parameter of the URL, 64MB by default, and on
+// Close. With --journal every page is loaded as it comes instead, as the journal records the
+// documents of a page as delivered once it is written. The rows are the fields of the _source of
+// the hits, along with their _index and _id, and their columns and types are inferred by DuckDB:
+// the table is created from the first batch, when missing, and the columns of fields appearing in
+// later batches are added as they appear
+type duckDBSink struct {
+	cli        string
+	path       string
+	table      string
+	batchBytes int64
+
+	// the columns of the table, nil until it exists
+	columns map[string]bool
+
+	// the rows buffered since the last load, nil when there are none, and their fields
+	batch       *os.File
+	batchSize   int64
+	batchFields map[string]bool
+}
+
+// newDuckDBSink opens the sink of a duckdb://FILE URL, which table parameter names the table,
+// docs by default, and batch parameter how many bytes of rows are loaded at once
+func newDuckDBSink(u *url.URL) (*duckDBSink, error) {
+	path := u.Host + u.Path
+	if u.Opaque != "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return nil, fmt.Errorf("invalid --output %q, expected duckdb://FILE", u.String())
+	}
+	query := u.Query()
+	batchBytes := int64(duckDBBatchBytes)
+	if batch := query.Get("batch"); batch != "" {
+		var err error
+		if batchBytes, err = parseByteSize(batch); err != nil || batchBytes == 0 {
+			return nil, fmt.Errorf("invalid batch %q of --output, expected a size, e.g. 64MB", batch)
+		}
+	}
+	cli, err := exec.LookPath("duckdb")
+	if err != nil {
+		return nil, fmt.Errorf("--output duckdb:// needs the duckdb command line client in the PATH: %w", err)
+	}
+	s := &duckDBSink{cli: cli, path: path, table: cmp.Or(query.Get("table"), "docs"), batchBytes: batchBytes}
+	if err := s.checkVersion(); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.query(fmt.Sprintf(
+		"SELECT column_name FROM information_schema.columns WHERE table_schema = 'main' AND table_name = %s;",
+		duckDBString(s.table),
+	))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if s.columns == nil {
+			s.columns = map[string]bool{}
+		}
+		name, _ := row["column_name"].(string)
+		s.columns[strings.ToLower(name)] = true
+	}
+	return s, nil
+}
+
+// checkVersion fails for clients older than DuckDB 1.0, the first version with a stable
+// database file format, and the one the statements of the sink are written for
+func (s *duckDBSink) checkVersion() error {
+	out, err := exec.Command(s.cli, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("failed to run %s --version: %w", s.cli, err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "v") {
+		return fmt.Errorf("unexpected version %q of %s, --output duckdb:// needs DuckDB 1.0 or later", strings.TrimSpace(string(out)), s.cli)
+	}
+	if !parseClusterVersion(strings.TrimPrefix(fields[0], "v")).atLeast(1, 0) {
+		return fmt.Errorf("--output duckdb:// needs DuckDB 1.0 or later, %s is %s", s.cli, fields[0])
+	}
+	return nil
+}
+
+// write adds the rows of the hits to the batch, loading it once it is large enough
+func (s *duckDBSink) write(hits []json.RawMessage) error {
+	if len(hits) == 0 {
+		return nil
+	}
+	var page bytes.Buffer
+	fields := map[string]bool{}
+	for _, hit := range hits {
+		row, err := duckDBRow(hit)
+		if err != nil {
+			return err
+		}
+		for field := range row {
+			fields[field] = true
+		}
+		data, err := json.Marshal(row)
+		if err != nil {
+			return fmt.Errorf("failed to encode row: %w", err)
+		}
+		page.Write(data)
+		page.WriteByte('\n')
+	}
+
+	if s.batch == nil {
+		file, err := os.CreateTemp("", "esfetcher-*.jsonl")
+		if err != nil {
+			return fmt.Errorf("failed to write to DuckDB: %w", err)
+		}
+		s.batch, s.batchSize, s.batchFields = file, 0, map[string]bool{}
+	}
+	if _, err := s.batch.Write(page.Bytes()); err != nil {
+		s.batch.Close()
+		os.Remove(s.batch.Name())
+		s.batch = nil
+		return fmt.Errorf("failed to write to DuckDB: %w", err)
+	}
+	s.batchSize += int64(page.Len())
+	for field := range fields {
+		s.batchFields[field] = true
+	}
+	if s.batchSize < s.batchBytes {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush loads the rows of the batch in a transaction, adding the columns of the fields the table
+// doesn't have yet. The batch is dropped whether it is loaded or not
+func (s *duckDBSink) flush() error {
+	if s.batch == nil {
+		return nil
+	}
+	file, fields := s.batch, s.batchFields
+	s.batch, s.batchSize, s.batchFields = nil, 0, nil
+	defer os.Remove(file.Name())
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write to DuckDB: %w", err)
+	}
+
+	read := fmt.Sprintf("read_json_auto(%s, format = 'newline_delimited', sample_size = -1)", duckDBString(file.Name()))
+	table := duckDBIdentifier(s.table)
+	var script strings.Builder
+	script.WriteString("BEGIN;\n")
+	if s.columns == nil {
+		fmt.Fprintf(&script, "CREATE TABLE %s AS SELECT * FROM %s;\n", table, read)
+	} else {
+		var added []string
+		for field := range fields {
+			if !s.columns[strings.ToLower(field)] {
+				added = append(added, field)
+			}
+		}
+		if len(added) > 0 {
+			sort.Strings(added)
+			types, err := s.columnTypes(read, added)
+			if err != nil {
+				return err
+			}
+			for _, field := range added {
+				// fields only holding nulls so far have no type yet
+				if kind := types[field]; kind == "" || kind == "NULL" {
+					types[field] = "VARCHAR"
+				}
+				fmt.Fprintf(&script, "ALTER TABLE %s ADD COLUMN %s %s;\n", table, duckDBIdentifier(field), types[field])
+			}
+		}
+		fmt.Fprintf(&script, "INSERT INTO %s BY NAME SELECT * FROM %s;\n", table, read)
+	}
+	script.WriteString("COMMIT;\n")
+	if err := s.run(script.String(), nil); err != nil {
+		return err
+	}
+
+	if s.columns == nil {
+		s.columns = map[string]bool{}
+	}
+	for field := range fields {
+		s.columns[strings.ToLower(field)] = true
+	}
+	return nil
+}
+
+// Close loads the rows still in the batch
+func (s *duckDBSink) Close() error {
+	return s.flush()
+}
+
+// columnTypes returns the types DuckDB infers for some columns of a json lines file
+func (s *duckDBSink) columnTypes(read string, columns []string) (map[string]string, error) {
+	selected := make([]string, len(columns))
+	for i, column := range columns {
+		selected[i] = duckDBIdentifier(column)
+	}
+	rows, err := s.query(fmt.Sprintf("DESCRIBE SELECT %s FROM %s;", strings.Join(selected, ", "), read))
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]string{}
+	for _, row := range rows {
+		name, _ := row["column_name"].(string)
+		kind, _ := row["column_type"].(string)
+		types[name] = kind
+	}
+	return types, nil
+}
+
+// query runs a query with the duckdb client, returning its rows
+func (s *duckDBSink) query(sql string) ([]map[string]any, error) {
+	var out bytes.Buffer
+	if err := s.run(sql, &out); err != nil {
+		return nil, err
+	}
+	var rows []map[string]any
+	if len(bytes.TrimSpace(out.Bytes())) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		return nil, fmt.Errorf("failed to parse the output of duckdb: %w", err)
+	}
+	return rows, nil
+}
+
+// run runs a script of statements with the duckdb client on the database, writing the results
+// of queries to out as json. The script stops at the first error
+func (s *duckDBSink) run(script string, out *bytes.Buffer) error {
+	args := []string{"-bail", "-batch"}
+	if out != nil {
+		args = append(args, "-json")
+	}
+	cmd := exec.Command(s.cli, append(args, s.path)...)
+	cmd.Stdin = strings.NewReader(script)
+	if out != nil {
+		cmd.Stdout = out
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("failed to write to DuckDB database %s: %s", s.path, msg)
+		}
+		return fmt.Errorf("failed to write to DuckDB database %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// duckDBRow returns the row of a hit: the fields of its _source, and its _index and _id
+func duckDBRow(hit json.RawMessage) (map[string]any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(hit))
+	decoder.UseNumber()
+	var doc struct {
+		Index  string         `json:"_index"`
+		ID     string         `json:"_id"`
+		Source map[string]any `json:"_source"`
+	}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode hit: %w", err)
+	}
+	row := map[string]any{"_index": doc.Index, "_id": doc.ID}
+	for field, value := range doc.Source {
+		row[field] = value
+	}
+	return row, nil
+}
+
+// duckDBIdentifier quotes an identifier, as a table or column name, for DuckDB
+func duckDBIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// duckDBString quotes a string literal for DuckDB
+func duckDBString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// duckDBTestPages are pages of hits adding columns as they come: c with a type, and d only
+// holding nulls at first
+var duckDBTestPages = [][]json.RawMessage{
+	{
+		json.RawMessage(`{"_index": "i", "_id": "1", "_source": {"a": 1, "b": "x"}}`),
+	},
+	{
+		json.RawMessage(`{"_index": "i", "_id": "2", "_source": {"a": 2, "c": true, "d": null}}`),
+	},
+	{
+		json.RawMessage(`{"_index": "i", "_id": "3", "_source": {"d": "later"}}`),
+	},
+}
+
+func openDuckDBTestSink(t *testing.T, output string) *duckDBSink {
+	t.Helper()
+	u, err := url.Parse(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newDuckDBSink(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDuckDBSink(t *testing.T) {
+	if _, err := exec.LookPath("duckdb"); err != nil {
+		t.Skip("the duckdb command line client is not in the PATH")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	// every page is a batch of its own
+	s := openDuckDBTestSink(t, "duckdb://"+path+"?table=docs&batch=1B")
+	for _, page := range duckDBTestPages {
+		if err := s.write(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	columns, err := s.query("SELECT column_name, data_type FROM information_schema.columns WHERE table_name = 'docs' ORDER BY ordinal_position;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantColumns := []map[string]any{
+		{"column_name": "_id", "data_type": "VARCHAR"},
+		{"column_name": "_index", "data_type": "VARCHAR"},
+		{"column_name": "a", "data_type": "BIGINT"},
+		{"column_name": "b", "data_type": "VARCHAR"},
+		{"column_name": "c", "data_type": "BOOLEAN"},
+		{"column_name": "d", "data_type": "VARCHAR"},
+	}
+	if !reflect.DeepEqual(columns, wantColumns) {
+		t.Errorf("got columns %v, want %v", columns, wantColumns)
+	}
+
+	rows, err := s.query(`SELECT _id, a, c, d FROM docs ORDER BY _id;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRows := []map[string]any{
+		{"_id": "1", "a": float64(1), "c": nil, "d": nil},
+		{"_id": "2", "a": float64(2), "c": true, "d": nil},
+		{"_id": "3", "a": nil, "c": nil, "d": "later"},
+	}
+	if !reflect.DeepEqual(rows, wantRows) {
+		t.Errorf("got rows %v, want %v", rows, wantRows)
+	}
+
+	// the table is appended to by later exports, with the columns it has
+	s = openDuckDBTestSink(t, "duckdb://"+path)
+	if err := s.write(duckDBTestPages[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	count, err := s.query("SELECT count(*) AS n FROM docs;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []map[string]any{{"n": float64(4)}}; !reflect.DeepEqual(count, want) {
+		t.Errorf("got count %v, want %v", count, want)
+	}
+}
+
+// fakeDuckDB puts a duckdb client in the PATH that reports the given version and appends the
+// scripts it runs to the file it returns, each followed by an -- end line
+func fakeDuckDB(t *testing.T, version string) string {
+	t.Helper()
+	dir := t.TempDir()
+	log := filepath.Join(dir, "scripts.log")
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = --version ]; then echo %q; exit; fi\ncat >> %q\necho '\n-- end' >> %q\n", version, log, log)
+	if err := os.WriteFile(filepath.Join(dir, "duckdb"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+// duckDBLoads returns the scripts loading rows the fake client ran
+func duckDBLoads(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loads []string
+	for _, script := range strings.Split(string(data), "-- end\n") {
+		if script = strings.TrimSpace(script); strings.HasPrefix(script, "BEGIN;") {
+			loads = append(loads, script)
+		}
+	}
+	return loads
+}
+
+func TestDuckDBSinkBatches(t *testing.T) {
+	t.Run("loaded on close", func(t *testing.T) {
+		log := fakeDuckDB(t, "v1.1.3 19864453f7")
+		s := openDuckDBTestSink(t, "duckdb://test.db")
+		for _, page := range duckDBTestPages {
+			if err := s.write(page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if loads := duckDBLoads(t, log); len(loads) != 0 {
+			t.Errorf("got %d loads before the batch is full, want none", len(loads))
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		loads := duckDBLoads(t, log)
+		if len(loads) != 1 || !strings.Contains(loads[0], `CREATE TABLE "docs"`) {
+			t.Errorf("got loads %q, want the table created from a single batch", loads)
+		}
+	})
+
+	t.Run("loaded once full", func(t *testing.T) {
+		log := fakeDuckDB(t, "v1.1.3 19864453f7")
+		s := openDuckDBTestSink(t, "duckdb://test.db?batch=1B")
+		for _, page := range duckDBTestPages {
+			if err := s.write(page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		loads := duckDBLoads(t, log)
+		if len(loads) != 3 {
+			t.Fatalf("got %d loads, want one per page", len(loads))
+		}
+		// the fake client infers no type, as DuckDB for fields only holding nulls
+		for _, want := range []string{`ADD COLUMN "c" VARCHAR`, `ADD COLUMN "d" VARCHAR`, `INSERT INTO "docs" BY NAME`} {
+			if !strings.Contains(loads[1], want) {
+				t.Errorf("got second load %q, want %s", loads[1], want)
+			}
+		}
+		if strings.Contains(loads[2], "ADD COLUMN") {
+			t.Errorf("got third load %q, want no column added", loads[2])
+		}
+	})
+
+	t.Run("loaded every page with a journal", func(t *testing.T) {
+		log := fakeDuckDB(t, "v1.1.3 19864453f7")
+		journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Client{Sink: openDuckDBTestSink(t, "duckdb://test.db"), Journal: journal}
+		for _, page := range duckDBTestPages[:2] {
+			if _, err := c.writeSink(page, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if loads := duckDBLoads(t, log); len(loads) != 2 {
+			t.Errorf("got %d loads, want one per page", len(loads))
+		}
+	})
+
+	t.Run("old version", func(t *testing.T) {
+		fakeDuckDB(t, "v0.9.2 3c695d7ba9")
+		_, err := newDuckDBSink(&url.URL{Scheme: "duckdb", Host: "test.db"})
+		if err == nil || !strings.Contains(err.Error(), "needs DuckDB 1.0 or later") {
+			t.Errorf("got error %v, want DuckDB 1.0 to be required", err)
+		}
+	})
+}
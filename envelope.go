@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// envelopeField is a field of the --envelope output records, and the field of the hit it holds
+type envelopeField struct {
+	name   string
+	record string
+	hit    string
+}
+
+// envelopeFields are the fields --envelope can pick, by name
+var envelopeFields = []envelopeField{
+	{name: "index", record: "index", hit: "_index"},
+	{name: "id", record: "id", hit: "_id"},
+	{name: "source", record: "doc", hit: "_source"},
+	{name: "score", record: "score", hit: "_score"},
+	{name: "routing", record: "routing", hit: "_routing"},
+	{name: "version", record: "version", hit: "_version"},
+	{name: "seq_no", record: "seq_no", hit: "_seq_no"},
+	{name: "primary_term", record: "primary_term", hit: "_primary_term"},
+	{name: "sort", record: "sort", hit: "sort"},
+	{name: "fields", record: "fields", hit: "fields"},
+	{name: "highlight", record: "highlight", hit: "highlight"},
+	{name: "inner_hits", record: "inner_hits", hit: "inner_hits"},
+}
+
+// envelopeTransform returns a transform replacing the hits by records of the fields of spec, a
+// comma separated list of envelopeFields names, as index,id,source. Every field of spec is in
+// every record, null when the hit doesn't have it, so consumers get the same schema whatever the
+// version of the cluster and the options of the search
+func envelopeTransform(spec string) (hitTransform, error) {
+	names := make([]string, len(envelopeFields))
+	for i, field := range envelopeFields {
+		names[i] = field.name
+	}
+	var fields []envelopeField
+	for _, name := range splitList(spec) {
+		i := slices.Index(names, name)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --envelope field %q, expected some of %s", name, strings.Join(names, ", "))
+		}
+		fields = append(fields, envelopeFields[i])
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid --envelope %q, expected some of %s", spec, strings.Join(names, ", "))
+	}
+
+	return func(hit map[string]any) error {
+		record := make(map[string]any, len(fields))
+		for _, field := range fields {
+			record[field.record] = hit[field.hit]
+		}
+		clear(hit)
+		for key, value := range record {
+			hit[key] = value
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Exit codes by error class, so wrapper scripts can branch on the failure type
+const (
+	exitGeneric       = 1
+	exitAuth          = 3
+	exitConnection    = 4
+	exitQuery         = 5
+	exitShardFailures = 6
+	exitInterrupted   = 7
+	exitCountMismatch = 8
+	exitTooManyHits   = 9
+	exitPartial       = 10
+)
+
+// errInterrupted is returned when the export is interrupted by a signal before completing
+var errInterrupted = errors.New("interrupted")
+
+// ElasticsearchError is returned when Elasticsearch answers a request with an error status
+type ElasticsearchError struct {
+	StatusCode int
+	Status     string
+	Type       string
+	Reason     string
+}
+
+func newElasticsearchError(res *http.Response, body []byte) *ElasticsearchError {
+	e := &ElasticsearchError{StatusCode: res.StatusCode, Status: res.Status}
+	var errorBody struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &errorBody); err != nil {
+		// some proxies and the OpenSearch security plugin answer with plain text
+		e.Reason = strings.TrimSpace(string(body))
+		if len(e.Reason) > 200 {
+			e.Reason = e.Reason[:200] + "..."
+		}
+		return e
+	}
+	if len(errorBody.Error) == 0 {
+		// AWS and Kibana report errors as a message
+		e.Reason = errorBody.Message
+		return e
+	}
+	var detailed struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(errorBody.Error, &detailed); err == nil {
+		e.Type, e.Reason = detailed.Type, detailed.Reason
+		return e
+	}
+	// very old versions of Elasticsearch report errors as plain strings
+	json.Unmarshal(errorBody.Error, &e.Reason)
+	return e
+}
+
+func (e *ElasticsearchError) Error() string {
+	msg := "failed to query Elasticsearch: " + e.Status
+	switch {
+	case e.Type != "":
+		msg += fmt.Sprintf(": %s: %s", e.Type, e.Reason)
+	case e.Reason != "":
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// ConnectionError is returned when Elasticsearch could not be reached
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("failed to query Elasticsearch: %v", e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// QueryError is returned when the query itself is invalid
+type QueryError struct {
+	Err error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("invalid query: %v", e.Err)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+type ShardFailure struct {
+	Shard  int    `json:"shard"`
+	Index  string `json:"index"`
+	Node   string `json:"node"`
+	Reason struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"reason"`
+}
+
+// ShardFailuresError is returned when some shards failed to answer a search
+type ShardFailuresError struct {
+	Failed   int
+	Failures []ShardFailure
+}
+
+func (e *ShardFailuresError) Error() string {
+	reasons := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		reasons[i] = fmt.Sprintf("[%s][%d] %s: %s", f.Index, f.Shard, f.Reason.Type, f.Reason.Reason)
+	}
+	return fmt.Sprintf("%d shards failed to answer the query: %s", e.Failed, strings.Join(reasons, "; "))
+}
+
+// TimedOutError is returned when a page of results timed out, missing the hits of the shards
+// that didn't answer in time, and could not be fetched again
+type TimedOutError struct {
+	Slice    int
+	Page     int
+	Attempts int
+}
+
+func (e *TimedOutError) Error() string {
+	return fmt.Sprintf("page %d of slice %d timed out after %d attempts, missing the hits of the shards that didn't answer in time", e.Page, e.Slice, e.Attempts)
+}
+
+// PartialResultsError is returned when some slices failed with --keep-partial, while the others
+// exported their documents
+type PartialResultsError struct {
+	// Missing are the failed slices, whose documents are missing from the export
+	Missing []int
+	Slices  int
+	// Err is the error of the first failed slice
+	Err error
+}
+
+func (e *PartialResultsError) Error() string {
+	missing := make([]string, len(e.Missing))
+	for i, slice := range e.Missing {
+		missing[i] = strconv.Itoa(slice)
+	}
+	return fmt.Sprintf("%d of %d slices failed, missing the documents of slices %s, the first with: %v", len(e.Missing), e.Slices, strings.Join(missing, ", "), e.Err)
+}
+
+func (e *PartialResultsError) Unwrap() error {
+	return e.Err
+}
+
+// CountMismatchError is returned when a complete export did not fetch as many documents as the
+// query matched
+type CountMismatchError struct {
+	Fetched  int64
+	Expected int64
+}
+
+func (e *CountMismatchError) Error() string {
+	return fmt.Sprintf("fetched %d documents but the query matched %d documents", e.Fetched, e.Expected)
+}
+
+// TooManyHitsError is returned, before fetching anything, when the query matches more documents
+// than allowed
+type TooManyHitsError struct {
+	Hits  int64
+	Limit int64
+}
+
+func (e *TooManyHitsError) Error() string {
+	return fmt.Sprintf("the query matches %d documents, more than the limit of %d", e.Hits, e.Limit)
+}
+
+// TooLargeExportError is returned, before fetching anything, when the export is estimated larger
+// than allowed
+type TooLargeExportError struct {
+	Bytes int64
+	Limit int64
+}
+
+func (e *TooLargeExportError) Error() string {
+	return fmt.Sprintf("the export is estimated at %s, more than the limit of %s", formatBytes(float64(e.Bytes)), formatBytes(float64(e.Limit)))
+}
+
+// exitCode maps an error to the exit code of its class
+func exitCode(err error) int {
+	var esErr *ElasticsearchError
+	var connErr *ConnectionError
+	var queryErr *QueryError
+	var shardErr *ShardFailuresError
+	var timedOutErr *TimedOutError
+	var countErr *CountMismatchError
+	var tooManyErr *TooManyHitsError
+	var tooLargeErr *TooLargeExportError
+	var partialErr *PartialResultsError
+	switch {
+	case errors.Is(err, errInterrupted):
+		return exitInterrupted
+	case errors.As(err, &partialErr):
+		return exitPartial
+	case errors.As(err, &esErr) && (esErr.StatusCode == http.StatusUnauthorized || esErr.StatusCode == http.StatusForbidden):
+		return exitAuth
+	case errors.As(err, &esErr) && esErr.StatusCode == http.StatusBadRequest, errors.As(err, &queryErr):
+		return exitQuery
+	case errors.As(err, &connErr) && !errors.Is(err, context.Canceled):
+		return exitConnection
+	case errors.As(err, &shardErr), errors.As(err, &timedOutErr):
+		return exitShardFailures
+	case errors.As(err, &countErr):
+		return exitCountMismatch
+	case errors.As(err, &tooManyErr), errors.As(err, &tooLargeErr):
+		return exitTooManyHits
+	default:
+		return exitGeneric
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// estimateSampleSize is how many hits are sampled to estimate the size of an export, when the
+// query doesn't set its own page size
+const estimateSampleSize = 100
+
+// sizeEstimate is the expected size of an export, as the number of matching documents times the
+// average size of the hits of a sample page
+type sizeEstimate struct {
+	Hits        int64
+	Exact       bool
+	AvgHitBytes float64
+	Bytes       int64
+}
+
+// estimateSize fetches a page of the query, of its own size or estimateSampleSize hits, and
+// estimates the size of exporting all its results from the size of the hits as returned by the
+// cluster, before any transformation or encoding. Aggregations are dropped from the sample search
+func (c *Client) estimateSize(ctx context.Context, index string, query string) (sizeEstimate, error) {
+	queryObj := map[string]any{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &queryObj); err != nil {
+			return sizeEstimate{}, &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+	delete(queryObj, "aggs")
+	delete(queryObj, "aggregations")
+	if _, ok := queryObj["size"]; !ok {
+		queryObj["size"] = estimateSampleSize
+	}
+	if c.supports(7, 0) {
+		queryObj["track_total_hits"] = true
+	}
+	body, err := json.Marshal(queryObj)
+	if err != nil {
+		return sizeEstimate{}, fmt.Errorf("failed to marshal sample query: %w", err)
+	}
+
+	path := c.indexPath(index, "_search") + "?" + c.searchParams().Encode()
+	_, data, err := c.do(ctx, "GET", path, string(body))
+	if err != nil {
+		return sizeEstimate{}, err
+	}
+	var sr SearchResult
+	if err := json.Unmarshal(data, &sr); err != nil {
+		return sizeEstimate{}, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	estimate := sizeEstimate{Hits: sr.Hits.Total.Value, Exact: sr.Hits.Total.Relation == "eq"}
+	if len(sr.Hits.Hits) > 0 {
+		var sampled int64
+		for _, hit := range sr.Hits.Hits {
+			// every hit is written on a line of its own
+			sampled += int64(len(hit)) + 1
+		}
+		estimate.AvgHitBytes = float64(sampled) / float64(len(sr.Hits.Hits))
+	}
+	estimate.Bytes = int64(estimate.AvgHitBytes * float64(estimate.Hits))
+	return estimate, nil
+}
+
+// parseByteSize parses a size in bytes, with an optional KB, MB, GB or TB unit in powers of 1024
+// as formatBytes writes them, e.g. 500MB or 1.5 TB
+func parseByteSize(value string) (int64, error) {
+	units := []string{"TB", "GB", "MB", "KB", "B"}
+	number := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := float64(1)
+	for i, unit := range units {
+		if trimmed, ok := strings.CutSuffix(number, unit); ok {
+			number = strings.TrimSpace(trimmed)
+			for range len(units) - 1 - i {
+				multiplier *= 1024
+			}
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes with an optional KB, MB, GB or TB unit, e.g. 50GB", value)
+	}
+	return int64(size * multiplier), nil
+}
+
+// checkEstimatedSize logs the estimated size of exporting all the results of the query, failing
+// when it is larger than maxSize, if set. The export goes on without an estimate when it can't be
+// made and there is no maxSize to enforce
+func (c *Client) checkEstimatedSize(ctx context.Context, index string, query string, maxSize string) error {
+	var limit int64
+	if maxSize != "" {
+		var err error
+		if limit, err = parseByteSize(maxSize); err != nil {
+			return fmt.Errorf("invalid --max-estimated-size: %w", err)
+		}
+	}
+	estimate, err := c.estimateSize(ctx, index, query)
+	if err != nil {
+		if limit > 0 {
+			return fmt.Errorf("failed to estimate the size of the export: %w", err)
+		}
+		slog.Warn(fmt.Sprintf("failed to estimate the size of the export: %v", err), "event", "size_estimate_failed", "error", err)
+		return nil
+	}
+	atLeast := ""
+	if !estimate.Exact {
+		atLeast = "at least "
+	}
+	slog.Info(
+		fmt.Sprintf(
+			"≈ %s%s expected: %d documents of %s on average",
+			atLeast, formatBytes(float64(estimate.Bytes)), estimate.Hits, formatBytes(estimate.AvgHitBytes),
+		),
+		"event", "size_estimate", "docs", estimate.Hits, "bytes", estimate.Bytes, "exact", estimate.Exact,
+	)
+	if limit > 0 && estimate.Bytes > limit {
+		return &TooLargeExportError{Bytes: estimate.Bytes, Limit: limit}
+	}
+	return nil
+}
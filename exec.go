@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// execWriter pipes the output through an external command: everything written to it goes to the
+// standard input of the command, whose standard output goes to the output. Writing blocks while
+// the command is busy, so a slow command slows down the export instead of buffering it in memory.
+// Only complete lines are sent, and when the command crashes it is restarted, up to a limit, and
+// the lines that failed to be sent are sent to the new one. Lines the command had read but not
+// processed when it crashed are lost
+type execWriter struct {
+	command     string
+	out         io.Writer
+	maxRestarts int
+
+	mu       sync.Mutex
+	restarts int
+	pending  []byte
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	copied   chan error
+}
+
+func newExecWriter(command string, out io.Writer, maxRestarts int) (*execWriter, error) {
+	w := &execWriter{command: command, out: out, maxRestarts: maxRestarts}
+	if err := w.start(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *execWriter) start() error {
+	cmd := exec.Command("sh", "-c", w.command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to run %q: %w", w.command, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to run %q: %w", w.command, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %q: %w", w.command, err)
+	}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w.out, stdout)
+		copied <- err
+	}()
+	w.cmd, w.stdin, w.copied = cmd, stdin, copied
+	return nil
+}
+
+// wait closes the standard input of the command and waits for it to exit and its output to be
+// copied
+func (w *execWriter) wait() error {
+	w.stdin.Close()
+	copyErr := <-w.copied
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("%q failed: %w", w.command, err)
+	}
+	if copyErr != nil {
+		return fmt.Errorf("failed to write the output of %q: %w", w.command, copyErr)
+	}
+	return nil
+}
+
+func (w *execWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stdin == nil {
+		return 0, fmt.Errorf("%q is not running", w.command)
+	}
+	w.pending = append(w.pending, p...)
+	end := bytes.LastIndexByte(w.pending, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+	lines := w.pending[:end+1]
+	for {
+		_, err := w.stdin.Write(lines)
+		if err == nil {
+			break
+		}
+		if err := w.restart(err); err != nil {
+			return 0, err
+		}
+	}
+	w.pending = append(w.pending[:0], w.pending[end+1:]...)
+	return len(p), nil
+}
+
+// restart replaces a command that stopped reading its input, most likely because it crashed
+func (w *execWriter) restart(writeErr error) error {
+	waitErr := w.wait()
+	if waitErr == nil {
+		waitErr = writeErr
+	}
+	if w.restarts >= w.maxRestarts {
+		w.stdin = nil
+		return fmt.Errorf("giving up after restarting %q %d times: %w", w.command, w.restarts, waitErr)
+	}
+	w.restarts++
+	metrics.recordError("exec_restart")
+	slog.Warn(
+		fmt.Sprintf("%v, restarting it (restart %d of %d)", waitErr, w.restarts, w.maxRestarts),
+		"event", "exec_restart", "restart", w.restarts, "error", waitErr,
+	)
+	return w.start()
+}
+
+// Close sends what is left of the output to the command and waits for it to finish
+func (w *execWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stdin == nil {
+		// the command was given up on, which was already reported
+		return nil
+	}
+	var err error
+	if len(w.pending) > 0 {
+		_, err = w.stdin.Write(w.pending)
+	}
+	return errors.Join(err, w.wait())
+}
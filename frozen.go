@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// frozenKeepAlive is the scroll keep alive used by default when searching the frozen tier, where
+// fetching a page can take minutes as the data is read from the snapshot repository
+const frozenKeepAlive = "5m"
+
+// checkFrozenTier warns when the indices the query targets include partially mounted searchable
+// snapshots, the frozen tier, or frozen indices, which exports need to pace very differently
+// than hot indices. The keep alive of the scroll is raised unless set explicitly. Failures to
+// read the settings are only logged, as restricted users may not be allowed to
+func (c *Client) checkFrozenTier(ctx context.Context, index string) {
+	if c.Flavor != flavorElasticsearch || c.Serverless {
+		return
+	}
+	_, data, err := c.do(ctx, "GET", index+"/_settings/index.store.snapshot.partial,index.frozen?flat_settings=true", "")
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Could not read the settings of %s: %v", index, err), "event", "settings_failed", "error", err)
+		return
+	}
+	var result map[string]struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		slog.Debug(fmt.Sprintf("Could not unmarshal the settings of %s: %v", index, err), "event", "settings_failed", "error", err)
+		return
+	}
+	var partial, frozen int
+	for _, settings := range result {
+		if settings.Settings["index.store.snapshot.partial"] == "true" {
+			partial++
+		}
+		if settings.Settings["index.frozen"] == "true" {
+			frozen++
+		}
+	}
+
+	if partial > 0 {
+		if c.KeepAlive == "" {
+			c.KeepAlive = frozenKeepAlive
+		}
+		slog.Warn(
+			fmt.Sprintf(
+				"%d of the %d indices searched are partially mounted snapshots of the frozen tier. Pages can take minutes to fetch, keeping the scroll alive for %s between them. Prefer few --slices and a narrow time range",
+				partial, len(result), c.keepAlive(),
+			),
+			"event", "frozen_tier", "indices", len(result), "partial", partial, "keep_alive", c.keepAlive(),
+		)
+	}
+	if frozen > 0 && c.IgnoreThrottled != "false" {
+		slog.Warn(
+			fmt.Sprintf("%d of the %d indices searched are frozen and skipped by default. Set --ignore-throttled false to search them", frozen, len(result)),
+			"event", "frozen_indices", "indices", len(result), "frozen", frozen,
+		)
+	}
+}
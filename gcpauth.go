@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpTokenURL is where Google OAuth2 access tokens are obtained, unless the credentials say
+// otherwise
+const gcpTokenURL = "https://oauth2.googleapis.com/token"
+
+// gcpCredentials gets OAuth2 access tokens for Google Cloud APIs from the Application Default
+// Credentials, looked up as the Google client libraries do: the file of the
+// GOOGLE_APPLICATION_CREDENTIALS env var, then the one written by gcloud auth
+// application-default login, then the metadata server of the instance running esfetcher.
+// Service account keys and gcloud user credentials are supported. Tokens are cached until
+// shortly before they expire
+type gcpCredentials struct {
+	scope  string
+	client *http.Client
+
+	// the credentials file, nil to use the metadata server
+	file *gcpCredentialsFile
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gcpCredentialsFile holds the fields of the service_account and authorized_user credential files
+// used to get tokens
+type gcpCredentialsFile struct {
+	Type string `json:"type"`
+
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func newGCPCredentials(scope string) (*gcpCredentials, error) {
+	creds := &gcpCredentials{scope: scope, client: http.DefaultClient}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return creds, nil
+		}
+		path = filepath.Join(dir, "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			return creds, nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Google credentials: %w", err)
+	}
+	var file gcpCredentialsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse Google credentials %s: %w", path, err)
+	}
+	if file.Type != "service_account" && file.Type != "authorized_user" {
+		return nil, fmt.Errorf("unsupported Google credentials %s of type %q, expected service_account or authorized_user", path, file.Type)
+	}
+	creds.file = &file
+	return creds, nil
+}
+
+// authorize sets the Authorization header of a request to a Google Cloud API
+func (g *gcpCredentials) authorize(ctx context.Context, req *http.Request) error {
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (g *gcpCredentials) accessToken(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Until(g.expires) > time.Minute {
+		return g.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	switch {
+	case g.file == nil:
+		req, err = g.metadataTokenRequest(ctx)
+	case g.file.Type == "service_account":
+		req, err = g.serviceAccountTokenRequest(ctx)
+	default:
+		req, err = g.refreshTokenRequest(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+	res, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get a Google access token: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to get a Google access token: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get a Google access token: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("failed to parse Google access token: %w", err)
+	}
+	g.token, g.expires = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second)
+	return g.token, nil
+}
+
+// metadataTokenRequest asks the metadata server of Compute Engine, GKE or Cloud Run for a token
+// of the service account of the instance
+func (g *gcpCredentials) metadataTokenRequest(ctx context.Context) (*http.Request, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	u := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token?scopes=" + url.QueryEscape(g.scope)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return req, nil
+}
+
+// serviceAccountTokenRequest exchanges a JWT signed with the key of a service account for a token
+func (g *gcpCredentials) serviceAccountTokenRequest(ctx context.Context) (*http.Request, error) {
+	block, _ := pem.Decode([]byte(g.file.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid private key in the Google service account credentials")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid private key in the Google service account credentials: %w", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid private key in the Google service account credentials: not an RSA key")
+	}
+
+	tokenURL := g.file.TokenURI
+	if tokenURL == "" {
+		tokenURL = gcpTokenURL
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": g.file.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   g.file.ClientEmail,
+		"scope": g.scope,
+		"aud":   tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign the Google token request: %w", err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	return newFormRequest(ctx, tokenURL, form)
+}
+
+// refreshTokenRequest exchanges the refresh token of gcloud user credentials for a token
+func (g *gcpCredentials) refreshTokenRequest(ctx context.Context) (*http.Request, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {g.file.ClientID},
+		"client_secret": {g.file.ClientSecret},
+		"refresh_token": {g.file.RefreshToken},
+	}
+	return newFormRequest(ctx, gcpTokenURL, form)
+}
+
+func newFormRequest(ctx context.Context, u string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGCPCredentialsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      string // content of the file of GOOGLE_APPLICATION_CREDENTIALS, none when empty
+		gcloud   string // content of the file of gcloud auth application-default login
+		wantType string // type of the credentials file used, empty for the metadata server
+		wantErr  string
+	}{
+		{name: "metadata server"},
+		{name: "service account", env: `{"type": "service_account", "client_email": "sa@p.iam.gserviceaccount.com"}`, wantType: "service_account"},
+		{name: "gcloud", gcloud: `{"type": "authorized_user", "refresh_token": "r"}`, wantType: "authorized_user"},
+		{name: "env over gcloud", env: `{"type": "service_account"}`, gcloud: `{"type": "authorized_user"}`, wantType: "service_account"},
+		{name: "unsupported type", env: `{"type": "external_account"}`, wantErr: `of type "external_account"`},
+		{name: "invalid json", env: `{"type":`, wantErr: "failed to parse Google credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", dir)
+			t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+			if tt.env != "" {
+				path := filepath.Join(dir, "key.json")
+				if err := os.WriteFile(path, []byte(tt.env), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+			}
+			if tt.gcloud != "" {
+				path := filepath.Join(dir, "gcloud", "application_default_credentials.json")
+				if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tt.gcloud), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			creds, err := newGCPCredentials("scope")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotType := ""
+			if creds.file != nil {
+				gotType = creds.file.Type
+			}
+			if gotType != tt.wantType {
+				t.Errorf("got credentials of type %q, want %q", gotType, tt.wantType)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filepath.Join(t.TempDir(), "missing.json"))
+		if _, err := newGCPCredentials("scope"); err == nil {
+			t.Errorf("got no error for a missing GOOGLE_APPLICATION_CREDENTIALS file")
+		}
+	})
+}
+
+// redirectTransport sends every request to the server of target, whatever its URL
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGCPAccessToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	// the token server checks the requests of every kind of credentials, and answers tokens
+	// numbered after the requests made so far
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		var kind string
+		switch {
+		case r.Host == "metadata.google.internal":
+			kind = "metadata"
+			if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Query().Get("scopes") != "scope" {
+				t.Errorf("got metadata request %s with headers %v", r.URL, r.Header)
+			}
+		case r.FormValue("grant_type") == "refresh_token":
+			kind = "user"
+			if r.FormValue("client_id") != "id" || r.FormValue("client_secret") != "secret" {
+				t.Errorf("got refresh request %v", r.Form)
+			}
+			if r.FormValue("refresh_token") == "revoked" {
+				http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		case r.FormValue("grant_type") == "urn:ietf:params:oauth:grant-type:jwt-bearer":
+			kind = "sa"
+			if r.Host != "oauth2.example.com" {
+				t.Errorf("got token request to %s, want the token_uri of the credentials", r.Host)
+			}
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			if len(parts) != 3 {
+				t.Errorf("got assertion %q, want a JWT", r.FormValue("assertion"))
+				return
+			}
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+				t.Errorf("invalid JWT signature: %v", err)
+			}
+			var claims map[string]any
+			data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			if err := json.Unmarshal(data, &claims); err != nil {
+				t.Error(err)
+			}
+			if claims["iss"] != "sa@p.iam.gserviceaccount.com" || claims["scope"] != "scope" || claims["aud"] != "https://oauth2.example.com/token" {
+				t.Errorf("got JWT claims %v", claims)
+			}
+		default:
+			t.Errorf("unexpected token request %s %s", r.Method, r.URL)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "%s-%d", "expires_in": 3600, "token_type": "Bearer"}`, kind, n)
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	client := &http.Client{Transport: &redirectTransport{target: target}}
+
+	tests := []struct {
+		name string
+		file *gcpCredentialsFile
+		kind string
+	}{
+		{"metadata server", nil, "metadata"},
+		{"service account", &gcpCredentialsFile{
+			Type: "service_account", ClientEmail: "sa@p.iam.gserviceaccount.com", PrivateKey: privateKey,
+			PrivateKeyID: "kid", TokenURI: "https://oauth2.example.com/token",
+		}, "sa"},
+		{"authorized user", &gcpCredentialsFile{
+			Type: "authorized_user", ClientID: "id", ClientSecret: "secret", RefreshToken: "refresh",
+		}, "user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GCE_METADATA_HOST", "")
+			creds := &gcpCredentials{scope: "scope", client: client, file: tt.file}
+			ctx := context.Background()
+			first := requests.Load()
+			token, err := creds.accessToken(ctx)
+			if want := fmt.Sprintf("%s-%d", tt.kind, first+1); err != nil || token != want {
+				t.Fatalf("got token %q and error %v, want %q", token, err, want)
+			}
+			// cached while it is valid for more than a minute
+			if token, err = creds.accessToken(ctx); err != nil || token != fmt.Sprintf("%s-%d", tt.kind, first+1) {
+				t.Errorf("got token %q and error %v, want the cached one", token, err)
+			}
+			// refreshed shortly before it expires
+			creds.expires = time.Now().Add(30 * time.Second)
+			if token, err = creds.accessToken(ctx); err != nil || token != fmt.Sprintf("%s-%d", tt.kind, first+2) {
+				t.Errorf("got token %q and error %v, want a refreshed one", token, err)
+			}
+			req, _ := http.NewRequest("GET", "https://bigquery.googleapis.com", nil)
+			if err := creds.authorize(ctx, req); err != nil || req.Header.Get("Authorization") != "Bearer "+token {
+				t.Errorf("got Authorization %q and error %v, want the token", req.Header.Get("Authorization"), err)
+			}
+		})
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		creds := &gcpCredentials{scope: "scope", client: client, file: &gcpCredentialsFile{
+			Type: "authorized_user", ClientID: "id", ClientSecret: "secret", RefreshToken: "revoked",
+		}}
+		_, err := creds.accessToken(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "400 Bad Request") || !strings.Contains(err.Error(), "invalid_grant") {
+			t.Errorf("got error %v, want the refusal of the token server", err)
+		}
+	})
+
+	t.Run("invalid private key", func(t *testing.T) {
+		creds := &gcpCredentials{scope: "scope", client: client, file: &gcpCredentialsFile{
+			Type: "service_account", PrivateKey: "not a key",
+		}}
+		if _, err := creds.accessToken(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid private key") {
+			t.Errorf("got error %v, want an invalid private key", err)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// geoFormats are the formats --normalize-geo rewrites geo points to
+var geoFormats = []string{"object", "wkt"}
+
+// geoPoint is a point of a geo_point field, in degrees
+type geoPoint struct {
+	lat, lon float64
+}
+
+// geoFields returns the geo_point fields of the mappings of the indices matching index, by
+// their dotted path in the documents
+func (c *Client) geoFields(ctx context.Context, index string) ([]string, error) {
+	mappings, err := c.mappingProperties(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, properties := range mappings {
+		collectGeoFields(found, "", properties)
+	}
+	fields := make([]string, 0, len(found))
+	for path := range found {
+		fields = append(fields, path)
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+func collectGeoFields(found map[string]bool, prefix string, properties map[string]any) {
+	for name, def := range properties {
+		def, ok := def.(map[string]any)
+		if !ok {
+			continue
+		}
+		path := prefix + name
+		if children, ok := def["properties"].(map[string]any); ok {
+			collectGeoFields(found, path+".", children)
+			continue
+		}
+		if kind, _ := def["type"].(string); kind == "geo_point" {
+			found[path] = true
+		}
+	}
+}
+
+// geoTransform returns a transform rewriting the geo_point fields of the documents, as found in
+// the mapping of the index, from any of the representations Elasticsearch accepts to a single
+// one: an object with lat and lon, or a WKT POINT. Values that can't be parsed are left as they
+// are, with a warning the first time for each field
+func (c *Client) geoTransform(ctx context.Context, index string, format string) (hitTransform, error) {
+	switch format {
+	case "object", "wkt":
+	default:
+		return nil, fmt.Errorf("invalid --normalize-geo %q, expected one of %s", format, strings.Join(geoFormats, ", "))
+	}
+	fields, err := c.geoFields(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug(fmt.Sprintf("Normalizing %d geo_point fields to %s", len(fields), format), "event", "geo_fields", "fields", len(fields))
+
+	var warnedLock sync.Mutex
+	warned := map[string]bool{}
+	normalize := func(field string, value any) any {
+		point, ok := parseGeoPoint(value)
+		if !ok {
+			warnedLock.Lock()
+			defer warnedLock.Unlock()
+			if !warned[field] {
+				warned[field] = true
+				slog.Warn(
+					fmt.Sprintf("Could not parse %v of geo_point field %s, leaving it as is", value, field),
+					"event", "geo_unparsed", "field", field,
+				)
+			}
+			return value
+		}
+		if format == "wkt" {
+			return fmt.Sprintf("POINT (%s %s)", formatDegrees(point.lon), formatDegrees(point.lat))
+		}
+		return map[string]any{"lat": point.lat, "lon": point.lon}
+	}
+
+	return func(hit map[string]any) error {
+		source, ok := hit["_source"].(map[string]any)
+		if !ok {
+			return nil
+		}
+		for _, field := range fields {
+			updatePath(source, field, func(value any) any {
+				// an array is either a single [lon, lat] point or an array of points
+				if values, ok := value.([]any); ok && !isGeoArray(values) {
+					for i, v := range values {
+						values[i] = normalize(field, v)
+					}
+					return values
+				}
+				return normalize(field, value)
+			})
+		}
+		return nil
+	}, nil
+}
+
+// parseGeoPoint parses the representations of a geo point Elasticsearch accepts: an object with
+// lat and lon, a GeoJSON point, a "lat,lon" string, a geohash, a WKT POINT and a [lon, lat] array
+func parseGeoPoint(value any) (geoPoint, bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		if coordinates, ok := v["coordinates"].([]any); ok {
+			return parseGeoArray(coordinates)
+		}
+		lat, latOk := geoCoordinate(v["lat"])
+		lon, lonOk := geoCoordinate(v["lon"])
+		return geoPoint{lat, lon}, latOk && lonOk
+	case []any:
+		return parseGeoArray(v)
+	case string:
+		text := strings.TrimSpace(v)
+		if rest, ok := cutPrefixFold(text, "POINT"); ok {
+			rest = strings.TrimSpace(rest)
+			if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+				return geoPoint{}, false
+			}
+			coordinates := strings.Fields(rest[1 : len(rest)-1])
+			if len(coordinates) < 2 {
+				return geoPoint{}, false
+			}
+			lon, lonErr := strconv.ParseFloat(coordinates[0], 64)
+			lat, latErr := strconv.ParseFloat(coordinates[1], 64)
+			return geoPoint{lat, lon}, lonErr == nil && latErr == nil
+		}
+		if latText, lonText, ok := strings.Cut(text, ","); ok {
+			// a third value, the altitude, is ignored
+			lonText, _, _ = strings.Cut(lonText, ",")
+			lat, latErr := strconv.ParseFloat(strings.TrimSpace(latText), 64)
+			lon, lonErr := strconv.ParseFloat(strings.TrimSpace(lonText), 64)
+			return geoPoint{lat, lon}, latErr == nil && lonErr == nil
+		}
+		return decodeGeohash(text)
+	}
+	return geoPoint{}, false
+}
+
+// parseGeoArray parses a [lon, lat] array, with an optional altitude, as GeoJSON orders them
+func parseGeoArray(values []any) (geoPoint, bool) {
+	if !isGeoArray(values) {
+		return geoPoint{}, false
+	}
+	lon, _ := geoNumber(values[0])
+	lat, _ := geoNumber(values[1])
+	return geoPoint{lat, lon}, true
+}
+
+// isGeoArray tells whether values is a single [lon, lat] point, rather than an array of points
+func isGeoArray(values []any) bool {
+	if len(values) < 2 || len(values) > 3 {
+		return false
+	}
+	for _, v := range values {
+		if _, ok := geoNumber(v); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func geoNumber(value any) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// geoCoordinate is a number, or a string holding one as Elasticsearch also accepts for the lat
+// and lon of objects
+func geoCoordinate(value any) (float64, bool) {
+	if text, ok := value.(string); ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		return f, err == nil
+	}
+	return geoNumber(value)
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// decodeGeohash returns the center of the cell of a geohash
+func decodeGeohash(hash string) (geoPoint, bool) {
+	if hash == "" || len(hash) > 12 {
+		return geoPoint{}, false
+	}
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	even := true
+	for _, r := range strings.ToLower(hash) {
+		bits := strings.IndexRune(geohashAlphabet, r)
+		if bits < 0 {
+			return geoPoint{}, false
+		}
+		for mask := 16; mask > 0; mask >>= 1 {
+			interval := &latRange
+			if even {
+				interval = &lonRange
+			}
+			mid := (interval[0] + interval[1]) / 2
+			if bits&mask != 0 {
+				interval[0] = mid
+			} else {
+				interval[1] = mid
+			}
+			even = !even
+		}
+	}
+	return geoPoint{(latRange[0] + latRange[1]) / 2, (lonRange[0] + lonRange[1]) / 2}, true
+}
+
+func formatDegrees(degrees float64) string {
+	return strconv.FormatFloat(degrees, 'f', -1, 64)
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
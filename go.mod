@@ -3,7 +3,12 @@ module github.com/bcap/esfetch
 go 1.22.1
 
 require (
-	github.com/alexflint/go-arg v1.4.3 // indirect
-	github.com/alexflint/go-scalar v1.2.0 // indirect
-	golang.org/x/sync v0.7.0 // indirect
+	github.com/alexflint/go-arg v1.4.3
+	github.com/alexflint/go-scalar v1.2.0
+	github.com/tetratelabs/wazero v1.9.0
+	golang.org/x/net v0.30.0
+	golang.org/x/sync v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/text v0.19.0 // indirect
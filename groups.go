@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// groupsPageSize is how many groups each composite aggregation page holds
+const groupsPageSize = 100
+
+// groupsResult is the part of a search response QueryGroups reads
+type groupsResult struct {
+	ShardsMetaResult ShardsMetaResult `json:"_shards"`
+
+	Aggregations struct {
+		Groups struct {
+			AfterKey json.RawMessage `json:"after_key"`
+			Buckets  []struct {
+				Key struct {
+					Group json.RawMessage `json:"group"`
+				} `json:"key"`
+				Top struct {
+					Hits struct {
+						Hits []map[string]json.RawMessage `json:"hits"`
+					} `json:"hits"`
+				} `json:"top"`
+			} `json:"buckets"`
+		} `json:"groups"`
+	} `json:"aggregations"`
+}
+
+// QueryGroups fetches the top perGroup documents of every value of field among the documents
+// the query matches, paging through the values with a composite aggregation with a top_hits sub
+// aggregation. The documents are ordered by the sort of the query, by score when it has none,
+// and written with the value of their group in _group
+func (c *Client) QueryGroups(ctx context.Context, index string, query string, field string, perGroup int, writer io.Writer) (*Summary, error) {
+	p := newProgress(1)
+	p.export = c.MetricsExport
+	ctx = withProgress(ctx, p)
+	ctx, span := startSpan(ctx, "esfetcher.groups", spanKindInternal, map[string]any{
+		"elasticsearch.index": index, "esfetcher.group_by": field,
+	})
+	start := time.Now()
+
+	err := c.queryGroups(ctx, index, query, field, perGroup, p, writer)
+	p.finishSlice(0, err)
+	span.setAttribute("esfetcher.docs", p.docs.Load())
+	span.finish(err)
+	summary := p.summary(index, start, err)
+	if err != nil {
+		return summary, err
+	}
+	logDone(p, start)
+	return summary, nil
+}
+
+func (c *Client) queryGroups(ctx context.Context, index string, query string, field string, perGroup int, p *progress, writer io.Writer) error {
+	if !c.supports(6, 1) {
+		return fmt.Errorf("--group-by needs Elasticsearch 6.1 or later, for composite aggregations")
+	}
+	queryObj := map[string]json.RawMessage{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &queryObj); err != nil {
+			return &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+	// the hits of the groups are fetched by the top_hits aggregation, which takes the options of
+	// the query that shape them
+	topHits := map[string]any{"size": perGroup, "_source": !c.IDsOnly}
+	if source, ok := queryObj["_source"]; ok && !c.IDsOnly {
+		topHits["_source"] = source
+	}
+	for _, option := range []string{"sort", "script_fields"} {
+		if value, ok := queryObj[option]; ok {
+			topHits[option] = value
+		}
+	}
+	if c.DocVersion {
+		topHits["version"] = true
+	}
+	if c.SeqNoPrimaryTerm {
+		topHits["seq_no_primary_term"] = true
+	}
+	composite := map[string]any{
+		"size":    groupsPageSize,
+		"sources": []any{map[string]any{"group": map[string]any{"terms": map[string]any{"field": field}}}},
+	}
+	body := map[string]any{
+		"size": 0,
+		"aggs": map[string]any{
+			"groups": map[string]any{
+				"composite": composite,
+				"aggs":      map[string]any{"top": map[string]any{"top_hits": topHits}},
+			},
+		},
+	}
+	// a post_filter would only restrict the hits of the search, which has none, and not the
+	// groups, so it restricts the query instead
+	if clause, ok := hitsQuery(queryObj); ok {
+		body["query"] = clause
+	}
+	path := c.indexPath(index, "_search") + "?" + c.searchParams().Encode()
+
+	for page := 1; ; page++ {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal groups query: %w", err)
+		}
+		pageStart := time.Now()
+		_, res, err := c.do(ctx, "POST", path, string(data))
+		if err != nil {
+			return err
+		}
+		took := time.Since(pageStart)
+		c.checkSlowPage(ctx, 0, page, took)
+
+		var result groupsResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			return fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		if err := checkShards(&SearchResult{ShardsMetaResult: result.ShardsMetaResult}, p); err != nil {
+			return err
+		}
+		groups := result.Aggregations.Groups
+		if len(groups.Buckets) == 0 {
+			return nil
+		}
+
+		var hits []json.RawMessage
+		for _, bucket := range groups.Buckets {
+			for _, hit := range bucket.Top.Hits.Hits {
+				hit["_group"] = bucket.Key.Group
+				var buf bytes.Buffer
+				encoder := json.NewEncoder(&buf)
+				encoder.SetEscapeHTML(false)
+				if err := encoder.Encode(hit); err != nil {
+					return fmt.Errorf("failed to encode hit: %w", err)
+				}
+				hits = append(hits, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+			}
+		}
+		written, err := c.writeHits(hits, nil, writer)
+		if err != nil {
+			return err
+		}
+		p.recordPage(0, len(hits), written, took)
+
+		if len(groups.AfterKey) == 0 {
+			return nil
+		}
+		composite["after"] = groups.AfterKey
+	}
+}
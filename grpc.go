@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// grpcFetchPath is the path of the Fetch method of the Fetcher service of esfetcher.proto
+const grpcFetchPath = "/esfetcher.v1.Fetcher/Fetch"
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK                = 0
+	grpcCancelled         = 1
+	grpcUnknown           = 2
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+)
+
+// grpcFetch serves the Fetch method of the gRPC Fetcher service: it reads a QueryRequest, runs
+// it as a /fetch request would, and streams back a Document message per result. The protocol is
+// implemented directly on top of the HTTP/2 server: every message is framed with a compressed
+// flag and its length, and the outcome is reported in the grpc-status and grpc-message trailers
+func (s *fetchServer) grpcFetch(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "expected a gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	status := func(code int, msg string) {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		if msg != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEncodeMessage(msg))
+		}
+	}
+
+	message, code, err := readGRPCMessage(r.Body)
+	if err != nil {
+		status(code, err.Error())
+		return
+	}
+	req, err := decodeQueryRequest(message)
+	if err != nil {
+		status(grpcInvalidArgument, err.Error())
+		return
+	}
+	query, err := s.resolve(&req)
+	if err != nil {
+		status(grpcInvalidArgument, err.Error())
+		return
+	}
+
+	out := &documentWriter{w: w, rc: http.NewResponseController(w)}
+	summary, err := s.client.Query(r.Context(), req.Index, query, req.FetchAll, req.Slices, out)
+	if err != nil {
+		if r.Context().Err() != nil {
+			slog.Warn(fmt.Sprintf("Fetch of %s interrupted by the client after %d documents", req.Index, summary.Docs), "event", "fetch_interrupted", "index", req.Index, "docs", summary.Docs)
+			status(grpcCancelled, "interrupted by the client")
+			return
+		}
+		slog.Error(fmt.Sprintf("Fetch of %s failed: %v", req.Index, err), "event", "fetch_failed", "index", req.Index, "error", err)
+		status(grpcStatus(err), err.Error())
+		return
+	}
+	status(grpcOK, "")
+}
+
+// readGRPCMessage reads the single length prefixed message of a unary or server streaming
+// request, returning the gRPC status code to fail the call with on errors
+func readGRPCMessage(body io.Reader) ([]byte, int, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcInvalidArgument, fmt.Errorf("failed to read request: %w", err)
+	}
+	if prefix[0] != 0 {
+		return nil, grpcUnimplemented, fmt.Errorf("compressed requests are not supported")
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > serveMaxRequestBytes {
+		return nil, grpcResourceExhausted, fmt.Errorf("request of %d bytes is larger than the %d bytes allowed", length, serveMaxRequestBytes)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, grpcInvalidArgument, fmt.Errorf("failed to read request: %w", err)
+	}
+	return message, grpcOK, nil
+}
+
+// decodeQueryRequest decodes a QueryRequest protobuf message. Unknown fields are skipped
+func decodeQueryRequest(data []byte) (fetchRequest, error) {
+	var req fetchRequest
+	err := protoFields(data, func(field int, wireType int, value uint64, bytesValue []byte) error {
+		switch {
+		case field == 1 && wireType == 2:
+			req.Index = string(bytesValue)
+		case field == 2 && wireType == 2:
+			req.Query = json.RawMessage(bytesValue)
+		case field == 3 && wireType == 0:
+			req.FetchAll = value != 0
+		case field == 4 && wireType == 0:
+			req.Slices = int(int32(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return req, fmt.Errorf("invalid QueryRequest message")
+	}
+	return req, nil
+}
+
+// documentWriter writes the json lines of the results as Document messages of a gRPC response,
+// flushing every one of them as soon as it is complete
+type documentWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	line []byte
+}
+
+func (dw *documentWriter) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			dw.line = append(dw.line, data...)
+			break
+		}
+		dw.line = append(dw.line, data[:i]...)
+		data = data[i+1:]
+		if err := dw.writeDocument(dw.line); err != nil {
+			return 0, err
+		}
+		dw.line = dw.line[:0]
+	}
+	return written, nil
+}
+
+func (dw *documentWriter) writeDocument(line []byte) error {
+	var doc struct {
+		Index  string          `json:"_index"`
+		ID     string          `json:"_id"`
+		Source json.RawMessage `json:"_source"`
+	}
+	if len(line) > 0 && line[0] == '{' {
+		if err := json.Unmarshal(line, &doc); err != nil {
+			return fmt.Errorf("failed to decode hit: %w", err)
+		}
+	} else {
+		// --ids-only writes the bare ids
+		doc.ID = string(line)
+		line = nil
+	}
+	var message []byte
+	message = appendProtoBytes(message, 1, []byte(doc.Index))
+	message = appendProtoBytes(message, 2, []byte(doc.ID))
+	message = appendProtoBytes(message, 3, doc.Source)
+	message = appendProtoBytes(message, 4, line)
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	if _, err := dw.w.Write(append(frame, message...)); err != nil {
+		return err
+	}
+	return dw.rc.Flush()
+}
+
+// grpcStatus maps an error of a fetch to the gRPC status code the call fails with
+func grpcStatus(err error) int {
+	var esErr *ElasticsearchError
+	var queryErr *QueryError
+	var connErr *ConnectionError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return grpcCancelled
+	case errors.As(err, &queryErr), errors.As(err, &esErr) && esErr.StatusCode == http.StatusBadRequest:
+		return grpcInvalidArgument
+	case errors.As(err, &esErr) && esErr.StatusCode == http.StatusNotFound:
+		return grpcNotFound
+	case errors.As(err, &connErr):
+		return grpcUnavailable
+	default:
+		return grpcUnknown
+	}
+}
+
+// grpcEncodeMessage percent encodes a grpc-message, as the protocol requires for anything but
+// printable ascii
+func grpcEncodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// grpcError is the status of a failed gRPC call made by esfetcher
+type grpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("%s (gRPC status %d)", e.Message, e.Code)
+}
+
+// grpcCall makes a gRPC call over the HTTP/2 client, sending a single message and returning the
+// single message answered, as unary calls and streaming calls used for one request at a time do
+func grpcCall(ctx context.Context, client *http.Client, target string, header http.Header, message []byte) ([]byte, error) {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(append(frame, message...)))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	var answer []byte
+	var prefix [5]byte
+	if _, err := io.ReadFull(res.Body, prefix[:]); err == nil {
+		answer = make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		if _, err := io.ReadFull(res.Body, answer); err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+	} else if err != io.EOF {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// calls failing right away answer with the status in the headers, without trailers
+	status := res.Trailer.Get("Grpc-Status")
+	msg := res.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, msg = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gRPC status %q", status)
+	}
+	if code != grpcOK {
+		decoded, err := url.PathUnescape(msg)
+		if err != nil {
+			decoded = msg
+		}
+		return nil, &grpcError{Code: code, Message: decoded}
+	}
+	return answer, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcTestCluster answers searches of any index but missing with two documents, and scroll
+// continuations with none, or by blocking until they are cancelled when continued is set
+type grpcTestCluster struct {
+	continued chan struct{}
+	cancelled chan struct{}
+}
+
+func (c *grpcTestCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodDelete:
+		io.WriteString(w, `{"succeeded":true,"num_freed":1}`)
+	case strings.HasPrefix(r.URL.Path, "/missing/"):
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `{"error":{"type":"index_not_found_exception","reason":"no such index [missing]"},"status":404}`)
+	case strings.HasPrefix(r.URL.Path, "/_search/scroll"):
+		if c.continued != nil {
+			// the server only notices the client going away once the body is read
+			io.Copy(io.Discard, r.Body)
+			close(c.continued)
+			<-r.Context().Done()
+			close(c.cancelled)
+			return
+		}
+		io.WriteString(w, `{"_scroll_id":"s","hits":{"total":{"value":2,"relation":"eq"},"hits":[]}}`)
+	default:
+		io.WriteString(w, `{"_scroll_id":"s","hits":{"total":{"value":2,"relation":"eq"},"hits":[`+
+			`{"_index":"logs","_id":"1","_source":{"msg":"héllo"}},`+
+			`{"_index":"logs","_id":"2","_source":{"msg":"world"}}]}}`)
+	}
+}
+
+// newGRPCTestServer serves the Fetch method over h2c in front of cluster, returning its address
+// and an HTTP/2 client without TLS to call it with
+func newGRPCTestServer(t *testing.T, cluster http.Handler) (string, *http.Client) {
+	t.Helper()
+	es := httptest.NewServer(cluster)
+	t.Cleanup(es.Close)
+	s := &fetchServer{client: &Client{ESURL: es.URL}, slices: 1}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+grpcFetchPath, s.grpcFetch)
+	server := httptest.NewServer(h2c.NewHandler(mux, &http2.Server{}))
+	t.Cleanup(server.Close)
+	return server.URL + grpcFetchPath, h2cClient()
+}
+
+// h2cClient returns an HTTP/2 client without TLS, as gRPC clients of servers in clear text are
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func queryRequest(index string, query string, fetchAll bool) []byte {
+	var message []byte
+	message = appendProtoBytes(message, 1, []byte(index))
+	message = appendProtoBytes(message, 2, []byte(query))
+	if fetchAll {
+		message = appendProtoVarint(message, 3, 1)
+	}
+	return message
+}
+
+func TestGRPCFetch(t *testing.T) {
+	target, client := newGRPCTestServer(t, &grpcTestCluster{})
+	answer, err := grpcCall(context.Background(), client, target, nil, queryRequest("logs", `{"query":{"match_all":{}}}`, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[int]string{}
+	err = protoFields(answer, func(field int, wireType int, value uint64, bytesValue []byte) error {
+		got[field] = string(bytesValue)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{
+		1: "logs",
+		2: "1",
+		3: `{"msg":"héllo"}`,
+		4: `{"_index":"logs","_id":"1","_source":{"msg":"héllo"}}`,
+	}
+	for field, value := range want {
+		if got[field] != value {
+			t.Errorf("got field %d %q, want %q", field, got[field], value)
+		}
+	}
+}
+
+func TestGRPCFetchErrors(t *testing.T) {
+	frame := func(flag byte, length uint32, message []byte) []byte {
+		prefix := []byte{flag, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(prefix[1:], length)
+		return append(prefix, message...)
+	}
+	valid := queryRequest("logs", "", false)
+	tests := []struct {
+		name string
+		body []byte
+		want int
+	}{
+		{"missing index", frame(0, uint32(len(queryRequest("missing", "", false))), queryRequest("missing", "", false)), grpcNotFound},
+		{"no index", frame(0, 0, nil), grpcInvalidArgument},
+		{"compressed", frame(1, uint32(len(valid)), valid), grpcUnimplemented},
+		{"oversized", frame(0, serveMaxRequestBytes+1, nil), grpcResourceExhausted},
+		{"truncated prefix", []byte{0, 0}, grpcInvalidArgument},
+		{"truncated message", frame(0, uint32(len(valid)+10), valid), grpcInvalidArgument},
+		{"malformed message", frame(0, 2, []byte{0x0a, 0x7f}), grpcInvalidArgument},
+	}
+	target, client := newGRPCTestServer(t, &grpcTestCluster{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", target, bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/grpc")
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if _, err := io.Copy(io.Discard, res.Body); err != nil {
+				t.Fatal(err)
+			}
+			status := res.Trailer.Get("Grpc-Status")
+			if status == "" {
+				status = res.Header.Get("Grpc-Status")
+			}
+			if status != strconv.Itoa(tt.want) {
+				t.Errorf("got status %q, want %d", status, tt.want)
+			}
+		})
+	}
+
+	// grpcCall surfaces the status of failed calls as a grpcError
+	_, err := grpcCall(context.Background(), client, target, nil, queryRequest("missing", "", false))
+	var grpcErr *grpcError
+	if !errors.As(err, &grpcErr) || grpcErr.Code != grpcNotFound || !strings.Contains(grpcErr.Message, "no such index [missing]") {
+		t.Errorf("got error %v, want a NOT_FOUND grpcError", err)
+	}
+}
+
+func TestGRPCFetchCancel(t *testing.T) {
+	cluster := &grpcTestCluster{continued: make(chan struct{}), cancelled: make(chan struct{})}
+	target, client := newGRPCTestServer(t, cluster)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := grpcCall(ctx, client, target, nil, queryRequest("logs", "", true))
+		errs <- err
+	}()
+
+	// the first page is streamed, and the call is cancelled while the next one is searched
+	select {
+	case <-cluster.continued:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the scroll was never continued")
+	}
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the call did not return after being cancelled")
+	}
+	select {
+	case <-cluster.cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the search of the cluster was not cancelled with the call")
+	}
+}
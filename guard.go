@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// confirmLargeExport asks for confirmation before exporting count documents, more than the
+// threshold. Without a terminal to ask on, the export is refused and --yes is required
+func confirmLargeExport(count int64, threshold int64) error {
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stderr) {
+		return fmt.Errorf(
+			"the query matches %d documents, more than the --confirm-above threshold of %d. Pass --yes to export them anyway",
+			count, threshold,
+		)
+	}
+	fmt.Fprintf(os.Stderr, "The query matches %d documents, more than the --confirm-above threshold of %d. Export them all? [y/N] ", count, threshold)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	default:
+		return fmt.Errorf("export of %d documents aborted", count)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idsBatchSize is how many documents each multi get request of QueryIDs fetches
+const idsBatchSize = 1000
+
+// readIDs reads the document ids of an --ids-file, one per line. Blank lines and repeated ids
+// are skipped
+func readIDs(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ids file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var ids []string
+	seen := map[string]bool{}
+	lines := bufio.NewScanner(file)
+	for lines.Scan() {
+		id := strings.TrimSpace(lines.Text())
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ids file %s: %w", path, err)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("ids file %s has no ids", path)
+	}
+	return ids, nil
+}
+
+// mgetResult is the part of a multi get response QueryIDs reads
+type mgetResult struct {
+	Docs []map[string]json.RawMessage `json:"docs"`
+}
+
+// QueryIDs fetches the documents of the index with the given ids, in batches of multi get
+// requests, and writes them in the order of the ids. Ids without a document are logged, and
+// are the difference between the total and the fetched documents of the summary
+func (c *Client) QueryIDs(ctx context.Context, index string, ids []string, writer io.Writer) (*Summary, error) {
+	p := newProgress(1)
+	p.export = c.MetricsExport
+	ctx = withProgress(ctx, p)
+	ctx, span := startSpan(ctx, "esfetcher.ids", spanKindInternal, map[string]any{
+		"elasticsearch.index": index, "esfetcher.ids": len(ids),
+	})
+	start := time.Now()
+
+	p.recordSliceTotal(0, int64(len(ids)), true)
+	stopProgress := reportProgress(ctx, p, c.ProgressBar, c.SliceProgress)
+	err := c.queryIDs(ctx, index, ids, p, writer)
+	stopProgress()
+	p.finishSlice(0, err)
+	span.setAttribute("esfetcher.docs", p.docs.Load())
+	span.finish(err)
+	summary := p.summary(index, start, err)
+	if err != nil {
+		return summary, err
+	}
+	logDone(p, start)
+	return summary, nil
+}
+
+func (c *Client) queryIDs(ctx context.Context, index string, ids []string, p *progress, writer io.Writer) error {
+	params := url.Values{}
+	params.Set("_source", strconv.FormatBool(!c.IDsOnly))
+	if c.Routing != "" {
+		params.Set("routing", c.Routing)
+	}
+	path := c.indexPath(index, "_mget") + "?" + params.Encode()
+
+	var missing int
+	for page := 1; len(ids) > 0; page++ {
+		batch := ids[:min(idsBatchSize, len(ids))]
+		ids = ids[len(batch):]
+		body, err := json.Marshal(map[string][]string{"ids": batch})
+		if err != nil {
+			return fmt.Errorf("failed to marshal multi get request: %w", err)
+		}
+		pageStart := time.Now()
+		_, res, err := c.do(ctx, "POST", path, string(body))
+		if err != nil {
+			return err
+		}
+		took := time.Since(pageStart)
+		c.checkSlowPage(ctx, 0, page, took)
+
+		var result mgetResult
+		if err := json.Unmarshal(res, &result); err != nil {
+			return fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		hits := make([]json.RawMessage, 0, len(result.Docs))
+		for _, doc := range result.Docs {
+			var id string
+			json.Unmarshal(doc["_id"], &id)
+			if reason, ok := doc["error"]; ok {
+				return fmt.Errorf("failed to get document %s: %s", id, reason)
+			}
+			if found := string(doc["found"]); found != "true" {
+				missing++
+				slog.Debug(fmt.Sprintf("Document %s not found", id), "event", "id_not_found", "id", id)
+				continue
+			}
+			// the documents are written as search hits, which have no found field
+			delete(doc, "found")
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			encoder.SetEscapeHTML(false)
+			if err := encoder.Encode(doc); err != nil {
+				return fmt.Errorf("failed to encode hit: %w", err)
+			}
+			hits = append(hits, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		}
+		written, err := c.writeHits(hits, nil, writer)
+		if err != nil {
+			return err
+		}
+		p.recordPage(0, len(hits), written, took)
+	}
+	if missing > 0 {
+		slog.Warn(
+			fmt.Sprintf("%d of the %d ids were not found in %s", missing, p.totalDocs.Load(), index),
+			"event", "ids_not_found", "ids", missing,
+		)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// indices lists the names of the indices of the cluster matching pattern, sorted by name. An
+// empty pattern matches every index
+func (c *Client) indices(ctx context.Context, pattern string) ([]string, error) {
+	switch {
+	case c.Serverless:
+		return c.resolveIndices(ctx, pattern)
+	case c.AOSS:
+		return c.getIndices(ctx, pattern)
+	}
+	path := "_cat/indices"
+	if pattern != "" {
+		path += "/" + url.PathEscape(pattern)
+	}
+	params := url.Values{}
+	params.Set("h", "index")
+	params.Set("s", "index")
+	params.Set("format", "json")
+	_, data, err := c.do(ctx, "GET", path+"?"+params.Encode(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indices: %w", err)
+	}
+	var result []struct {
+		Index string `json:"index"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal indices: %w", err)
+	}
+	names := make([]string, 0, len(result))
+	for _, index := range result {
+		names = append(names, index.Index)
+	}
+	return names, nil
+}
+
+// resolveIndices lists the indices and data streams matching pattern with the resolve index API,
+// for serverless projects, which don't have the _cat APIs
+func (c *Client) resolveIndices(ctx context.Context, pattern string) ([]string, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	_, data, err := c.do(ctx, "GET", "_resolve/index/"+url.PathEscape(pattern), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indices: %w", err)
+	}
+	var result struct {
+		Indices []struct {
+			Name string `json:"name"`
+		} `json:"indices"`
+		DataStreams []struct {
+			Name string `json:"name"`
+		} `json:"data_streams"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal indices: %w", err)
+	}
+	names := make([]string, 0, len(result.Indices)+len(result.DataStreams))
+	for _, index := range result.Indices {
+		names = append(names, index.Name)
+	}
+	for _, stream := range result.DataStreams {
+		names = append(names, stream.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// getIndices lists the indices matching pattern with the get index API, for Amazon OpenSearch
+// Serverless collections, which have neither the _cat nor the resolve index APIs
+func (c *Client) getIndices(ctx context.Context, pattern string) ([]string, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	_, data, err := c.do(ctx, "GET", url.PathEscape(pattern), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list indices: %w", err)
+	}
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal indices: %w", err)
+	}
+	names := make([]string, 0, len(result))
+	for name := range result {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
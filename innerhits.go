@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// innerHitsModes are what --inner-hits can do with the inner hits of nested and has_child queries
+var innerHitsModes = []string{"embed", "explode"}
+
+// innerHits is the inner_hits of a hit, by the name of the inner hits definition
+type innerHits map[string]struct {
+	Hits struct {
+		Hits []map[string]json.RawMessage `json:"hits"`
+	} `json:"hits"`
+}
+
+// embedInnerHitsTransform moves the inner hits of the hits into their _source, as the array of
+// the _source of the inner hits under _inner_hits.<name>, dropping the search response envelope
+// around them so they read as part of the document
+func embedInnerHitsTransform() hitTransform {
+	return func(hit map[string]any) error {
+		inner, ok := hit["inner_hits"].(map[string]any)
+		if !ok {
+			return nil
+		}
+		delete(hit, "inner_hits")
+		source, ok := hit["_source"].(map[string]any)
+		if !ok {
+			source = map[string]any{}
+			hit["_source"] = source
+		}
+		embedded := map[string]any{}
+		for name, result := range inner {
+			var hits []any
+			if result, ok := result.(map[string]any); ok {
+				if outer, ok := result["hits"].(map[string]any); ok {
+					hits, _ = outer["hits"].([]any)
+				}
+			}
+			sources := make([]any, 0, len(hits))
+			for _, innerHit := range hits {
+				if innerHit, ok := innerHit.(map[string]any); ok {
+					sources = append(sources, innerHit["_source"])
+				}
+			}
+			embedded[name] = sources
+		}
+		source["_inner_hits"] = embedded
+		return nil
+	}
+}
+
+// explodeInnerHits replaces every hit by its inner hits, one output row each, with a _parent
+// reference to the _index and _id of the hit and the name of the inner hits definition in
+// _inner_hits. Hits without inner hits produce no rows. Only the first level of inner hits is
+// exploded, the inner hits of inner hits are kept in their rows as they are. The index of the hit
+// each row comes from is returned along
+func explodeInnerHits(hits []json.RawMessage) ([]json.RawMessage, []int, error) {
+	var out []json.RawMessage
+	var origins []int
+	for i, raw := range hits {
+		var hit struct {
+			Index     string    `json:"_index"`
+			ID        string    `json:"_id"`
+			InnerHits innerHits `json:"inner_hits"`
+		}
+		if err := json.Unmarshal(raw, &hit); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode hit: %w", err)
+		}
+		parent, err := json.Marshal(map[string]string{"_index": hit.Index, "_id": hit.ID})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode parent reference: %w", err)
+		}
+
+		// inner hits are exploded in a stable order, as they come in a json object
+		names := make([]string, 0, len(hit.InnerHits))
+		for name := range hit.InnerHits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			nameJSON, _ := json.Marshal(name)
+			for _, innerHit := range hit.InnerHits[name].Hits.Hits {
+				innerHit["_parent"] = parent
+				innerHit["_inner_hits"] = nameJSON
+				var buf bytes.Buffer
+				encoder := json.NewEncoder(&buf)
+				encoder.SetEscapeHTML(false)
+				if err := encoder.Encode(innerHit); err != nil {
+					return nil, nil, fmt.Errorf("failed to encode inner hit: %w", err)
+				}
+				out = append(out, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+				origins = append(origins, i)
+			}
+		}
+	}
+	return out, origins, nil
+}
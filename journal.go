@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Journal records the documents delivered to the output in a file, and drops the documents it
+// already has from later pages and runs, so the overlapping runs of an incremental sync and the
+// retries of a failed one don't write duplicates to sinks that can't deduplicate them. Documents
+// are identified by their _index and _id, and their _version when it is fetched, so updated
+// documents are delivered again. The journal is appended to right after every page is written:
+// a crash in between can still deliver that page twice. A nil *Journal is valid and keeps
+// nothing
+type Journal struct {
+	mu   sync.Mutex
+	file *os.File
+	seen map[string]bool
+}
+
+// OpenJournal opens the journal file at path, creating it when missing
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{seen: map[string]bool{}}
+	existing, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	default:
+		scanner := bufio.NewScanner(existing)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			if line := scanner.Bytes(); len(line) > 0 {
+				j.seen[string(line)] = true
+			}
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read journal %s: %w", path, err)
+		}
+	}
+
+	if j.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	slog.Debug(fmt.Sprintf("Journal %s has %d delivered documents", path, len(j.seen)), "event", "journal_opened", "docs", len(j.seen))
+	return j, nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// filter drops the hits the journal already has, returning the others and their keys, to
+// record once they are written
+func (j *Journal) filter(hits []json.RawMessage) ([]json.RawMessage, []string, error) {
+	if j == nil {
+		return hits, nil, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	kept := hits[:0:0]
+	var keys []string
+	for _, hit := range hits {
+		key, err := journalKey(hit)
+		if err != nil {
+			return nil, nil, err
+		}
+		if j.seen[key] {
+			continue
+		}
+		kept = append(kept, hit)
+		keys = append(keys, key)
+	}
+	if skipped := len(hits) - len(kept); skipped > 0 {
+		slog.Debug(fmt.Sprintf("Skipped %d documents already delivered", skipped), "event", "journal_skipped", "docs", skipped)
+	}
+	return kept, keys, nil
+}
+
+// record adds the keys of delivered hits to the journal, synced to disk before returning
+func (j *Journal) record(keys []string) error {
+	if j == nil || len(keys) == 0 {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var buf bytes.Buffer
+	for _, key := range keys {
+		j.seen[key] = true
+		buf.WriteString(key)
+		buf.WriteByte('\n')
+	}
+	if _, err := j.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
+
+// journalKey identifies a hit in the journal, as a json array of its _index, _id and _version
+func journalKey(hit json.RawMessage) (string, error) {
+	var meta struct {
+		Index   string `json:"_index"`
+		ID      string `json:"_id"`
+		Version *int64 `json:"_version"`
+	}
+	if err := json.Unmarshal(hit, &meta); err != nil {
+		return "", fmt.Errorf("failed to decode hit: %w", err)
+	}
+	key := []any{meta.Index, meta.ID}
+	if meta.Version != nil {
+		key = append(key, *meta.Version)
+	}
+	data, err := json.Marshal(key)
+	return string(data), err
+}
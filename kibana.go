@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// kibanaSavedObject is the part of a Kibana saved object esfetcher cares about, as returned by
+// the saved objects API
+type kibanaSavedObject struct {
+	Attributes struct {
+		Title         string     `json:"title"`
+		Columns       []string   `json:"columns"`
+		Sort          [][]string `json:"sort"`
+		TimeFieldName string     `json:"timeFieldName"`
+		TimeRestore   bool       `json:"timeRestore"`
+		TimeRange     *struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		} `json:"timeRange"`
+		KibanaSavedObjectMeta struct {
+			SearchSourceJSON string `json:"searchSourceJSON"`
+		} `json:"kibanaSavedObjectMeta"`
+	} `json:"attributes"`
+	References []struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	} `json:"references"`
+}
+
+// kibanaSearchSource is the search definition stored, json encoded, in saved searches
+type kibanaSearchSource struct {
+	Query *struct {
+		Query    any    `json:"query"`
+		Language string `json:"language"`
+	} `json:"query"`
+	Filter       []map[string]any `json:"filter"`
+	Index        any              `json:"index"`
+	IndexRefName string           `json:"indexRefName"`
+}
+
+// kibanaSearch is a Kibana saved search converted to an esfetcher run
+type kibanaSearch struct {
+	Title string
+	Index string
+	Query string
+}
+
+// kibanaSavedSearch fetches a saved search (a Discover session in recent versions) from Kibana
+// and converts its index pattern, query, filters, columns, sort and time range, when stored with
+// the search, to an index and query esfetcher can run. The Kibana URL can include the space, as
+// in https://kibana:5601/s/my-space
+func (c *Client) kibanaSavedSearch(ctx context.Context, kibanaURL string, id string) (*kibanaSearch, error) {
+	kibana := *c
+	kibana.ESURL = kibanaURL
+	kibana.CompatVersion = 0
+
+	var search kibanaSavedObject
+	if err := kibana.getSavedObject(ctx, "search", id, &search); err != nil {
+		return nil, err
+	}
+	attributes := search.Attributes
+	var source kibanaSearchSource
+	if err := json.Unmarshal([]byte(attributes.KibanaSavedObjectMeta.SearchSourceJSON), &source); err != nil {
+		return nil, fmt.Errorf("failed to parse the search source of Kibana saved search %s: %w", id, err)
+	}
+
+	// the data view is either referenced by id, or embedded for ad hoc data views
+	var dataView kibanaSavedObject
+	switch index := source.Index.(type) {
+	case map[string]any:
+		dataView.Attributes.Title, _ = index["title"].(string)
+		dataView.Attributes.TimeFieldName, _ = index["timeFieldName"].(string)
+	default:
+		dataViewID, _ := index.(string)
+		for _, ref := range search.References {
+			if source.IndexRefName != "" && ref.Name == source.IndexRefName {
+				dataViewID = ref.ID
+			}
+		}
+		if dataViewID == "" {
+			return nil, fmt.Errorf("Kibana saved search %s has no data view", id)
+		}
+		if err := kibana.getSavedObject(ctx, "index-pattern", dataViewID, &dataView); err != nil {
+			return nil, err
+		}
+	}
+
+	var filter, mustNot []any
+	if source.Query != nil {
+		switch source.Query.Language {
+		case "kuery", "":
+			text, _ := source.Query.Query.(string)
+			query, err := kqlToQuery(text)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert the query of Kibana saved search %s: %w", id, err)
+			}
+			filter = append(filter, query)
+		case "lucene":
+			switch query := source.Query.Query.(type) {
+			case string:
+				if query != "" {
+					filter = append(filter, map[string]any{"query_string": map[string]any{"query": query}})
+				}
+			case map[string]any:
+				filter = append(filter, query)
+			}
+		default:
+			return nil, fmt.Errorf("Kibana saved search %s uses the unsupported query language %s", id, source.Query.Language)
+		}
+	}
+	for _, f := range source.Filter {
+		meta, _ := f["meta"].(map[string]any)
+		if disabled, _ := meta["disabled"].(bool); disabled {
+			continue
+		}
+		// recent versions keep the query of the filter under "query", older ones at the top level
+		// next to meta
+		query, ok := f["query"].(map[string]any)
+		if !ok {
+			query = map[string]any{}
+			for key, value := range f {
+				if key != "meta" && key != "$state" {
+					query[key] = value
+				}
+			}
+		}
+		if negate, _ := meta["negate"].(bool); negate {
+			mustNot = append(mustNot, query)
+		} else {
+			filter = append(filter, query)
+		}
+	}
+	if attributes.TimeRestore && attributes.TimeRange != nil && dataView.Attributes.TimeFieldName != "" {
+		filter = append(filter, map[string]any{"range": map[string]any{
+			dataView.Attributes.TimeFieldName: map[string]any{
+				"gte": attributes.TimeRange.From, "lte": attributes.TimeRange.To,
+			},
+		}})
+	}
+
+	boolQuery := map[string]any{}
+	if len(filter) > 0 {
+		boolQuery["filter"] = filter
+	}
+	if len(mustNot) > 0 {
+		boolQuery["must_not"] = mustNot
+	}
+	body := map[string]any{"query": map[string]any{"bool": boolQuery}}
+	if len(attributes.Columns) > 0 && !(len(attributes.Columns) == 1 && attributes.Columns[0] == "_source") {
+		body["_source"] = attributes.Columns
+	}
+	if len(attributes.Sort) > 0 {
+		var sort []any
+		for _, s := range attributes.Sort {
+			if len(s) == 2 {
+				sort = append(sort, map[string]any{s[0]: map[string]any{"order": s[1]}})
+			}
+		}
+		body["sort"] = sort
+	}
+	query, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the query of Kibana saved search %s: %w", id, err)
+	}
+	return &kibanaSearch{Title: attributes.Title, Index: dataView.Attributes.Title, Query: string(query)}, nil
+}
+
+func (c *Client) getSavedObject(ctx context.Context, kind string, id string, object *kibanaSavedObject) error {
+	_, data, err := c.do(ctx, "GET", fmt.Sprintf("api/saved_objects/%s/%s", kind, url.PathEscape(id)), "")
+	if err != nil {
+		return fmt.Errorf("failed to fetch Kibana %s %s: %w", kind, id, err)
+	}
+	if err := json.Unmarshal(data, object); err != nil {
+		return fmt.Errorf("failed to unmarshal Kibana %s %s: %w", kind, id, err)
+	}
+	return nil
+}
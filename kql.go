@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// kqlToQuery translates a Kibana Query Language (KQL) expression to an Elasticsearch query, the
+// way Kibana does it for the common cases: field:value, field:"phrase", field:(a or b), field:*,
+// wildcards, ranges, free text, and/or/not and parentheses. Nested field queries (field:{...})
+// are not supported
+func kqlToQuery(kql string) (map[string]any, error) {
+	tokens, err := kqlTokenize(kql)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return map[string]any{"match_all": map[string]any{}}, nil
+	}
+	p := &kqlParser{tokens: tokens}
+	query, err := p.parseOr(nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != kqlEOF {
+		return nil, fmt.Errorf("invalid KQL %q: unexpected %s", kql, p.peek())
+	}
+	return query, nil
+}
+
+type kqlTokenKind int
+
+const (
+	kqlEOF kqlTokenKind = iota
+	kqlLiteral
+	kqlLParen
+	kqlRParen
+	kqlColon
+	kqlRange
+	kqlAnd
+	kqlOr
+	kqlNot
+	kqlLBrace
+	kqlRBrace
+)
+
+type kqlToken struct {
+	kind     kqlTokenKind
+	value    string
+	quoted   bool
+	wildcard bool
+	// value as a query_string query, for wildcard literals: escaped but for the wildcards
+	pattern string
+}
+
+func (t kqlToken) String() string {
+	switch t.kind {
+	case kqlEOF:
+		return "end of query"
+	case kqlLiteral:
+		return fmt.Sprintf("%q", t.value)
+	default:
+		return fmt.Sprintf("'%s'", t.value)
+	}
+}
+
+const kqlSpecial = `\():<>"{}`
+
+// luceneReserved are the characters query_string queries give a meaning to, escaped in the
+// values of wildcard literals as Kibana does, except the * and ? wildcards
+const luceneReserved = `+-=&|><!(){}[]^"~*?:\/`
+
+// luceneEscape escapes r for a query_string query, whitespace included so a value with spaces
+// stays a single term
+func luceneEscape(r rune) string {
+	if strings.ContainsRune(luceneReserved, r) || unicode.IsSpace(r) {
+		return `\` + string(r)
+	}
+	return string(r)
+}
+
+func kqlTokenize(s string) ([]kqlToken, error) {
+	var tokens []kqlToken
+	runes := []rune(s)
+	i := 0
+	// keywordAt reports the length of the and/or/not keyword starting at j, which must be
+	// followed by whitespace or a parenthesis
+	keywordAt := func(j int) (kqlTokenKind, int) {
+		for _, kw := range []struct {
+			word string
+			kind kqlTokenKind
+		}{{"and", kqlAnd}, {"or", kqlOr}, {"not", kqlNot}} {
+			end := j + len(kw.word)
+			if end < len(runes) && strings.EqualFold(string(runes[j:end]), kw.word) &&
+				(unicode.IsSpace(runes[end]) || runes[end] == '(') {
+				return kw.kind, len(kw.word)
+			}
+		}
+		return kqlEOF, 0
+	}
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, kqlToken{kind: kqlLParen, value: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, kqlToken{kind: kqlRParen, value: ")"})
+			i++
+		case r == '{':
+			tokens = append(tokens, kqlToken{kind: kqlLBrace, value: "{"})
+			i++
+		case r == '}':
+			tokens = append(tokens, kqlToken{kind: kqlRBrace, value: "}"})
+			i++
+		case r == ':':
+			tokens = append(tokens, kqlToken{kind: kqlColon, value: ":"})
+			i++
+		case r == '<' || r == '>':
+			op := string(r)
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				op += "="
+				i++
+			}
+			tokens = append(tokens, kqlToken{kind: kqlRange, value: op})
+		case r == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, fmt.Errorf("invalid KQL %q: unterminated quoted string", s)
+			}
+			i++
+			tokens = append(tokens, kqlToken{kind: kqlLiteral, value: b.String(), quoted: true})
+		default:
+			if kind, n := keywordAt(i); n > 0 && (kind == kqlNot || len(tokens) > 0) {
+				tokens = append(tokens, kqlToken{kind: kind, value: string(runes[i : i+n])})
+				i += n
+				continue
+			}
+			// unquoted literals run until a special character or a keyword, and may contain
+			// whitespace, as in message:hello world
+			var b, pattern strings.Builder
+			token := kqlToken{kind: kqlLiteral}
+			for i < len(runes) {
+				r := runes[i]
+				if r == '\\' && i+1 < len(runes) {
+					b.WriteRune(runes[i+1])
+					pattern.WriteString(luceneEscape(runes[i+1]))
+					i += 2
+					continue
+				}
+				if strings.ContainsRune(kqlSpecial, r) {
+					break
+				}
+				if unicode.IsSpace(r) {
+					j := i
+					for j < len(runes) && unicode.IsSpace(runes[j]) {
+						j++
+					}
+					if _, n := keywordAt(j); j == len(runes) || n > 0 || strings.ContainsRune(kqlSpecial, runes[j]) {
+						break
+					}
+				}
+				if r == '*' {
+					token.wildcard = true
+				}
+				if r == '*' || r == '?' {
+					pattern.WriteRune(r)
+				} else {
+					pattern.WriteString(luceneEscape(r))
+				}
+				b.WriteRune(r)
+				i++
+			}
+			token.value = strings.TrimSpace(b.String())
+			token.pattern = pattern.String()
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+type kqlParser struct {
+	tokens []kqlToken
+	pos    int
+}
+
+func (p *kqlParser) peek() kqlToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return kqlToken{kind: kqlEOF}
+}
+
+func (p *kqlParser) next() kqlToken {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// The parse functions take the field the expression applies to, which is only set inside the
+// value list of field:(a or b). The grammar is the same at both levels, except that only values
+// are allowed inside a value list
+
+func (p *kqlParser) parseOr(field *string) (map[string]any, error) {
+	var clauses []any
+	for {
+		query, err := p.parseAnd(field)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, query)
+		if p.peek().kind != kqlOr {
+			break
+		}
+		p.next()
+	}
+	if len(clauses) == 1 {
+		return clauses[0].(map[string]any), nil
+	}
+	return map[string]any{"bool": map[string]any{"should": clauses, "minimum_should_match": 1}}, nil
+}
+
+func (p *kqlParser) parseAnd(field *string) (map[string]any, error) {
+	var clauses []any
+	for {
+		query, err := p.parseNot(field)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, query)
+		if p.peek().kind != kqlAnd {
+			break
+		}
+		p.next()
+	}
+	if len(clauses) == 1 {
+		return clauses[0].(map[string]any), nil
+	}
+	return map[string]any{"bool": map[string]any{"filter": clauses}}, nil
+}
+
+func (p *kqlParser) parseNot(field *string) (map[string]any, error) {
+	if p.peek().kind != kqlNot {
+		return p.parseSub(field)
+	}
+	p.next()
+	query, err := p.parseSub(field)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"bool": map[string]any{"must_not": query}}, nil
+}
+
+func (p *kqlParser) parseSub(field *string) (map[string]any, error) {
+	t := p.next()
+	switch t.kind {
+	case kqlLParen:
+		query, err := p.parseOr(field)
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != kqlRParen {
+			return nil, fmt.Errorf("invalid KQL: expected ')', got %s", t)
+		}
+		return query, nil
+	case kqlLiteral:
+	default:
+		return nil, fmt.Errorf("invalid KQL: unexpected %s", t)
+	}
+
+	if field != nil {
+		return kqlFieldValue(*field, t), nil
+	}
+	switch p.peek().kind {
+	case kqlColon:
+		p.next()
+		name := t.value
+		switch p.peek().kind {
+		case kqlLParen:
+			p.next()
+			query, err := p.parseOr(&name)
+			if err != nil {
+				return nil, err
+			}
+			if t := p.next(); t.kind != kqlRParen {
+				return nil, fmt.Errorf("invalid KQL: expected ')', got %s", t)
+			}
+			return query, nil
+		case kqlLBrace:
+			return nil, fmt.Errorf("nested field queries (%s:{...}) are not supported", name)
+		case kqlLiteral:
+			return kqlFieldValue(name, p.next()), nil
+		default:
+			return nil, fmt.Errorf("invalid KQL: expected a value for field %s, got %s", name, p.peek())
+		}
+	case kqlRange:
+		op := p.next().value
+		value := p.next()
+		if value.kind != kqlLiteral {
+			return nil, fmt.Errorf("invalid KQL: expected a value for range on field %s, got %s", t.value, value)
+		}
+		ops := map[string]string{"<": "lt", "<=": "lte", ">": "gt", ">=": "gte"}
+		return map[string]any{"range": map[string]any{t.value: map[string]any{ops[op]: value.value}}}, nil
+	default:
+		return kqlFreeText(t), nil
+	}
+}
+
+func kqlFieldValue(field string, value kqlToken) map[string]any {
+	switch {
+	case value.quoted:
+		return map[string]any{"match_phrase": map[string]any{field: value.value}}
+	case value.pattern == "*":
+		return map[string]any{"exists": map[string]any{"field": field}}
+	case value.wildcard:
+		return map[string]any{"query_string": map[string]any{"query": value.pattern, "fields": []string{field}}}
+	default:
+		return map[string]any{"match": map[string]any{field: value.value}}
+	}
+}
+
+func kqlFreeText(value kqlToken) map[string]any {
+	switch {
+	case value.quoted:
+		return map[string]any{"multi_match": map[string]any{"type": "phrase", "query": value.value, "lenient": true}}
+	case value.wildcard:
+		return map[string]any{"query_string": map[string]any{"query": value.pattern}}
+	default:
+		return map[string]any{"multi_match": map[string]any{"type": "best_fields", "query": value.value, "lenient": true}}
+	}
+}
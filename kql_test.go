@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestKQLToQuery(t *testing.T) {
+	tests := []struct {
+		kql   string
+		query string
+	}{
+		{``, `{"match_all":{}}`},
+		{`status:200`, `{"match":{"status":"200"}}`},
+		{`message:"hello world"`, `{"match_phrase":{"message":"hello world"}}`},
+		{`host:*`, `{"exists":{"field":"host"}}`},
+		{`host:\*`, `{"match":{"host":"*"}}`},
+		{`name:foo\*bar`, `{"match":{"name":"foo*bar"}}`},
+		{`host:web-*`, `{"query_string":{"fields":["host"],"query":"web\\-*"}}`},
+		{`name:a?b*`, `{"query_string":{"fields":["name"],"query":"a?b*"}}`},
+		{`name:foo\*bar*`, `{"query_string":{"fields":["name"],"query":"foo\\*bar*"}}`},
+		{`path:/var/log/*.log`, `{"query_string":{"fields":["path"],"query":"\\/var\\/log\\/*.log"}}`},
+		{`url:http\://x*`, `{"query_string":{"fields":["url"],"query":"http\\:\\/\\/x*"}}`},
+		{`tag:c++*`, `{"query_string":{"fields":["tag"],"query":"c\\+\\+*"}}`},
+		{`message:hello wor*`, `{"query_string":{"fields":["message"],"query":"hello\\ wor*"}}`},
+		{`err*`, `{"query_string":{"query":"err*"}}`},
+		{`a=b*`, `{"query_string":{"query":"a\\=b*"}}`},
+		{`error`, `{"multi_match":{"lenient":true,"query":"error","type":"best_fields"}}`},
+		{`"out of memory"`, `{"multi_match":{"lenient":true,"query":"out of memory","type":"phrase"}}`},
+		{`bytes >= 100`, `{"range":{"bytes":{"gte":"100"}}}`},
+		{
+			`a:1 and not b:2`,
+			`{"bool":{"filter":[{"match":{"a":"1"}},{"bool":{"must_not":{"match":{"b":"2"}}}}]}}`,
+		},
+		{
+			`a:(x or y*)`,
+			`{"bool":{"minimum_should_match":1,"should":[{"match":{"a":"x"}},{"query_string":{"fields":["a"],"query":"y*"}}]}}`,
+		},
+		{
+			`(a:1 or b:2) and c:3`,
+			`{"bool":{"filter":[{"bool":{"minimum_should_match":1,"should":[{"match":{"a":"1"}},{"match":{"b":"2"}}]}},{"match":{"c":"3"}}]}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.kql, func(t *testing.T) {
+			query, err := kqlToQuery(test.kql)
+			if err != nil {
+				t.Fatalf("kqlToQuery(%q) failed: %v", test.kql, err)
+			}
+			got, err := json.Marshal(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.query {
+				t.Errorf("kqlToQuery(%q) = %s, want %s", test.kql, got, test.query)
+			}
+		})
+	}
+}
+
+func TestKQLToQueryErrors(t *testing.T) {
+	for _, kql := range []string{`a:{b:1}`, `message:"unterminated`, `(a:1`, `a:`, `bytes >`} {
+		if query, err := kqlToQuery(kql); err == nil {
+			t.Errorf("kqlToQuery(%q) = %v, want an error", kql, query)
+		}
+	}
+}
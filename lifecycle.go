@@ -0,0 +1,141 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lifecycleIndices returns the indices pattern resolves to, as the backing indices of a data
+// stream or an alias, from the oldest to the newest by creation date. With skipHot, the indices
+// index lifecycle management hasn't rolled over yet, which are still written to, are left out
+func (c *Client) lifecycleIndices(ctx context.Context, pattern string, skipHot bool) ([]string, error) {
+	_, data, err := c.do(ctx, "GET", pattern+"/_settings/index.creation_date?flat_settings=true", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the indices of %s: %w", pattern, err)
+	}
+	var settings map[string]struct {
+		Settings map[string]string `json:"settings"`
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the settings of %s: %w", pattern, err)
+	}
+	created := make(map[string]int64, len(settings))
+	indices := make([]string, 0, len(settings))
+	for index, s := range settings {
+		created[index], _ = strconv.ParseInt(s.Settings["index.creation_date"], 10, 64)
+		indices = append(indices, index)
+	}
+	slices.SortFunc(indices, func(a, b string) int {
+		return cmp.Or(cmp.Compare(created[a], created[b]), strings.Compare(a, b))
+	})
+
+	if skipHot {
+		hot, err := c.hotIndices(ctx, pattern)
+		if err != nil {
+			return nil, err
+		}
+		indices = slices.DeleteFunc(indices, func(index string) bool { return hot[index] })
+		if len(indices) == 0 {
+			return nil, fmt.Errorf("all the indices of %s are still written to, there is nothing to export with --skip-hot", pattern)
+		}
+	}
+	slog.Debug(fmt.Sprintf("Indices of %s, oldest first: %s", pattern, strings.Join(indices, ", ")), "event", "lifecycle_indices", "indices", indices)
+	return indices, nil
+}
+
+// hotIndices returns the indices of pattern that index lifecycle management hasn't rolled over
+// yet: the ones waiting in the rollover action of their policy, which receive the writes of
+// their alias or data stream
+func (c *Client) hotIndices(ctx context.Context, pattern string) (map[string]bool, error) {
+	if c.Flavor != flavorElasticsearch || c.Serverless {
+		return nil, fmt.Errorf("--skip-hot needs the index lifecycle management of Elasticsearch, which %s doesn't have", c.Flavor)
+	}
+	_, data, err := c.do(ctx, "GET", pattern+"/_ilm/explain", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the lifecycle of the indices of %s: %w", pattern, err)
+	}
+	var explain struct {
+		Indices map[string]struct {
+			Managed bool   `json:"managed"`
+			Phase   string `json:"phase"`
+			Action  string `json:"action"`
+		} `json:"indices"`
+	}
+	if err := json.Unmarshal(data, &explain); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the lifecycle of the indices of %s: %w", pattern, err)
+	}
+	hot := map[string]bool{}
+	managed := 0
+	for index, lifecycle := range explain.Indices {
+		if !lifecycle.Managed {
+			continue
+		}
+		managed++
+		if lifecycle.Action == "rollover" {
+			hot[index] = true
+			slog.Info(fmt.Sprintf("Skipping index %s, still written to until it rolls over", index), "event", "skip_hot_index", "index", index, "phase", lifecycle.Phase)
+		}
+	}
+	if managed == 0 {
+		slog.Warn(
+			fmt.Sprintf("None of the indices of %s is managed by index lifecycle management, --skip-hot can't tell which are still written to and skips none", pattern),
+			"event", "skip_hot_unmanaged",
+		)
+	}
+	return hot, nil
+}
+
+// QueryIndices runs the query against every index in turn, in the given order, writing all their
+// documents to the writer. It stops at the first index that fails. The summary adds up the ones
+// of the indices, under the name pattern
+func (c *Client) QueryIndices(ctx context.Context, pattern string, indices []string, query string, slices int, writer io.Writer) (*Summary, error) {
+	start := time.Now()
+	summaries := make([]*Summary, 0, len(indices))
+	var err error
+	for i, index := range indices {
+		slog.Info(fmt.Sprintf("Exporting index %s (%d of %d)", index, i+1, len(indices)), "event", "index_start", "index", index)
+		var summary *Summary
+		summary, err = c.Query(ctx, index, query, true, slices, writer)
+		summaries = append(summaries, summary)
+		if err != nil {
+			err = fmt.Errorf("index %s: %w", index, err)
+			break
+		}
+	}
+	return mergeSummaries(pattern, start, summaries, err), err
+}
+
+// mergeSummaries adds up the summaries of the queries of an export, slice by slice
+func mergeSummaries(index string, start time.Time, summaries []*Summary, err error) *Summary {
+	merged := newProgress(0).summary(index, start, err)
+	for _, s := range summaries {
+		merged.Docs += s.Docs
+		merged.TotalDocs += s.TotalDocs
+		merged.Bytes += s.Bytes
+		merged.Retries += s.Retries
+		merged.ShardFailures += s.ShardFailures
+		merged.TimedOutPages += s.TimedOutPages
+		merged.TookMillis += s.TookMillis
+		for _, slice := range s.Slices {
+			if slice.Slice >= len(merged.Slices) {
+				merged.Slices = append(merged.Slices, SliceSummary{Slice: slice.Slice, Done: true})
+			}
+			m := &merged.Slices[slice.Slice]
+			m.Docs += slice.Docs
+			m.TotalDocs += slice.TotalDocs
+			m.Bytes += slice.Bytes
+			m.Pages += slice.Pages
+			m.Done = m.Done && slice.Done
+			m.Error = cmp.Or(m.Error, slice.Error)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// setupLogging configures the default logger with the minimum level to log and the output
+// format, either text or json. quiet overrides the level so only errors are logged
+func setupLogging(level string, format string, quiet bool) error {
+	if quiet {
+		level = "error"
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(strings.ToLower(level))); err != nil {
+		return fmt.Errorf("invalid log level %q, expected one of debug, info, warn or error", level)
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = &textHandler{level: lvl, writer: os.Stderr, mu: &sync.Mutex{}}
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: lvl})
+	default:
+		return fmt.Errorf("invalid log format %q, expected either text or json", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// fatal logs the error and exits the program with the exit code matching the error class
+func fatal(err error) {
+	code := exitCode(err)
+	slog.Error(err.Error(), "event", "error", "exit_code", code)
+	os.Exit(code)
+}
+
+type sliceKey struct{}
+
+// withSlice marks the context as belonging to the given slice, so every record logged with it
+// carries the slice id
+func withSlice(ctx context.Context, slice int) context.Context {
+	return context.WithValue(ctx, sliceKey{}, slice)
+}
+
+// contextHandler adds information carried by the context to log records
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if slice, ok := ctx.Value(sliceKey{}).(int); ok {
+		r.AddAttrs(slog.Int("slice", slice))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// textHandler writes human readable log lines in the same format as the standard log package.
+// Messages are expected to be self describing, so attributes are only kept for json output
+type textHandler struct {
+	level  slog.Leveler
+	writer io.Writer
+	mu     *sync.Mutex
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	line := fmt.Sprintf("%s %s %s\n", r.Time.Format("2006/01/02 15:04:05"), r.Level, r.Message)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.writer, line)
+	return err
+}
+
+func (h *textHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *textHandler) WithGroup(string) slog.Handler {
+	return h
+}
@@ -1,24 +1,241 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alexflint/go-arg"
+	"golang.org/x/sync/semaphore"
 )
 
 type args struct {
-	ESURL       string `arg:"-u,--elasticsearch-url,required" help:"URL of the Elasticsearch cluster"`
-	User        string `arg:"env:ES_USER" help:"Basic Auth User to authenticate with Elasticsearch"`
-	Password    string `arg:"env:ES_PASSWD" help:"Basic Auth Password to authenticate with Elasticsearch"`
-	Index       string `arg:"-i,--index,required" help:"Index to search in"`
-	QueryString string `arg:"-q,--query" help:"Query to run against the index"`
-	QueryFile   string `arg:"-f,--query-file" help:"File containing the query to run against the index"`
-	FetchAll    bool   `arg:"-a,--fetch-all" help:"Fetch all results from the query by paginating through it. Use with caution, as this can be a lot of data. See also --slices"`
-	Slices      int    `arg:"-s,--slices" default:"1" help:"Number of slices to use for the scroll query. Improves fetching performance by running queries in parallel. Only relevant if --fetch-all is passed. NOTE: Do not set a number of slices greater than the number of shards in the queried index. See more at https://www.elastic.co/guide/en/elasticsearch/reference/current/paginate-search-results.html"`
+	ESURL            string   `arg:"-u,--elasticsearch-url,env:ES_URL" help:"URL of the Elasticsearch cluster. Required"`
+	Clusters         []string `arg:"--cluster,separate,env:ESFETCHER_CLUSTER" help:"Run the query against this cluster instead of --elasticsearch-url, as NAME=URL, e.g. eu=https://es.eu.example.com:9200. Can be repeated to query several independent clusters concurrently, with the same authentication, merging their hits to the standard output with the NAME of their cluster in a _cluster field. Only for jsonl"`
+	User             string   `arg:"env:ES_USER" help:"Basic Auth User to authenticate with Elasticsearch"`
+	Password         string   `arg:"env:ES_PASSWD" help:"Basic Auth Password to authenticate with Elasticsearch"`
+	PasswordFile     string   `arg:"--password-file,env:ES_PASSWORD_FILE" help:"File containing the Basic Auth Password, used when --password is not set. Trailing newlines are ignored"`
+	TokenFile        string   `arg:"--token-file,env:ES_TOKEN_FILE" help:"File containing an Elasticsearch service account token to authenticate with instead of Basic Auth, as mounted from a Kubernetes secret. The file is read again when it changes, so rotated tokens are used without restarting"`
+	CACert           string   `arg:"--ca-cert,env:ES_CA_CERT" help:"PEM file with the certificate authorities to trust when connecting to Elasticsearch over https"`
+	TLSMinVersion    string   `arg:"--tls-min-version,env:ESFETCHER_TLS_MIN_VERSION" help:"Minimum TLS version to connect to the cluster with: 1.0, 1.1, 1.2 or 1.3. Defaults to 1.2"`
+	TLSCiphers       string   `arg:"--tls-ciphers,env:ESFETCHER_TLS_CIPHERS" help:"Comma separated TLS 1.2 cipher suites allowed, e.g. TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 for FIPS approved suites only. TLS 1.3 suites are not configurable"`
+	Resolve          []string `arg:"--resolve,separate,env:ESFETCHER_RESOLVE" help:"Connect to this address for a host and port, as HOST:PORT:ADDRESS like curl, e.g. es.internal:9200:10.1.2.3, for hosts that only resolve on other networks. Certificates are still verified for the host. Can be repeated"`
+	DNSServer        string   `arg:"--dns-server,env:ESFETCHER_DNS_SERVER" help:"Resolve host names with this DNS server, as HOST or HOST:PORT, instead of the system resolver, e.g. for split-horizon DNS"`
+	IPVersion        string   `arg:"--ip-version,env:ESFETCHER_IP_VERSION" default:"auto" help:"Address family to connect to the cluster with: 4, 6, or auto for both. Set to 4 where broken IPv6 routes make connections hang"`
+	SNI              string   `arg:"--sni,env:ESFETCHER_SNI" help:"Server name sent in the TLS handshake, and certificates are verified for, instead of the host of the URL. For clusters reached by address behind SNI routing proxies"`
+	HostHeader       string   `arg:"--host-header,env:ESFETCHER_HOST_HEADER" help:"Host header sent instead of the host of the URL, for clusters reached by address behind proxies routing on the host name"`
+	Flavor           string   `arg:"--flavor,env:ES_FLAVOR" default:"auto" help:"Flavor of the cluster: elasticsearch, opensearch, or auto to detect it on startup"`
+	CompatVersion    int      `arg:"--compat-version,env:ESFETCHER_COMPAT_VERSION" help:"Send REST compatibility headers asking the cluster to behave as this major version of Elasticsearch, as 8 to keep working against Elasticsearch 9 clusters"`
+	Serverless       bool     `arg:"--serverless,env:ESFETCHER_SERVERLESS" help:"The cluster is an Elastic Cloud Serverless project, which doesn't support scrolls: fetch all results with point in time searches instead. Detected on startup when the cluster allows it"`
+	AWSRegion        string   `arg:"--aws-region,env:ESFETCHER_AWS_REGION" help:"Sign requests with AWS Signature Version 4 for this region, as Amazon OpenSearch Service requires. Credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN env vars or the shared credentials file"`
+	AWSService       string   `arg:"--aws-service,env:ESFETCHER_AWS_SERVICE" default:"es" help:"AWS service name requests are signed for: es for Amazon OpenSearch Service domains, aoss for Amazon OpenSearch Serverless"`
+	Index            string   `arg:"-i,--index,env:ES_INDEX" help:"Index to search in. Required"`
+	DocType          string   `arg:"--doc-type,env:ES_DOC_TYPE" help:"Only search documents of this mapping type, for indices of Elasticsearch 6.x and older holding several types. Mapping types were removed in Elasticsearch 8.0"`
+	Routing          string   `arg:"--routing,env:ESFETCHER_ROUTING" help:"Comma separated routing values, as tenant ids, of the documents to fetch from an index with custom routing. Only the shards they route to are searched, which is much faster than searching all of them"`
+	OldestFirst      bool     `arg:"--oldest-first,env:ESFETCHER_OLDEST_FIRST" help:"Export the indices --index resolves to, as the backing indices of a data stream or an alias, one after another from the oldest to the newest by creation date, instead of searching them all at once. Needs --fetch-all"`
+	SkipHot          bool     `arg:"--skip-hot,env:ESFETCHER_SKIP_HOT" help:"Leave out the indices index lifecycle management hasn't rolled over yet, which are still written to, so archive jobs only export indices that won't change anymore. Needs --fetch-all"`
+	QueryString      string   `arg:"-q,--query,env:ESFETCHER_QUERY" help:"Query to run against the index"`
+	QueryFile        string   `arg:"-f,--query-file,env:ESFETCHER_QUERY_FILE" help:"File containing the query to run against the index"`
+	Params           string   `arg:"--params,env:ESFETCHER_PARAMS" help:"JSON or YAML file with the values of the {{name}} placeholders of the query. Strings fill placeholders inside json strings, as \"user\": \"{{user}}\", while arrays, numbers and objects replace the whole quoted placeholder, so \"terms\": {\"user\": \"{{users}}\"} takes a list. --param values of saved queries take precedence"`
+	PitID            string   `arg:"--pit-id,env:ESFETCHER_PIT_ID" help:"Fetch all results from this point in time, opened with pit open, instead of a scroll, so several exports see the same snapshot of the index. It is neither extended nor closed"`
+	IDsFile          string   `arg:"--ids-file,env:ESFETCHER_IDS_FILE" help:"Fetch the documents with the ids of this file, one per line, with batched multi get requests instead of a search. Ids without a document are logged. --index must be a single index or an alias of one"`
+	QueryDir         string   `arg:"--query-dir,env:ESFETCHER_QUERY_DIR" help:"Run every query of this directory, its .json files, or of the files matching this glob, e.g. 'queries/daily-*.json', writing the hits of each to the file named by --batch-output. A failed query is logged and the others still run"`
+	BatchOutput      string   `arg:"--batch-output,env:ESFETCHER_BATCH_OUTPUT" default:"{{name}}.jsonl" help:"Path of the file the hits of every --query-dir query are written to, with {{name}} replaced by the name of the query file without its extension and {{date}} by the current date, e.g. exports/{{date}}/{{name}}.csv. Missing directories are created"`
+	BatchParallel    int      `arg:"--batch-parallel,env:ESFETCHER_BATCH_PARALLEL" default:"1" help:"How many --query-dir queries run at the same time"`
+	Manifest         string   `arg:"--manifest,env:ESFETCHER_MANIFEST" help:"Write a json manifest of the files written by the --query-dir queries to this file: the path, number of documents, size and sha256 checksum of every file, with the query and --params it ran with, and the queries that failed. For loaders and auditors to verify the export is complete"`
+	FetchAll         bool     `arg:"-a,--fetch-all,env:ESFETCHER_FETCH_ALL" help:"Fetch all results from the query by paginating through it. Use with caution, as this can be a lot of data. See also --slices"`
+	ConfirmAbove     int64    `arg:"--confirm-above,env:ESFETCHER_CONFIRM_ABOVE" default:"10000000" help:"Ask for confirmation before fetching all results of a query matching more documents than this. Without a terminal, --yes is required instead. Set to 0 to never ask"`
+	Check            bool     `arg:"--check,env:ESFETCHER_CHECK" help:"Check the cluster answers, the credentials, that the index exists and the query is valid, and the health of the index, report the results and exit without fetching anything. A lighter check, of the index existing and its shards being available, runs before every export"`
+	Yes              bool     `arg:"-y,--yes,env:ESFETCHER_YES" help:"Fetch all results without asking for confirmation, whatever the number of matching documents"`
+	ShardReport      bool     `arg:"--shard-report,env:ESFETCHER_SHARD_REPORT" help:"Report the shards of the index before fetching: the primary shards, documents and size of every index, how the shards are spread over the nodes, and hints on the --slices to use and the hot spots to expect. Written to stderr, or to the standard output with --check"`
+	MaxTotalHits     int64    `arg:"--max-total-hits,env:ESFETCHER_MAX_TOTAL_HITS" help:"Fail before fetching anything, with exit code 9, when the query matches more documents than this. Meant for pipelines where a huge result means a bad query"`
+	MaxEstimatedSize string   `arg:"--max-estimated-size,env:ESFETCHER_MAX_ESTIMATED_SIZE" help:"Fail before fetching anything, with exit code 9, when the export is estimated larger than this size, e.g. 50GB. The estimate, logged before every --fetch-all, is the number of matching documents times the average size of the hits of a sample page"`
+	KeepPartial      bool     `arg:"--keep-partial,env:ESFETCHER_KEEP_PARTIAL" help:"Let the other slices finish when one fails for good, instead of stopping them all, keeping what they exported. The export still fails, with exit code 10, and the summary and the --manifest list the slices whose documents are missing"`
+	Slices           int      `arg:"-s,--slices,env:ESFETCHER_SLICES" default:"1" help:"Number of slices to use for the scroll query. Improves fetching performance by running queries in parallel. Only relevant if --fetch-all is passed. NOTE: Do not set a number of slices greater than the number of shards in the queried index. See more at https://www.elastic.co/guide/en/elasticsearch/reference/current/paginate-search-results.html"`
+	ProgressBar      bool     `arg:"-p,--progress-bar,env:ESFETCHER_PROGRESS_BAR" help:"Show a progress bar with throughput and ETA on stderr while fetching all results. Falls back to periodic log lines when stderr is not a terminal"`
+	SliceProgress    bool     `arg:"--slice-progress,env:ESFETCHER_SLICE_PROGRESS" help:"Also report the progress of every slice (documents fetched, latency of the last page, done or active) on each periodic progress log line, to spot straggler slices. Not shown with --progress-bar"`
+	Quiet            bool     `arg:"--quiet,env:ESFETCHER_QUIET" help:"Only log errors. Suppresses progress reporting"`
+	LogLevel         string   `arg:"--log-level,env:ESFETCHER_LOG_LEVEL" default:"info" help:"Minimum level of log messages to show: debug, info, warn or error. debug logs every request sent to Elasticsearch"`
+	LogFormat        string   `arg:"--log-format,env:ESFETCHER_LOG_FORMAT" default:"text" help:"Format of log messages: text or json. json emits structured records (event, slice, docs, bytes, duration, ...) suitable for log pipelines"`
+	TraceHTTP        bool     `arg:"--trace-http,env:ESFETCHER_TRACE_HTTP" help:"Dump every request and response exchanged with Elasticsearch (method, URL, headers, request body, status and timing) to stderr. Credentials are redacted"`
+	TraceFile        string   `arg:"--trace-file,env:ESFETCHER_TRACE_FILE" help:"Write the --trace-http dump to this file instead of stderr"`
+	Summary          bool     `arg:"--summary,env:ESFETCHER_SUMMARY" help:"Print a json summary of the run (totals, per slice counts, bytes, retries, shard failures and duration) to stderr on completion or failure"`
+	SummaryFile      string   `arg:"--summary-file,env:ESFETCHER_SUMMARY_FILE" help:"Write the json run summary to this file instead of stderr. Implies --summary"`
+	MetricsListen    string   `arg:"--metrics-listen,env:ESFETCHER_METRICS_LISTEN" help:"Expose Prometheus metrics (docs fetched, bytes, request latencies, retries, errors and per slice progress) at /metrics on this address, e.g. :9090"`
+	ReportRuntime    bool     `arg:"--report-runtime,env:ESFETCHER_REPORT_RUNTIME" help:"Log the heap in use, garbage collections and goroutines of esfetcher every 30s, to diagnose its own performance on big exports"`
+	PprofListen      string   `arg:"--pprof-listen,env:ESFETCHER_PPROF_LISTEN" help:"Expose the Go pprof profiles of esfetcher at /debug/pprof/ on this address, e.g. localhost:6060"`
+	MaxInflight      int      `arg:"--max-inflight,env:ESFETCHER_MAX_INFLIGHT" help:"Maximum number of requests in flight against the cluster at any time, independently of --slices. Useful to get good shard coverage with many slices without overloading a small coordinating node. Unlimited when not set"`
+
+	MaxConcurrentShardRequests int      `arg:"--max-concurrent-shard-requests,env:ESFETCHER_MAX_CONCURRENT_SHARD_REQUESTS" help:"Maximum number of concurrent shard requests each search executes per node. Lower it to reduce the load a single search puts on clusters with many shards. Uses the Elasticsearch default when not set"`
+	BatchedReduceSize          int      `arg:"--batched-reduce-size,env:ESFETCHER_BATCHED_REDUCE_SIZE" help:"Number of shard results reduced at once on the coordinating node. Lower it to reduce coordinator memory usage on searches hitting many shards. Uses the Elasticsearch default when not set"`
+	ScrollKeepAlive            string   `arg:"--scroll-keepalive,env:ESFETCHER_SCROLL_KEEPALIVE" help:"How long the cluster keeps the scroll, or point in time, alive between pages, in Elasticsearch time units (30s, 5m). Defaults to 1m, or 5m when searching partially mounted snapshots of the frozen tier"`
+	IgnoreThrottled            string   `arg:"--ignore-throttled,env:ESFETCHER_IGNORE_THROTTLED" help:"Value of the ignore_throttled search parameter, true or false. false also searches the frozen indices of Elasticsearch 7.x, which are skipped by default"`
+	SearchParams               []string `arg:"--search-param,separate,env:ESFETCHER_SEARCH_PARAM" help:"Query string parameter added to the search requests, as KEY=VALUE, e.g. search_type=dfs_query_then_fetch or ccs_minimize_roundtrips=false. Overrides the parameters set by other options. Can be repeated"`
+
+	TimeField   string  `arg:"--time-field,env:ESFETCHER_TIME_FIELD" default:"@timestamp" help:"Date field --since and --until filter on"`
+	Since       string  `arg:"--since,env:ESFETCHER_SINCE" help:"Only fetch documents with --time-field at or after this time: a date (2024-01-31), a time (2024-01-31T08:00:00), a duration before now (24h, 7d) or date math (now-1d/d). Times without an offset are in --timezone"`
+	Until       string  `arg:"--until,env:ESFETCHER_UNTIL" help:"Only fetch documents with --time-field before this time. Same formats as --since"`
+	Timezone    string  `arg:"--timezone,env:ESFETCHER_TIMEZONE" help:"Time zone, e.g. Europe/Berlin, of --since and --until, also set on their range filter and on the date aggregations of the query so date math and buckets align with local days. Defaults to UTC"`
+	GroupBy     string  `arg:"--group-by,env:ESFETCHER_GROUP_BY" help:"Fetch the top --per-group documents of every value of this field, e.g. user.id, instead of all the matching documents, ordered by the sort of the query. The field must be aggregatable, as a keyword. The value of the group of each document is written in _group"`
+	PerGroup    int     `arg:"--per-group,env:ESFETCHER_PER_GROUP" default:"1" help:"How many documents --group-by fetches for every group"`
+	SampleRate  float64 `arg:"--sample-rate,env:ESFETCHER_SAMPLE_RATE" help:"Only fetch this random fraction of the matching documents, e.g. 0.01 for 1%. The sample is reproducible: the same --sample-seed selects the same documents"`
+	SampleSeed  int64   `arg:"--sample-seed,env:ESFETCHER_SAMPLE_SEED" help:"Seed of the random selection of --sample-rate. Different seeds select different samples"`
+	SampleField string  `arg:"--sample-field,env:ESFETCHER_SAMPLE_FIELD" default:"_seq_no" help:"Field the random selection of --sample-rate is derived from, along with the seed. The default changes when documents are updated; use a field that doesn't, as a numeric id, for samples stable across updates"`
+
+	StateFile   string        `arg:"--state-file,env:ESFETCHER_STATE_FILE" help:"Incremental sync: only export the documents with --time-field after the time recorded in this file by the previous run, and record the time this run exported up to. Needs --fetch-all. An explicit --since takes precedence over the file"`
+	SyncOverlap time.Duration `arg:"--sync-overlap,env:ESFETCHER_SYNC_OVERLAP" help:"Start every --state-file run this long before the end of the previous one, to also export documents arriving late with older times. Documents in the overlap are exported again"`
+	SyncDelay   time.Duration `arg:"--sync-delay,env:ESFETCHER_SYNC_DELAY" help:"End every --state-file run this long before now, to give the documents being indexed time to arrive, e.g. 5m"`
+	Watch       time.Duration `arg:"--watch,env:ESFETCHER_WATCH" help:"Run the query again every this long, e.g. 5m, until interrupted, writing only the documents added, changed or removed since the previous run, with the change in a _change field. Documents are compared by _index, _id and _version, and the last results are held in memory, so keep the query bounded. Needs --fetch-all"`
+	Journal     string        `arg:"--journal,env:ESFETCHER_JOURNAL" help:"Record the _index, _id, and _version with --doc-version, of the documents written in this file, and skip the documents it already has, so the overlaps of --state-file runs and re-runs of failed exports don't write duplicates. Grows with every document exported"`
+
+	PostFilter       string   `arg:"--post-filter,env:ESFETCHER_POST_FILTER" help:"Filter applied to the hits of the query, as the post_filter of the search, without editing the query. Inline json, e.g. '{\"term\": {\"status\": \"active\"}}', or the path of a file holding it. Combined with the post_filter of the query, if any"`
+	ScriptFields     []string `arg:"--script-field,separate,env:ESFETCHER_SCRIPT_FIELD" help:"Add a field computed by a painless script to the _source of the exported hits, as NAME:SCRIPT, e.g. 'total:doc[\"price\"].value * doc[\"qty\"].value'. Can be repeated"`
+	DocVersion       bool     `arg:"--doc-version,env:ESFETCHER_DOC_VERSION" help:"Include the _version of the documents in the exported hits"`
+	SeqNoPrimaryTerm bool     `arg:"--seq-no-primary-term,env:ESFETCHER_SEQ_NO_PRIMARY_TERM" help:"Include the _seq_no and _primary_term of the documents in the exported hits, for optimistic concurrency control when writing them back"`
+	IDsOnly          bool     `arg:"--ids-only,env:ESFETCHER_IDS_ONLY" help:"Only output the _id of the matching documents, one per line, without fetching their source. Fast, and what deletion lists or membership checks need"`
+	Format           string   `arg:"--format,env:ESFETCHER_FORMAT" default:"jsonl" help:"Output format: jsonl, one json hit per line, or csv, one row per hit with its fields flattened to dotted columns"`
+	Columns          string   `arg:"--columns,env:ESFETCHER_COLUMNS" help:"Comma separated columns of the csv output, in order, as dotted paths into the hit, e.g. _id,_source.user.name. Defaults to the fields of the index mapping and the metadata of the first hit, sorted"`
+	MissingValue     string   `arg:"--missing-value,env:ESFETCHER_MISSING_VALUE" help:"Written in csv columns for missing and null fields, e.g. null or NA. Empty by default"`
+	StrictColumns    bool     `arg:"--strict-columns,env:ESFETCHER_STRICT_COLUMNS" help:"Fail when a document has a _source field that is not one of the csv columns, instead of dropping it with a warning. Meant for loading into fixed schema tables"`
+	MappingTypes     bool     `arg:"--mapping-types,env:ESFETCHER_MAPPING_TYPES" help:"Write the values of the csv columns as the types of the index mapping instead of as found in the documents: longs as integers, booleans as true or false and dates as rfc3339 in UTC"`
+	NormalizeDates   string   `arg:"--normalize-dates,env:ESFETCHER_NORMALIZE_DATES" help:"Rewrite the date fields of the documents, found in the index mapping, from epoch_millis or custom formats to a single one: rfc3339 (in UTC) or epoch_millis"`
+	NormalizeGeo     string   `arg:"--normalize-geo,env:ESFETCHER_NORMALIZE_GEO" help:"Rewrite the geo_point fields of the documents, found in the index mapping, from the mixture of strings, arrays, objects and geohashes to a single representation: object ({\"lat\": ..., \"lon\": ...}) or wkt (POINT (lon lat))"`
+	InnerHits        string   `arg:"--inner-hits,env:ESFETCHER_INNER_HITS" help:"What to do with the inner hits of nested and has_child queries: embed them in the _source of their document under _inner_hits, or explode them into separate rows with a _parent reference, in place of their documents. Written as returned by default"`
+	DecodeBase64     string   `arg:"--decode-base64,env:ESFETCHER_DECODE_BASE64" help:"Comma separated binary fields to decode from base64, as dotted paths into the _source, e.g. attachment.data. Text replaces the encoded values, binary data needs --decode-base64-dir"`
+	DecodeBase64Dir  string   `arg:"--decode-base64-dir,env:ESFETCHER_DECODE_BASE64_DIR" help:"Write the fields decoded with --decode-base64 to files in this directory, named <_id>.<field>, replacing them in the hits with the path of the files"`
+	Rename           []string `arg:"--rename,separate,env:ESFETCHER_RENAME" help:"Rename a field of the exported hits, as FROM=TO with dotted paths into the hit, e.g. _source.user.name=username or _id=doc_id. Can be repeated"`
+	Envelope         string   `arg:"--envelope,env:ESFETCHER_ENVELOPE" help:"Write records of these comma separated fields instead of the hits as returned, e.g. index,id,source for {\"index\":...,\"id\":...,\"doc\":{...}}, a schema that doesn't change with the version of the cluster. Fields are index, id, source, score, routing, version, seq_no, primary_term, sort, fields, highlight and inner_hits, written as null when a hit lacks them"`
+	MaxDocBytes      int      `arg:"--max-doc-bytes,env:ESFETCHER_MAX_DOC_BYTES" help:"Limit on the size of the exported hits, as json, so a few pathological multi-megabyte documents can't break line based consumers. No limit by default"`
+	OversizedDocs    string   `arg:"--oversized-docs,env:ESFETCHER_OVERSIZED_DOCS" default:"skip" help:"What to do with hits larger than --max-doc-bytes: skip them, truncate their longest string fields, marking them with \"_truncated\": true, or fail the export. Their _id is logged"`
+	OnTimeout        string   `arg:"--on-timeout,env:ESFETCHER_ON_TIMEOUT" default:"retry" help:"What to do with pages the cluster answers with timed_out, which miss the hits of the shards that didn't answer before the timeout of the search: retry them, up to --max-retries times, fail the export, or ignore it, writing them with a warning. Scroll pages after the first can't be fetched again, and fail the export unless ignored"`
+	OnDocError       string   `arg:"--on-doc-error,env:ESFETCHER_ON_DOC_ERROR" default:"fail" help:"What to do with a hit that fails to be transformed or written, as by --rename or --decode-base64, the csv conversion, or for holding invalid UTF-8: fail the export, skip it, logging its _id, or route it to the --doc-errors file along with the reason"`
+	DocErrors        string   `arg:"--doc-errors,env:ESFETCHER_DOC_ERRORS" help:"File recording the hits left out by --on-doc-error, one json line each with their _index, _id and the error, and the hit itself when routed"`
+	Exec             string   `arg:"--exec,env:ESFETCHER_EXEC" help:"Pipe the output through this shell command, e.g. 'python transform.py', which reads the hits as json lines on its standard input and writes its own output to the standard output"`
+	ExecRestarts     int      `arg:"--exec-restarts,env:ESFETCHER_EXEC_RESTARTS" default:"3" help:"How many times the --exec command is restarted when it crashes before giving up"`
+	Plugin           string   `arg:"--plugin,env:ESFETCHER_PLUGIN" help:"Run every hit through this WebAssembly module, compiled for WASI, in process and after the other transforms. The module reads the hit as json on its standard input and writes the hit to export instead on its standard output, or nothing to drop it. A non-zero exit code fails the hit, as handled by --on-doc-error"`
+	Output           string   `arg:"-o,--output,env:ESFETCHER_OUTPUT" help:"Deliver the hits to this destination instead of the standard output: bigquery://PROJECT.DATASET.TABLE appends them to a BigQuery table, created from the mapping of the index when missing, authenticating with the Google Application Default Credentials. splunk-hec://HOST:PORT?sourcetype=...&index=... posts them as events to a Splunk HTTP Event Collector. syslog://HOST:PORT?proto=tcp sends them as syslog messages over udp, tcp or tls. duckdb://FILE?table=docs appends them to a table of a DuckDB database, with the duckdb command line client"`
+	HECToken         string   `arg:"--hec-token,env:ESFETCHER_HEC_TOKEN" help:"Token of the Splunk HTTP Event Collector of --output splunk-hec://"`
+	SyslogTemplate   string   `arg:"--syslog-template,env:ESFETCHER_SYSLOG_TEMPLATE" help:"Message sent for every hit to --output syslog://, with {{path}} placeholders replaced by the values at dotted paths into the hit, e.g. '{{_source.host.name}} {{_source.message}}'. The hit as json by default"`
+
+	MaxRetries       int           `arg:"--max-retries,env:ESFETCHER_MAX_RETRIES" default:"3" help:"How many times to retry a request that failed with a connection error or an overloaded cluster response (429, 502, 503, 504)"`
+	BreakerThreshold int           `arg:"--breaker-threshold,env:ESFETCHER_BREAKER_THRESHOLD" default:"3" help:"Pause all slices once a request fails this many consecutive times, or once the cluster answers this many consecutive requests with 429. Set to 0 to disable the circuit breaker"`
+	RetryBackoff     time.Duration `arg:"--retry-backoff,env:ESFETCHER_RETRY_BACKOFF" default:"1s" help:"How long to wait before the first retry of a failed request, doubling on every attempt"`
+	RetryMaxBackoff  time.Duration `arg:"--retry-max-backoff,env:ESFETCHER_RETRY_MAX_BACKOFF" default:"30s" help:"Maximum wait between two retries of a request"`
+	RetryJitter      string        `arg:"--retry-jitter,env:ESFETCHER_RETRY_JITTER" default:"none" help:"Randomization of the waits between retries: none, or full to wait a random duration up to the backoff, so slices failing together don't retry in lockstep"`
+	RetryBudget      time.Duration `arg:"--retry-budget,env:ESFETCHER_RETRY_BUDGET" help:"Maximum total time spent waiting on retries by all requests together, e.g. 10m. Once spent, requests are not retried anymore and the export fails quickly. Unlimited when not set"`
+	RetryBudgetRatio float64       `arg:"--retry-budget-ratio,env:ESFETCHER_RETRY_BUDGET_RATIO" help:"Maximum fraction of the requests sent that are retries, e.g. 0.2. Above it requests are not retried anymore and the export fails quickly. Enforced after 10 retries. Unlimited when not set"`
+	BreakerCooldown  time.Duration `arg:"--breaker-cooldown,env:ESFETCHER_BREAKER_COOLDOWN" default:"30s" help:"How long all slices are paused for when the circuit breaker trips"`
+	KeepAlive        time.Duration `arg:"--keep-alive,env:ESFETCHER_KEEP_ALIVE" default:"30s" help:"Interval of the TCP keep-alive probes sent on connections to the cluster, -1s to disable them. Lower it when NAT gateways or firewalls drop flows idle for less than this"`
+	IdleTimeout      time.Duration `arg:"--idle-timeout,env:ESFETCHER_IDLE_TIMEOUT" default:"90s" help:"How long idle connections to the cluster are kept open for reuse, 0 to keep them forever. Lower it below the idle timeout of NAT gateways and load balancers in between"`
+	MaxIdleConns     int           `arg:"--max-idle-conns,env:ESFETCHER_MAX_IDLE_CONNS" help:"How many idle connections to the cluster are kept open for reuse, 2 by default. Set to at least --slices so slices don't open new connections for every page, which can exhaust ephemeral ports"`
+	CacheDir         string        `arg:"--cache-dir,env:ESFETCHER_CACHE_DIR" help:"Keep the responses of the cluster in this directory, e.g. ~/.cache/esfetcher, and answer the same requests from it for --cache-ttl instead of hitting the cluster again. Meant for iterating on output and transform options during development"`
+	CacheTTL         time.Duration `arg:"--cache-ttl,env:ESFETCHER_CACHE_TTL" default:"1h" help:"How long the responses kept in --cache-dir are used for"`
+
+	SlowRequestThreshold time.Duration `arg:"--slow-request-threshold,env:ESFETCHER_SLOW_REQUEST_THRESHOLD" help:"Log a warning, with slice id and page number, whenever fetching a page takes longer than this, e.g. 10s"`
+	TraceConn            bool          `arg:"--trace-conn,env:ESFETCHER_TRACE_CONN" help:"Log DNS resolution, connect, TLS handshake, server and time to first byte timings of every request, to tell a slow cluster apart from a slow network path"`
+	StatsD               string        `arg:"--statsd,env:ESFETCHER_STATSD" help:"Push throughput and error counters to the StatsD or DogStatsD agent at this host:port every 10 seconds while running"`
+	StatsDPrefix         string        `arg:"--statsd-prefix,env:ESFETCHER_STATSD_PREFIX" default:"esfetcher." help:"Prefix of every metric pushed to StatsD"`
+	Record               string        `arg:"--record,env:ESFETCHER_RECORD" help:"Record every request to the cluster and its response to this tar archive, e.g. session.tar, to reproduce a run offline with --replay. Credentials are not recorded, but the documents fetched are"`
+	Replay               string        `arg:"--replay,env:ESFETCHER_REPLAY" help:"Answer the requests to the cluster with the responses recorded by --record in this tar archive, without any network access. The same command line as when recording is needed, as requests must match the recorded ones"`
+
+	KibanaURL         string `arg:"--kibana-url,env:ESFETCHER_KIBANA_URL" help:"URL of Kibana, including the space if not the default one, e.g. https://kibana:5601/s/my-space. Used with --kibana-saved-search. Authenticates with the same credentials as Elasticsearch"`
+	KibanaSavedSearch string `arg:"--kibana-saved-search,env:ESFETCHER_KIBANA_SAVED_SEARCH" help:"Id of a Kibana saved search (Discover session) to export. Its data view, query, filters, columns, sort and stored time range replace --query, and its data view is used when --index is not given"`
+
+	Config  string `arg:"--config,env:ESFETCHER_CONFIG" help:"YAML file with default values for any of these options, keyed by long flag name. Flags and env vars take precedence over it. Defaults to ~/.config/esfetcher/config.yaml when it exists"`
+	Profile string `arg:"--profile,env:ESFETCHER_PROFILE" help:"Named profile of the config file to use. Its options (URL, credentials, CA, index, ...) take precedence over the top level ones of the config file"`
+
+	// name of the export in the labels of the per slice metrics, telling apart the exports of
+	// --cluster and --query-dir running in the same process
+	MetricsExport string `arg:"-"`
+
+	Completion       *completionCmd       `arg:"subcommand:completion" help:"Print the shell completion script for bash, zsh or fish"`
+	ListIndices      *listIndicesCmd      `arg:"subcommand:list-indices" help:"List the indices of the cluster, one per line"`
+	Repl             *replCmd             `arg:"subcommand:repl" help:"Interactively run queries against the cluster, preview their results and export them"`
+	SavedQuery       *savedQueryCmd       `arg:"subcommand:query" help:"Save, list and run named queries, stored in the config directory"`
+	Bench            *benchCmd            `arg:"subcommand:bench" help:"Benchmark fetching all the results of the query, without writing them, reporting page latency percentiles and throughput for every combination of --sizes and --slice-counts"`
+	Serve            *serveCmd            `arg:"subcommand:serve" help:"Serve the results of queries over HTTP: POST /fetch with a json body of index, query, fetch_all and slices streams them back as json lines"`
+	SignificantTerms *significantTermsCmd `arg:"subcommand:significant-terms" help:"Report the terms of a field that are unusually frequent in the documents matching --query compared to the rest of the index, as json lines by decreasing significance"`
+	ConfigCmd        *configCmd           `arg:"subcommand:config" help:"Inspect the configuration"`
+	PIT              *pitCmd              `arg:"subcommand:pit" help:"Open, list and close points in time, to fetch several exports from the same snapshot of an index with --pit-id"`
+	ClearScrolls     *clearScrollsCmd     `arg:"subcommand:clear-scrolls" help:"Clear the scrolls left open by exports that were killed or crashed, which otherwise hold cluster memory until they expire"`
+}
+
+type clearScrollsCmd struct {
+	All bool `arg:"--all" help:"Clear all the scrolls of the cluster instead, including the ones of running exports and of other clients"`
+}
+
+type pitCmd struct {
+	Open  *pitOpenCmd  `arg:"subcommand:open" help:"Open a point in time on --index and print its id. It is recorded in the config directory"`
+	Close *pitCloseCmd `arg:"subcommand:close" help:"Close points in time, given by id or all the ones opened with pit open on the cluster with --all"`
+	List  *struct{}    `arg:"subcommand:list" help:"List the points in time opened with pit open that are neither closed nor expired"`
+}
+
+type pitOpenCmd struct {
+	KeepAlive time.Duration `arg:"--pit-keep-alive" default:"1h" help:"How long the cluster keeps the point in time, from when it is opened. Exports using it don't extend it"`
+}
+
+type pitCloseCmd struct {
+	IDs []string `arg:"positional" help:"Ids of the points in time to close"`
+	All bool     `arg:"--all" help:"Close all the points in time opened with pit open on the cluster"`
+}
+
+type configCmd struct {
+	Show *struct{} `arg:"subcommand:show" help:"Print the configuration resolved from flags, env vars, the config file and defaults, with the source of every value. Secrets are masked"`
+}
+
+type completionCmd struct {
+	Shell string `arg:"positional,required" help:"Shell to generate the completion script for: bash, zsh or fish"`
+}
+
+type listIndicesCmd struct {
+	Pattern string `arg:"positional" help:"Only list the indices matching this pattern, e.g. logs-*"`
+}
+
+type replCmd struct{}
+
+type savedQueryCmd struct {
+	Save *querySaveCmd `arg:"subcommand:save" help:"Save the query given with --query or --query-file under a name. It can contain {{name}} placeholders"`
+	List *struct{}     `arg:"subcommand:list" help:"List the saved queries and their placeholders"`
+	Run  *queryRunCmd  `arg:"subcommand:run" help:"Run a saved query, as if it was given with --query"`
+}
+
+type querySaveCmd struct {
+	Name string `arg:"positional,required" help:"Name to save the query under"`
+}
+
+type queryRunCmd struct {
+	Name   string            `arg:"positional,required" help:"Name of the saved query to run"`
+	Params map[string]string `arg:"--param,separate" help:"Value of a placeholder of the query, as NAME=VALUE, overriding the one of --params. Can be repeated"`
+}
+
+type benchCmd struct {
+	Sizes       string        `arg:"--sizes" help:"Comma separated page sizes to benchmark, e.g. 500,1000,5000. Defaults to the size of the query"`
+	SliceCounts string        `arg:"--slice-counts" help:"Comma separated numbers of slices to benchmark, e.g. 1,2,4,8. Defaults to --slices"`
+	Duration    time.Duration `arg:"--duration" default:"30s" help:"How long to run every combination for, at most"`
+	Pages       int           `arg:"--pages" help:"How many pages to fetch with every combination, at most. Unlimited when not set"`
+}
+
+type serveCmd struct {
+	Listen string `arg:"--listen" default:":8080" help:"Address to listen on"`
+	GRPC   bool   `arg:"--grpc" help:"Serve the gRPC Fetcher service of esfetcher.proto, over HTTP/2 without TLS, instead of POST /fetch"`
+}
+
+type significantTermsCmd struct {
+	Field string `arg:"positional,required" help:"Field to find the significant terms of, e.g. process.name"`
+	Text  bool   `arg:"--text" help:"The field is full text, not a keyword: use a significant_text aggregation on a sample of the best matching documents"`
+	Size  int    `arg:"--size" default:"20" help:"How many terms to report"`
 }
 
 func (args) Description() string {
@@ -47,23 +264,739 @@ func (a args) Query() (string, error) {
 
 func main() {
 	var args args
-	arg.MustParse(&args)
-
-	query, err := args.Query()
+	cfg, origin, err := loadConfig(os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := cfg.applyDefaults(&args); err != nil {
+		log.Fatal(err)
+	}
+	parser := arg.MustParse(&args)
+	if err := cfg.applyRest(&args); err != nil {
+		log.Fatal(err)
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if args.Completion != nil {
+		if err := writeCompletion(os.Stdout, args.Completion.Shell, filepath.Base(os.Args[0])); err != nil {
+			parser.Fail(err.Error())
+		}
+		return
+	}
+
+	if args.ConfigCmd != nil {
+		if args.ConfigCmd.Show == nil {
+			parser.FailSubcommand("expected show", "config")
+		}
+		if err := showConfig(os.Stdout, args, cfg, origin, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if args.SavedQuery != nil && args.SavedQuery.Save == nil && args.SavedQuery.List == nil && args.SavedQuery.Run == nil {
+		parser.FailSubcommand("expected one of save, list or run", "query")
+	}
+	if args.PIT != nil && args.PIT.Open == nil && args.PIT.Close == nil && args.PIT.List == nil {
+		parser.FailSubcommand("expected one of open, close or list", "pit")
+	}
+	localOnly := args.SavedQuery != nil && args.SavedQuery.Run == nil || args.PIT != nil && args.PIT.List != nil
 
-	client := Client{
-		ESURL:    args.ESURL,
-		User:     args.User,
-		Password: args.Password,
+	// required is enforced here rather than by the parser, which would reject values coming from
+	// the config file
+	// --cluster takes the place of --elasticsearch-url for exports
+	clustersOnly := len(args.Clusters) > 0 && (parser.Subcommand() == nil || args.SavedQuery != nil && args.SavedQuery.Run != nil)
+	if args.ESURL == "" && !localOnly && !clustersOnly {
+		parser.Fail("--elasticsearch-url is required")
+	}
+	if args.Index == "" && args.KibanaSavedSearch == "" && args.ListIndices == nil && args.Repl == nil && args.Serve == nil && (args.PIT == nil || args.PIT.Open != nil) && args.ClearScrolls == nil && !localOnly {
+		parser.Fail("--index is required")
 	}
 
-	if err := client.Query(ctx, args.Index, query, args.FetchAll, args.Slices, os.Stdout); err != nil {
+	if err := setupLogging(args.LogLevel, args.LogFormat, args.Quiet); err != nil {
 		log.Fatal(err)
 	}
+	if httpSession, err = openSession(args.Record, args.Replay); err != nil {
+		fatal(err)
+	}
+
+	switch {
+	case args.ListIndices != nil:
+		err = listIndices(args)
+	case args.Repl != nil:
+		err = runRepl(args)
+	case args.SavedQuery != nil:
+		err = runSavedQuery(args)
+	case args.Bench != nil:
+		err = runBench(args)
+	case args.Serve != nil:
+		err = runServe(args)
+	case args.SignificantTerms != nil:
+		err = runSignificantTerms(args)
+	case args.PIT != nil:
+		err = runPIT(args)
+	case args.ClearScrolls != nil:
+		err = runClearScrolls(args)
+	default:
+		err = run(args)
+	}
+	// the session is recorded even when the run failed, to reproduce the failure
+	if closeErr := httpSession.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// newClient creates a client with the connection, tuning and retry options of args. The requests
+// are dumped to traceWriter when not nil, as sent over the wire
+func newClient(args args, traceWriter io.Writer) (*Client, error) {
+	password := args.Password
+	if password == "" && args.PasswordFile != "" {
+		data, err := os.ReadFile(args.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password file %s: %w", args.PasswordFile, err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	switch args.IgnoreThrottled {
+	case "", "true", "false":
+	default:
+		return nil, fmt.Errorf("invalid --ignore-throttled %q, expected true or false", args.IgnoreThrottled)
+	}
+	searchParams := url.Values{}
+	for _, spec := range args.SearchParams {
+		key, value, ok := strings.Cut(spec, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --search-param %q, expected KEY=VALUE, e.g. search_type=dfs_query_then_fetch", spec)
+		}
+		searchParams.Add(key, value)
+	}
+
+	transport, err := newTransport(transportOptions{
+		caCert:    args.CACert,
+		resolve:   args.Resolve,
+		dnsServer: args.DNSServer,
+		ipVersion: args.IPVersion,
+
+		tlsMinVersion: args.TLSMinVersion,
+		tlsCiphers:    args.TLSCiphers,
+		sni:           args.SNI,
+
+		keepAlive:    args.KeepAlive,
+		idleTimeout:  args.IdleTimeout,
+		maxIdleConns: args.MaxIdleConns,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if traceWriter != nil {
+		// innermost, so the dump has the headers the token file and signing transports add
+		transport = newTracingTransport(transport, traceWriter)
+	}
+	if args.TokenFile != "" {
+		if args.User != "" || args.AWSRegion != "" {
+			return nil, fmt.Errorf("--token-file can't be used with --user or --aws-region")
+		}
+		if transport, err = newTokenFileTransport(transport, args.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if args.AWSRegion != "" {
+		credentials, err := loadAWSCredentials()
+		if err != nil {
+			return nil, err
+		}
+		transport = newSigV4Transport(transport, args.AWSRegion, args.AWSService, credentials)
+	}
+	if args.CacheDir != "" {
+		// outermost, so cached requests are not signed again
+		if transport, err = newCachingTransport(transport, args.CacheDir, args.CacheTTL); err != nil {
+			return nil, err
+		}
+	}
+	transport = httpSession.wrap(transport)
+	client := &Client{
+		ESURL:         args.ESURL,
+		User:          args.User,
+		Password:      password,
+		HTTPClient:    &http.Client{Transport: transport},
+		OpaqueID:      newOpaqueID(),
+		HostHeader:    args.HostHeader,
+		DocType:       args.DocType,
+		Routing:       args.Routing,
+		PIT:           args.PitID,
+		Serverless:    args.Serverless,
+		AOSS:          args.AWSRegion != "" && args.AWSService == "aoss",
+		CompatVersion: args.CompatVersion,
+
+		MaxConcurrentShardRequests: args.MaxConcurrentShardRequests,
+		BatchedReduceSize:          args.BatchedReduceSize,
+		KeepAlive:                  args.ScrollKeepAlive,
+		IgnoreThrottled:            args.IgnoreThrottled,
+		SearchParams:               searchParams,
+		DocVersion:                 args.DocVersion,
+		SeqNoPrimaryTerm:           args.SeqNoPrimaryTerm,
+		InnerHits:                  args.InnerHits,
+		MaxDocBytes:                args.MaxDocBytes,
+		OversizedDocs:              args.OversizedDocs,
+		OnTimeout:                  args.OnTimeout,
+		KeepPartial:                args.KeepPartial,
+		MetricsExport:              args.MetricsExport,
+
+		SlowRequestThreshold: args.SlowRequestThreshold,
+		TraceConn:            args.TraceConn,
+		ProgressBar:          args.ProgressBar && !args.Quiet,
+		SliceProgress:        args.SliceProgress,
+		MaxRetries:           args.MaxRetries,
+		Backoff:              Backoff{Initial: args.RetryBackoff, Max: args.RetryMaxBackoff, Jitter: args.RetryJitter == "full"},
+		RetryBudget:          NewRetryBudget(args.RetryBudget, args.RetryBudgetRatio),
+		Breaker:              NewCircuitBreaker(args.BreakerThreshold, args.BreakerCooldown),
+	}
+	switch args.RetryJitter {
+	case "none", "full":
+	default:
+		return nil, fmt.Errorf("invalid --retry-jitter %q, expected none or full", args.RetryJitter)
+	}
+	if args.RetryBudgetRatio < 0 || args.RetryBudgetRatio > 1 {
+		return nil, fmt.Errorf("invalid --retry-budget-ratio %v, expected a fraction between 0 and 1", args.RetryBudgetRatio)
+	}
+	switch args.OnTimeout {
+	case "retry", "fail", "ignore":
+	default:
+		return nil, fmt.Errorf("invalid --on-timeout %q, expected retry, fail or ignore", args.OnTimeout)
+	}
+	if args.KeepPartial && (!args.FetchAll || args.Slices < 2) {
+		return nil, fmt.Errorf("--keep-partial needs --fetch-all and --slices of at least 2")
+	}
+	if err := validOversizedPolicy(args.OversizedDocs); err != nil {
+		return nil, err
+	}
+	if args.OversizedDocs == "truncate" && args.Envelope != "" {
+		return nil, fmt.Errorf("--oversized-docs truncate can't be used together with --envelope, which moves the _source it truncates")
+	}
+	if args.GroupBy != "" && (args.PerGroup < 1 || args.Slices > 1) {
+		return nil, fmt.Errorf("--group-by needs a --per-group of at least 1, and can't be used with --slices")
+	}
+	switch args.InnerHits {
+	case "":
+	case "embed":
+		client.Transforms = append(client.Transforms, embedInnerHitsTransform())
+	case "explode":
+	default:
+		return nil, fmt.Errorf("invalid --inner-hits %q, expected one of %s", args.InnerHits, strings.Join(innerHitsModes, ", "))
+	}
+	if args.DecodeBase64Dir != "" && args.DecodeBase64 == "" {
+		return nil, fmt.Errorf("--decode-base64-dir needs --decode-base64")
+	}
+	if args.DecodeBase64 != "" {
+		decode, err := base64Transform(splitList(args.DecodeBase64), args.DecodeBase64Dir)
+		if err != nil {
+			return nil, err
+		}
+		client.Transforms = append(client.Transforms, decode)
+	}
+	if len(args.Rename) > 0 {
+		rename, err := renameTransform(args.Rename)
+		if err != nil {
+			return nil, err
+		}
+		client.Transforms = append(client.Transforms, rename)
+	}
+	if args.Envelope != "" {
+		envelope, err := envelopeTransform(args.Envelope)
+		if err != nil {
+			return nil, err
+		}
+		client.Transforms = append(client.Transforms, envelope)
+	}
+	if args.IDsOnly {
+		if args.Format != "jsonl" || len(args.Rename) > 0 || args.Envelope != "" || args.NormalizeDates != "" || args.NormalizeGeo != "" || args.DecodeBase64 != "" || args.InnerHits != "" {
+			return nil, fmt.Errorf("--ids-only can't be used together with --format, --rename, --envelope, --normalize-dates, --normalize-geo, --decode-base64 or --inner-hits")
+		}
+		client.IDsOnly = true
+		client.Encoder = idsEncoder{}
+	}
+	switch args.Format {
+	case "jsonl":
+		if args.Columns != "" || args.MissingValue != "" || args.StrictColumns || args.MappingTypes {
+			return nil, fmt.Errorf("--columns, --missing-value, --strict-columns and --mapping-types only apply to --format csv")
+		}
+	case "csv":
+		if args.MappingTypes && (len(args.Rename) > 0 || args.Envelope != "") {
+			return nil, fmt.Errorf("--mapping-types can't be used together with --rename or --envelope, the columns are the fields of the mapping")
+		}
+		client.Encoder = newCSVEncoder(splitList(args.Columns), args.MissingValue, args.StrictColumns)
+	default:
+		return nil, fmt.Errorf("invalid --format %q, expected jsonl or csv", args.Format)
+	}
+	if args.MaxInflight > 0 {
+		client.Inflight = semaphore.NewWeighted(int64(args.MaxInflight))
+	}
+	return client, nil
+}
+
+func listIndices(args args) error {
+	client, err := newClient(args, nil)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := client.detectCluster(ctx, args.Flavor); err != nil {
+		return err
+	}
+	indices, err := client.indices(ctx, args.ListIndices.Pattern)
+	if err != nil {
+		return err
+	}
+	for _, index := range indices {
+		fmt.Println(index)
+	}
+	return nil
+}
+
+func runSavedQuery(args args) error {
+	cmd := args.SavedQuery
+	switch {
+	case cmd.Save != nil:
+		query, err := args.Query()
+		if err != nil {
+			return err
+		}
+		if query == "" {
+			return fmt.Errorf("no query to save, pass one with --query or --query-file")
+		}
+		if err := saveQuery(cmd.Save.Name, query); err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("Saved query %s", cmd.Save.Name), "event", "query_saved", "query", cmd.Save.Name)
+		return nil
+	case cmd.List != nil:
+		names, err := savedQueries()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			query, err := loadQuery(name)
+			if err != nil {
+				return err
+			}
+			if params := placeholders(query); len(params) > 0 {
+				fmt.Printf("%s\t%s\n", name, strings.Join(params, ", "))
+			} else {
+				fmt.Println(name)
+			}
+		}
+		return nil
+	default:
+		if args.QueryString != "" || args.QueryFile != "" {
+			return fmt.Errorf("a saved query can't be run together with --query or --query-file")
+		}
+		query, err := loadQuery(cmd.Run.Name)
+		if err != nil {
+			return err
+		}
+		params := map[string]any{}
+		if args.Params != "" {
+			if params, err = loadParams(args.Params); err != nil {
+				return err
+			}
+		}
+		for name, value := range cmd.Run.Params {
+			params[name] = value
+		}
+		if args.QueryString, err = renderQuery(query, params); err != nil {
+			return err
+		}
+		// the placeholders are already filled in
+		args.Params = ""
+		return run(args)
+	}
+}
+
+// run sets up what the whole process shares, as metrics, tracing and the handling of signals, and
+// runs the export, or the exports of --query-dir or --cluster
+func run(args args) error {
+	if args.MetricsListen != "" {
+		if err := serveMetrics(args.MetricsListen); err != nil {
+			return err
+		}
+	}
+	if args.PprofListen != "" {
+		servePprof(args.PprofListen)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if args.ReportRuntime {
+		stopReporting := reportRuntime(ctx, runtimeReportInterval)
+		defer stopReporting()
+	}
+
+	shutdownTracing := setupTracing()
+	defer shutdownTracing()
+
+	if args.StatsD != "" {
+		stopStatsd, err := pushStatsd(ctx, args.StatsD, args.StatsDPrefix, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		defer stopStatsd()
+	}
+
+	var traceWriter io.Writer
+	if args.TraceHTTP {
+		traceWriter = os.Stderr
+		if args.TraceFile != "" {
+			file, err := os.Create(args.TraceFile)
+			if err != nil {
+				return fmt.Errorf("failed to create trace file %s: %w", args.TraceFile, err)
+			}
+			defer file.Close()
+			traceWriter = file
+		}
+	}
+
+	if args.Manifest != "" && args.QueryDir == "" {
+		return fmt.Errorf("--manifest needs --query-dir, whose queries write the files it lists")
+	}
+	if args.QueryDir != "" {
+		if len(args.Clusters) > 0 {
+			return fmt.Errorf("--query-dir can't be used together with --cluster")
+		}
+		return runBatch(ctx, args, traceWriter)
+	}
+	if len(args.Clusters) > 0 {
+		return runClusters(ctx, args, traceWriter)
+	}
+	return export(ctx, args, os.Stdout, traceWriter)
+}
+
+// export runs the query of args, writing the hits to stdout. The requests are dumped to
+// traceWriter when not nil
+func export(ctx context.Context, args args, stdout io.Writer, traceWriter io.Writer) (err error) {
+	// the summary is written however the export ends, as a failure one when it ends before
+	// fetching anything
+	start := time.Now()
+	var summary *Summary
+	if args.Summary || args.SummaryFile != "" {
+		defer func() {
+			if summary == nil {
+				summary = newProgress(0).summary(args.Index, start, err)
+			}
+			if errors.Is(err, errInterrupted) {
+				summary.Status = "interrupted"
+			}
+			if err := writeSummary(summary, args.SummaryFile); err != nil {
+				slog.Error(err.Error())
+			}
+		}()
+	}
+
+	query, err := args.Query()
+	if err != nil {
+		return err
+	}
+	if args.Params != "" {
+		params, err := loadParams(args.Params)
+		if err != nil {
+			return err
+		}
+		if query, err = renderQuery(query, params); err != nil {
+			return err
+		}
+	}
+
+	var ids []string
+	if args.IDsFile != "" {
+		switch {
+		case query != "" || args.KibanaSavedSearch != "":
+			return fmt.Errorf("--ids-file can't be used together with --query, --query-file or --kibana-saved-search")
+		case args.FetchAll || args.Slices > 1 || args.PitID != "" || args.GroupBy != "" || args.StateFile != "":
+			return fmt.Errorf("--ids-file fetches all the listed documents at once, it can't be used together with --fetch-all, --slices, --pit-id, --group-by or --state-file")
+		case args.Since != "" || args.Until != "" || args.SampleRate != 0 || args.PostFilter != "" || len(args.ScriptFields) > 0 || args.Check:
+			return fmt.Errorf("--ids-file doesn't search, it can't be used together with --since, --until, --sample-rate, --post-filter, --script-field or --check")
+		}
+		if ids, err = readIDs(args.IDsFile); err != nil {
+			return err
+		}
+	}
+	if args.OldestFirst || args.SkipHot {
+		switch {
+		case !args.FetchAll || args.GroupBy != "" || args.PitID != "":
+			return fmt.Errorf("--oldest-first and --skip-hot need --fetch-all, and can't be used together with --group-by or --pit-id")
+		case args.SkipHot && args.StateFile != "":
+			return fmt.Errorf("--skip-hot can't be used together with --state-file, the documents of the skipped indices would be behind the recorded time once exported")
+		}
+	}
+	if args.Watch > 0 {
+		switch {
+		case !args.FetchAll || ids != nil || args.GroupBy != "" || args.OldestFirst:
+			return fmt.Errorf("--watch needs --fetch-all, and can't be used together with --ids-file, --group-by or --oldest-first")
+		case args.Format != "jsonl" || args.IDsOnly || args.Envelope != "" || args.Output != "":
+			return fmt.Errorf("--watch writes jsonl hits, it can't be used together with --format, --ids-only, --envelope or --output")
+		case args.StateFile != "" || args.Journal != "" || args.Summary || args.SummaryFile != "":
+			return fmt.Errorf("--watch can't be used together with --state-file, --journal, --summary or --summary-file")
+		}
+	}
+
+	client, err := newClient(args, traceWriter)
+	if err != nil {
+		return err
+	}
+
+	if err := client.detectCluster(ctx, args.Flavor); err != nil {
+		return err
+	}
+
+	if args.KibanaSavedSearch != "" {
+		if args.KibanaURL == "" {
+			return fmt.Errorf("--kibana-saved-search requires --kibana-url")
+		}
+		if query != "" {
+			return fmt.Errorf("--kibana-saved-search can't be used together with --query or --query-file")
+		}
+		search, err := client.kibanaSavedSearch(ctx, args.KibanaURL, args.KibanaSavedSearch)
+		if err != nil {
+			return err
+		}
+		query = search.Query
+		if args.Index == "" {
+			args.Index = search.Index
+		}
+		slog.Info(
+			fmt.Sprintf("Exporting Kibana saved search %q from %s", search.Title, args.Index),
+			"event", "kibana_saved_search", "title", search.Title, "index", args.Index,
+		)
+		slog.Debug(fmt.Sprintf("Kibana saved search query: %s", query), "event", "kibana_query", "query", query)
+	}
+
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		stopWatching := client.watchTasks(ctx, 10*time.Second)
+		defer stopWatching()
+	}
+
+	if !args.Check {
+		if err := client.preflight(ctx, args.Index); err != nil {
+			return err
+		}
+	}
+	// the indices are resolved once, so the checks and the export are about the same ones
+	pattern := args.Index
+	var ordered []string
+	if args.OldestFirst || args.SkipHot {
+		indices, err := client.lifecycleIndices(ctx, args.Index, args.SkipHot)
+		if err != nil {
+			return err
+		}
+		if args.OldestFirst {
+			ordered = indices
+		}
+		if args.SkipHot {
+			args.Index = strings.Join(indices, ",")
+		}
+	}
+	if args.FetchAll {
+		client.checkFrozenTier(ctx, args.Index)
+	}
+
+	// dates and geo points are normalized before any renaming, as the mapping has the original
+	// field names
+	if args.NormalizeDates != "" {
+		normalize, err := client.dateTransform(ctx, args.Index, args.NormalizeDates)
+		if err != nil {
+			return err
+		}
+		client.Transforms = append([]hitTransform{normalize}, client.Transforms...)
+	}
+	if args.NormalizeGeo != "" {
+		normalize, err := client.geoTransform(ctx, args.Index, args.NormalizeGeo)
+		if err != nil {
+			return err
+		}
+		client.Transforms = append([]hitTransform{normalize}, client.Transforms...)
+	}
+	// the csv columns come from the mapping unless given, as the first hit may lack fields that
+	// only appear later. Renamed and enveloped fields are not in the mapping under their new name
+	if encoder, ok := client.Encoder.(*csvEncoder); ok && (args.MappingTypes || args.Columns == "" && len(args.Rename) == 0 && args.Envelope == "") {
+		types, err := client.csvColumns(ctx, args.Index)
+		switch {
+		case err == nil:
+			encoder.types, encoder.convert = types, args.MappingTypes
+		case args.MappingTypes:
+			return err
+		default:
+			slog.Warn(
+				fmt.Sprintf("failed to get the csv columns from the mapping, taking them from the first hit: %v", err),
+				"event", "csv_columns_from_hit", "error", err,
+			)
+		}
+	}
+
+	var syncMark time.Time
+	if args.PitID != "" && !args.FetchAll {
+		return fmt.Errorf("--pit-id needs --fetch-all")
+	}
+
+	if args.StateFile != "" {
+		if !args.FetchAll || args.Until != "" {
+			return fmt.Errorf("--state-file needs --fetch-all, and can't be used with --until")
+		}
+		state, err := readSyncState(args.StateFile)
+		if err != nil {
+			return err
+		}
+		if args.Since, args.Until, syncMark, err = syncRange(state, args.Index, args.TimeField, args.Since, args.SyncOverlap, args.SyncDelay, time.Now()); err != nil {
+			return err
+		}
+		slog.Info(
+			fmt.Sprintf("Syncing the documents of %s with %s from %s until %s", args.Index, args.TimeField, cmp.Or(args.Since, "the start"), args.Until),
+			"event", "sync_range", "since", args.Since, "until", args.Until,
+		)
+	}
+
+	if query, err = applyTimeRange(query, args.TimeField, args.Since, args.Until, args.Timezone); err != nil {
+		return err
+	}
+
+	if query, err = applySample(query, args.SampleRate, args.SampleSeed, args.SampleField); err != nil {
+		return err
+	}
+
+	if args.PostFilter != "" {
+		filter, err := readPostFilter(args.PostFilter)
+		if err != nil {
+			return err
+		}
+		if query, err = applyPostFilter(query, filter); err != nil {
+			return err
+		}
+	}
+
+	if len(args.ScriptFields) > 0 {
+		scriptFields, err := parseScriptFields(args.ScriptFields)
+		if err != nil {
+			return err
+		}
+		if query, err = applyScriptFields(query, scriptFields); err != nil {
+			return err
+		}
+		// script fields are moved into the _source first, so they can be renamed as any other
+		client.Transforms = append([]hitTransform{scriptFieldsTransform(scriptFields)}, client.Transforms...)
+	}
+
+	if args.Check {
+		err := client.runChecks(ctx, args.Index, query, os.Stdout)
+		if args.ShardReport {
+			client.logShardReport(ctx, args.Index, args.Slices, os.Stdout)
+		}
+		return err
+	}
+	if args.ShardReport {
+		client.logShardReport(ctx, args.Index, args.Slices, os.Stderr)
+	}
+
+	if args.FetchAll && args.GroupBy == "" {
+		if err := client.checkEstimatedSize(ctx, args.Index, query, args.MaxEstimatedSize); err != nil {
+			return err
+		}
+	}
+
+	confirm := args.FetchAll && args.ConfirmAbove > 0 && !args.Yes
+	if ids != nil && args.MaxTotalHits > 0 && int64(len(ids)) > args.MaxTotalHits {
+		return &TooManyHitsError{Hits: int64(len(ids)), Limit: args.MaxTotalHits}
+	}
+	if ids == nil && (confirm || args.MaxTotalHits > 0) {
+		count, err := client.count(ctx, args.Index, query)
+		if err != nil {
+			return err
+		}
+		if args.MaxTotalHits > 0 && count > args.MaxTotalHits {
+			return &TooManyHitsError{Hits: count, Limit: args.MaxTotalHits}
+		}
+		if confirm && count > args.ConfirmAbove {
+			if err := confirmLargeExport(count, args.ConfirmAbove); err != nil {
+				return err
+			}
+		}
+	}
+
+	if args.FetchAll {
+		client.Scrolls = newScrollRegistry(args.ESURL, client.OpaqueID)
+	}
+
+	if client.DocErrors, err = newDocErrorLog(args.OnDocError, args.DocErrors); err != nil {
+		return err
+	}
+	defer client.DocErrors.Close()
+	if args.Journal != "" {
+		if client.Journal, err = OpenJournal(args.Journal); err != nil {
+			return err
+		}
+		defer client.Journal.Close()
+	}
+
+	if args.Plugin != "" {
+		if client.Plugin, err = newWASMPlugin(ctx, args.Plugin); err != nil {
+			return err
+		}
+		defer client.Plugin.Close()
+	}
+
+	if args.Output != "" {
+		if args.Exec != "" || args.Format != "jsonl" || args.IDsOnly {
+			return fmt.Errorf("--output can't be used together with --exec, --format or --ids-only")
+		}
+		if client.Sink, err = client.newSink(ctx, args.Index, args.Output, sinkOptions{hecToken: args.HECToken, syslogTemplate: args.SyslogTemplate}); err != nil {
+			return err
+		}
+	}
+
+	output := stdout
+	var pipe *execWriter
+	if args.Exec != "" {
+		if pipe, err = newExecWriter(args.Exec, stdout, args.ExecRestarts); err != nil {
+			return err
+		}
+		output = pipe
+	}
+
+	if args.Watch > 0 {
+		// the documents are compared by version, which the hits only have when asked for
+		client.DocVersion = true
+		err = client.Watch(ctx, args.Index, query, args.Slices, args.Watch, output)
+	} else if ids != nil {
+		summary, err = client.QueryIDs(ctx, args.Index, ids, output)
+	} else if ordered != nil {
+		summary, err = client.QueryIndices(ctx, pattern, ordered, query, args.Slices, output)
+	} else if args.GroupBy != "" {
+		summary, err = client.QueryGroups(ctx, args.Index, query, args.GroupBy, args.PerGroup, output)
+	} else {
+		summary, err = client.Query(ctx, args.Index, query, args.FetchAll, args.Slices, output)
+	}
+	if pipe != nil {
+		if closeErr := pipe.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if client.Sink != nil {
+		if closeErr := client.Sink.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil && args.StateFile != "" {
+		// the mark only moves once all the documents before it are exported
+		err = writeSyncState(args.StateFile, syncState{Index: args.Index, TimeField: args.TimeField, HighWaterMark: syncMark})
+	}
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w before completion: %v", errInterrupted, err)
+
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := client.cancelOwnTasks(cleanupCtx); err != nil {
+			slog.Warn(err.Error(), "event", "cancel_tasks_failed", "error", err)
+		}
+	}
+	return err
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// manifest lists the files written by the queries of --query-dir, for downstream loaders and
+// auditors to verify an export is complete and unaltered
+type manifest struct {
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at"`
+	Cluster    string           `json:"cluster"`
+	Index      string           `json:"index"`
+	Format     string           `json:"format"`
+	Params     map[string]any   `json:"params,omitempty"`
+	Files      []manifestFile   `json:"files"`
+	Failed     []manifestFailed `json:"failed,omitempty"`
+}
+
+// manifestFile is a file written by a query, with the number of documents it holds, counted
+// from the file itself, its size and its sha256 checksum
+type manifestFile struct {
+	Path      string          `json:"path"`
+	QueryFile string          `json:"query_file"`
+	Query     json.RawMessage `json:"query"`
+	Docs      int64           `json:"docs"`
+	Bytes     int64           `json:"bytes"`
+	SHA256    string          `json:"sha256"`
+	// MissingSlices are the slices that failed with --keep-partial, whose documents the file
+	// misses
+	MissingSlices []int `json:"missing_slices,omitempty"`
+}
+
+// manifestFailed is a query that failed, and wrote no file
+type manifestFailed struct {
+	QueryFile string `json:"query_file"`
+	Error     string `json:"error"`
+}
+
+// describeFile returns the manifest entry of an output file written in format
+func describeFile(path string, format string) (manifestFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return manifestFile{}, fmt.Errorf("failed to read output file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	reader := io.TeeReader(file, io.MultiWriter(hash, counter))
+	var docs int64
+	if format == "csv" {
+		// rows are counted by parsing, as quoted values can hold newlines, without the header
+		rows := csv.NewReader(reader)
+		rows.FieldsPerRecord = -1
+		rows.LazyQuotes = true
+		for ; ; docs++ {
+			if _, err = rows.Read(); err != nil {
+				break
+			}
+		}
+		docs = max(docs-1, 0)
+	} else {
+		lines := bufio.NewScanner(reader)
+		lines.Buffer(nil, 1<<30)
+		for lines.Scan() {
+			docs++
+		}
+		err = lines.Err()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return manifestFile{}, fmt.Errorf("failed to read output file %s: %w", path, err)
+	}
+	return manifestFile{Path: path, Docs: docs, Bytes: counter.n, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// writeManifest writes the manifest as json to path, replacing it at once so readers never see
+// a partial one
+func writeManifest(path string, m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// manifestQuery returns the query of a query file as run, with the placeholders filled in by
+// params, as json, or as a json string when it is not valid json
+func manifestQuery(file string, params map[string]any) json.RawMessage {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	query := string(data)
+	if params != nil {
+		if rendered, err := renderQuery(query, params); err == nil {
+			query = rendered
+		}
+	}
+	if json.Valid([]byte(query)) {
+		return json.RawMessage(query)
+	}
+	quoted, _ := json.Marshal(query)
+	return quoted
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics holds the process wide counters exported through the Prometheus endpoint
+var metrics = newMetricsRegistry()
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	counts []int64 // one per bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+type metricsRegistry struct {
+	mu         sync.Mutex
+	docs       int64
+	bytes      int64
+	retries    int64
+	errors     map[string]int64
+	latencies  map[string]*histogram // keyed by operation
+	sliceDocs  map[sliceMetric]int64
+	sliceTotal map[sliceMetric]int64
+	sliceDone  map[sliceMetric]bool
+}
+
+// sliceMetric identifies a slice among the ones of all the exports of the process, which run
+// concurrently with --cluster and --query-dir
+type sliceMetric struct {
+	export string
+	slice  int
+}
+
+// labels returns the labels of the slice metrics, without an export one when there is a single
+// export
+func (k sliceMetric) labels() string {
+	if k.export == "" {
+		return fmt.Sprintf("slice=\"%d\"", k.slice)
+	}
+	return fmt.Sprintf("export=%q,slice=\"%d\"", k.export, k.slice)
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		errors:     map[string]int64{},
+		latencies:  map[string]*histogram{},
+		sliceDocs:  map[sliceMetric]int64{},
+		sliceTotal: map[sliceMetric]int64{},
+		sliceDone:  map[sliceMetric]bool{},
+	}
+}
+
+func (m *metricsRegistry) recordPage(export string, slice int, docs int, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs += int64(docs)
+	m.bytes += bytes
+	m.sliceDocs[sliceMetric{export, slice}] += int64(docs)
+}
+
+func (m *metricsRegistry) recordSliceTotal(export string, slice int, total int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sliceTotal[sliceMetric{export, slice}] = total
+	m.sliceDone[sliceMetric{export, slice}] = false
+}
+
+func (m *metricsRegistry) recordSliceDone(export string, slice int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sliceDone[sliceMetric{export, slice}] = true
+}
+
+func (m *metricsRegistry) recordRetry() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries++
+}
+
+func (m *metricsRegistry) recordError(errorType string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[errorType]++
+}
+
+func (m *metricsRegistry) recordRequest(operation string, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.latencies[operation]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latencies[operation] = h
+	}
+	seconds := took.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// writePrometheus writes all metrics in the Prometheus text exposition format
+func (m *metricsRegistry) writePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("esfetcher_docs_fetched_total", "counter", "Documents fetched from Elasticsearch")
+	fmt.Fprintf(w, "esfetcher_docs_fetched_total %d\n", m.docs)
+
+	metric("esfetcher_bytes_fetched_total", "counter", "Bytes of documents fetched from Elasticsearch")
+	fmt.Fprintf(w, "esfetcher_bytes_fetched_total %d\n", m.bytes)
+
+	metric("esfetcher_retries_total", "counter", "Requests retried")
+	fmt.Fprintf(w, "esfetcher_retries_total %d\n", m.retries)
+
+	metric("esfetcher_errors_total", "counter", "Failed requests by error type")
+	for _, errorType := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "esfetcher_errors_total{type=%q} %d\n", errorType, m.errors[errorType])
+	}
+
+	metric("esfetcher_request_duration_seconds", "histogram", "Latency of requests to Elasticsearch by operation")
+	for _, operation := range sortedKeys(m.latencies) {
+		h := m.latencies[operation]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "esfetcher_request_duration_seconds_bucket{operation=%q,le=%q} %d\n", operation, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "esfetcher_request_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", operation, h.count)
+		fmt.Fprintf(w, "esfetcher_request_duration_seconds_sum{operation=%q} %g\n", operation, h.sum)
+		fmt.Fprintf(w, "esfetcher_request_duration_seconds_count{operation=%q} %d\n", operation, h.count)
+	}
+
+	metric("esfetcher_slice_docs_fetched", "gauge", "Documents fetched so far by each slice")
+	for _, key := range sortedSliceMetrics(m.sliceDocs) {
+		fmt.Fprintf(w, "esfetcher_slice_docs_fetched{%s} %d\n", key.labels(), m.sliceDocs[key])
+	}
+
+	metric("esfetcher_slice_docs_total", "gauge", "Documents matched by the query in each slice")
+	for _, key := range sortedSliceMetrics(m.sliceTotal) {
+		fmt.Fprintf(w, "esfetcher_slice_docs_total{%s} %d\n", key.labels(), m.sliceTotal[key])
+	}
+
+	metric("esfetcher_slice_done", "gauge", "Whether each slice finished (1) or is still active (0)")
+	for _, key := range sortedSliceMetrics(m.sliceDone) {
+		done := 0
+		if m.sliceDone[key] {
+			done = 1
+		}
+		fmt.Fprintf(w, "esfetcher_slice_done{%s} %d\n", key.labels(), done)
+	}
+}
+
+// serveMetrics exposes the metrics in the Prometheus format at /metrics on the given address. It
+// fails when the address can't be listened on, rather than export with no metrics to watch
+func serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writePrometheus(w)
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error(fmt.Sprintf("metrics endpoint failed: %v", err), "event", "error", "error", err)
+		}
+	}()
+	return nil
+}
+
+// operationName maps a request to a low cardinality operation name, suitable as a metric label
+func operationName(method string, path string) string {
+	path, _, _ = strings.Cut(path, "?")
+	switch {
+	case strings.HasSuffix(path, "_search/scroll") && method == http.MethodDelete:
+		return "clear_scroll"
+	case strings.HasSuffix(path, "_search/scroll"):
+		return "scroll"
+	case strings.HasSuffix(path, "_search"):
+		return "search"
+	default:
+		return "other"
+	}
+}
+
+func sortedKeys[K int | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedSliceMetrics[V any](m map[sliceMetric]V) []sliceMetric {
+	keys := make([]sliceMetric, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].export != keys[j].export {
+			return keys[i].export < keys[j].export
+		}
+		return keys[i].slice < keys[j].slice
+	})
+	return keys
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// clusterTarget is a cluster of --cluster, as NAME=URL
+type clusterTarget struct {
+	name string
+	url  string
+}
+
+func parseClusters(specs []string) ([]clusterTarget, error) {
+	targets := make([]clusterTarget, 0, len(specs))
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		name, url, ok := strings.Cut(spec, "=")
+		if !ok || name == "" || url == "" {
+			return nil, fmt.Errorf("invalid --cluster %q, expected NAME=URL, e.g. eu=https://es.eu.example.com:9200", spec)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("invalid --cluster %q, %s is given twice", spec, name)
+		}
+		seen[name] = true
+		targets = append(targets, clusterTarget{name: name, url: url})
+	}
+	return targets, nil
+}
+
+// runClusters runs the query against every cluster of --cluster concurrently, merging their hits
+// into stdout with the name of their cluster in a _cluster field. A failed cluster doesn't stop
+// the others, but fails the run, as the extract misses its hits
+func runClusters(ctx context.Context, args args, traceWriter io.Writer) error {
+	switch {
+	case args.ESURL != "":
+		return fmt.Errorf("--cluster can't be used together with --elasticsearch-url")
+	case args.Format != "jsonl" || args.IDsOnly || args.Exec != "" || args.Plugin != "":
+		return fmt.Errorf("--cluster only writes jsonl hits, it can't be used together with --format, --ids-only, --exec or --plugin")
+	case args.Output != "" || args.StateFile != "" || args.Journal != "" || args.SummaryFile != "" || args.DocErrors != "" || args.PitID != "":
+		return fmt.Errorf("--cluster can't be used together with --output, --state-file, --journal, --summary-file, --doc-errors or --pit-id")
+	case args.FetchAll && args.ConfirmAbove > 0 && !args.Yes:
+		return fmt.Errorf("--cluster can't ask for the confirmation of large exports, pass --yes or --confirm-above 0")
+	}
+	targets, err := parseClusters(args.Clusters)
+	if err != nil {
+		return err
+	}
+	if traceWriter != nil {
+		traceWriter = &syncWriter{writer: traceWriter}
+	}
+	out := &syncWriter{writer: os.Stdout}
+
+	start := time.Now()
+	errs := make([]error, len(targets))
+	group := errgroup.Group{}
+	for i, target := range targets {
+		group.Go(func() error {
+			clusterArgs := args
+			clusterArgs.Clusters = nil
+			clusterArgs.ESURL = target.url
+			clusterArgs.MetricsExport = target.name
+			writer := &clusterWriter{cluster: target.name, out: out}
+			errs[i] = export(ctx, clusterArgs, writer, traceWriter)
+			if errs[i] != nil {
+				slog.Error(fmt.Sprintf("Cluster %s failed: %v", target.name, errs[i]), "event", "cluster_failed", "cluster", target.name, "error", errs[i])
+			}
+			return nil
+		})
+	}
+	group.Wait()
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w before all the clusters of --cluster were exported", errInterrupted)
+	}
+	var failed []string
+	var first error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, targets[i].name)
+			first = cmp.Or(first, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d clusters failed (%s), the first with: %w", len(failed), len(targets), strings.Join(failed, ", "), first)
+	}
+	slog.Info(
+		fmt.Sprintf("Exported the %d clusters in %v", len(targets), time.Since(start).Round(time.Millisecond)),
+		"event", "clusters_done", "clusters", len(targets), "duration", time.Since(start),
+	)
+	return nil
+}
+
+// clusterWriter adds the _cluster field to the hits an export writes, one json object per line,
+// and writes them whole to the output shared with the exports of the other clusters, so their
+// lines don't interleave
+type clusterWriter struct {
+	cluster string
+	out     io.Writer
+
+	mu      sync.Mutex
+	pending []byte
+}
+
+func (w *clusterWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, p...)
+	end := bytes.LastIndexByte(w.pending, '\n')
+	if end < 0 {
+		return len(p), nil
+	}
+
+	field, _ := json.Marshal(w.cluster)
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(w.pending[:end+1], []byte("\n")) {
+		rest, ok := bytes.CutPrefix(line, []byte("{"))
+		if !ok {
+			buf.Write(line)
+			continue
+		}
+		buf.WriteString(`{"_cluster":`)
+		buf.Write(field)
+		if !bytes.HasPrefix(bytes.TrimSpace(rest), []byte("}")) {
+			buf.WriteByte(',')
+		}
+		buf.Write(rest)
+	}
+	w.pending = append(w.pending[:0], w.pending[end+1:]...)
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// hitEncoder encodes hits for an output format other than the default json lines. encode is
+// never called concurrently, and leaves buf as it was when it fails
+type hitEncoder interface {
+	encode(buf *bytes.Buffer, hit json.RawMessage) error
+}
+
+// idsEncoder writes only the _id of the hits, one per line
+type idsEncoder struct{}
+
+func (idsEncoder) encode(buf *bytes.Buffer, hit json.RawMessage) error {
+	var meta struct {
+		ID string `json:"_id"`
+	}
+	if err := json.Unmarshal(hit, &meta); err != nil {
+		return fmt.Errorf("failed to decode hit: %w", err)
+	}
+	buf.WriteString(meta.ID)
+	buf.WriteByte('\n')
+	return nil
+}
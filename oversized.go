@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// oversizedPolicies are what --oversized-docs can do with the hits larger than --max-doc-bytes
+var oversizedPolicies = []string{"skip", "truncate", "fail"}
+
+// limitDocSize applies the oversized policy to the hit when it is larger than MaxDocBytes,
+// measured as the json line written for it. It returns nil when the hit is skipped, and the hit
+// untouched when there is no limit
+func (c *Client) limitDocSize(hit json.RawMessage) (json.RawMessage, error) {
+	if c.MaxDocBytes <= 0 || len(hit) <= c.MaxDocBytes {
+		return hit, nil
+	}
+	id := hitID(hit)
+	metrics.recordError("doc_oversized")
+	switch c.OversizedDocs {
+	case "fail":
+		return nil, fmt.Errorf("document %s is %d bytes, more than --max-doc-bytes %d", id, len(hit), c.MaxDocBytes)
+	case "truncate":
+		truncated, err := truncateHit(hit, c.MaxDocBytes)
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn(
+			fmt.Sprintf("Truncating document %s from %d to %d bytes", id, len(hit), len(truncated)),
+			"event", "doc_truncated", "id", id, "bytes", len(hit),
+		)
+		return truncated, nil
+	default:
+		slog.Warn(
+			fmt.Sprintf("Skipping document %s of %d bytes, more than --max-doc-bytes %d", id, len(hit), c.MaxDocBytes),
+			"event", "doc_skipped", "id", id, "bytes", len(hit),
+		)
+		return nil, nil
+	}
+}
+
+// hitID returns the _id of the hit, for logging
+func hitID(hit json.RawMessage) string {
+	var meta struct {
+		ID string `json:"_id"`
+	}
+	json.Unmarshal(hit, &meta)
+	return meta.ID
+}
+
+// truncateMarker ends the string values shortened by truncateHit
+const truncateMarker = "..."
+
+// truncateHit shortens the longest string values of the _source of the hit until it fits in
+// maxBytes, and marks it with "_truncated": true so consumers can tell. When shortening the
+// strings is not enough, as for documents made of many small fields, the _source is dropped
+func truncateHit(hit json.RawMessage, maxBytes int) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(hit))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode hit: %w", err)
+	}
+	doc["_truncated"] = true
+
+	encode := func() (json.RawMessage, error) {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(doc); err != nil {
+			return nil, fmt.Errorf("failed to encode hit: %w", err)
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+	}
+
+	for {
+		data, err := encode()
+		if err != nil || len(data) <= maxBytes {
+			return data, err
+		}
+		value, set := longestString(doc["_source"])
+		// strings are not shortened below a few bytes, that would not make a difference
+		if set == nil || len(value) <= 2*len(truncateMarker) {
+			break
+		}
+		keep := max(len(value)-(len(data)-maxBytes)-len(truncateMarker), len(value)/2)
+		keep = min(keep, len(value)-2*len(truncateMarker))
+		for keep > 0 && !utf8.RuneStart(value[keep]) {
+			keep--
+		}
+		set(value[:keep] + truncateMarker)
+	}
+	delete(doc, "_source")
+	return encode()
+}
+
+// longestString finds the longest string value under value, returning it with a function
+// replacing it
+func longestString(value any) (string, func(string)) {
+	var longest string
+	var setLongest func(string)
+	var walk func(value any, set func(string))
+	walk = func(value any, set func(string)) {
+		switch v := value.(type) {
+		case map[string]any:
+			for key, child := range v {
+				walk(child, func(s string) { v[key] = s })
+			}
+		case []any:
+			for i, child := range v {
+				walk(child, func(s string) { v[i] = s })
+			}
+		case string:
+			if len(v) > len(longest) {
+				longest, setLongest = v, set
+			}
+		}
+	}
+	walk(value, nil)
+	return longest, setLongest
+}
+
+// validOversizedPolicy checks the value of --oversized-docs
+func validOversizedPolicy(policy string) error {
+	if slices.Contains(oversizedPolicies, policy) {
+		return nil
+	}
+	return fmt.Errorf("invalid --oversized-docs %q, expected one of %s", policy, strings.Join(oversizedPolicies, ", "))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// pitRecord is a point in time opened with pit open. Elasticsearch has no API listing the points
+// in time open, so they are recorded in the config directory for pit list and pit close --all
+type pitRecord struct {
+	ID      string    `json:"id"`
+	Cluster string    `json:"cluster"`
+	Index   string    `json:"index"`
+	Opened  time.Time `json:"opened"`
+	Expires time.Time `json:"expires"`
+}
+
+// pitRecordsPath returns the file the points in time opened are recorded in, next to the config
+// file
+func pitRecordsPath() (string, error) {
+	path := defaultConfigPath()
+	if path == "" {
+		return "", fmt.Errorf("could not find the config directory to record points in time in")
+	}
+	return filepath.Join(filepath.Dir(path), "pits.json"), nil
+}
+
+// loadPITRecords reads the recorded points in time that have not expired yet
+func loadPITRecords() ([]pitRecord, error) {
+	path, err := pitRecordsPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read points in time: %w", err)
+	}
+	var records []pitRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse points in time in %s: %w", path, err)
+	}
+	now := time.Now()
+	return slices.DeleteFunc(records, func(r pitRecord) bool { return r.Expires.Before(now) }), nil
+}
+
+// savePITRecords replaces the recorded points in time
+func savePITRecords(records []pitRecord) error {
+	path, err := pitRecordsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode points in time: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to record points in time: %w", err)
+	}
+	return nil
+}
+
+func runPIT(args args) error {
+	cmd := args.PIT
+	if cmd.List != nil {
+		records, err := loadPITRecords()
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			fmt.Printf("%s\t%s\t%s\texpires %s\n", r.ID, r.Index, r.Cluster, r.Expires.Local().Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	client, err := newClient(args, nil)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := client.detectCluster(ctx, args.Flavor); err != nil {
+		return err
+	}
+	if client.Flavor == flavorOpenSearch || client.AOSS || !client.supports(7, 10) {
+		return fmt.Errorf("points in time need Elasticsearch 7.10 or later")
+	}
+	records, err := loadPITRecords()
+	if err != nil {
+		return err
+	}
+
+	if cmd.Open != nil {
+		if cmd.Open.KeepAlive < time.Second {
+			return fmt.Errorf("invalid --pit-keep-alive %v, expected at least 1s", cmd.Open.KeepAlive)
+		}
+		id, err := client.openPIT(ctx, args.Index, fmt.Sprintf("%ds", int(cmd.Open.KeepAlive.Seconds())))
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		records = append(records, pitRecord{ID: id, Cluster: args.ESURL, Index: args.Index, Opened: now, Expires: now.Add(cmd.Open.KeepAlive)})
+		if err := savePITRecords(records); err != nil {
+			return err
+		}
+		fmt.Println(id)
+		return nil
+	}
+
+	ids := cmd.Close.IDs
+	if cmd.Close.All {
+		for _, r := range records {
+			if r.Cluster == args.ESURL {
+				ids = append(ids, r.ID)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no points in time to close, pass their ids or --all")
+	}
+	var failed error
+	for _, id := range ids {
+		if err := client.deletePIT(ctx, id); err != nil {
+			slog.Error(err.Error(), "event", "close_pit_failed", "error", err)
+			failed = cmp.Or(failed, err)
+			continue
+		}
+		records = slices.DeleteFunc(records, func(r pitRecord) bool { return r.ID == id })
+	}
+	if err := savePITRecords(records); err != nil {
+		return err
+	}
+	return failed
+}
+
+// deletePIT closes a point in time. Points in time that already expired are logged, not failed
+func (c *Client) deletePIT(ctx context.Context, id string) error {
+	body, _ := json.Marshal(map[string]string{"id": id})
+	_, _, err := c.do(ctx, "DELETE", "_pit", string(body))
+	var esErr *ElasticsearchError
+	if errors.As(err, &esErr) && esErr.StatusCode == http.StatusNotFound {
+		slog.Info(fmt.Sprintf("Point in time %s already expired", id), "event", "pit_expired")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close point in time %s: %w", id, err)
+	}
+	slog.Info(fmt.Sprintf("Closed point in time %s", id), "event", "pit_closed")
+	return nil
+}
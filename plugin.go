@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// wasmPlugin runs every hit through a WebAssembly module compiled for WASI, in process, as the
+// last transform before it is written. The module is a WASI command run once per hit: it reads
+// the hit as json on its standard input, and writes the hit to write in its place on its
+// standard output, or nothing to drop it. Exiting with a non-zero code fails the hit, with what
+// the module wrote on its standard error as the reason, and --on-doc-error decides what becomes
+// of it. Modules have no access to the file system, the network or the environment, and every
+// hit gets a fresh instance, so nothing is shared between hits or slices
+type wasmPlugin struct {
+	ctx     context.Context
+	path    string
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+}
+
+// newWASMPlugin compiles the module of path. Running modules are stopped when ctx is done
+func newWASMPlugin(ctx context.Context, path string) (*wasmPlugin, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --plugin: %w", err)
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to set up WASI for --plugin: %w", err)
+	}
+	module, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile --plugin %s: %w", path, err)
+	}
+	return &wasmPlugin{ctx: ctx, path: path, runtime: runtime, module: module}, nil
+}
+
+// transform runs the module on a hit, returning the hit it wrote, nil when it dropped it
+func (p *wasmPlugin) transform(hit json.RawMessage) (json.RawMessage, error) {
+	var stdout, stderr bytes.Buffer
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(p.path).
+		WithStdin(bytes.NewReader(hit)).
+		WithStdout(&stdout).
+		WithStderr(&stderr)
+	module, err := p.runtime.InstantiateModule(p.ctx, p.module, config)
+	if module != nil {
+		module.Close(p.ctx)
+	}
+	if err != nil {
+		var exitErr *sys.ExitError
+		if errors.As(err, &exitErr) && p.ctx.Err() == nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("--plugin exited with code %d: %s", exitErr.ExitCode(), msg)
+			}
+			return nil, fmt.Errorf("--plugin exited with code %d", exitErr.ExitCode())
+		}
+		return nil, fmt.Errorf("--plugin failed: %w", err)
+	}
+
+	out := bytes.TrimSpace(stdout.Bytes())
+	if len(out) == 0 {
+		return nil, nil
+	}
+	if !json.Valid(out) || out[0] != '{' {
+		return nil, fmt.Errorf("--plugin wrote %.100q, expected a json object or nothing", out)
+	}
+	return out, nil
+}
+
+func (p *wasmPlugin) Close() error {
+	if p == nil {
+		return nil
+	}
+	return p.runtime.Close(p.ctx)
+}
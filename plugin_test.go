@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildTestPlugin builds the module of testdata/plugin for WASI, skipping the test without a Go
+// toolchain to build it with
+func buildTestPlugin(t *testing.T) string {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go toolchain to build the plugin with")
+	}
+	path := filepath.Join(t.TempDir(), "plugin.wasm")
+	cmd := exec.Command(goTool, "build", "-o", path, "./testdata/plugin")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the plugin: %v\n%s", err, out)
+	}
+	return path
+}
+
+func TestWASMPlugin(t *testing.T) {
+	plugin, err := newWASMPlugin(context.Background(), buildTestPlugin(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close()
+
+	tests := []struct {
+		name    string
+		hit     string
+		want    string
+		wantErr string
+	}{
+		{name: "transformed", hit: `{"_id":"1","_source":{"a":1}}`, want: `{"_id":"1","_source":{"a":1,"plugin":"wasm"}}`},
+		{name: "dropped", hit: `{"_id":"drop","_source":{}}`},
+		{name: "failed", hit: `{"_id":"fail","_source":{}}`, wantErr: "--plugin exited with code 3: refusing hit fail"},
+		{name: "not json", hit: `{"_id":"garble","_source":{}}`, wantErr: `--plugin wrote "not json"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := plugin.transform(json.RawMessage(tt.hit))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// dropped hits are left out of the output, and of the hits delivered
+	c := &Client{Plugin: plugin}
+	var out bytes.Buffer
+	hits := []json.RawMessage{
+		json.RawMessage(`{"_id":"1","_source":{}}`),
+		json.RawMessage(`{"_id":"drop","_source":{}}`),
+		json.RawMessage(`{"_id":"2","_source":{}}`),
+	}
+	_, delivered, err := c.encodeHits(hits, nil, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"_id":"1","_source":{"plugin":"wasm"}}` + "\n" + `{"_id":"2","_source":{"plugin":"wasm"}}` + "\n"
+	if out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+	if !reflect.DeepEqual(delivered, []int{0, 2}) {
+		t.Errorf("got delivered hits %v, want [0 2]", delivered)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readPostFilter returns the --post-filter value, given either inline as a json object or as
+// the path of a file holding one
+func readPostFilter(value string) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "{") {
+		return value, nil
+	}
+	data, err := os.ReadFile(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to read --post-filter file %s: %w", value, err)
+	}
+	return string(data), nil
+}
+
+// applyPostFilter sets the post_filter of the query to filter. When the query has a post_filter
+// already, both apply
+func applyPostFilter(query string, filter string) (string, error) {
+	if filter == "" {
+		return query, nil
+	}
+	var filterObj map[string]any
+	if err := json.Unmarshal([]byte(filter), &filterObj); err != nil {
+		return "", &QueryError{fmt.Errorf("failed to parse --post-filter: %w", err)}
+	}
+	body := map[string]any{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &body); err != nil {
+			return "", &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+	if existing, ok := body["post_filter"]; ok {
+		body["post_filter"] = map[string]any{"bool": map[string]any{"filter": []any{existing, filterObj}}}
+	} else {
+		body["post_filter"] = filterObj
+	}
+
+	out, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query with post filter: %w", err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// indexHealth is the health of the indices matching an index pattern, by index
+type indexHealth map[string]struct {
+	Status           string `json:"status"`
+	UnassignedShards int    `json:"unassigned_shards"`
+}
+
+// preflight checks that the index exists and that all its primary shards are available before
+// an export starts, so misconfigurations fail right away instead of after the first pages. A
+// missing index is an error and red indices are warned about. Checks the user is not allowed to
+// run are skipped
+func (c *Client) preflight(ctx context.Context, index string) error {
+	if err := c.indexExists(ctx, index); err != nil {
+		if isForbidden(err) {
+			slog.Debug(fmt.Sprintf("Could not check that %s exists: %v", index, err), "event", "preflight_skipped", "error", err)
+			return nil
+		}
+		return err
+	}
+	if c.Serverless || c.AOSS {
+		// shards are managed by the service, and the health API is not available
+		return nil
+	}
+	health, err := c.indexHealth(ctx, index)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("Could not read the health of %s: %v", index, err), "event", "preflight_skipped", "error", err)
+		return nil
+	}
+	if red := health.withStatus("red"); len(red) > 0 {
+		slog.Warn(
+			fmt.Sprintf("%d of the indices searched are red, with primary shards unavailable, the export will likely fail with shard failures: %s", len(red), strings.Join(red, ", ")),
+			"event", "indices_red", "indices", red,
+		)
+	}
+	return nil
+}
+
+// indexExists returns an error when no index matches index
+func (c *Client) indexExists(ctx context.Context, index string) error {
+	_, _, err := c.do(ctx, "HEAD", index+"?allow_no_indices=false", "")
+	var esErr *ElasticsearchError
+	if errors.As(err, &esErr) && esErr.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("no index matches %s", index)
+	}
+	return err
+}
+
+func (c *Client) indexHealth(ctx context.Context, index string) (indexHealth, error) {
+	_, data, err := c.do(ctx, "GET", "_cluster/health/"+index+"?level=indices", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the health of %s: %w", index, err)
+	}
+	var result struct {
+		Indices indexHealth `json:"indices"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the health of %s: %w", index, err)
+	}
+	return result.Indices, nil
+}
+
+// withStatus returns the sorted names of the indices with the given status
+func (h indexHealth) withStatus(status string) []string {
+	var names []string
+	for name, index := range h {
+		if index.Status == status {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isForbidden(err error) bool {
+	var esErr *ElasticsearchError
+	return errors.As(err, &esErr) && esErr.StatusCode == http.StatusForbidden
+}
+
+// runChecks runs the checks of --check, writing a line per check to w: that the cluster answers,
+// who we are authenticated as, that the index exists and the query is valid, and the health of
+// the index. It returns the error of the first failed check, after running all the others that
+// don't depend on it
+func (c *Client) runChecks(ctx context.Context, index string, query string, w io.Writer) error {
+	report := func(status, check, detail string) {
+		fmt.Fprintf(w, "%-4s  %-7s  %s\n", status, check, detail)
+	}
+	var failed error
+	fail := func(check string, err error) {
+		report("FAIL", check, err.Error())
+		if failed == nil {
+			failed = err
+		}
+	}
+
+	if c.AOSS {
+		report("skip", "cluster", "Amazon OpenSearch Serverless does not expose cluster information")
+	} else if info, err := c.clusterInfo(ctx); err != nil {
+		fail("cluster", err)
+		var connErr *ConnectionError
+		if errors.As(err, &connErr) {
+			return failed
+		}
+	} else {
+		report("ok", "cluster", fmt.Sprintf("%s %s %s", info.ClusterName, info.flavor(), info.Version.Number))
+	}
+
+	if user, err := c.authenticatedUser(ctx); err != nil {
+		fail("auth", err)
+		return failed
+	} else if user == "" {
+		report("ok", "auth", "security is not enabled or does not report the user")
+	} else {
+		report("ok", "auth", "authenticated as "+user)
+	}
+
+	if err := c.indexExists(ctx, index); err != nil {
+		fail("index", err)
+		return failed
+	}
+	count, err := c.count(ctx, index, query)
+	if err != nil {
+		fail("query", err)
+	} else {
+		report("ok", "query", fmt.Sprintf("%d documents of %s match", count, index))
+	}
+
+	if c.Serverless || c.AOSS {
+		report("skip", "health", "shards are managed by the service")
+		return failed
+	}
+	health, err := c.indexHealth(ctx, index)
+	if err != nil {
+		fail("health", err)
+		return failed
+	}
+	red, yellow := health.withStatus("red"), health.withStatus("yellow")
+	switch {
+	case len(red) > 0:
+		fail("health", fmt.Errorf("%d of %d indices are red, with primary shards unavailable: %s", len(red), len(health), strings.Join(red, ", ")))
+	case len(yellow) > 0:
+		report("warn", "health", fmt.Sprintf("%d of %d indices are yellow, with replicas unassigned: %s", len(yellow), len(health), strings.Join(yellow, ", ")))
+	default:
+		report("ok", "health", fmt.Sprintf("%d indices are green", len(health)))
+	}
+	return failed
+}
+
+// authenticatedUser returns the name of the user the requests are authenticated as, or "" when
+// the cluster has no security enabled
+func (c *Client) authenticatedUser(ctx context.Context) (string, error) {
+	path := "_security/_authenticate"
+	if c.Flavor == flavorOpenSearch {
+		path = "_plugins/_security/authinfo"
+	}
+	_, data, err := c.do(ctx, "GET", path, "")
+	var esErr *ElasticsearchError
+	if errors.As(err, &esErr) && esErr.StatusCode != http.StatusUnauthorized && esErr.StatusCode != http.StatusForbidden {
+		// the security endpoints are missing or rejected when security is disabled
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var user struct {
+		Username string `json:"username"`
+		UserName string `json:"user_name"`
+	}
+	if err := json.Unmarshal(data, &user); err != nil {
+		return "", fmt.Errorf("failed to unmarshal the authenticated user: %w", err)
+	}
+	if user.UserName != "" {
+		return user.UserName, nil
+	}
+	return user.Username, nil
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// processRunning tells whether a process with this pid is running. Finding a process fails when
+// it doesn't exist outside of unix
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
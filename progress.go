@@ -0,0 +1,250 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progress tracks how far a query is. It is shared between all slices of the query
+type progress struct {
+	docs          atomic.Int64
+	totalDocs     atomic.Int64
+	bytes         atomic.Int64
+	retries       atomic.Int64
+	shardFailures atomic.Int64
+	timedOutPages atomic.Int64
+	// sum of the took of the searches, in milliseconds: the time the cluster spent on them
+	took atomic.Int64
+	// whether totalDocs is an exact count, instead of a lower bound
+	exactTotal atomic.Bool
+
+	slices []sliceProgress
+
+	// name of the export in the labels of the per slice metrics, empty when it is the only one
+	export string
+
+	// optional function called with every page recorded, from the goroutines of the slices
+	onPage func(slice int, docs int, bytes int64, latency time.Duration)
+}
+
+type sliceProgress struct {
+	docs        atomic.Int64
+	totalDocs   atomic.Int64
+	bytes       atomic.Int64
+	pages       atomic.Int64
+	lastLatency atomic.Int64 // nanoseconds taken to fetch the last page
+	done        atomic.Bool
+	err         atomic.Pointer[error]
+}
+
+func newProgress(slices int) *progress {
+	p := &progress{slices: make([]sliceProgress, slices)}
+	p.exactTotal.Store(true)
+	return p
+}
+
+// recordSliceTotal accounts for the number of documents matched by the slice. exact tells
+// whether the total is exact or a lower bound
+func (p *progress) recordSliceTotal(slice int, total int64, exact bool) {
+	p.totalDocs.Add(total)
+	if !exact {
+		p.exactTotal.Store(false)
+	}
+	p.slices[slice].totalDocs.Store(total)
+	metrics.recordSliceTotal(p.export, slice, total)
+}
+
+// recordPage accounts for a page of documents written by the slice
+func (p *progress) recordPage(slice int, docs int, bytes int64, latency time.Duration) {
+	p.docs.Add(int64(docs))
+	p.bytes.Add(bytes)
+	sp := &p.slices[slice]
+	sp.docs.Add(int64(docs))
+	sp.bytes.Add(bytes)
+	sp.pages.Add(1)
+	sp.lastLatency.Store(int64(latency))
+	metrics.recordPage(p.export, slice, docs, bytes)
+	if p.onPage != nil {
+		p.onPage(slice, docs, bytes, latency)
+	}
+}
+
+// partialError returns the error of the slices that failed, nil when none did, and the error of
+// the first one when they all did, as nothing was exported then
+func (p *progress) partialError() error {
+	partial := &PartialResultsError{Slices: len(p.slices)}
+	for i := range p.slices {
+		if err := p.slices[i].err.Load(); err != nil {
+			partial.Missing = append(partial.Missing, i)
+			partial.Err = cmp.Or(partial.Err, *err)
+		}
+	}
+	switch len(partial.Missing) {
+	case 0:
+		return nil
+	case len(p.slices):
+		return partial.Err
+	}
+	return partial
+}
+
+func (p *progress) finishSlice(slice int, err error) {
+	sp := &p.slices[slice]
+	if err != nil {
+		sp.err.Store(&err)
+	}
+	sp.done.Store(true)
+	metrics.recordSliceDone(p.export, slice)
+}
+
+type progressKey struct{}
+
+func withProgress(ctx context.Context, p *progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// progressFromContext returns the progress of the query the context belongs to. Requests done
+// outside of a query get a throwaway progress
+func progressFromContext(ctx context.Context) *progress {
+	if p, ok := ctx.Value(progressKey{}).(*progress); ok {
+		return p
+	}
+	return newProgress(0)
+}
+
+// reportProgress periodically reports the query progress on stderr until the returned stop
+// function is called. When bar is set and stderr is a terminal, a progress bar is rendered in
+// place, otherwise a log line is printed every 10 seconds, followed by a line per slice if
+// perSlice is set
+func reportProgress(ctx context.Context, p *progress, bar bool, perSlice bool) (stop func()) {
+	bar = bar && isTerminal(os.Stderr)
+	every := 10 * time.Second
+	if bar {
+		every = time.Second
+	}
+	// moving average over 1 minute
+	maxAvgPoints := int(time.Minute / every)
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var avgPoints int
+		var avgDocsPerS, avgBytesPerS float64
+		var lastDocs, lastBytes int64
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if bar {
+					fmt.Fprintln(os.Stderr)
+				}
+				return
+			case <-ticker.C:
+				docs := p.docs.Load()
+				totalDocs := p.totalDocs.Load()
+				bytes := p.bytes.Load()
+
+				// Apply moving average to smooth out speed and ETA calculations
+				docsPerS := float64(docs-lastDocs) / every.Seconds()
+				bytesPerS := float64(bytes-lastBytes) / every.Seconds()
+				avgDocsPerS = (avgDocsPerS*float64(avgPoints) + docsPerS) / float64(avgPoints+1)
+				avgBytesPerS = (avgBytesPerS*float64(avgPoints) + bytesPerS) / float64(avgPoints+1)
+				if avgPoints < maxAvgPoints {
+					avgPoints++
+				}
+				lastDocs, lastBytes = docs, bytes
+
+				var pct float64
+				if totalDocs > 0 {
+					pct = float64(docs) / float64(totalDocs) * 100
+				}
+				eta := "unknown"
+				if avgDocsPerS > 0 && totalDocs >= docs {
+					eta = time.Duration(float64(totalDocs-docs) / avgDocsPerS * float64(time.Second)).Truncate(time.Second).String()
+				}
+
+				if bar {
+					fmt.Fprintf(
+						os.Stderr, "\r%s %5.1f%% %d/%d docs, %d docs/s, %s/s, ETA: %s\x1b[K",
+						progressBar(pct, 30), pct, docs, totalDocs, int(avgDocsPerS), formatBytes(avgBytesPerS), eta,
+					)
+					continue
+				}
+				slog.Info(
+					fmt.Sprintf(
+						"Fetched %d documents out of %d documents (%.1f%%). Avg Speed: %d docs/s, %s/s. ETA: %v",
+						docs, totalDocs, pct, int(avgDocsPerS), formatBytes(avgBytesPerS), eta,
+					),
+					"event", "progress", "docs", docs, "total_docs", totalDocs, "bytes", bytes,
+					"docs_per_s", int(avgDocsPerS), "bytes_per_s", int(avgBytesPerS), "eta", eta,
+				)
+				if perSlice {
+					p.logSlices()
+				}
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func (p *progress) logSlices() {
+	for i := range p.slices {
+		sp := &p.slices[i]
+		docs, totalDocs := sp.docs.Load(), sp.totalDocs.Load()
+		var pct float64
+		if totalDocs > 0 {
+			pct = float64(docs) / float64(totalDocs) * 100
+		}
+		state := "active"
+		if sp.done.Load() {
+			state = "done"
+		}
+		latency := time.Duration(sp.lastLatency.Load()).Truncate(time.Millisecond)
+		slog.Info(
+			fmt.Sprintf(
+				"Slice %d: fetched %d documents out of %d documents (%.1f%%). Last page took %v. %s",
+				i, docs, totalDocs, pct, latency, state,
+			),
+			"event", "slice_progress", "slice", i, "docs", docs, "total_docs", totalDocs,
+			"last_page_latency", latency, "state", state,
+		)
+	}
+}
+
+func progressBar(pct float64, width int) string {
+	filled := min(max(int(pct/100*float64(width)), 0), width)
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
+
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"time"
+)
+
+// dumpProgressOnSignal prints a detailed progress snapshot to stderr every time the process
+// receives one of progressDumpSignals (SIGUSR1, and SIGINFO where available), until the returned
+// stop function is called
+func dumpProgressOnSignal(p *progress, start time.Time) (stop func()) {
+	if len(progressDumpSignals) == 0 {
+		return func() {}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, progressDumpSignals...)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				p.dump(os.Stderr, start)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+func (p *progress) dump(w io.Writer, start time.Time) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	elapsed := time.Since(start).Truncate(time.Second)
+	docs, totalDocs := p.docs.Load(), p.totalDocs.Load()
+	var pct float64
+	if totalDocs > 0 {
+		pct = float64(docs) / float64(totalDocs) * 100
+	}
+
+	fmt.Fprintf(w, "\n=== esfetcher progress after %v ===\n", elapsed)
+	fmt.Fprintf(w, "documents: %d of %d (%.1f%%), %s\n", docs, totalDocs, pct, formatBytes(float64(p.bytes.Load())))
+	fmt.Fprintf(w, "retries: %d, shard failures: %d\n", p.retries.Load(), p.shardFailures.Load())
+	fmt.Fprintf(
+		w, "memory: heap in use %s, system %s, %d GCs, %d goroutines\n",
+		formatBytes(float64(mem.HeapInuse)), formatBytes(float64(mem.Sys)), mem.NumGC, runtime.NumGoroutine(),
+	)
+	for i := range p.slices {
+		sp := &p.slices[i]
+		state := "active"
+		if err := sp.err.Load(); err != nil {
+			state = "failed: " + (*err).Error()
+		} else if sp.done.Load() {
+			state = "done"
+		}
+		fmt.Fprintf(
+			w, "slice %d: %d of %d documents, %d pages, last page took %v, %s\n",
+			i, sp.docs.Load(), sp.totalDocs.Load(), sp.pages.Load(),
+			time.Duration(sp.lastLatency.Load()).Truncate(time.Millisecond), state,
+		)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SIGINFO is sent by Ctrl-T on BSD terminals
+var progressDumpSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGINFO}
@@ -0,0 +1,10 @@
+//go:build unix && !(darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var progressDumpSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// errInvalidProto is returned when decoding a malformed protobuf message
+var errInvalidProto = errors.New("invalid protobuf message")
+
+// protoFields calls fn with every field of a protobuf message, in order: the value of varint and
+// fixed size fields, the bytes of length delimited ones
+func protoFields(data []byte, fn func(field int, wireType int, value uint64, bytesValue []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errInvalidProto
+		}
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&7)
+
+		var value uint64
+		var bytesValue []byte
+		switch wireType {
+		case 0: // varint
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return errInvalidProto
+			}
+			data = data[n:]
+		case 1: // 64 bit
+			if len(data) < 8 {
+				return errInvalidProto
+			}
+			value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2: // length delimited
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errInvalidProto
+			}
+			bytesValue, data = data[n:n+int(length)], data[n+int(length):]
+		case 5: // 32 bit
+			if len(data) < 4 {
+				return errInvalidProto
+			}
+			value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return errInvalidProto
+		}
+		if err := fn(field, wireType, value, bytesValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendProtoBytes appends a length delimited protobuf field, omitted when empty as proto3 does
+func appendProtoBytes(message []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return message
+	}
+	return appendProtoDelimited(message, field, value)
+}
+
+// appendProtoDelimited appends a length delimited protobuf field, even when empty, as the
+// optional fields of proto2 messages need to tell empty values apart from missing ones
+func appendProtoDelimited(message []byte, field int, value []byte) []byte {
+	message = binary.AppendUvarint(message, uint64(field)<<3|2)
+	message = binary.AppendUvarint(message, uint64(len(value)))
+	return append(message, value...)
+}
+
+// appendProtoVarint appends a varint protobuf field, as int64, int32 and bool ones
+func appendProtoVarint(message []byte, field int, value uint64) []byte {
+	message = binary.AppendUvarint(message, uint64(field)<<3)
+	return binary.AppendUvarint(message, value)
+}
+
+// appendProtoFixed64 appends a 64 bit protobuf field, as double ones
+func appendProtoFixed64(message []byte, field int, value uint64) []byte {
+	message = binary.AppendUvarint(message, uint64(field)<<3|1)
+	return binary.LittleEndian.AppendUint64(message, value)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	queryNameRe   = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	placeholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}`)
+
+	// a placeholder making up a whole json string, replaced with the quotes by non string values
+	quotedPlaceholderRe = regexp.MustCompile(`"\{\{\s*([A-Za-z0-9_.-]+)\s*\}\}"`)
+)
+
+// savedQueriesDir returns the directory saved queries are stored in, next to the config file
+func savedQueriesDir() (string, error) {
+	path := defaultConfigPath()
+	if path == "" {
+		return "", fmt.Errorf("could not find the config directory to store saved queries in")
+	}
+	return filepath.Join(filepath.Dir(path), "queries"), nil
+}
+
+func savedQueryPath(name string) (string, error) {
+	if !queryNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid query name %q, only letters, digits, '.', '-' and '_' are allowed", name)
+	}
+	dir, err := savedQueriesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// saveQuery stores the query under name, replacing any query previously saved with that name
+func saveQuery(name string, query string) error {
+	path, err := savedQueryPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create saved queries directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(query), 0o600); err != nil {
+		return fmt.Errorf("failed to save query %s: %w", name, err)
+	}
+	return nil
+}
+
+// loadQuery reads the query saved under name
+func loadQuery(name string) (string, error) {
+	path, err := savedQueryPath(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("no saved query named %s", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read saved query %s: %w", name, err)
+	}
+	return string(data), nil
+}
+
+// savedQueries lists the names of the saved queries, sorted
+func savedQueries() ([]string, error) {
+	dir, err := savedQueriesDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved queries: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !entry.IsDir() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// placeholders returns the names of the {{name}} placeholders of a query, in order of appearance
+func placeholders(query string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, match := range placeholderRe.FindAllStringSubmatch(query, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// renderQuery replaces the {{name}} placeholders of a query with the given params. String values
+// are json escaped, so they can be used inside json strings, as in "user": "{{user}}". Other
+// values, as the arrays, numbers and objects of a --params file, are written as json, replacing
+// the quotes around the placeholder too, so "terms": {"user": "{{users}}"} takes a list of users
+func renderQuery(query string, params map[string]any) (string, error) {
+	var missing []string
+	for _, name := range placeholders(query) {
+		if _, ok := params[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return "", &QueryError{fmt.Errorf("missing value for query parameters %s, pass them with --params, or --param NAME=VALUE when running a saved query", strings.Join(missing, ", "))}
+	}
+
+	var err error
+	query = quotedPlaceholderRe.ReplaceAllStringFunc(query, func(placeholder string) string {
+		value := params[quotedPlaceholderRe.FindStringSubmatch(placeholder)[1]]
+		if _, ok := value.(string); ok {
+			return placeholder
+		}
+		data, marshalErr := json.Marshal(value)
+		if marshalErr != nil {
+			err = cmp.Or(err, marshalErr)
+		}
+		return string(data)
+	})
+	if err != nil {
+		return "", &QueryError{fmt.Errorf("invalid query parameter: %w", err)}
+	}
+	query = placeholderRe.ReplaceAllStringFunc(query, func(placeholder string) string {
+		value := params[placeholderRe.FindStringSubmatch(placeholder)[1]]
+		quoted, marshalErr := json.Marshal(value)
+		if marshalErr != nil {
+			err = cmp.Or(err, marshalErr)
+		}
+		if _, ok := value.(string); ok {
+			return string(quoted[1 : len(quoted)-1])
+		}
+		return string(quoted)
+	})
+	if err != nil {
+		return "", &QueryError{fmt.Errorf("invalid query parameter: %w", err)}
+	}
+	return query, nil
+}
+
+// loadParams reads the values of query placeholders from a --params file, a json object or, for
+// .yaml and .yml files, a yaml mapping
+func loadParams(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read params file %s: %w", path, err)
+	}
+	var params map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &params)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&params)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid params file %s, expected an object of placeholder names to values: %w", path, err)
+	}
+	return params, nil
+}
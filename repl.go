@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+const replHelp = `Commands:
+  {...}                       set the query to this json body, which can span several lines, and preview it
+  q TEXT                      set the query to a query_string query, e.g. q status:500 AND path:/api*
+  index NAME                  search NAME from now on
+  size N                      preview N documents (default 10)
+  sort FIELD[:asc|desc] ...   sort by these fields. Without fields, clear the sort
+  run                         preview the current query again
+  show                        print the current query, as sent for the preview
+  export FILE [SLICES]        fetch all results of the current query into FILE, or stdout with -
+  help                        print this help
+  quit                        leave, as does Ctrl-D
+Ctrl-C interrupts the running preview or export`
+
+// repl is an interactive session: the index and query being worked on, and the preview options
+// applied on top of the query. Results are written to out, everything else to msg
+type repl struct {
+	client *Client
+	index  string
+	query  map[string]any
+	size   int
+	sort   []string
+	slices int
+
+	in  *bufio.Scanner
+	out io.Writer
+	msg io.Writer
+}
+
+func runRepl(args args) error {
+	client, err := newClient(args, nil)
+	if err != nil {
+		return err
+	}
+	if err := client.detectCluster(context.Background(), args.Flavor); err != nil {
+		return err
+	}
+
+	r := &repl{
+		client: client,
+		index:  args.Index,
+		query:  map[string]any{},
+		size:   10,
+		slices: args.Slices,
+		in:     bufio.NewScanner(os.Stdin),
+		out:    os.Stdout,
+		msg:    os.Stderr,
+	}
+	r.in.Buffer(nil, 16*1024*1024)
+
+	query, err := args.Query()
+	if err != nil {
+		return err
+	}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &r.query); err != nil {
+			return &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+
+	fmt.Fprintln(r.msg, "Type help for the list of commands")
+	for {
+		line, ok := r.read("esfetcher> ")
+		if !ok {
+			return r.in.Err()
+		}
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		if err := r.exec(line); err != nil {
+			fmt.Fprintf(r.msg, "error: %v\n", err)
+		}
+	}
+}
+
+func (r *repl) read(prompt string) (string, bool) {
+	fmt.Fprint(r.msg, prompt)
+	if !r.in.Scan() {
+		fmt.Fprintln(r.msg)
+		return "", false
+	}
+	return strings.TrimSpace(r.in.Text()), true
+}
+
+func (r *repl) exec(line string) error {
+	if strings.HasPrefix(line, "{") {
+		return r.setQuery(line)
+	}
+	command, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	fields := strings.Fields(rest)
+	switch command {
+	case "":
+		return nil
+	case "help":
+		fmt.Fprintln(r.msg, replHelp)
+		return nil
+	case "q":
+		if rest == "" {
+			return fmt.Errorf("usage: q TEXT")
+		}
+		r.query = map[string]any{"query": map[string]any{"query_string": map[string]any{"query": rest}}}
+		return r.preview()
+	case "index":
+		if len(fields) != 1 {
+			return fmt.Errorf("usage: index NAME")
+		}
+		r.index = fields[0]
+		return nil
+	case "size":
+		size, err := strconv.Atoi(rest)
+		if err != nil || size < 0 {
+			return fmt.Errorf("usage: size N")
+		}
+		r.size = size
+		return r.preview()
+	case "sort":
+		r.sort = fields
+		return r.preview()
+	case "run":
+		return r.preview()
+	case "show":
+		body, err := json.MarshalIndent(r.body(true), "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(r.msg, "index: %s\n%s\n", r.index, body)
+		return nil
+	case "export":
+		if len(fields) < 1 || len(fields) > 2 {
+			return fmt.Errorf("usage: export FILE [SLICES]")
+		}
+		slices := r.slices
+		if len(fields) == 2 {
+			var err error
+			if slices, err = strconv.Atoi(fields[1]); err != nil || slices < 1 {
+				return fmt.Errorf("usage: export FILE [SLICES]")
+			}
+		}
+		return r.export(fields[0], slices)
+	default:
+		return fmt.Errorf("unknown command %q, type help for the list of commands", command)
+	}
+}
+
+// setQuery reads a json query, continuing on the next lines until it is complete
+func (r *repl) setQuery(line string) error {
+	text := line
+	for !json.Valid([]byte(text)) {
+		more, ok := r.read("      ...> ")
+		if !ok || more == "" {
+			return fmt.Errorf("incomplete query discarded")
+		}
+		text += "\n" + more
+	}
+	query := map[string]any{}
+	if err := json.Unmarshal([]byte(text), &query); err != nil {
+		return fmt.Errorf("failed to parse query: %w", err)
+	}
+	r.query = query
+	return r.preview()
+}
+
+// body returns the query with the sort applied, and for previews the size too
+func (r *repl) body(preview bool) map[string]any {
+	body := make(map[string]any, len(r.query)+2)
+	for key, value := range r.query {
+		body[key] = value
+	}
+	if preview {
+		body["size"] = r.size
+	}
+	if len(r.sort) > 0 {
+		var sort []any
+		for _, field := range r.sort {
+			name, order, _ := strings.Cut(field, ":")
+			if order == "" {
+				order = "asc"
+			}
+			sort = append(sort, map[string]any{name: map[string]any{"order": order}})
+		}
+		body["sort"] = sort
+	}
+	return body
+}
+
+func (r *repl) preview() error {
+	if r.index == "" {
+		return fmt.Errorf("no index set, use index NAME")
+	}
+	body, err := json.Marshal(r.body(true))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	summary, err := r.client.Query(ctx, r.index, string(body), false, 1, r.out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.msg, "Showing %d of %d documents\n", summary.Docs, summary.TotalDocs)
+	return nil
+}
+
+func (r *repl) export(file string, slices int) error {
+	if r.index == "" {
+		return fmt.Errorf("no index set, use index NAME")
+	}
+	body, err := json.Marshal(r.body(false))
+	if err != nil {
+		return err
+	}
+	writer := r.out
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", file, err)
+		}
+		defer f.Close()
+		writer = f
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	summary, err := r.client.Query(ctx, r.index, string(body), true, slices, writer)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.msg, "Exported %d documents to %s\n", summary.Docs, file)
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	retryInitialBackoff = 1 * time.Second
+	retryMaxBackoff     = 30 * time.Second
+
+	// retryBudgetMinRetries is how many retries are always allowed before the ratio of retried
+	// requests of a RetryBudget is enforced, so a few early failures don't fail the export
+	retryBudgetMinRetries = 10
+)
+
+// Backoff is how long to wait between the retries of a request: Initial before the first one,
+// doubling on every attempt up to Max. The zero value uses 1s and 30s. With Jitter, the wait is
+// a random duration up to that instead, "full jitter", so slices failing together don't retry in
+// lockstep
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Jitter  bool
+}
+
+// shouldRetry tells whether a failed request is worth retrying. Connection errors and responses
+// signaling an overloaded or temporarily unavailable cluster are retried, anything else is not.
+// Requests that aren't repeatable, as scroll continuations moving the scroll on, are only retried
+// when rejected with 429, before the cluster ran them: after a connection error or a proxy error
+// it may have run them already, and sending them again would skip their results
+func shouldRetry(ctx context.Context, res *http.Response, repeatable bool) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if !repeatable {
+		return res != nil && res.StatusCode == http.StatusTooManyRequests
+	}
+	if res == nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// delay returns how long to wait before the given retry attempt (0 based)
+func (b Backoff) delay(attempt int) time.Duration {
+	initial, maxBackoff := b.Initial, b.Max
+	if initial <= 0 {
+		initial = retryInitialBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = retryMaxBackoff
+	}
+	backoff := initial
+	for i := 0; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBackoff)
+	if b.Jitter {
+		backoff = rand.N(backoff + 1)
+	}
+	return backoff
+}
+
+// RetryBudget limits the retries of all the requests of a client, so a cluster that keeps
+// failing fails the export quickly instead of every request retrying for its full backoff: at
+// most MaxTime is spent waiting on retries in total, and at most MaxRatio of the requests sent
+// are retries. A zero limit is disabled. Once exhausted no request is retried anymore. A nil
+// *RetryBudget is valid and never runs out
+type RetryBudget struct {
+	MaxTime  time.Duration
+	MaxRatio float64
+
+	mu        sync.Mutex
+	requests  int
+	retries   int
+	waited    time.Duration
+	exhausted error
+}
+
+func NewRetryBudget(maxTime time.Duration, maxRatio float64) *RetryBudget {
+	if maxTime <= 0 && maxRatio <= 0 {
+		return nil
+	}
+	return &RetryBudget{MaxTime: maxTime, MaxRatio: maxRatio}
+}
+
+// request records a request being sent, including retries
+func (b *RetryBudget) request() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.requests++
+}
+
+// spend takes a retry waiting wait from the budget, or returns why the budget doesn't allow it
+func (b *RetryBudget) spend(wait time.Duration) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exhausted != nil {
+		return b.exhausted
+	}
+
+	switch {
+	case b.MaxTime > 0 && b.waited+wait > b.MaxTime:
+		b.exhausted = fmt.Errorf("retry budget exhausted, %v already spent waiting on retries of the %v allowed", b.waited, b.MaxTime)
+	case b.MaxRatio > 0 && b.retries >= retryBudgetMinRetries && float64(b.retries+1) > b.MaxRatio*float64(b.requests):
+		b.exhausted = fmt.Errorf("retry budget exhausted, %d of %d requests were retries, above the %v allowed", b.retries, b.requests, b.MaxRatio)
+	default:
+		b.retries++
+		b.waited += wait
+		return nil
+	}
+	slog.Warn(
+		fmt.Sprintf("The cluster keeps failing, no request will be retried anymore: %v", b.exhausted),
+		"event", "retry_budget_exhausted", "retries", b.retries, "requests", b.requests, "waited", b.waited,
+	)
+	return b.exhausted
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// CircuitBreaker pauses all requests for a cool-down period once the cluster looks to be in
+// trouble: either a single request failed Threshold consecutive times, or the cluster answered
+// Threshold consecutive requests with 429 Too Many Requests. A nil *CircuitBreaker is valid and
+// never trips
+type CircuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu             sync.Mutex
+	openUntil      time.Time
+	consecutive429 int
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// wait blocks while the breaker is open
+func (b *CircuitBreaker) wait(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		remaining := time.Until(b.openUntil)
+		b.mu.Unlock()
+		if remaining <= 0 {
+			return nil
+		}
+		if err := sleep(ctx, remaining); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *CircuitBreaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.consecutive429 = 0
+}
+
+// failure records a failed attempt. consecutive is how many times in a row the current request
+// has failed so far
+func (b *CircuitBreaker) failure(res *http.Response, consecutive int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if res != nil && res.StatusCode == http.StatusTooManyRequests {
+		b.consecutive429++
+	} else {
+		b.consecutive429 = 0
+	}
+
+	var reason string
+	switch {
+	case b.consecutive429 >= b.Threshold:
+		reason = "cluster keeps rejecting requests with 429 Too Many Requests"
+	case consecutive >= b.Threshold:
+		reason = "a request failed too many consecutive times"
+	default:
+		return
+	}
+
+	if time.Now().Before(b.openUntil) {
+		return
+	}
+	b.openUntil = time.Now().Add(b.Cooldown)
+	b.consecutive429 = 0
+	slog.Warn(
+		fmt.Sprintf("Circuit breaker tripped (%s), pausing all requests for %v", reason, b.Cooldown),
+		"event", "circuit_breaker", "reason", reason, "cooldown", b.Cooldown,
+	)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// runtimeReportInterval is how often --report-runtime logs
+const runtimeReportInterval = 30 * time.Second
+
+// reportRuntime logs the memory used by the process, the garbage collections it went through and
+// its number of goroutines every interval, until stopped, to diagnose the performance of
+// esfetcher itself
+func reportRuntime(ctx context.Context, every time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		var lastGC uint32
+		var lastPause uint64
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				gcs := stats.NumGC - lastGC
+				pause := time.Duration(stats.PauseTotalNs - lastPause)
+				lastGC, lastPause = stats.NumGC, stats.PauseTotalNs
+				slog.Info(
+					fmt.Sprintf(
+						"Runtime: %s of heap in use, %s obtained from the OS, %d GCs pausing %v in the last %v, %d goroutines",
+						formatBytes(float64(stats.HeapInuse)), formatBytes(float64(stats.Sys)), gcs, pause, every, runtime.NumGoroutine(),
+					),
+					"event", "runtime", "heap_inuse", stats.HeapInuse, "sys", stats.Sys, "gc", gcs, "gc_pause", pause,
+					"goroutines", runtime.NumGoroutine(),
+				)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// servePprof exposes the pprof profiles of the process at /debug/pprof/ on the given address
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error(fmt.Sprintf("pprof endpoint failed: %v", err), "event", "error", "error", err)
+		}
+	}()
+}
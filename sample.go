@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// applySample wraps the query clause of the query in a function_score query keeping a random
+// fraction rate of its matches. The random score of every document is derived from the seed and
+// the value of field, so the same seed selects the same documents as long as field doesn't
+// change. The min_score is set on the function_score query itself, rather than on the search,
+// so counts see the same sample
+func applySample(query string, rate float64, seed int64, field string) (string, error) {
+	if rate == 0 {
+		return query, nil
+	}
+	if rate < 0 || rate > 1 {
+		return "", fmt.Errorf("invalid --sample-rate %v, expected a fraction between 0 and 1", rate)
+	}
+	body := map[string]any{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &body); err != nil {
+			return "", &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+	inner, ok := body["query"]
+	if !ok {
+		inner = map[string]any{"match_all": map[string]any{}}
+	}
+	body["query"] = map[string]any{
+		"function_score": map[string]any{
+			"query": inner,
+			"functions": []any{
+				map[string]any{"random_score": map[string]any{"seed": seed, "field": field}},
+			},
+			// random scores are uniform between 0 and 1, so this keeps rate of the documents
+			"boost_mode": "replace",
+			"min_score":  1 - rate,
+		},
+	}
+
+	out, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal sampled query: %w", err)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// scriptField is a field computed by a script for every hit, from --script-field NAME:SCRIPT
+type scriptField struct {
+	name, script string
+}
+
+func parseScriptFields(specs []string) ([]scriptField, error) {
+	fields := make([]scriptField, 0, len(specs))
+	for _, spec := range specs {
+		name, script, ok := strings.Cut(spec, ":")
+		name, script = strings.TrimSpace(name), strings.TrimSpace(script)
+		if !ok || name == "" || script == "" {
+			return nil, fmt.Errorf(`invalid --script-field %q, expected NAME:SCRIPT, e.g. 'total:doc["price"].value * doc["qty"].value'`, spec)
+		}
+		fields = append(fields, scriptField{name, script})
+	}
+	return fields, nil
+}
+
+// applyScriptFields adds the script fields to the script_fields of the query, in painless
+func applyScriptFields(query string, fields []scriptField) (string, error) {
+	if len(fields) == 0 {
+		return query, nil
+	}
+	body := map[string]any{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &body); err != nil {
+			return "", &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+	scriptFields, _ := body["script_fields"].(map[string]any)
+	if scriptFields == nil {
+		scriptFields = map[string]any{}
+	}
+	for _, field := range fields {
+		scriptFields[field.name] = map[string]any{
+			"script": map[string]any{"lang": "painless", "source": field.script},
+		}
+	}
+	body["script_fields"] = scriptFields
+
+	out, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query with script fields: %w", err)
+	}
+	return string(out), nil
+}
+
+// scriptFieldsTransform returns a transform moving the values of the script fields, which
+// Elasticsearch returns apart under the fields of the hit, to its _source, so they come out as
+// any other column. Single values are unwrapped from the array they are returned in
+func scriptFieldsTransform(fields []scriptField) hitTransform {
+	return func(hit map[string]any) error {
+		computed, ok := hit["fields"].(map[string]any)
+		if !ok {
+			return nil
+		}
+		source, ok := hit["_source"].(map[string]any)
+		if !ok {
+			source = map[string]any{}
+			hit["_source"] = source
+		}
+		for _, field := range fields {
+			value, ok := computed[field.name]
+			if !ok {
+				continue
+			}
+			delete(computed, field.name)
+			if values, ok := value.([]any); ok && len(values) == 1 {
+				value = values[0]
+			}
+			setPath(source, field.name, value)
+		}
+		if len(computed) == 0 {
+			delete(hit, "fields")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scrollRecord lists the scrolls an export has open, so the ones left behind by an export that
+// was killed can be cleared by clear-scrolls instead of holding cluster resources until they
+// expire
+type scrollRecord struct {
+	Cluster string    `json:"cluster"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	IDs     []string  `json:"scroll_ids"`
+}
+
+// scrollRegistry records the scrolls open by an export in a file of its own in the scrolls
+// directory, removed once they are all cleared. A nil registry records nothing. Failing to
+// record scrolls is logged, as it doesn't affect the export
+type scrollRegistry struct {
+	mu     sync.Mutex
+	path   string
+	record scrollRecord
+	failed bool
+}
+
+// scrollsDir returns the directory the scrolls of the exports are recorded in, next to the
+// config file
+func scrollsDir() (string, error) {
+	path := defaultConfigPath()
+	if path == "" {
+		return "", fmt.Errorf("could not find the config directory scrolls are recorded in")
+	}
+	return filepath.Join(filepath.Dir(path), "scrolls"), nil
+}
+
+// newScrollRegistry returns the registry of the scrolls of an export identified by id, or nil
+// when there is no config directory to record them in
+func newScrollRegistry(cluster string, id string) *scrollRegistry {
+	dir, err := scrollsDir()
+	if err != nil {
+		return nil
+	}
+	return &scrollRegistry{
+		path:   filepath.Join(dir, id+".json"),
+		record: scrollRecord{Cluster: cluster, PID: os.Getpid(), Started: time.Now()},
+	}
+}
+
+// add records a scroll opened
+func (r *scrollRegistry) add(id string) {
+	r.update(func(ids []string) []string { return append(ids, id) })
+}
+
+// replace records that a scroll has a new id, as returned by a page of it
+func (r *scrollRegistry) replace(old string, id string) {
+	if old == id {
+		return
+	}
+	r.update(func(ids []string) []string {
+		ids = slices.DeleteFunc(ids, func(s string) bool { return s == old })
+		return append(ids, id)
+	})
+}
+
+// remove records that a scroll was cleared
+func (r *scrollRegistry) remove(id string) {
+	r.update(func(ids []string) []string { return slices.DeleteFunc(ids, func(s string) bool { return s == id }) })
+}
+
+func (r *scrollRegistry) update(change func([]string) []string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record.IDs = change(r.record.IDs)
+
+	var err error
+	if len(r.record.IDs) == 0 {
+		if err = os.Remove(r.path); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	} else if err = os.MkdirAll(filepath.Dir(r.path), 0o700); err == nil {
+		data, _ := json.Marshal(r.record)
+		err = os.WriteFile(r.path, data, 0o600)
+	}
+	if err != nil && !r.failed {
+		// logged once, as every page of every slice would log it again
+		r.failed = true
+		slog.Warn(fmt.Sprintf("failed to record the open scrolls, clear-scrolls won't find them: %v", err), "event", "record_scrolls_failed", "error", err)
+	}
+}
+
+func runClearScrolls(args args) error {
+	client, err := newClient(args, nil)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := client.detectCluster(ctx, args.Flavor); err != nil {
+		return err
+	}
+	if client.Serverless || client.AOSS {
+		return fmt.Errorf("the cluster has no scrolls to clear")
+	}
+
+	if args.ClearScrolls.All {
+		freed, err := client.clearScrolls(ctx, nil)
+		if err != nil {
+			return err
+		}
+		slog.Info(fmt.Sprintf("Cleared all the %d scroll contexts of the cluster", freed), "event", "scrolls_cleared", "freed", freed)
+		return nil
+	}
+
+	dir, err := scrollsDir()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to list the recorded scrolls: %w", err)
+	}
+	var runs, freed int
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read the recorded scrolls: %w", err)
+		}
+		var record scrollRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			slog.Warn(fmt.Sprintf("ignoring invalid scroll record %s: %v", path, err), "event", "invalid_scroll_record", "error", err)
+			continue
+		}
+		if record.Cluster != args.ESURL || processRunning(record.PID) {
+			continue
+		}
+		n, err := client.clearScrolls(ctx, record.IDs)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove the recorded scrolls: %w", err)
+		}
+		runs++
+		freed += n
+	}
+	slog.Info(
+		fmt.Sprintf("Cleared %d scroll contexts left by %d exports that didn't finish", freed, runs),
+		"event", "scrolls_cleared", "freed", freed, "runs", runs,
+	)
+	return nil
+}
+
+// scrollRequest is the body of the requests for the next page of a scroll
+type scrollRequest struct {
+	Scroll   string `json:"scroll"`
+	ScrollID string `json:"scroll_id"`
+}
+
+// clearScrollRequest is the body of the requests clearing scrolls, several at once
+type clearScrollRequest struct {
+	ScrollIDs []string `json:"scroll_id"`
+}
+
+// clearScrolls deletes the scrolls of ids in a single request, or every scroll of the cluster
+// when ids is nil, returning how many search contexts were freed. Scrolls that already expired
+// are not an error
+func (c *Client) clearScrolls(ctx context.Context, ids []string) (int, error) {
+	path, body := "_search/scroll/_all", ""
+	if ids != nil {
+		data, err := json.Marshal(clearScrollRequest{ScrollIDs: ids})
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal clear scroll request: %w", err)
+		}
+		path, body = "_search/scroll", string(data)
+	}
+	_, data, err := c.do(ctx, "DELETE", path, body)
+	var esErr *ElasticsearchError
+	if errors.As(err, &esErr) && esErr.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to clear scrolls: %w", err)
+	}
+	var result struct {
+		NumFreed int `json:"num_freed"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal clear scroll response: %w", err)
+	}
+	return result.NumFreed, nil
+}
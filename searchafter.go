@@ -0,0 +1,143 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// search_after pagination, used instead of scrolls on clusters that don't support them. Elastic
+// Cloud Serverless projects paginate through a point in time (PIT), opened for the whole query
+// and shared by all slices, each of them paginating through its part of it, as do exports given
+// a point in time opened beforehand with --pit-id. Amazon OpenSearch Serverless collections have
+// no points in time either, and paginate through the live index
+
+// openPIT opens a point in time on the index, kept alive for keepAlive, or the keep alive of the
+// client when empty
+func (c *Client) openPIT(ctx context.Context, index string, keepAlive string) (string, error) {
+	params := url.Values{}
+	params.Set("keep_alive", cmp.Or(keepAlive, c.keepAlive()))
+	if c.Routing != "" {
+		params.Set("routing", c.Routing)
+	}
+	_, data, err := c.do(ctx, "POST", index+"/_pit?"+params.Encode(), "")
+	if err != nil {
+		return "", fmt.Errorf("failed to open point in time: %w", err)
+	}
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("failed to unmarshal point in time: %w", err)
+	}
+	return result.ID, nil
+}
+
+// closePIT closes the point in time, even if the export was interrupted, so it does not hold
+// cluster resources
+func (c *Client) closePIT(ctx context.Context, id string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	body, _ := json.Marshal(map[string]string{"id": id})
+	if _, _, err := c.do(ctx, "DELETE", "_pit", string(body)); err != nil {
+		slog.WarnContext(ctx, fmt.Sprintf("failed to close point in time: %v", err), "event", "close_pit_failed", "error", err)
+	}
+}
+
+// searchAfterSlice fetches all documents of a slice of the point in time, or of the index when
+// there is no point in time, page by page, each page starting after the sort values of the last
+// hit of the previous one
+func (c *Client) searchAfterSlice(ctx context.Context, index string, pit string, query string, slice int, maxSlices int, p *progress, writerLock *sync.Mutex, writer io.Writer) error {
+	params := c.searchParams()
+	path := "_search"
+	if pit == "" {
+		path = c.indexPath(index, path)
+	} else {
+		// the routing was given when opening the point in time, searches of it can't repeat it
+		params.Del("routing")
+	}
+	path += "?" + params.Encode()
+
+	queryObj := map[string]any{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &queryObj); err != nil {
+			return &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+	// _shard_doc is the cheapest sort, and the tiebreaker Elasticsearch adds to any other sort
+	// of a point in time search. Without a point in time, _id is added as tiebreaker so pages
+	// don't skip or repeat documents with the same sort values
+	sort, ok := queryObj["sort"]
+	switch {
+	case pit != "" && !ok:
+		queryObj["sort"] = []any{"_shard_doc"}
+	case pit == "" && !ok:
+		queryObj["sort"] = []any{"_id"}
+	case pit == "":
+		if s, isList := sort.([]any); isList {
+			queryObj["sort"] = append(s, "_id")
+		} else {
+			queryObj["sort"] = []any{sort, "_id"}
+		}
+	}
+	if maxSlices > 1 {
+		queryObj["slice"] = map[string]int{"id": slice, "max": maxSlices}
+	}
+
+	for page := 1; ; page++ {
+		if pit != "" {
+			pitObj := map[string]string{"id": pit}
+			// a point in time of --pit-id keeps the lifetime it was opened with
+			if c.PIT == "" {
+				pitObj["keep_alive"] = c.keepAlive()
+			}
+			queryObj["pit"] = pitObj
+		}
+		body, err := json.Marshal(queryObj)
+		if err != nil {
+			return fmt.Errorf("failed to marshal search_after query: %w", err)
+		}
+
+		sr, took, err := c.searchPage(ctx, p, slice, page, "GET", path, string(body), true)
+		if err != nil {
+			return err
+		}
+		if err := checkShards(sr, p); err != nil {
+			return err
+		}
+		if page == 1 {
+			p.recordSliceTotal(slice, sr.Hits.Total.Value, sr.Hits.Total.Relation == "eq")
+		}
+		if len(sr.Hits.Hits) == 0 {
+			return nil
+		}
+
+		bytes, err := c.writeHits(sr.Hits.Hits, writerLock, writer)
+		if err != nil {
+			return err
+		}
+		p.recordPage(slice, len(sr.Hits.Hits), bytes, took)
+
+		// sort values are kept raw, as long values like nanosecond dates don't fit a float64
+		var last struct {
+			Sort []json.RawMessage `json:"sort"`
+		}
+		if err := json.Unmarshal(sr.Hits.Hits[len(sr.Hits.Hits)-1], &last); err != nil {
+			return fmt.Errorf("failed to unmarshal hit: %w", err)
+		}
+		if len(last.Sort) == 0 {
+			return fmt.Errorf("search_after search returned hits without sort values")
+		}
+		queryObj["search_after"] = last.Sort
+		// the point in time id can change between responses, and the latest one must be used
+		if sr.PitId != "" {
+			pit = sr.PitId
+		}
+	}
+}
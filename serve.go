@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// serveMaxRequestBytes is the largest /fetch request body accepted
+const serveMaxRequestBytes = 16 * 1024 * 1024
+
+// serveErrorTrailer is the HTTP trailer reporting why a fetch failed after its results started
+// streaming, when the status code can't be changed anymore
+const serveErrorTrailer = "Esfetcher-Error"
+
+// fetchRequest is the body of a /fetch request
+type fetchRequest struct {
+	// index to search, the --index of the server when empty
+	Index string `json:"index"`
+	// search body, as given with --query. All the documents when empty
+	Query json.RawMessage `json:"query"`
+	// fetch all results instead of the first page, in Slices parallel slices. The --slices of
+	// the server when zero
+	FetchAll bool `json:"fetch_all"`
+	Slices   int  `json:"slices"`
+}
+
+// fetchServer serves the results of queries over HTTP, streamed as json lines by the client
+type fetchServer struct {
+	client *Client
+	index  string
+	slices int
+}
+
+func runServe(args args) error {
+	if args.Format != "jsonl" || args.Exec != "" || args.Plugin != "" {
+		return fmt.Errorf("serve only streams json lines, and can't be used with --format, --exec or --plugin")
+	}
+	client, err := newClient(args, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := client.detectCluster(ctx, args.Flavor); err != nil {
+		return err
+	}
+
+	shutdownTracing := setupTracing()
+	defer shutdownTracing()
+	if args.MetricsListen != "" {
+		serveMetrics(args.MetricsListen)
+	}
+	if args.PprofListen != "" {
+		servePprof(args.PprofListen)
+	}
+	if args.ReportRuntime {
+		stopReporting := reportRuntime(ctx, runtimeReportInterval)
+		defer stopReporting()
+	}
+
+	s := &fetchServer{client: client, index: args.Index, slices: args.Slices}
+	mux := http.NewServeMux()
+	server := &http.Server{Addr: args.Serve.Listen, Handler: mux}
+	endpoint := fmt.Sprintf("http://%s/fetch", args.Serve.Listen)
+	if args.Serve.GRPC {
+		mux.HandleFunc("POST "+grpcFetchPath, s.grpcFetch)
+		// gRPC runs over HTTP/2, in clear text as service meshes terminate TLS in their proxies
+		server.Handler = h2c.NewHandler(mux, &http2.Server{})
+		endpoint = fmt.Sprintf("grpc://%s%s", args.Serve.Listen, grpcFetchPath)
+	} else {
+		mux.HandleFunc("POST /fetch", s.fetch)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	slog.Info(fmt.Sprintf("Serving fetches at %s", endpoint), "event", "serving", "listen", args.Serve.Listen)
+
+	select {
+	case err := <-errs:
+		return fmt.Errorf("failed to serve: %w", err)
+	case <-ctx.Done():
+	}
+	// running fetches are given some time to finish, then interrupted
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+	}
+	return nil
+}
+
+// fetch runs the query of the request and streams its results back as json lines. Errors before
+// the first result are answered with an error status, later ones in the Esfetcher-Error trailer
+func (s *fetchServer) fetch(w http.ResponseWriter, r *http.Request) {
+	var req fetchRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, serveMaxRequestBytes))
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	query, err := s.resolve(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", serveErrorTrailer)
+	out := &responseWriter{w: w, rc: http.NewResponseController(w)}
+	start := time.Now()
+	summary, err := s.client.Query(r.Context(), req.Index, query, req.FetchAll, req.Slices, out)
+	if err != nil {
+		if r.Context().Err() != nil {
+			slog.Warn(fmt.Sprintf("Fetch of %s interrupted by the client after %d documents", req.Index, summary.Docs), "event", "fetch_interrupted", "index", req.Index, "docs", summary.Docs)
+			return
+		}
+		slog.Error(fmt.Sprintf("Fetch of %s failed: %v", req.Index, err), "event", "fetch_failed", "index", req.Index, "error", err)
+		if !out.written {
+			w.Header().Del("Trailer")
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		w.Header().Set(serveErrorTrailer, err.Error())
+		return
+	}
+	slog.Debug(
+		fmt.Sprintf("Fetched %d documents of %s in %v", summary.Docs, req.Index, time.Since(start)),
+		"event", "fetch_done", "index", req.Index, "docs", summary.Docs, "duration", time.Since(start),
+	)
+}
+
+// resolve fills in the defaults of the server in a request, returning its query
+func (s *fetchServer) resolve(req *fetchRequest) (string, error) {
+	if req.Index == "" {
+		req.Index = s.index
+	}
+	if req.Index == "" {
+		return "", fmt.Errorf("no index to search, and the server has no --index")
+	}
+	if req.Slices <= 0 {
+		req.Slices = s.slices
+	}
+	if len(req.Query) == 0 || string(req.Query) == "null" {
+		return "", nil
+	}
+	return string(req.Query), nil
+}
+
+// responseWriter flushes every page of results to the client as soon as it is written
+type responseWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	written bool
+}
+
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	rw.written = true
+	n, err := rw.w.Write(data)
+	if err != nil {
+		return n, err
+	}
+	return n, rw.rc.Flush()
+}
+
+// httpStatus maps an error of a fetch to the status it is answered with: client errors for
+// invalid queries and missing indices, bad gateway for anything going wrong with the cluster
+func httpStatus(err error) int {
+	var esErr *ElasticsearchError
+	var queryErr *QueryError
+	switch {
+	case errors.As(err, &queryErr), errors.As(err, &esErr) && esErr.StatusCode == http.StatusBadRequest:
+		return http.StatusBadRequest
+	case errors.As(err, &esErr) && esErr.StatusCode == http.StatusNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// httpSession is the --record or --replay archive of the run, nil when there is none. Every
+// client of the run goes through it
+var httpSession *sessionArchive
+
+// exchange is a request to the cluster and its response, as recorded in the archive. The
+// credentials of the request are not recorded
+type exchange struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	RequestBody  string      `json:"request_body,omitempty"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header"`
+	ResponseBody string      `json:"response_body"`
+}
+
+// key is what a replayed request must match: its method, URL and body
+func (e exchange) key() string {
+	return e.Method + " " + e.URL + "\n" + e.RequestBody
+}
+
+// sessionArchive is a tar archive of the exchanges of a run with the cluster, one json file per
+// exchange in the order they completed. When recording, exchanges are appended as they complete,
+// so the archive holds what happened until a run crashed. When replaying, requests are answered
+// with the responses recorded for the same request, in the order they were recorded, without any
+// network access
+type sessionArchive struct {
+	mu sync.Mutex
+
+	// recording
+	file   *os.File
+	writer *tar.Writer
+	count  int
+
+	// replaying
+	path      string
+	responses map[string][]exchange
+}
+
+// openSession starts recording to record or replaying from replay, returning nil when neither is
+// set
+func openSession(record string, replay string) (*sessionArchive, error) {
+	switch {
+	case record != "" && replay != "":
+		return nil, fmt.Errorf("--record can't be used together with --replay")
+	case record != "":
+		file, err := os.Create(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session archive %s: %w", record, err)
+		}
+		return &sessionArchive{file: file, writer: tar.NewWriter(file)}, nil
+	case replay != "":
+		return loadSession(replay)
+	}
+	return nil, nil
+}
+
+func loadSession(path string) (*sessionArchive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session archive %s: %w", path, err)
+	}
+	defer file.Close()
+
+	s := &sessionArchive{path: path, responses: map[string][]exchange{}}
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session archive %s: %w", path, err)
+		}
+		var e exchange
+		if err := json.NewDecoder(reader).Decode(&e); err != nil {
+			return nil, fmt.Errorf("invalid exchange %s in session archive %s: %w", header.Name, path, err)
+		}
+		s.responses[e.key()] = append(s.responses[e.key()], e)
+		s.count++
+	}
+	slog.Info(fmt.Sprintf("Replaying %d exchanges recorded in %s", s.count, path), "event", "replay_session", "exchanges", s.count)
+	return s, nil
+}
+
+// wrap returns the transport of the clients of the session: next recorded, or a transport
+// answering from the recorded exchanges instead of next
+func (s *sessionArchive) wrap(next http.RoundTripper) http.RoundTripper {
+	switch {
+	case s == nil:
+		return next
+	case s.responses != nil:
+		return roundTripFunc(s.replay)
+	}
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return s.record(next, req)
+	})
+}
+
+// roundTripFunc is a function used as an http.RoundTripper
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (s *sessionArchive) record(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	e, err := newExchange(req)
+	if err != nil {
+		return nil, err
+	}
+	forward := req.Clone(req.Context())
+	forward.Body = io.NopCloser(bytes.NewBufferString(e.RequestBody))
+	res, err := next.RoundTrip(forward)
+	if err != nil {
+		// nothing to replay, the request is sent again when replaying and fails the same way
+		return nil, err
+	}
+	data, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	res.Body = io.NopCloser(bytes.NewReader(data))
+	e.Status, e.Header, e.ResponseBody = res.StatusCode, res.Header, string(data)
+
+	entry, _ := json.MarshalIndent(e, "", "  ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	header := &tar.Header{Name: fmt.Sprintf("%06d.json", s.count), Mode: 0o600, Size: int64(len(entry)), ModTime: time.Now()}
+	if err := s.writer.WriteHeader(header); err != nil {
+		return nil, fmt.Errorf("failed to record exchange: %w", err)
+	}
+	if _, err := s.writer.Write(entry); err != nil {
+		return nil, fmt.Errorf("failed to record exchange: %w", err)
+	}
+	if err := s.writer.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to record exchange: %w", err)
+	}
+	return res, nil
+}
+
+// replay answers a request with the next response recorded for it. The last one is answered
+// again once they were all replayed, as for requests repeated more often than when recording,
+// as the polling of tasks
+func (s *sessionArchive) replay(req *http.Request) (*http.Response, error) {
+	e, err := newExchange(req)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	recorded := s.responses[e.key()]
+	if len(recorded) > 1 {
+		s.responses[e.key()] = recorded[1:]
+	}
+	s.mu.Unlock()
+	if len(recorded) == 0 {
+		// answered with an error of the cluster rather than failing the request, which would be
+		// retried as a network error
+		reason, _ := json.Marshal(fmt.Sprintf("no response recorded in %s for %s %s", s.path, req.Method, e.URL))
+		recorded = []exchange{{
+			Status:       http.StatusNotImplemented,
+			Header:       http.Header{"Content-Type": {"application/json"}},
+			ResponseBody: fmt.Sprintf(`{"error":{"type":"replay_missing","reason":%s},"status":%d}`, reason, http.StatusNotImplemented),
+		}}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded[0].Status, http.StatusText(recorded[0].Status)),
+		StatusCode:    recorded[0].Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded[0].Header.Clone(),
+		Body:          io.NopCloser(bytes.NewBufferString(recorded[0].ResponseBody)),
+		ContentLength: int64(len(recorded[0].ResponseBody)),
+		Request:       req,
+	}, nil
+}
+
+// newExchange returns the exchange of a request, without its response. Credentials in the URL
+// are left out
+func newExchange(req *http.Request) (exchange, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return exchange{}, fmt.Errorf("failed to read request body: %w", err)
+		}
+		req.Body.Close()
+	}
+	u := *req.URL
+	u.User = nil
+	return exchange{Method: req.Method, URL: (&u).String(), RequestBody: string(body)}, nil
+}
+
+// Close finishes the recorded archive
+func (s *sessionArchive) Close() error {
+	if s == nil || s.file == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.writer.Close()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write session archive %s: %w", s.file.Name(), err)
+	}
+	slog.Info(fmt.Sprintf("Recorded %d exchanges to %s", s.count, s.file.Name()), "event", "record_session", "exchanges", s.count)
+	return nil
+}
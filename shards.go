@@ -0,0 +1,192 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+)
+
+// shardCopy is a copy of a shard, primary or replica, as listed by the _cat/shards API
+type shardCopy struct {
+	Index   string
+	Shard   string
+	Primary bool
+	Node    string
+	Docs    int64
+	Bytes   int64
+}
+
+// shards lists the copies of the shards of the indices matching index
+func (c *Client) shards(ctx context.Context, index string) ([]shardCopy, error) {
+	params := url.Values{}
+	params.Set("h", "index,shard,prirep,node,docs,store")
+	params.Set("bytes", "b")
+	params.Set("format", "json")
+	_, data, err := c.do(ctx, "GET", "_cat/shards/"+url.PathEscape(index)+"?"+params.Encode(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the shards of %s: %w", index, err)
+	}
+	// numbers are strings, and null for shards that are not assigned
+	var result []struct {
+		Index  string  `json:"index"`
+		Shard  string  `json:"shard"`
+		Prirep string  `json:"prirep"`
+		Node   *string `json:"node"`
+		Docs   *string `json:"docs"`
+		Store  *string `json:"store"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the shards of %s: %w", index, err)
+	}
+	copies := make([]shardCopy, 0, len(result))
+	for _, r := range result {
+		shard := shardCopy{Index: r.Index, Shard: r.Shard, Primary: r.Prirep == "p"}
+		if r.Node != nil {
+			shard.Node = *r.Node
+		}
+		if r.Docs != nil {
+			shard.Docs, _ = strconv.ParseInt(*r.Docs, 10, 64)
+		}
+		if r.Store != nil {
+			shard.Bytes, _ = strconv.ParseInt(*r.Store, 10, 64)
+		}
+		copies = append(copies, shard)
+	}
+	return copies, nil
+}
+
+// reportShards writes a breakdown of the shards of the indices matching index to w: the primary
+// shards, documents and size of every index, how the copies of the shards are spread over the
+// nodes, and hints on the number of slices to use and the hot spots to expect
+func (c *Client) reportShards(ctx context.Context, index string, sliceCount int, w io.Writer) error {
+	if c.Serverless || c.AOSS {
+		return fmt.Errorf("no shard report, shards are managed by the service")
+	}
+	copies, err := c.shards(ctx, index)
+	if err != nil {
+		return err
+	}
+	writeShardReport(w, index, copies, sliceCount)
+	return nil
+}
+
+// logShardReport writes the shard report to w, only warning when it can't be made, as it is not
+// needed for the export
+func (c *Client) logShardReport(ctx context.Context, index string, sliceCount int, w io.Writer) {
+	if err := c.reportShards(ctx, index, sliceCount, w); err != nil {
+		slog.Warn(err.Error(), "event", "shard_report_failed", "error", err)
+	}
+}
+
+func writeShardReport(w io.Writer, index string, copies []shardCopy, sliceCount int) {
+	type indexShards struct {
+		name      string
+		primaries int
+		docs      int64
+		bytes     int64
+		largest   int64
+	}
+	type nodeShards struct {
+		name      string
+		copies    int
+		primaries int
+		bytes     int64
+	}
+	indices := map[string]*indexShards{}
+	nodes := map[string]*nodeShards{}
+	var primaries, unassigned int
+	var totalDocs, totalBytes, largest int64
+	largestName := ""
+	for _, shard := range copies {
+		if shard.Node == "" {
+			unassigned++
+			continue
+		}
+		node := nodes[shard.Node]
+		if node == nil {
+			node = &nodeShards{name: shard.Node}
+			nodes[shard.Node] = node
+		}
+		node.copies++
+		node.bytes += shard.Bytes
+		if !shard.Primary {
+			continue
+		}
+		node.primaries++
+		idx := indices[shard.Index]
+		if idx == nil {
+			idx = &indexShards{name: shard.Index}
+			indices[shard.Index] = idx
+		}
+		idx.primaries++
+		idx.docs += shard.Docs
+		idx.bytes += shard.Bytes
+		idx.largest = max(idx.largest, shard.Bytes)
+		primaries++
+		totalDocs += shard.Docs
+		totalBytes += shard.Bytes
+		if shard.Bytes > largest {
+			largest, largestName = shard.Bytes, fmt.Sprintf("%s[%s]", shard.Index, shard.Shard)
+		}
+	}
+
+	fmt.Fprintf(
+		w, "Shards of %s: %d indices, %d primary shards holding %d documents in %s\n",
+		index, len(indices), primaries, totalDocs, formatBytes(float64(totalBytes)),
+	)
+	if len(indices) == 0 {
+		return
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "  index\tprimaries\tdocuments\tsize\tlargest shard")
+	byIndex := make([]*indexShards, 0, len(indices))
+	for _, idx := range indices {
+		byIndex = append(byIndex, idx)
+	}
+	slices.SortFunc(byIndex, func(a, b *indexShards) int { return cmp.Compare(a.name, b.name) })
+	for _, idx := range byIndex {
+		fmt.Fprintf(table, "  %s\t%d\t%d\t%s\t%s\n", idx.name, idx.primaries, idx.docs, formatBytes(float64(idx.bytes)), formatBytes(float64(idx.largest)))
+	}
+	fmt.Fprintln(table, "  node\tshards\tprimaries\tsize\t")
+	byNode := make([]*nodeShards, 0, len(nodes))
+	for _, node := range nodes {
+		byNode = append(byNode, node)
+	}
+	slices.SortFunc(byNode, func(a, b *nodeShards) int { return cmp.Or(cmp.Compare(b.bytes, a.bytes), cmp.Compare(a.name, b.name)) })
+	var copiesBytes int64
+	for _, node := range byNode {
+		fmt.Fprintf(table, "  %s\t%d\t%d\t%s\t\n", node.name, node.copies, node.primaries, formatBytes(float64(node.bytes)))
+		copiesBytes += node.bytes
+	}
+	table.Flush()
+
+	// a sliced scroll splits every shard, so slices beyond the shards of the smallest index only
+	// add overhead for it
+	fewest := slices.MinFunc(byIndex, func(a, b *indexShards) int { return cmp.Compare(a.primaries, b.primaries) })
+	fmt.Fprintf(w, "Hint: use at most --slices %d, the primary shards of %s", fewest.primaries, fewest.name)
+	if sliceCount > fewest.primaries {
+		fmt.Fprintf(w, ", the %d slices asked for split its shards", sliceCount)
+	}
+	fmt.Fprintln(w)
+	if unassigned > 0 {
+		fmt.Fprintf(w, "Hint: %d shard copies are not assigned to any node\n", unassigned)
+	}
+	if len(byNode) > 1 && copiesBytes > 0 {
+		if share := float64(byNode[0].bytes) / float64(copiesBytes); share > 2/float64(len(byNode)) {
+			fmt.Fprintf(w, "Hint: %s holds %.0f%% of the data, it will likely be a hot spot\n", byNode[0].name, share*100)
+		}
+	}
+	if primaries > 1 && totalBytes > 0 {
+		if ratio := float64(largest) / (float64(totalBytes) / float64(primaries)); ratio > 2 {
+			fmt.Fprintf(w, "Hint: %s is %.1fx the average shard, its slice will likely finish last\n", largestName, ratio)
+		}
+	}
+}
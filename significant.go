@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// significantSamplerSize is how many of the top matching documents of every shard significant
+// text is computed on, as analyzing the text of all of them is too expensive
+const significantSamplerSize = 200
+
+// significantTerm is a term that is unusually frequent in the documents matching the query
+// compared to the whole index
+type significantTerm struct {
+	Term json.RawMessage `json:"term"`
+	// significance score, higher for terms more frequent in the foreground than the background
+	Score float64 `json:"score"`
+	// how many foreground and background documents have the term
+	DocCount int64 `json:"doc_count"`
+	BgCount  int64 `json:"bg_count"`
+}
+
+func runSignificantTerms(args args) error {
+	query, err := args.Query()
+	if err != nil {
+		return err
+	}
+	if query, err = applyTimeRange(query, args.TimeField, args.Since, args.Until, args.Timezone); err != nil {
+		return err
+	}
+	client, err := newClient(args, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := client.detectCluster(ctx, args.Flavor); err != nil {
+		return err
+	}
+
+	cmd := args.SignificantTerms
+	terms, err := client.significantTerms(ctx, args.Index, query, cmd.Field, cmd.Text, cmd.Size)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	for _, term := range terms {
+		if err := encoder.Encode(term); err != nil {
+			return fmt.Errorf("failed to write entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// significantTerms returns the terms of field that are unusually frequent in the documents the
+// query matches, the foreground, compared to all the documents of the index, the background, by
+// decreasing score
+func (c *Client) significantTerms(ctx context.Context, index string, query string, field string, text bool, size int) ([]significantTerm, error) {
+	queryObj := map[string]json.RawMessage{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &queryObj); err != nil {
+			return nil, &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+	clause, ok := queryObj["query"]
+	if !ok {
+		return nil, fmt.Errorf("significant terms need a --query selecting the documents to compare to the rest of the index")
+	}
+
+	agg := map[string]any{"significant_terms": map[string]any{"field": field, "size": size}}
+	if text {
+		if !c.supports(6, 0) {
+			return nil, fmt.Errorf("--text needs Elasticsearch 6.0 or later, for significant_text aggregations")
+		}
+		agg = map[string]any{
+			"sampler": map[string]any{"shard_size": significantSamplerSize},
+			"aggs": map[string]any{
+				"terms": map[string]any{"significant_text": map[string]any{"field": field, "size": size, "filter_duplicate_text": true}},
+			},
+		}
+	}
+	body, err := json.Marshal(map[string]any{
+		"size":  0,
+		"query": clause,
+		"aggs":  map[string]any{"terms": agg},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal significant terms query: %w", err)
+	}
+	path := c.indexPath(index, "_search")
+	params := c.searchParams()
+	params.Del("_source")
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	_, data, err := c.do(ctx, "POST", path, string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	type buckets struct {
+		Buckets []struct {
+			Key      json.RawMessage `json:"key"`
+			DocCount int64           `json:"doc_count"`
+			BgCount  int64           `json:"bg_count"`
+			Score    float64         `json:"score"`
+		} `json:"buckets"`
+	}
+	var result struct {
+		ShardsMetaResult ShardsMetaResult `json:"_shards"`
+		Aggregations     struct {
+			Terms struct {
+				buckets
+				// significant text is nested under the sampler
+				Terms buckets `json:"terms"`
+			} `json:"terms"`
+		} `json:"aggregations"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if shards := result.ShardsMetaResult; shards.Failed > 0 {
+		return nil, &ShardFailuresError{Failed: shards.Failed, Failures: shards.Failures}
+	}
+	found := result.Aggregations.Terms.buckets
+	if text {
+		found = result.Aggregations.Terms.Terms
+	}
+
+	terms := make([]significantTerm, 0, len(found.Buckets))
+	for _, bucket := range found.Buckets {
+		terms = append(terms, significantTerm{Term: bucket.Key, Score: bucket.Score, DocCount: bucket.DocCount, BgCount: bucket.BgCount})
+	}
+	return terms, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsCredentials are the credentials requests are signed with
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// loadAWSCredentials reads the AWS credentials from the standard environment variables, falling
+// back to the shared credentials file and the AWS_PROFILE profile
+func loadAWSCredentials() (awsCredentials, error) {
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
+		return creds, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return creds, fmt.Errorf("no AWS credentials in the environment and no home directory to find them in: %w", err)
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return creds, fmt.Errorf("no AWS credentials in the environment and failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	creds = awsCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("no AWS credentials found for profile %s in %s", profile, path)
+	}
+	return creds, nil
+}
+
+// sigv4Transport signs requests with AWS Signature Version 4, as required by Amazon OpenSearch
+// Service (service es) and Amazon OpenSearch Serverless (service aoss)
+type sigv4Transport struct {
+	next        http.RoundTripper
+	region      string
+	service     string
+	credentials awsCredentials
+	now         func() time.Time
+}
+
+func newSigV4Transport(next http.RoundTripper, region string, service string, credentials awsCredentials) *sigv4Transport {
+	return &sigv4Transport{next: next, region: region, service: service, credentials: credentials, now: time.Now}
+}
+
+func (t *sigv4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	signed := req.Clone(req.Context())
+	signed.Body = io.NopCloser(bytes.NewReader(body))
+	signed.ContentLength = int64(len(body))
+	t.sign(signed, body)
+	return t.next.RoundTrip(signed)
+}
+
+func (t *sigv4Transport) sign(req *http.Request, body []byte) {
+	now := t.now().UTC()
+	payloadHash := sha256Hex(body)
+
+	// the payload hash header is not required by the es service, but aoss rejects requests
+	// without it
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if t.credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", t.credentials.SessionToken)
+	}
+	req.Header.Set("Authorization", t.authorization(req, payloadHash, now))
+}
+
+// authorization returns the Authorization header signing req, over its host, content type and
+// x-amz- headers, at the time now
+func (t *sigv4Transport) authorization(req *http.Request, payloadHash string, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	// the signature covers the Host header actually sent, which --host-header may override
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := sortedKeys(headers)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		sigv4EscapePath(req.URL.EscapedPath()),
+		sigv4CanonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, t.region, t.service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+t.credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, t.region)
+	key = hmacSHA256(key, t.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.credentials.AccessKeyID, scope, signedHeaders, signature,
+	)
+}
+
+// sigv4EscapePath escapes the already escaped request path once more, as AWS expects for every
+// service but S3. Index patterns like logs-* are the usual victims of getting this wrong
+func sigv4EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sigv4CanonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, sigv4Escape(key)+"="+sigv4Escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func sigv4Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the credentials and time of the AWS Signature Version 4 test suite
+var (
+	sigv4TestCredentials = awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	sigv4TestTime        = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+// TestSigV4TestSuite checks the signatures of requests of the AWS Signature Version 4 test suite,
+// which only carry the host and x-amz-date headers
+func TestSigV4TestSuite(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		signature string
+	}{
+		{"get-vanilla", "GET", "/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-query-order-key-case", "GET", "/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"get-vanilla-empty-query-key", "GET", "/?Param1=value1", "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb"},
+		{"post-vanilla", "POST", "/", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	}
+	transport := &sigv4Transport{region: "us-east-1", service: "service", credentials: sigv4TestCredentials}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, "https://example.amazonaws.com"+test.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Amz-Date", "20150830T123600Z")
+			got := transport.authorization(req, sha256Hex(nil), sigv4TestTime)
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + test.signature
+			if got != want {
+				t.Errorf("got authorization\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+// TestSigV4Sign checks the requests esfetcher sends to Amazon OpenSearch Service, with index
+// patterns and query strings, against signatures computed with the signer of the AWS SDK for Go
+func TestSigV4Sign(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		body      string
+		signature string
+	}{
+		{
+			"search with an index pattern",
+			"POST", "https://search-logs.eu-west-1.es.amazonaws.com/logs-*/_search?scroll=1m&size=1000", `{"query":{"match_all":{}}}`,
+			"bfcedf97771f21e93acc03c01c83829cc6a53bfbc3cb074873dd0035a898a1c3",
+		},
+		{
+			"count with several index patterns and a query",
+			"GET", "https://search-logs.eu-west-1.es.amazonaws.com/logs-2024.*,metrics-*/_count?q=status:200&ignore_unavailable=true", "",
+			"e523f427d0284e4e58040cd73c3e0f79b0139cf29bcd9b539e8868c754229dd6",
+		},
+	}
+	credentials := sigv4TestCredentials
+	credentials.SessionToken = "session-token"
+	transport := newSigV4Transport(nil, "eu-west-1", "es", credentials)
+	transport.now = func() time.Time { return sigv4TestTime }
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			transport.sign(req, []byte(test.body))
+
+			for name, want := range map[string]string{
+				"X-Amz-Date":           "20150830T123600Z",
+				"X-Amz-Content-Sha256": sha256Hex([]byte(test.body)),
+				"X-Amz-Security-Token": "session-token",
+				"Authorization": "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/eu-west-1/es/aws4_request, " +
+					"SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date;x-amz-security-token, Signature=" + test.signature,
+			} {
+				if got := req.Header.Get(name); got != want {
+					t.Errorf("got %s header\n%s\nwant\n%s", name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// sinkSchemes are the schemes of the --output URLs
+var sinkSchemes = []string{"bigquery", "splunk-hec", "syslog", "duckdb"}
+
+// sink is where --output delivers the hits instead of the standard output, for destinations that
+// are not a stream of bytes, as databases and log collectors. write is called with every page of
+// hits, once transformed, never concurrently, and returns once they are delivered, so the journal
+// only records delivered documents, unless the sink is a batchSink. Close delivers anything still
+// buffered
+type sink interface {
+	write(hits []json.RawMessage) error
+	Close() error
+}
+
+// batchSink is a sink buffering the hits of several pages to deliver them at once, as loading
+// them is costly. flush delivers the hits buffered so far, and is called after every page when
+// the journal needs them delivered before recording them
+type batchSink interface {
+	sink
+	flush() error
+}
+
+// sinkOptions are the options of the sinks given by flags rather than in the --output URL, as
+// secrets
+type sinkOptions struct {
+	hecToken       string
+	syslogTemplate string
+}
+
+// newSink opens the sink of an --output URL, for the documents of index
+func (c *Client) newSink(ctx context.Context, index string, output string, opts sinkOptions) (sink, error) {
+	u, err := url.Parse(output)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --output %q: %w", output, err)
+	}
+	switch u.Scheme {
+	case "bigquery":
+		return c.newBigQuerySink(ctx, index, u)
+	case "splunk-hec":
+		return c.newSplunkSink(ctx, u, opts.hecToken)
+	case "syslog":
+		return c.newSyslogSink(ctx, u, opts.syslogTemplate)
+	case "duckdb":
+		return newDuckDBSink(u)
+	default:
+		return nil, fmt.Errorf("invalid --output %q, expected a URL with one of the schemes %s", output, strings.Join(sinkSchemes, ", "))
+	}
+}
+
+// writeSink delivers the hits to the sink of the client, returning their size as json lines
+func (c *Client) writeSink(hits []json.RawMessage, writerLock *sync.Mutex) (int64, error) {
+	if writerLock != nil {
+		writerLock.Lock()
+		defer writerLock.Unlock()
+	}
+	if err := c.Sink.write(hits); err != nil {
+		return 0, err
+	}
+	if batch, ok := c.Sink.(batchSink); ok && c.Journal != nil {
+		if err := batch.flush(); err != nil {
+			return 0, err
+		}
+	}
+	var written int64
+	for _, hit := range hits {
+		written += int64(len(hit)) + 1
+	}
+	return written, nil
+}
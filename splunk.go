@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// splunkDefaultBatch is how many events are posted to the HTTP Event Collector at once by default
+const splunkDefaultBatch = 1000
+
+// splunkSink posts the hits as events to a Splunk HTTP Event Collector, in batches of several
+// events per request. The _source of the hits is the event, with their _index and _id as the
+// es_index and es_id indexed fields, and the time of the event is read from a field of the
+// _source, @timestamp by default, leaving it to Splunk when missing. Requests rejected for the
+// collector being busy are retried, which can deliver a batch twice
+type splunkSink struct {
+	ctx        context.Context
+	client     *http.Client
+	url        string
+	token      string
+	maxRetries int
+	backoff    Backoff
+
+	batch      int
+	timeField  string
+	sourceType string
+	index      string
+	source     string
+	host       string
+}
+
+// newSplunkSink opens the sink of a splunk-hec://HOST:PORT URL, which query sets the sourcetype,
+// index, source and host of the events, the time_field they are timed by, the batch size, and
+// tls=false for collectors without TLS or insecure=true for the ones with a self-signed
+// certificate
+func (c *Client) newSplunkSink(ctx context.Context, u *url.URL, token string) (*splunkSink, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid --output %q, expected splunk-hec://HOST:PORT", u.String())
+	}
+	if token == "" {
+		return nil, fmt.Errorf("--output %s needs the token of the HTTP Event Collector in --hec-token", u.Redacted())
+	}
+	query := u.Query()
+	s := &splunkSink{
+		ctx:        ctx,
+		client:     http.DefaultClient,
+		token:      token,
+		maxRetries: c.MaxRetries,
+		backoff:    c.Backoff,
+		batch:      splunkDefaultBatch,
+		timeField:  "@timestamp",
+		sourceType: query.Get("sourcetype"),
+		index:      query.Get("index"),
+		source:     query.Get("source"),
+		host:       query.Get("host"),
+	}
+	if field := query.Get("time_field"); field != "" {
+		s.timeField = field
+	}
+	if batch := query.Get("batch"); batch != "" {
+		n, err := strconv.Atoi(batch)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid batch %q of --output, expected a positive number of events", batch)
+		}
+		s.batch = n
+	}
+
+	scheme := "https"
+	if query.Get("tls") == "false" {
+		scheme = "http"
+	}
+	if query.Get("insecure") == "true" {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		s.client = &http.Client{Transport: transport}
+	}
+	path := u.Path
+	if path == "" {
+		path = "/services/collector/event"
+	}
+	s.url = scheme + "://" + u.Host + path
+	return s, nil
+}
+
+func (s *splunkSink) write(hits []json.RawMessage) error {
+	var body bytes.Buffer
+	events := 0
+	for _, hit := range hits {
+		if err := s.encodeEvent(&body, hit); err != nil {
+			return err
+		}
+		if events++; events == s.batch {
+			if err := s.post(body.Bytes(), events); err != nil {
+				return err
+			}
+			body.Reset()
+			events = 0
+		}
+	}
+	if events == 0 {
+		return nil
+	}
+	return s.post(body.Bytes(), events)
+}
+
+func (s *splunkSink) Close() error {
+	return nil
+}
+
+// encodeEvent appends the event of a hit to the body of a request
+func (s *splunkSink) encodeEvent(buf *bytes.Buffer, hit json.RawMessage) error {
+	decoder := json.NewDecoder(bytes.NewReader(hit))
+	decoder.UseNumber()
+	var doc struct {
+		Index  string         `json:"_index"`
+		ID     string         `json:"_id"`
+		Source map[string]any `json:"_source"`
+	}
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("failed to decode hit: %w", err)
+	}
+
+	event := map[string]any{
+		"event":  doc.Source,
+		"fields": map[string]string{"es_index": doc.Index, "es_id": doc.ID},
+	}
+	if doc.Source == nil {
+		event["event"] = hit
+	}
+	value, _ := getPath(doc.Source, s.timeField)
+	if t, ok := parseDate(value, defaultDateFormats); ok {
+		event["time"] = json.Number(strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', 3, 64))
+	}
+	for key, value := range map[string]string{"sourcetype": s.sourceType, "index": s.index, "source": s.source, "host": s.host} {
+		if value != "" {
+			event[key] = value
+		}
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %w", err)
+	}
+	buf.Write(data)
+	buf.WriteByte('\n')
+	return nil
+}
+
+// post sends a batch of events to the collector, retrying while it is busy
+func (s *splunkSink) post(body []byte, events int) error {
+	for attempt := 0; ; attempt++ {
+		retryable, err := s.postOnce(body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= s.maxRetries || s.ctx.Err() != nil {
+			return fmt.Errorf("failed to send %d events to the HTTP Event Collector: %w", events, err)
+		}
+		wait := s.backoff.delay(attempt)
+		slog.Warn(
+			fmt.Sprintf("Sending %d events to the HTTP Event Collector failed, retrying in %v: %v", events, wait, err),
+			"event", "splunk_retry", "events", events, "error", err,
+		)
+		if err := sleep(s.ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *splunkSink) postOnce(body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(s.ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return true, err
+	}
+	if res.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	var answer struct {
+		Text string `json:"text"`
+		Code int    `json:"code"`
+	}
+	reason := strings.TrimSpace(string(data))
+	if json.Unmarshal(data, &answer) == nil && answer.Text != "" {
+		reason = fmt.Sprintf("%s (code %d)", answer.Text, answer.Code)
+	}
+	retryable := res.StatusCode == http.StatusServiceUnavailable || res.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("%s: %s", res.Status, reason)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// counters returns a snapshot of the process wide counters, keyed by a dotted metric name
+func (m *metricsRegistry) counters() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counters := map[string]int64{
+		"docs":    m.docs,
+		"bytes":   m.bytes,
+		"retries": m.retries,
+	}
+	for errorType, count := range m.errors {
+		counters["errors."+errorType] = count
+	}
+	for operation, h := range m.latencies {
+		counters["requests."+operation] = h.count
+	}
+	return counters
+}
+
+// pushStatsd periodically pushes the increase of every counter since the previous push to a
+// StatsD (or DogStatsD) agent over UDP, until the returned stop function is called. Stopping does a
+// final push so nothing is lost at the end of the run
+func pushStatsd(ctx context.Context, addr string, prefix string, every time.Duration) (stop func(), err error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd at %s: %w", addr, err)
+	}
+
+	last := map[string]int64{}
+	push := func() {
+		var buf bytes.Buffer
+		flush := func() {
+			if buf.Len() == 0 {
+				return
+			}
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				slog.Debug(fmt.Sprintf("failed to push metrics to statsd: %v", err), "event", "statsd_failed", "error", err)
+			}
+			buf.Reset()
+		}
+		counters := metrics.counters()
+		for _, name := range sortedKeys(counters) {
+			value := counters[name]
+			if delta := value - last[name]; delta > 0 {
+				line := fmt.Sprintf("%s%s:%d|c\n", prefix, name, delta)
+				// keep datagrams under the common 1432 bytes safe UDP payload size
+				if buf.Len()+len(line) > 1432 {
+					flush()
+				}
+				buf.WriteString(line)
+			}
+			last[name] = value
+		}
+		flush()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				push()
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+		push()
+		conn.Close()
+	}, nil
+}
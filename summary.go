@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Summary is a machine readable report of a query run, meant for orchestration systems to verify
+// and record exports
+type Summary struct {
+	Status          string         `json:"status"`
+	Error           string         `json:"error,omitempty"`
+	Index           string         `json:"index"`
+	StartedAt       time.Time      `json:"started_at"`
+	FinishedAt      time.Time      `json:"finished_at"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Docs            int64          `json:"docs"`
+	TotalDocs       int64          `json:"total_docs"`
+	Bytes           int64          `json:"bytes"`
+	Retries         int64          `json:"retries"`
+	ShardFailures   int64          `json:"shard_failures"`
+	TimedOutPages   int64          `json:"timed_out_pages"`
+	TookMillis      int64          `json:"took_ms"`
+	MissingSlices   []int          `json:"missing_slices,omitempty"`
+	Slices          []SliceSummary `json:"slices"`
+}
+
+type SliceSummary struct {
+	Slice     int    `json:"slice"`
+	Docs      int64  `json:"docs"`
+	TotalDocs int64  `json:"total_docs"`
+	Bytes     int64  `json:"bytes"`
+	Pages     int64  `json:"pages"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (p *progress) summary(index string, start time.Time, err error) *Summary {
+	now := time.Now()
+	s := &Summary{
+		Status:          "success",
+		Index:           index,
+		StartedAt:       start,
+		FinishedAt:      now,
+		DurationSeconds: now.Sub(start).Seconds(),
+		Docs:            p.docs.Load(),
+		TotalDocs:       p.totalDocs.Load(),
+		Bytes:           p.bytes.Load(),
+		Retries:         p.retries.Load(),
+		ShardFailures:   p.shardFailures.Load(),
+		TimedOutPages:   p.timedOutPages.Load(),
+		TookMillis:      p.took.Load(),
+		Slices:          make([]SliceSummary, len(p.slices)),
+	}
+	if err != nil {
+		s.Status = "failure"
+		s.Error = err.Error()
+	}
+	var partial *PartialResultsError
+	if errors.As(err, &partial) {
+		s.Status = "partial"
+		s.MissingSlices = partial.Missing
+	}
+	for i := range p.slices {
+		sp := &p.slices[i]
+		s.Slices[i] = SliceSummary{
+			Slice:     i,
+			Docs:      sp.docs.Load(),
+			TotalDocs: sp.totalDocs.Load(),
+			Bytes:     sp.bytes.Load(),
+			Pages:     sp.pages.Load(),
+			Done:      sp.done.Load(),
+		}
+		if err := sp.err.Load(); err != nil {
+			s.Slices[i].Error = (*err).Error()
+		}
+	}
+	return s
+}
+
+// writeSummary writes the summary as json to the given file, or to stderr if no file is given
+func writeSummary(summary *Summary, file string) error {
+	var writer io.Writer = os.Stderr
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return fmt.Errorf("failed to create summary file %s: %w", file, err)
+		}
+		defer f.Close()
+		writer = f
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(summary); err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+	return nil
+}
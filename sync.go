@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// syncState is what --state-file keeps between the runs of an incremental sync: the time up to
+// which the documents of the index were exported
+type syncState struct {
+	Index         string    `json:"index"`
+	TimeField     string    `json:"time_field"`
+	HighWaterMark time.Time `json:"high_water_mark"`
+}
+
+// readSyncState reads the state of an incremental sync, nil when there was no previous run
+func readSyncState(path string) (*syncState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	var state syncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// writeSyncState replaces the state file, through a temporary file renamed over it so an
+// interrupted write never leaves it truncated
+func writeSyncState(path string, state syncState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// syncRange returns the time range of this run of an incremental sync, as --since and --until
+// values, and the high-water mark to record once it succeeds. The run starts overlap before the
+// mark of the previous run, to catch documents that arrived late with older times, and ends delay
+// before now, to give the documents being indexed time to arrive. An explicit since, as for a
+// backfill, takes precedence over the previous mark. The first run exports everything up to the
+// end
+func syncRange(state *syncState, index string, timeField string, since string, overlap time.Duration, delay time.Duration, now time.Time) (string, string, time.Time, error) {
+	if state != nil && (state.Index != index || state.TimeField != timeField) {
+		return "", "", time.Time{}, fmt.Errorf(
+			"the state file was recorded for --time-field %s of %s, not --time-field %s of %s: use another --state-file",
+			state.TimeField, state.Index, timeField, index,
+		)
+	}
+	// dates are indexed with millisecond precision
+	mark := now.Add(-delay).UTC().Truncate(time.Millisecond)
+	if since == "" && state != nil {
+		since = state.HighWaterMark.Add(-overlap).UTC().Format(time.RFC3339Nano)
+	}
+	return since, mark.Format(time.RFC3339Nano), mark, nil
+}
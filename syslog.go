@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syslogFacilities are the facility names of the facility parameter of syslog:// outputs
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities are the severity names of the severity parameter of syslog:// outputs
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// syslogPlaceholderRe matches the {{path}} placeholders of --syslog-template
+var syslogPlaceholderRe = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+// syslogSink sends every hit as an RFC 5424 syslog message, over UDP, TCP or TLS. Messages over
+// TCP and TLS are framed by octet counting, as RFC 6587 and RFC 5425 describe. The message is the
+// hit as json, or --syslog-template rendered with the values of the hit, and its timestamp the
+// time field of the _source, @timestamp by default, or the time it is sent when missing. A TCP or
+// TLS connection that breaks is opened again and the page sent anew, so messages can be sent
+// twice. Over UDP, messages that are lost are not noticed
+type syslogSink struct {
+	ctx        context.Context
+	proto      string
+	addr       string
+	serverName string
+	maxRetries int
+	backoff    Backoff
+
+	conn net.Conn
+
+	priority  int
+	hostname  string
+	appName   string
+	timeField string
+	template  string
+}
+
+// newSyslogSink opens the sink of a syslog://HOST:PORT URL, which query sets the proto (udp,
+// tcp or tls), the facility and severity, the app name and hostname of the messages and the
+// time_field they are timed by
+func (c *Client) newSyslogSink(ctx context.Context, u *url.URL, template string) (*syslogSink, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid --output %q, expected syslog://HOST:PORT", u.String())
+	}
+	if err := validSyslogTemplate(template); err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	s := &syslogSink{
+		ctx:        ctx,
+		proto:      cmp.Or(query.Get("proto"), "udp"),
+		serverName: u.Hostname(),
+		maxRetries: c.MaxRetries,
+		backoff:    c.Backoff,
+		appName:    cmp.Or(query.Get("app"), "esfetcher"),
+		timeField:  cmp.Or(query.Get("time_field"), "@timestamp"),
+		template:   template,
+	}
+	port := u.Port()
+	switch s.proto {
+	case "udp", "tcp":
+		port = cmp.Or(port, "514")
+	case "tls":
+		port = cmp.Or(port, "6514")
+	default:
+		return nil, fmt.Errorf("invalid proto %q of --output, expected udp, tcp or tls", s.proto)
+	}
+	s.addr = net.JoinHostPort(u.Hostname(), port)
+
+	facility, ok := syslogFacilities[cmp.Or(query.Get("facility"), "user")]
+	if !ok {
+		return nil, fmt.Errorf("invalid facility %q of --output, expected one of kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp or local0 to local7", query.Get("facility"))
+	}
+	severity, ok := syslogSeverities[cmp.Or(query.Get("severity"), "info")]
+	if !ok {
+		return nil, fmt.Errorf("invalid severity %q of --output, expected one of emerg, alert, crit, err, warning, notice, info or debug", query.Get("severity"))
+	}
+	s.priority = facility*8 + severity
+
+	s.hostname = query.Get("hostname")
+	if s.hostname == "" {
+		if s.hostname, _ = os.Hostname(); s.hostname == "" {
+			s.hostname = "-"
+		}
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) connect() error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var err error
+	switch s.proto {
+	case "tls":
+		s.conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.serverName}}).DialContext(s.ctx, "tcp", s.addr)
+	default:
+		s.conn, err = dialer.DialContext(s.ctx, s.proto, s.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog server %s: %w", s.addr, err)
+	}
+	return nil
+}
+
+func (s *syslogSink) write(hits []json.RawMessage) error {
+	var page bytes.Buffer
+	var messages [][]byte
+	for _, hit := range hits {
+		message, err := s.format(hit)
+		if err != nil {
+			return err
+		}
+		if s.proto == "udp" {
+			messages = append(messages, message)
+			continue
+		}
+		page.WriteString(strconv.Itoa(len(message)))
+		page.WriteByte(' ')
+		page.Write(message)
+	}
+
+	if s.proto == "udp" {
+		// every message is a datagram of its own
+		for _, message := range messages {
+			if _, err := s.conn.Write(message); err != nil {
+				return fmt.Errorf("failed to send to syslog server %s: %w", s.addr, err)
+			}
+		}
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		_, err := s.conn.Write(page.Bytes())
+		if err == nil {
+			return nil
+		}
+		if attempt >= s.maxRetries || s.ctx.Err() != nil {
+			return fmt.Errorf("failed to send %d messages to syslog server %s: %w", len(hits), s.addr, err)
+		}
+		wait := s.backoff.delay(attempt)
+		slog.Warn(
+			fmt.Sprintf("Sending %d messages to syslog server %s failed, reconnecting in %v: %v", len(hits), s.addr, wait, err),
+			"event", "syslog_retry", "messages", len(hits), "error", err,
+		)
+		s.conn.Close()
+		if err := sleep(s.ctx, wait); err != nil {
+			return err
+		}
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *syslogSink) Close() error {
+	return s.conn.Close()
+}
+
+// format returns the syslog message of a hit
+func (s *syslogSink) format(hit json.RawMessage) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(hit))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode hit: %w", err)
+	}
+	timestamp := time.Now()
+	if source, ok := doc["_source"].(map[string]any); ok {
+		value, _ := getPath(source, s.timeField)
+		if t, ok := parseDate(value, defaultDateFormats); ok {
+			timestamp = t
+		}
+	}
+
+	message := []byte(hit)
+	if s.template != "" {
+		message = []byte(renderSyslogTemplate(s.template, doc))
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s - - - ", s.priority, timestamp.UTC().Format("2006-01-02T15:04:05.000000Z"), s.hostname, s.appName)
+	return append([]byte(header), message...), nil
+}
+
+// renderSyslogTemplate replaces the {{path}} placeholders of --syslog-template with the values at
+// the dotted paths of the hit: strings as they are, other values as json, and nothing for values
+// that are missing
+func renderSyslogTemplate(template string, doc map[string]any) string {
+	return syslogPlaceholderRe.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value, ok := getPath(doc, syslogPlaceholderRe.FindStringSubmatch(placeholder)[1])
+		if !ok || value == nil {
+			return ""
+		}
+		if text, ok := value.(string); ok {
+			return text
+		}
+		data, _ := json.Marshal(value)
+		return string(data)
+	})
+}
+
+// validSyslogTemplate checks the placeholders of --syslog-template are closed
+func validSyslogTemplate(template string) error {
+	if rest := syslogPlaceholderRe.ReplaceAllString(template, ""); strings.Contains(rest, "{{") {
+		return fmt.Errorf("invalid --syslog-template %q: unclosed or empty {{ placeholder", template)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// serverTask is a task running in the cluster on behalf of esfetcher, as reported by the
+// _tasks API
+type serverTask struct {
+	Node               string            `json:"node"`
+	ID                 int64             `json:"id"`
+	Action             string            `json:"action"`
+	Description        string            `json:"description"`
+	RunningTimeInNanos int64             `json:"running_time_in_nanos"`
+	Cancellable        bool              `json:"cancellable"`
+	Headers            map[string]string `json:"headers"`
+}
+
+func (t serverTask) taskID() string {
+	return fmt.Sprintf("%s:%d", t.Node, t.ID)
+}
+
+// newOpaqueID returns a random id identifying this run. It is sent in the X-Opaque-Id header of
+// every request, which Elasticsearch attaches to the tasks it runs on our behalf
+func newOpaqueID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return "esfetcher-" + hex.EncodeToString(b[:])
+}
+
+// ownTasks lists the search tasks running in the cluster on behalf of this client
+func (c *Client) ownTasks(ctx context.Context) ([]serverTask, error) {
+	// Elasticsearch only attaches the X-Opaque-Id header to tasks since 6.2, and serverless
+	// projects and collections don't have the tasks API
+	if c.OpaqueID == "" || !c.supports(6, 2) || c.Serverless || c.AOSS {
+		return nil, nil
+	}
+	params := url.Values{}
+	params.Set("detailed", "true")
+	params.Set("group_by", "none")
+	params.Set("actions", "*search*")
+	_, data, err := c.do(ctx, "GET", "_tasks?"+params.Encode(), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	var result struct {
+		Tasks []serverTask `json:"tasks"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tasks: %w", err)
+	}
+	var own []serverTask
+	for _, task := range result.Tasks {
+		if task.Headers["X-Opaque-Id"] == c.OpaqueID {
+			own = append(own, task)
+		}
+	}
+	return own, nil
+}
+
+// watchTasks periodically logs, at debug level, the status of the server side tasks running on
+// behalf of this client, until the returned stop function is called
+func (c *Client) watchTasks(ctx context.Context, every time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				tasks, err := c.ownTasks(ctx)
+				if err != nil {
+					slog.Debug(err.Error(), "event", "tasks_failed", "error", err)
+					continue
+				}
+				for _, task := range tasks {
+					running := time.Duration(task.RunningTimeInNanos).Truncate(time.Millisecond)
+					slog.Debug(
+						fmt.Sprintf("Server task %s (%s) running for %v: %s", task.taskID(), task.Action, running, task.Description),
+						"event", "server_task", "task", task.taskID(), "action", task.Action, "running", running,
+					)
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// cancelOwnTasks cancels the server side tasks still running on behalf of this client, so they
+// stop burning cluster resources after the client goes away
+func (c *Client) cancelOwnTasks(ctx context.Context) error {
+	tasks, err := c.ownTasks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if !task.Cancellable {
+			continue
+		}
+		if _, _, err := c.do(ctx, "POST", fmt.Sprintf("_tasks/%s/_cancel", task.taskID()), ""); err != nil {
+			return fmt.Errorf("failed to cancel task %s: %w", task.taskID(), err)
+		}
+		slog.Info(fmt.Sprintf("Cancelled server task %s (%s)", task.taskID(), task.Action), "event", "task_cancelled", "task", task.taskID())
+	}
+	return nil
+}
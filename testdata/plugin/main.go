@@ -0,0 +1,43 @@
+// Command plugin is the --plugin module of the tests, built with GOOS=wasip1 GOARCH=wasm. It
+// marks the hits it is given, and drops, fails or garbles the ones with the ids of these names
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var hit map[string]any
+	if err := json.Unmarshal(data, &hit); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	switch hit["_id"] {
+	case "drop":
+		return
+	case "fail":
+		fmt.Fprintln(os.Stderr, "refusing hit fail")
+		os.Exit(3)
+	case "garble":
+		fmt.Println("not json")
+		return
+	}
+	source, _ := hit["_source"].(map[string]any)
+	if source == nil {
+		source = map[string]any{}
+	}
+	source["plugin"] = "wasm"
+	hit["_source"] = source
+	if err := json.NewEncoder(os.Stdout).Encode(hit); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts accepted by --since and --until for absolute times. Times without an offset are in the
+// --timezone
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTimeBound parses a --since or --until value into a value for a range query. It accepts
+// absolute times, durations relative to now (90m, 24h, 7d) and Elasticsearch date math starting
+// with now (now-1d/d), which is passed as is for Elasticsearch to resolve in the time zone
+func parseTimeBound(value string, loc *time.Location, now time.Time) (string, error) {
+	if strings.HasPrefix(value, "now") {
+		return value, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return now.In(loc).AddDate(0, 0, -n).Format(time.RFC3339), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.In(loc).Add(-d).Format(time.RFC3339), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.Format(time.RFC3339Nano), nil
+		}
+	}
+	return "", fmt.Errorf("invalid time %q, expected a date like 2024-01-31, a time like 2024-01-31T08:00:00, a duration like 24h or 7d, or date math like now-1d/d", value)
+}
+
+// applyTimeRange restricts the query to documents with field between since (inclusive) and until
+// (exclusive), either of which can be empty. The time zone is set on the range filter, so date
+// math like now/d rounds to local days, and on the date aggregations of the query that don't set
+// their own
+func applyTimeRange(query string, field string, since string, until string, timezone string) (string, error) {
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return "", fmt.Errorf("invalid time zone %q: %w", timezone, err)
+		}
+	}
+	if since == "" && until == "" && timezone == "" {
+		return query, nil
+	}
+
+	body := map[string]any{}
+	if query != "" {
+		if err := json.Unmarshal([]byte(query), &body); err != nil {
+			return "", &QueryError{fmt.Errorf("failed to parse query: %w", err)}
+		}
+	}
+
+	if since != "" || until != "" {
+		now := time.Now()
+		bounds := map[string]any{}
+		if since != "" {
+			value, err := parseTimeBound(since, loc, now)
+			if err != nil {
+				return "", fmt.Errorf("invalid --since: %w", err)
+			}
+			bounds["gte"] = value
+		}
+		if until != "" {
+			value, err := parseTimeBound(until, loc, now)
+			if err != nil {
+				return "", fmt.Errorf("invalid --until: %w", err)
+			}
+			bounds["lt"] = value
+		}
+		if timezone != "" {
+			bounds["time_zone"] = timezone
+		}
+		filter := []any{map[string]any{"range": map[string]any{field: bounds}}}
+		if existing, ok := body["query"]; ok {
+			filter = append([]any{existing}, filter...)
+		}
+		body["query"] = map[string]any{"bool": map[string]any{"filter": filter}}
+	}
+
+	if timezone != "" {
+		for _, key := range []string{"aggs", "aggregations"} {
+			if aggs, ok := body[key].(map[string]any); ok {
+				setAggsTimeZone(aggs, timezone)
+			}
+		}
+	}
+
+	out, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal query with time range: %w", err)
+	}
+	return string(out), nil
+}
+
+// setAggsTimeZone sets the time zone on the date aggregations of aggs and their sub aggregations
+func setAggsTimeZone(aggs map[string]any, timezone string) {
+	for _, agg := range aggs {
+		agg, ok := agg.(map[string]any)
+		if !ok {
+			continue
+		}
+		for kind, def := range agg {
+			def, ok := def.(map[string]any)
+			if !ok {
+				continue
+			}
+			switch kind {
+			case "date_histogram", "auto_date_histogram", "date_range":
+				if _, set := def["time_zone"]; !set {
+					def["time_zone"] = timezone
+				}
+			case "aggs", "aggregations":
+				setAggsTimeZone(def, timezone)
+			}
+		}
+	}
+}
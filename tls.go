@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// transportOptions are the connection options of the transport used to talk to Elasticsearch
+type transportOptions struct {
+	// optional PEM file with the certificate authorities to trust, for clusters using a private CA
+	caCert string
+	// curl style HOST:PORT:ADDRESS overrides of the addresses host names resolve to
+	resolve []string
+	// optional DNS server, as HOST or HOST:PORT, host names are resolved with instead of the
+	// system resolver
+	dnsServer string
+	// address family connections are made with: 4, 6, or auto for both
+	ipVersion string
+	// minimum TLS version, as 1.2, and comma separated names of the cipher suites allowed for
+	// TLS 1.2 and older. The Go defaults when empty
+	tlsMinVersion string
+	tlsCiphers    string
+	// optional server name sent in the TLS handshake and certificates are verified for, instead
+	// of the host of the URL
+	sni string
+	// interval of the TCP keep-alive probes, disabled when negative, how long idle connections
+	// are kept open for reuse, forever when zero, and how many of them. The Go defaults apply
+	// when maxIdleConns is zero
+	keepAlive    time.Duration
+	idleTimeout  time.Duration
+	maxIdleConns int
+}
+
+// tlsVersions are the TLS versions --tls-min-version accepts
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTransport returns the transport used to talk to Elasticsearch
+func newTransport(options transportOptions) (http.RoundTripper, error) {
+	if options.caCert == "" && len(options.resolve) == 0 && options.dnsServer == "" && options.ipVersion == "auto" &&
+		options.tlsMinVersion == "" && options.tlsCiphers == "" && options.sni == "" &&
+		options.keepAlive == 30*time.Second && options.idleTimeout == 90*time.Second && options.maxIdleConns == 0 {
+		return http.DefaultTransport, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{ServerName: options.sni}
+	transport.IdleConnTimeout = options.idleTimeout
+	if options.maxIdleConns > 0 {
+		// all the connections go to the same cluster, so the per host limit, 2 by default, is
+		// the one that matters
+		transport.MaxIdleConns = options.maxIdleConns
+		transport.MaxIdleConnsPerHost = options.maxIdleConns
+	}
+	if options.tlsMinVersion != "" {
+		version, ok := tlsVersions[options.tlsMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid --tls-min-version %q, expected 1.0, 1.1, 1.2 or 1.3", options.tlsMinVersion)
+		}
+		transport.TLSClientConfig.MinVersion = version
+	}
+	if options.tlsCiphers != "" {
+		ciphers, err := parseCipherSuites(options.tlsCiphers)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.CipherSuites = ciphers
+	}
+	if options.caCert != "" {
+		pem, err := os.ReadFile(options.caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %s: %w", options.caCert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificate found in CA certificate file %s", options.caCert)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	dial, err := newDialer(options.resolve, options.dnsServer, options.ipVersion, options.keepAlive)
+	if err != nil {
+		return nil, err
+	}
+	transport.DialContext = dial
+	return transport, nil
+}
+
+// parseCipherSuites returns the ids of the comma separated cipher suite names, as
+// TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384. Suites with known security issues are rejected. The
+// cipher suites of TLS 1.3 are not configurable, all of them are considered secure
+func parseCipherSuites(names string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range splitList(names) {
+		id, ok := suites[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q in --tls-ciphers", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
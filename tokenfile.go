@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenFileTransport authenticates requests with an Elasticsearch service account token read
+// from a file, as the ones Kubernetes mounts from secrets. The file is read again whenever it
+// changes, so rotated tokens are picked up by long running syncs and daemons without restarting
+// them
+type tokenFileTransport struct {
+	next http.RoundTripper
+	path string
+
+	mu      sync.Mutex
+	token   string
+	modTime time.Time
+	size    int64
+}
+
+// newTokenFileTransport reads the token of path, failing when it can't be read or is empty
+func newTokenFileTransport(next http.RoundTripper, path string) (*tokenFileTransport, error) {
+	t := &tokenFileTransport{next: next, path: path}
+	if _, err := t.current(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tokenFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.current()
+	if err != nil {
+		return nil, err
+	}
+	authed := req.Clone(req.Context())
+	authed.Header.Set("Authorization", "Bearer "+token)
+	return t.next.RoundTrip(authed)
+}
+
+// current returns the token, reading the file again when its modification time or size changed
+// since it was last read. The last token read is kept when the file can't be read anymore, as
+// while a secret is being replaced
+func (t *tokenFileTransport) current() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.path)
+	if err == nil && t.token != "" && info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return t.token, nil
+	}
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(t.path)
+	}
+	token := strings.TrimSpace(string(data))
+	if err == nil && token == "" {
+		err = fmt.Errorf("token file %s is empty", t.path)
+	}
+	if err != nil {
+		if t.token == "" {
+			return "", fmt.Errorf("failed to read token file %s: %w", t.path, err)
+		}
+		slog.Warn(fmt.Sprintf("failed to read token file %s, using the last token read: %v", t.path, err), "event", "token_file", "error", err)
+		return t.token, nil
+	}
+	if t.token != "" && token != t.token {
+		slog.Info(fmt.Sprintf("token file %s changed, using the new token", t.path), "event", "token_file")
+	}
+	t.token, t.modTime, t.size = token, info.ModTime(), info.Size()
+	return t.token, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	// the session token of temporary AWS credentials, sent along with the SigV4 signature
+	"X-Amz-Security-Token": true,
+}
+
+// tracingTransport dumps every request and response going through it: method, URL, headers,
+// request body, status and timing. Credentials are redacted
+type tracingTransport struct {
+	next   http.RoundTripper
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+func newTracingTransport(next http.RoundTripper, writer io.Writer) *tracingTransport {
+	return &tracingTransport{next: next, writer: writer}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "> %s %s\n", req.Method, redactURL(req))
+	writeHeaders(&buf, "> ", req.Header)
+	if len(body) > 0 {
+		fmt.Fprintf(&buf, ">\n%s\n", indent("> ", string(body)))
+	}
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	took := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(&buf, "< error after %v: %v\n\n", took, err)
+	} else {
+		fmt.Fprintf(&buf, "< %s %s (%v)\n", res.Proto, res.Status, took)
+		writeHeaders(&buf, "< ", res.Header)
+		buf.WriteString("\n")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writer.Write(buf.Bytes())
+	return res, err
+}
+
+func redactURL(req *http.Request) string {
+	if req.URL.User == nil {
+		return req.URL.String()
+	}
+	u := *req.URL
+	u.User = nil
+	return strings.Replace(u.String(), "://", "://[REDACTED]@", 1)
+}
+
+func writeHeaders(buf *bytes.Buffer, prefix string, headers http.Header) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range headers[k] {
+			if redactedHeaders[http.CanonicalHeaderKey(k)] {
+				v = "[REDACTED]"
+			}
+			fmt.Fprintf(buf, "%s%s: %s\n", prefix, k, v)
+		}
+	}
+}
+
+func indent(prefix string, s string) string {
+	return prefix + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n"+prefix)
+}
+
+// connTrace collects connection level timings of a request through net/http/httptrace. The
+// callbacks of a trace can run on other goroutines than the request, as the dialing ones of the
+// transport, so the fields are guarded by mu
+type connTrace struct {
+	mu                          sync.Mutex
+	start                       time.Time
+	dnsStart, dnsDone           time.Time
+	connectStart, connectDone   time.Time
+	tlsStart, tlsDone           time.Time
+	gotConn, wroteRequest, ttfb time.Time
+	reused                      bool
+	remoteAddr                  string
+}
+
+func withConnTrace(ctx context.Context) (context.Context, *connTrace) {
+	t := &connTrace{start: time.Now()}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { t.mark(&t.dnsDone) },
+		ConnectStart:      func(string, string) { t.mark(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { t.mark(&t.connectDone) },
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { t.mark(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.gotConn = time.Now()
+			t.reused = info.Reused
+			if info.Conn != nil {
+				t.remoteAddr = info.Conn.RemoteAddr().String()
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() { t.mark(&t.ttfb) },
+	}), t
+}
+
+// mark sets the time of a phase to now
+func (t *connTrace) mark(at *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*at = time.Now()
+}
+
+// log reports the collected timings. Phases that did not happen, like DNS resolution or TLS
+// handshake on a reused connection, are reported as zero
+func (t *connTrace) log(ctx context.Context, method string, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phase := func(start, end time.Time) time.Duration {
+		if start.IsZero() || end.IsZero() {
+			return 0
+		}
+		return end.Sub(start)
+	}
+	dns := phase(t.dnsStart, t.dnsDone)
+	connect := phase(t.connectStart, t.connectDone)
+	tlsHandshake := phase(t.tlsStart, t.tlsDone)
+	// time between the request being fully sent and the first response byte, i.e. server time
+	server := phase(t.wroteRequest, t.ttfb)
+	ttfb := phase(t.start, t.ttfb)
+	total := time.Since(t.start)
+	slog.InfoContext(
+		ctx,
+		fmt.Sprintf(
+			"%s %s to %s: dns=%v connect=%v tls=%v server=%v ttfb=%v total=%v reused=%v",
+			method, path, t.remoteAddr, dns, connect, tlsHandshake, server, ttfb, total, t.reused,
+		),
+		"event", "conn_trace", "method", method, "path", path, "remote_addr", t.remoteAddr,
+		"dns", dns, "connect", connect, "tls", tlsHandshake, "server", server, "ttfb", ttfb, "total", total, "reused", t.reused,
+	)
+}
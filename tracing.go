@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal OpenTelemetry tracing: spans are exported in the OTLP/HTTP json encoding to the
+// collector configured through the standard OTEL_EXPORTER_OTLP_* environment variables
+
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+
+	statusCodeError = 2
+
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+)
+
+// tracer is nil when tracing is disabled
+var tracer *otlpTracer
+
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]any
+	err        error
+}
+
+type spanKey struct{}
+
+type otlpTracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	// span context the whole run hangs from, taken from the TRACEPARENT environment variable
+	parent *span
+
+	mu      sync.Mutex
+	pending []*span
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// setupTracing enables tracing if an OTLP endpoint is configured in the environment. The returned
+// function flushes pending spans and must be called before exiting
+func setupTracing() (shutdown func()) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return func() {}
+		}
+		endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+	if protocol := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); protocol != "" && protocol != "http/json" {
+		slog.Warn(fmt.Sprintf("OTLP protocol %s is not supported, exporting traces with http/json instead", protocol))
+	}
+
+	t := &otlpTracer{
+		endpoint:    endpoint,
+		headers:     parseOTELHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		serviceName: os.Getenv("OTEL_SERVICE_NAME"),
+		parent:      parseTraceparent(os.Getenv("TRACEPARENT")),
+		stop:        make(chan struct{}),
+	}
+	if t.serviceName == "" {
+		t.serviceName = "esfetcher"
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(spanFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-ticker.C:
+				t.flush()
+			}
+		}
+	}()
+
+	tracer = t
+	return func() {
+		close(t.stop)
+		t.wg.Wait()
+		t.flush()
+	}
+}
+
+// startSpan starts a span as a child of the span in the context, if any. The span is a no-op
+// when tracing is disabled
+func startSpan(ctx context.Context, name string, kind int, attributes map[string]any) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attributes: attributes}
+	rand.Read(s.spanID[:])
+	parent, ok := ctx.Value(spanKey{}).(*span)
+	if !ok {
+		parent = tracer.parent
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) setAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	if s.attributes == nil {
+		s.attributes = map[string]any{}
+	}
+	s.attributes[key] = value
+}
+
+// finish ends the span, marking it as failed if err is not nil
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	tracer.mu.Lock()
+	tracer.pending = append(tracer.pending, s)
+	full := len(tracer.pending) >= spanBatchSize
+	tracer.mu.Unlock()
+	if full {
+		go tracer.flush()
+	}
+}
+
+// traceparent returns the W3C trace context header value for the span, so Elasticsearch can
+// correlate its own traces with ours
+func (s *span) traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+func (t *otlpTracer) flush() {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	otlpSpans := make([]map[string]any, len(spans))
+	for i, s := range spans {
+		otlpSpan := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			otlpSpan["status"] = map[string]any{"code": statusCodeError, "message": s.err.Error()}
+		}
+		otlpSpans[i] = otlpSpan
+	}
+	payload := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": t.serviceName}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "esfetcher"},
+				"spans": otlpSpans,
+			}},
+		}},
+	}
+
+	if err := t.export(payload); err != nil {
+		slog.Warn(fmt.Sprintf("failed to export %d spans: %v", len(spans), err), "event", "tracing_export_failed", "error", err)
+	}
+}
+
+func (t *otlpTracer) export(payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered with %s", res.Status)
+	}
+	return nil
+}
+
+func otlpAttributes(attributes map[string]any) []any {
+	result := make([]any, 0, len(attributes))
+	for _, k := range sortedKeys(attributes) {
+		var value map[string]any
+		switch v := attributes[k].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]any{"key": k, "value": value})
+	}
+	return result
+}
+
+// parseOTELHeaders parses the OTEL_EXPORTER_OTLP_HEADERS format: comma separated key=value pairs
+func parseOTELHeaders(value string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers
+}
+
+// parseTraceparent parses a W3C traceparent header value, returning nil if it is invalid
+func parseTraceparent(value string) *span {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	var s span
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	return &s
+}
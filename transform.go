@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// hitTransform modifies a hit, decoded from json, before it is written to the output
+type hitTransform func(hit map[string]any) error
+
+// transformHit applies the transforms, in order, to a hit. The hit is returned untouched when
+// there are no transforms. Numbers are kept as they came, as json.Number, so long ids and
+// counters don't lose precision
+func transformHit(raw json.RawMessage, transforms []hitTransform) (json.RawMessage, error) {
+	if len(transforms) == 0 {
+		return raw, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var hit map[string]any
+	if err := decoder.Decode(&hit); err != nil {
+		return nil, fmt.Errorf("failed to decode hit: %w", err)
+	}
+	for _, transform := range transforms {
+		if err := transform(hit); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(hit); err != nil {
+		return nil, fmt.Errorf("failed to encode hit: %w", err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// renameTransform moves fields of the hit according to --rename specs, FROM=TO with dotted paths
+// into the hit, as _source.user.name=username. Hits without the FROM field are left as they are
+func renameTransform(specs []string) (hitTransform, error) {
+	type rename struct{ from, to string }
+	renames := make([]rename, 0, len(specs))
+	for _, spec := range specs {
+		from, to, ok := strings.Cut(spec, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid --rename %q, expected FROM=TO, e.g. _source.user.name=username", spec)
+		}
+		renames = append(renames, rename{from, to})
+	}
+	return func(hit map[string]any) error {
+		for _, r := range renames {
+			if value, ok := deletePath(hit, r.from); ok {
+				setPath(hit, r.to, value)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// deletePath removes the value at the dotted path of m, returning it. Keys containing dots, as
+// the flattened fields of some documents, are matched before descending into objects. Objects
+// left empty by the removal are kept
+func deletePath(m map[string]any, path string) (any, bool) {
+	if value, ok := m[path]; ok {
+		delete(m, path)
+		return value, true
+	}
+	for i := strings.IndexByte(path, '.'); i >= 0; i = nextDot(path, i) {
+		if child, ok := m[path[:i]].(map[string]any); ok {
+			if value, ok := deletePath(child, path[i+1:]); ok {
+				return value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// getPath returns the value at the dotted path of m. Keys containing dots are matched as with
+// deletePath
+func getPath(m map[string]any, path string) (any, bool) {
+	if value, ok := m[path]; ok {
+		return value, true
+	}
+	for i := strings.IndexByte(path, '.'); i >= 0; i = nextDot(path, i) {
+		if child, ok := m[path[:i]].(map[string]any); ok {
+			if value, ok := getPath(child, path[i+1:]); ok {
+				return value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// updatePath replaces the value at the dotted path of m, when there is one, with the result of
+// update. Keys containing dots are matched as with deletePath
+func updatePath(m map[string]any, path string, update func(value any) any) bool {
+	if value, ok := m[path]; ok {
+		m[path] = update(value)
+		return true
+	}
+	for i := strings.IndexByte(path, '.'); i >= 0; i = nextDot(path, i) {
+		if child, ok := m[path[:i]].(map[string]any); ok && updatePath(child, path[i+1:], update) {
+			return true
+		}
+	}
+	return false
+}
+
+// setPath sets the value at the dotted path of m, creating the intermediate objects missing
+func setPath(m map[string]any, path string, value any) {
+	for {
+		key, rest, nested := strings.Cut(path, ".")
+		if !nested {
+			m[key] = value
+			return
+		}
+		child, ok := m[key].(map[string]any)
+		if !ok {
+			child = map[string]any{}
+			m[key] = child
+		}
+		m, path = child, rest
+	}
+}
+
+func nextDot(path string, i int) int {
+	if j := strings.IndexByte(path[i+1:], '.'); j >= 0 {
+		return i + 1 + j
+	}
+	return -1
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, injected at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When not injected, they are taken from the build info the go toolchain embeds in the binary
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+func (args) Version() string {
+	v, c, d := version, commit, date
+	modified := false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && c == "":
+				c = setting.Value
+			case setting.Key == "vcs.time" && d == "":
+				d = setting.Value
+			case setting.Key == "vcs.modified" && commit == "":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if modified && c != "" {
+		c += "-dirty"
+	}
+	return fmt.Sprintf("esfetcher %s (commit %s, date %s, %s %s/%s)",
+		orUnknown(v), orUnknown(c), orUnknown(d), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// watchedDoc is a document of a --watch snapshot: the hit as written, and what tells whether it
+// changed since
+type watchedDoc struct {
+	hit     []byte
+	version string
+}
+
+// watchSnapshot is the set of documents a run of the query of --watch returned, by _index and
+// _id, in the order they were fetched
+type watchSnapshot struct {
+	keys []string
+	docs map[string]watchedDoc
+}
+
+// Watch runs the query every interval until the context is done, writing the documents added,
+// changed and removed since the previous run, with the change in a _change field. The first run
+// writes all the documents as added. Documents are compared by their _version, or by their
+// content when the hits have none. A run that fails is logged and the next one compares with the
+// last successful run. It returns nil once interrupted
+func (c *Client) Watch(ctx context.Context, index string, query string, slices int, interval time.Duration, writer io.Writer) error {
+	previous := &watchSnapshot{docs: map[string]watchedDoc{}}
+	for run := 1; ; run++ {
+		var buf bytes.Buffer
+		_, err := c.Query(ctx, index, query, true, slices, &buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Error(fmt.Sprintf("Run %d of the watched query failed, trying again in %v: %v", run, interval, err), "event", "watch_failed", "run", run, "error", err)
+		} else {
+			current, err := newWatchSnapshot(buf.Bytes())
+			if err != nil {
+				return err
+			}
+			added, changed, removed, err := writeChanges(previous, current, writer)
+			if err != nil && ctx.Err() == nil {
+				return err
+			}
+			slog.Info(
+				fmt.Sprintf("Run %d of the watched query: %d added, %d changed and %d removed documents", run, added, changed, removed),
+				"event", "watch_run", "run", run, "added", added, "changed", changed, "removed", removed,
+			)
+			previous = current
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// newWatchSnapshot reads the documents of a run from the jsonl hits it wrote
+func newWatchSnapshot(data []byte) (*watchSnapshot, error) {
+	s := &watchSnapshot{docs: map[string]watchedDoc{}}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var meta struct {
+			Index   string          `json:"_index"`
+			ID      string          `json:"_id"`
+			Version json.RawMessage `json:"_version"`
+		}
+		if err := json.Unmarshal(line, &meta); err != nil {
+			return nil, fmt.Errorf("failed to read watched hit: %w", err)
+		}
+		if meta.ID == "" {
+			return nil, fmt.Errorf("--watch needs the _id of the hits to compare them, it can't be renamed")
+		}
+		key := meta.Index + "/" + meta.ID
+		version := string(meta.Version)
+		if version == "" {
+			version = string(line)
+		}
+		if _, ok := s.docs[key]; !ok {
+			s.keys = append(s.keys, key)
+		}
+		s.docs[key] = watchedDoc{hit: line, version: version}
+	}
+	return s, nil
+}
+
+// writeChanges writes the documents of current that are not in previous or changed since, then
+// the ones of previous not in current anymore, as they were last seen
+func writeChanges(previous *watchSnapshot, current *watchSnapshot, writer io.Writer) (added int, changed int, removed int, err error) {
+	var buf bytes.Buffer
+	for _, key := range current.keys {
+		doc := current.docs[key]
+		before, ok := previous.docs[key]
+		switch {
+		case !ok:
+			added++
+			writeChange(&buf, "added", doc.hit)
+		case before.version != doc.version:
+			changed++
+			writeChange(&buf, "changed", doc.hit)
+		}
+	}
+	for _, key := range previous.keys {
+		if _, ok := current.docs[key]; !ok {
+			removed++
+			writeChange(&buf, "removed", previous.docs[key].hit)
+		}
+	}
+	if _, err := writer.Write(buf.Bytes()); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to write entry: %w", err)
+	}
+	return added, changed, removed, nil
+}
+
+// writeChange writes the hit as a line with the change in a _change field
+func writeChange(buf *bytes.Buffer, change string, hit []byte) {
+	rest, _ := bytes.CutPrefix(bytes.TrimSpace(hit), []byte("{"))
+	buf.WriteString(`{"_change":"` + change + `"`)
+	if !bytes.HasPrefix(bytes.TrimSpace(rest), []byte("}")) {
+		buf.WriteByte(',')
+	}
+	buf.Write(rest)
+	buf.WriteByte('\n')
+}